@@ -0,0 +1,86 @@
+package gdec
+
+import (
+	"fmt"
+	"sort"
+)
+
+// How JoinAgg() combines the values of a group.
+type Aggregate int
+
+const (
+	AggCount Aggregate = iota
+	AggSum
+	AggMin
+	AggMax
+)
+
+// The output tuple of JoinAgg(), one per group.
+type AggResult struct {
+	Key string
+	Val int
+}
+
+type joinAgg struct {
+	key func(interface{}) string
+	agg Aggregate
+	val func(interface{}) int // Unused by AggCount.
+}
+
+// JoinAgg groups the tuples of src by key, and produces an AggResult
+// per group into the join's destination.  AggCount counts the tuples
+// of a group, while the other aggregates combine val of each tuple.
+// Joins are stratified so that src reaches its fixpoint within a tick
+// before the aggregate is computed, as with Minus().  Aggregates can
+// shrink as well as grow between ticks, so the destination is usually
+// a scratch relation.
+func (d *D) JoinAgg(src Relation, key func(interface{}) string,
+	agg Aggregate, val func(interface{}) int) *joinDeclaration {
+	jd := d.Join(src)
+	if jd.err != nil {
+		return jd
+	}
+	if agg != AggCount && val == nil {
+		return jd.fail(fmt.Sprintf("JoinAgg() aggregate: %d, needs a val func", agg))
+	}
+	jd.agg = &joinAgg{key: key, agg: agg, val: val}
+	return jd
+}
+
+func (jd *joinDeclaration) executeAgg() {
+	d := jd.d
+	a := jd.agg
+
+	groups := map[string]int{}
+	for tuple := range jd.sources[0].Scan() {
+		k := a.key(tuple)
+		if a.agg == AggCount {
+			groups[k]++
+			continue
+		}
+		v := a.val(tuple)
+		cur, ok := groups[k]
+		switch {
+		case !ok:
+			groups[k] = v
+		case a.agg == AggSum:
+			groups[k] = cur + v
+		case a.agg == AggMin && v < cur, a.agg == AggMax && v > cur:
+			groups[k] = v
+		}
+	}
+
+	keys := make([]string, 0, len(groups))
+	for k := range groups {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	for _, k := range keys {
+		res := &AggResult{k, groups[k]}
+		if d.trace {
+			d.traceJoin(jd, nil, res)
+		}
+		jd.result(relationChange{jd.into, res, true})
+	}
+}
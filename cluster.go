@@ -0,0 +1,112 @@
+package gdec
+
+import (
+	"fmt"
+	"math/rand"
+	"sort"
+)
+
+// A Cluster advances several D's in one process in lockstep, for tests
+// and simulations.  Each Tick() ticks every node, and only then routes
+// the channel tuples they sent through the Transport, so a tuple sent
+// on one round shows up on the next round, whatever the order in which
+// the nodes ticked.  The Transport's partitions and delays still apply.
+type Cluster struct {
+	Transport *MemTransport
+	Nodes     []*D // Ordered by Addr.
+
+	// When non-nil, each Tick() ticks the nodes in a random order drawn
+	// from Rand, such as a node's D.Rand, to shake out order dependence.
+	Rand *rand.Rand
+
+	sent []clusterSend // Sent during the current round, in order.
+}
+
+type clusterSend struct {
+	from, to string
+	relName  string
+	tuple    interface{}
+}
+
+func NewCluster(ds ...*D) *Cluster {
+	c := &Cluster{Transport: NewMemTransport()}
+	for _, d := range ds {
+		c.Add(d)
+	}
+	return c
+}
+
+// Add registers a node with the cluster's Transport, so that what it
+// sends is held until the end of each round.
+func (c *Cluster) Add(d *D) {
+	if c.Node(d.Addr) != nil {
+		panic(fmt.Sprintf("Cluster.Add() of a duplicate addr: %s", d.Addr))
+	}
+	c.Transport.Register(d)
+	d.SetTransport(&clusterSender{c, d.Addr})
+	c.Nodes = append(c.Nodes, d)
+	sort.Slice(c.Nodes, func(i, j int) bool { return c.Nodes[i].Addr < c.Nodes[j].Addr })
+}
+
+// Node returns the node of an addr, or nil.
+func (c *Cluster) Node(addr string) *D {
+	for _, d := range c.Nodes {
+		if d.Addr == addr {
+			return d
+		}
+	}
+	return nil
+}
+
+// Tick runs one round: every node ticks, by Addr or else in a random
+// order, see Rand, and then the tuples sent are routed, by sender Addr
+// and then in the order sent.
+func (c *Cluster) Tick() {
+	order := append([]*D(nil), c.Nodes...)
+	if c.Rand != nil {
+		c.Rand.Shuffle(len(order), func(i, j int) {
+			order[i], order[j] = order[j], order[i]
+		})
+	}
+	for _, d := range order {
+		d.Tick()
+	}
+
+	sent := c.sent
+	c.sent = nil
+	sort.SliceStable(sent, func(i, j int) bool { return sent[i].from < sent[j].from })
+	for _, s := range sent {
+		if err := c.Transport.send(s.from, s.to, s.relName, s.tuple); err != nil {
+			c.Node(s.from).logDropped(s.to, s.relName, err)
+		}
+	}
+}
+
+// RunUntilQuiescent runs rounds until the nodes have no channel tuples
+// left to deliver, and a round changes nothing, as in D's
+// RunUntilQuiescent(), or until maxTicks rounds.  Returns true if
+// quiescence was reached.
+func (c *Cluster) RunUntilQuiescent(maxTicks int) bool {
+	for i := 0; i < maxTicks; i++ {
+		c.Tick()
+		quiet := i > 0
+		for _, d := range c.Nodes {
+			quiet = quiet && d.tickChanges == 0 && !d.pendingAsync()
+		}
+		if quiet {
+			return true
+		}
+	}
+	return false
+}
+
+type clusterSender struct {
+	c    *Cluster
+	from string
+}
+
+func (s *clusterSender) Send(destAddr string, relName string,
+	tuple interface{}) error {
+	s.c.sent = append(s.c.sent, clusterSend{s.from, destAddr, relName, tuple})
+	return nil
+}
@@ -0,0 +1,122 @@
+package gdec
+
+import (
+	"bufio"
+	"encoding/gob"
+	"encoding/json"
+	"fmt"
+	"io"
+	"reflect"
+)
+
+// A Codec frames the channel tuples that a TCPTransport sends, see
+// NewTCPTransportCodec().  Each connection gets its own encoder and
+// decoder, as a framing like gob's is stateful.
+type Codec interface {
+	NewEncoder(w io.Writer) CodecEncoder
+
+	// The tupleType func returns the tuple type of the receiving D's
+	// channel, or nil if there's no such channel, so that a codec
+	// whose wire form isn't self describing, like JSON, can decode.
+	NewDecoder(r io.Reader, tupleType func(relName string) reflect.Type) CodecDecoder
+}
+
+type CodecEncoder interface {
+	Encode(relName string, tuple interface{}) error
+}
+
+// An error with a relName means just that tuple was bad, and decoding
+// can go on, while an error without one ends the connection.
+type CodecDecoder interface {
+	Decode() (relName string, tuple interface{}, err error)
+}
+
+// GobCodec is the default Codec, for peers that are all Go.  The tuple
+// types of channels are registered with gob by TCPTransport.Listen().
+type GobCodec struct{}
+
+type gobEnvelope struct {
+	RelName string
+	Tuple   interface{}
+}
+
+type gobEncoder struct{ enc *gob.Encoder }
+
+type gobDecoder struct{ dec *gob.Decoder }
+
+func (GobCodec) NewEncoder(w io.Writer) CodecEncoder {
+	return &gobEncoder{gob.NewEncoder(w)}
+}
+
+func (GobCodec) NewDecoder(r io.Reader,
+	tupleType func(relName string) reflect.Type) CodecDecoder {
+	return &gobDecoder{gob.NewDecoder(r)}
+}
+
+func (e *gobEncoder) Encode(relName string, tuple interface{}) error {
+	return e.enc.Encode(&gobEnvelope{RelName: relName, Tuple: tuple})
+}
+
+func (e *gobDecoder) Decode() (string, interface{}, error) {
+	var env gobEnvelope
+	if err := e.dec.Decode(&env); err != nil {
+		return "", nil, err
+	}
+	return env.RelName, env.Tuple, nil
+}
+
+// JSONCodec sends each tuple as a line of JSON, like
+// {"RelName":"RaftVoteReq","Tuple":{"To":"b",...}}, for debugging and
+// for peers that aren't Go.  Struct tuples are decoded as pointers.
+type JSONCodec struct{}
+
+type jsonEnvelope struct {
+	RelName string
+	Tuple   json.RawMessage
+}
+
+type jsonEncoder struct{ enc *json.Encoder }
+
+type jsonDecoder struct {
+	dec       *json.Decoder
+	tupleType func(relName string) reflect.Type
+}
+
+func (JSONCodec) NewEncoder(w io.Writer) CodecEncoder {
+	return &jsonEncoder{json.NewEncoder(w)}
+}
+
+func (JSONCodec) NewDecoder(r io.Reader,
+	tupleType func(relName string) reflect.Type) CodecDecoder {
+	return &jsonDecoder{json.NewDecoder(bufio.NewReader(r)), tupleType}
+}
+
+func (e *jsonEncoder) Encode(relName string, tuple interface{}) error {
+	j, err := json.Marshal(tuple)
+	if err != nil {
+		return err
+	}
+	return e.enc.Encode(&jsonEnvelope{RelName: relName, Tuple: j})
+}
+
+func (e *jsonDecoder) Decode() (string, interface{}, error) {
+	var env jsonEnvelope
+	if err := e.dec.Decode(&env); err != nil {
+		return "", nil, err
+	}
+	t := e.tupleType(env.RelName)
+	if t == nil {
+		return env.RelName, nil, fmt.Errorf("no channel for relName: %s", env.RelName)
+	}
+	if t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	p := reflect.New(t)
+	if err := json.Unmarshal(env.Tuple, p.Interface()); err != nil {
+		return env.RelName, nil, err
+	}
+	if t.Kind() == reflect.Struct {
+		return env.RelName, p.Interface(), nil
+	}
+	return env.RelName, p.Elem().Interface(), nil
+}
@@ -0,0 +1,128 @@
+package gdec
+
+import (
+	"sort"
+)
+
+// Implemented by relations that can drop entries which no longer
+// contribute to their value, see Compact().
+type compacter interface {
+	Compact() int // Returns the number of entries dropped.
+}
+
+// Compact drops the dominated entries of every relation that supports
+// it, like an LSet with DeclareDominated(), returning the number of
+// entries dropped.  Use it between ticks, as it's not monotonic in the
+// entries a join may have scanned.
+func (d *D) Compact() int {
+	names := make([]string, 0, len(d.Relations))
+	for name := range d.Relations {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	n := 0
+	for _, name := range names {
+		if c, ok := d.Relations[name].(compacter); ok {
+			n += c.Compact()
+		}
+	}
+	return n
+}
+
+// ClearAll resets every relation to zero, see Relation.Clear(),
+// returning the number of relations that changed, so that a module can
+// start over, as after a crash that lost its state.  Like Compact(),
+// use it between ticks.  Changes pending for the next tick, like those
+// of IntoAsync() or received messages, still apply.
+func (d *D) ClearAll() int {
+	names := make([]string, 0, len(d.Relations))
+	for name := range d.Relations {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	n := 0
+	for _, name := range names {
+		if d.Relations[name].Clear() {
+			n++
+		}
+	}
+	for _, jd := range d.Joins {
+		jd.maintained = false
+	}
+	return n
+}
+
+// Invoked by a relation's Clear(), so that the joins reading or writing
+// it are fully evaluated again at the next tick, rather than only
+// against what changes from then on, which would leave the relation,
+// or what's derived from it, missing what its sources still hold.
+// Scratch relations already keep their joins from being maintained.
+func (d *D) cleared(r Relation) {
+	if d == nil || r.isScratch() {
+		return
+	}
+	for _, jd := range d.host().Joins {
+		if jd.into == r {
+			jd.maintained = false
+		}
+		for _, s := range jd.sources {
+			if baseRelation(s) == r {
+				jd.maintained = false
+			}
+		}
+	}
+}
+
+// DeclareDominated orders the LSet's tuples, where dominated(a, b)
+// returns true when tuple a is made useless by tuple b, like a vote in
+// an older term by one in a newer term.  The LSet then stands for the
+// tuples that no other tuple dominates, so Compact() may drop the rest
+// without changing that value.  A dropped tuple that's added again is
+// kept until the next Compact().
+func (m *LSet) DeclareDominated(dominated func(a, b interface{}) bool) *LSet {
+	m.dominated = dominated
+	return m
+}
+
+// Compact drops the tuples that another kept tuple dominates, see
+// DeclareDominated(), comparing every pair.  Of tuples that dominate
+// each other, the one with the greatest JSON is kept.
+func (m *LSet) Compact() int {
+	if m.dominated == nil || m.channel {
+		return 0
+	}
+	keys := make([]string, 0, len(m.m))
+	for k := range m.m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	n := 0
+	for _, k := range keys {
+		a := m.m[k]
+		for _, j := range keys {
+			if b, ok := m.m[j]; ok && j != k && m.dominated(a, b) {
+				m.Remove(a)
+				n++
+				break
+			}
+		}
+	}
+	return n
+}
+
+// Compact compacts the LMap's values that support it, and drops keys
+// whose values are bottom, as merging a bottom value changes nothing.
+// Returns the number of values and nested entries dropped.
+func (m *LMap) Compact() int {
+	n := 0
+	for k, v := range m.m {
+		if c, ok := v.(compacter); ok {
+			n += c.Compact()
+		}
+		if IsZero(v) {
+			delete(m.m, k)
+			n++
+		}
+	}
+	return n
+}
@@ -0,0 +1,138 @@
+package gdec
+
+import (
+	"sort"
+)
+
+// Relations that can track which of their tuples recently changed,
+// which allows semi-naive evaluation of joins.
+type deltaRelation interface {
+	Relation
+
+	// Scans the tuples that changed before the last rotateDelta().
+	ScanDelta() chan interface{}
+
+	// Invoked after each step of a tick's fixpoint.
+	rotateDelta()
+
+	// Scans the tuples that changed since the last clearTickDelta(),
+	// see maintainable().
+	ScanTickDelta() chan interface{}
+
+	// Invoked at the end of each tick's fixpoints.
+	clearTickDelta()
+}
+
+// Tracks the keys of changed tuples.  The prev keys are what
+// ScanDelta() shows, while the cur keys are still accumulating.  The
+// tick keys accumulate across a whole tick.
+type deltaKeys struct {
+	cur  map[string]bool
+	prev map[string]bool
+	tick map[string]bool
+}
+
+func (dk *deltaKeys) add(k string) {
+	if dk.cur == nil {
+		dk.cur = map[string]bool{}
+	}
+	dk.cur[k] = true
+	if dk.tick == nil {
+		dk.tick = map[string]bool{}
+	}
+	dk.tick[k] = true
+}
+
+// Returns the prev keys, sorted if d wants sorted scans.
+func (dk *deltaKeys) keys(d *D) []string {
+	return deltaKeysOf(d, dk.prev)
+}
+
+// Returns the tick keys, sorted if d wants sorted scans.
+func (dk *deltaKeys) tickKeys(d *D) []string {
+	return deltaKeysOf(d, dk.tick)
+}
+
+func deltaKeysOf(d *D, m map[string]bool) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	if d.sortedScan() {
+		sort.Strings(keys)
+	}
+	return keys
+}
+
+func (dk *deltaKeys) rotate() {
+	dk.prev = dk.cur
+	dk.cur = nil
+}
+
+// SemiNaive declares that the join's selectWhere func depends only on
+// its params, and not on other relations it might reference directly.
+// During a tick's fixpoint, such a join is then only evaluated against
+// tuples that changed in the previous step, rather than every tuple.
+//
+// Across ticks, once such a join has been fully evaluated, it's then
+// only evaluated against tuples that changed since the previous tick,
+// when the results of its earlier evaluations are known to still be in
+// its destination, see maintainable().
+func (jd *joinDeclaration) SemiNaive() *joinDeclaration {
+	jd.semiNaive = true
+	return jd
+}
+
+// Returns the delta relations of the join's sources, or nil if the
+// join can't be evaluated semi-naively.
+func (jd *joinDeclaration) deltaSources() []deltaRelation {
+	if !jd.semiNaive || jd.d.naive || len(jd.sources) == 0 {
+		return nil
+	}
+	rv := make([]deltaRelation, len(jd.sources))
+	for i, r := range jd.sources {
+		dr, ok := r.(deltaRelation)
+		if !ok || jd.d.readSnapshots[r] != nil { // Snapshots have no deltas.
+			return nil
+		}
+		rv[i] = dr
+	}
+	return rv
+}
+
+// Returns true if the join's results from earlier ticks are all still
+// in its destination, so that it need not be evaluated against the
+// tuples that it already saw.  That holds when the destination isn't
+// scratch or a channel, nothing filters or alters the results from
+// tick to tick, and the sources only grow.
+func (jd *joinDeclaration) maintainable() bool {
+	if !jd.maintained || jd.into == nil || jd.into.isScratch() ||
+		isRederived(jd.into) || jd.async || jd.minus != nil || jd.stamps != nil || jd.agg != nil {
+		return false
+	}
+	if c, ok := jd.into.(*LSet); ok && c.channel {
+		return false
+	}
+	for _, r := range jd.sources {
+		if r.isScratch() {
+			return false
+		}
+	}
+	return true
+}
+
+func (d *D) clearTickDeltas() {
+	for _, r := range d.Relations {
+		if dr, ok := r.(deltaRelation); ok {
+			dr.clearTickDelta()
+		}
+	}
+}
+
+func (d *D) rotateDeltas() {
+	for _, r := range d.Relations {
+		if dr, ok := r.(deltaRelation); ok {
+			dr.rotateDelta()
+		}
+	}
+}
@@ -0,0 +1,63 @@
+package gdec
+
+import (
+	"bytes"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+)
+
+// Dot returns a Graphviz DOT digraph of the dataflow, with a node per
+// relation and an edge from each join's sources to its destination.
+// Scratch relations are dashed, and async edges are labeled.
+func (d *D) Dot() string {
+	names := map[Relation]string{}
+	var sorted []string
+	for name, r := range d.Relations {
+		names[r] = name
+		sorted = append(sorted, name)
+	}
+	sort.Strings(sorted)
+
+	var b bytes.Buffer
+	b.WriteString("digraph gdec {\n")
+	for _, name := range sorted {
+		r := d.Relations[name]
+		kind := reflect.TypeOf(r).Elem().Name()
+		if c, ok := r.(*LSet); ok && c.channel {
+			kind = "channel"
+		}
+		style := ""
+		if r.isScratch() {
+			style = ", style=dashed"
+		}
+		fmt.Fprintf(&b, "  %q [label=%q%s];\n", name, name+"\n"+kind, style)
+	}
+	for _, jd := range d.Joins {
+		if jd.into == nil {
+			continue
+		}
+		var attrs []string
+		if jd.name != "" {
+			attrs = append(attrs, jd.name)
+		}
+		if jd.async {
+			attrs = append(attrs, "async")
+		}
+		label := ""
+		if len(attrs) > 0 {
+			label = fmt.Sprintf(" [label=%q]", strings.Join(attrs, ", "))
+		}
+		for _, s := range jd.sources {
+			fmt.Fprintf(&b, "  %q -> %q%s;\n", names[baseRelation(s)],
+				names[jd.into], label)
+		}
+		for _, m := range jd.minus {
+			fmt.Fprintf(&b, "  %q -> %q [label=\"minus\", arrowhead=odot];\n",
+				names[m], names[jd.into])
+		}
+	}
+	b.WriteString("}\n")
+	return b.String()
+}
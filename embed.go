@@ -0,0 +1,71 @@
+package gdec
+
+import (
+	"fmt"
+)
+
+// Embed moves the relations, joins and periodics of sub, a module that
+// was built on its own D, into d, with relation names prefixed by
+// prefix.  Joins keep referring to the same relation instances, which
+// d now owns, so sub's joins run as part of d's ticks.  Since join
+// funcs may have captured sub, sub forwards calls like Add() and
+// Ticks() to d, and sub should be created with d's Addr.  Likewise,
+// d's settings, like SortedScan, its Logger and CollectErrors(), apply
+// to sub's relations and joins.  A sub can only be embedded once, and
+// is no longer ticked on its own; build another sub to embed it again.
+func (d *D) Embed(sub *D, prefix string) {
+	if sub == d || sub.embeddedIn != nil {
+		panic(fmt.Sprintf("Embed() sub already embedded, prefix: %q", prefix))
+	}
+	for name := range sub.Relations {
+		if _, exists := d.Relations[prefix+name]; exists {
+			panic(fmt.Sprintf("Embed() prefix: %q, already declared"+
+				", relation: %s", prefix, prefix+name))
+		}
+	}
+
+	for name, r := range sub.Relations {
+		d.Relations[prefix+name] = r
+	}
+	for _, jd := range sub.Joins {
+		jd.d = d
+		d.Joins = append(d.Joins, jd)
+	}
+	d.periodics = append(d.periodics, sub.periodics...)
+	for r, fs := range sub.onChange {
+		for _, f := range fs {
+			if d.onChange == nil {
+				d.onChange = map[Relation][]func(interface{}){}
+			}
+			d.onChange[r] = append(d.onChange[r], f)
+		}
+	}
+	d.beforeEmit = append(d.beforeEmit, sub.beforeEmit...)
+	for r, tuples := range sub.seeds {
+		if d.seeds == nil {
+			d.seeds = map[Relation][]interface{}{}
+		}
+		d.seeds[r] = tuples
+	}
+	d.next = append(d.next, sub.next...)
+	d.strata, d.asyncJoins = nil, nil // Restratify with the new joins.
+
+	// Join funcs may look up relations by name, so sub's Relations stay.
+	sub.Joins, sub.periodics, sub.onChange, sub.next = nil, nil, nil, nil
+	sub.seeds, sub.beforeEmit = nil, nil
+	sub.embeddedIn = d
+}
+
+// Returns the D that d was embedded into, if any, see Embed().
+func (d *D) host() *D {
+	for d.embeddedIn != nil {
+		d = d.embeddedIn
+	}
+	return d
+}
+
+// Returns the SortedScan of d's host, as relations keep the D they were
+// declared on, even once embedded.
+func (d *D) sortedScan() bool {
+	return d != nil && d.host().SortedScan
+}
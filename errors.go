@@ -0,0 +1,181 @@
+package gdec
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strings"
+)
+
+// A JoinError describes a misused join declaration, such as a
+// selectWhereFunc whose params don't match its sources, or a bad
+// tuple seen while a join ran, see CollectErrors().
+type JoinError struct {
+	Join string // The join's Name(), else "join#" and its position.
+	Msg  string
+}
+
+func (e *JoinError) Error() string {
+	return e.Msg
+}
+
+// A QuiescenceError reports that RunUntilQuiescentErr() ran out of
+// ticks, and which relations kept changing, as in "nextState changed in
+// each of the last 3 ticks".
+type QuiescenceError struct {
+	Addr     string
+	Ticks    int            // The maxTicks that ran.
+	Changing []string       // Relations changed in the final ticks, sorted.
+	Changes  map[string]int // Key: relation name, value: ticks changed in.
+}
+
+func (e *QuiescenceError) Error() string {
+	window := quiescenceWindow
+	if e.Ticks < window {
+		window = e.Ticks
+	}
+	parts := make([]string, len(e.Changing))
+	for i, name := range e.Changing {
+		parts[i] = fmt.Sprintf("%s (%d)", name, e.Changes[name])
+	}
+	return fmt.Sprintf("no quiescence after %d ticks, addr: %s"+
+		", changed in the last %d ticks: %s",
+		e.Ticks, e.Addr, window, strings.Join(parts, ", "))
+}
+
+// CollectErrors makes misuse of the join machinery get recorded as
+// *JoinError's, see Errors(), instead of panicking.  A join whose
+// declaration failed is dropped, so it never runs, and later calls on
+// it, like Into(), are no-ops.  So is a join that closes a cycle
+// through Minus() or JoinAgg(), dropped when the joins are stratified
+// at the next tick.  A nil tuple from a source's Scan() during a tick
+// is recorded and skipped, as is DisableJoin() of an unknown name.
+func (d *D) CollectErrors() {
+	d.collectErrors = true
+}
+
+// CheckDeterminism is a debugging aid that invokes the selectWhere func
+// of every join with an Into() twice on each combination of source
+// tuples, and reports results that differ, via a panic or
+// CollectErrors(), as a func that reads mutable state outside its
+// params, or that's otherwise nondeterministic, can keep a fixpoint
+// from converging.  Joins without an Into(), which only run for their
+// side effects, like applying committed Raft entries, are invoked once.
+// What the second invocation adds through d.Add() and friends is
+// dropped, but its other side effects, like a direct change to a
+// relation, aren't undone.  Joins run serially while checking.
+func (d *D) CheckDeterminism() {
+	d.checkDeterminism = true
+}
+
+// Errors returns the errors recorded since CollectErrors(), oldest
+// first.
+func (d *D) Errors() []error {
+	d = d.host()
+	d.errsM.Lock()
+	defer d.errsM.Unlock()
+	return append([]error(nil), d.errs...)
+}
+
+// Used on misuse of a join declaration.  Panics with msg unless d is
+// collecting errors, else records the error and drops the join.
+func (jd *joinDeclaration) fail(msg string) *joinDeclaration {
+	d := jd.d
+	err := &JoinError{Join: jd.label(), Msg: msg}
+	if jd.err == nil {
+		jd.err = err
+	}
+	if !d.collectErrors {
+		panic(msg)
+	}
+	d.recordErr(err)
+	for i, x := range d.Joins {
+		if x == jd {
+			d.Joins = append(d.Joins[:i], d.Joins[i+1:]...)
+			d.strata = nil
+			break
+		}
+	}
+	return jd
+}
+
+// Records an error for Errors(), which joins running concurrently, see
+// d.Workers, may do at once.
+func (d *D) recordErr(err error) {
+	d = d.host()
+	d.errsM.Lock()
+	d.errs = append(d.errs, err)
+	d.errsM.Unlock()
+}
+
+// Used on a bad tuple seen while jd runs during a tick.
+func (d *D) tickFail(jd *joinDeclaration, msg string) {
+	if !d.collectErrors {
+		panic(msg)
+	}
+	d.recordErr(&JoinError{Join: jd.label(), Msg: msg})
+	if d.LogEnabled(LogError) {
+		d.Log(LogError, "join error", "addr", d.Addr, "join", jd.label(), "err", msg)
+	}
+}
+
+// Invokes selectWhere again for CheckDeterminism(), dropping what it
+// adds through d.Add() and friends, so those changes only happen once.
+func (jd *joinDeclaration) rerun(selectWhere func() *relationChange) *relationChange {
+	h := jd.d.host()
+	immediate, next := len(h.immediate), len(h.next)
+	rv := selectWhere()
+	h.immediate, h.next = h.immediate[:immediate], h.next[:next]
+	return rv
+}
+
+// Used by CheckDeterminism() on the two results of a selectWhere func.
+func (jd *joinDeclaration) checkDeterministic(join []interface{}, a, b *relationChange) {
+	var x, y interface{}
+	if a != nil {
+		x = a.arg
+	}
+	if b != nil {
+		y = b.arg
+	}
+	if !sameOutput(x, y) {
+		jd.d.tickFail(jd, fmt.Sprintf("nondeterministic join: %s"+
+			", selectWhereFunc gave: %#v, then: %#v, for sources: %#v",
+			jd.label(), x, y, join))
+	}
+}
+
+// Compares join results, relations by their values, as they're merged,
+// and tuples by their JSON, as an LSet does.
+func sameOutput(a, b interface{}) bool {
+	aNil := a == nil || isNil(reflect.ValueOf(a))
+	bNil := b == nil || isNil(reflect.ValueOf(b))
+	if aNil || bNil {
+		return aNil && bNil
+	}
+	if ea, ok := a.(*LMapEntry); ok {
+		eb, ok := b.(*LMapEntry)
+		return ok && ea.Key == eb.Key && sameOutput(ea.Val, eb.Val)
+	}
+	if ra, ok := a.(Relation); ok {
+		rb, ok := b.(Relation)
+		return ok && reflect.DeepEqual(RelationValue(ra), RelationValue(rb))
+	}
+	if va, vb := reflect.ValueOf(a), reflect.ValueOf(b); va.Kind() == reflect.Slice {
+		if vb.Kind() != reflect.Slice || va.Len() != vb.Len() {
+			return false
+		}
+		for i := 0; i < va.Len(); i++ {
+			if !sameOutput(va.Index(i).Interface(), vb.Index(i).Interface()) {
+				return false
+			}
+		}
+		return true
+	}
+	ja, err := json.Marshal(a)
+	if err != nil {
+		return reflect.DeepEqual(a, b)
+	}
+	jb, err := json.Marshal(b)
+	return err == nil && string(ja) == string(jb)
+}
@@ -0,0 +1,194 @@
+package gdec
+
+// Invoked by a coordinator to ask participants to prepare a txn.
+type TwoPhaseCommitPrepare struct {
+	To   string
+	From string // Coordinator's addr.
+	Txn  string
+}
+
+type TwoPhaseCommitVote struct { // Response.
+	To   string
+	From string
+	Txn  string
+	Yes  bool // True means the participant prepared the txn.
+}
+
+// Invoked by a coordinator once all participants voted yes.
+type TwoPhaseCommitCommit struct {
+	To   string
+	From string
+	Txn  string
+}
+
+// Invoked by a coordinator once a participant voted no, or the vote
+// timed out.
+type TwoPhaseCommitAbort struct {
+	To   string
+	From string
+	Txn  string
+}
+
+// How many ticks a coordinator waits for votes before aborting a txn.
+var TwoPhaseCommitTimeout int64 = 10
+
+// The states of a txn, ordered for LMax precedence, where a commit wins
+// over a timeout that's seen in the same tick as the last yes vote.
+const (
+	twoPhase_PREPARED  = 1
+	twoPhase_ABORTED   = 2
+	twoPhase_COMMITTED = 3
+)
+
+func TwoPhaseCommitProtocolInit(d *D, prefix string) *D {
+	d.declareProtocolChannel(prefix+"TwoPhaseCommitPrepare", TwoPhaseCommitPrepare{})
+	d.declareProtocolChannel(prefix+"TwoPhaseCommitVote", TwoPhaseCommitVote{})
+	d.declareProtocolChannel(prefix+"TwoPhaseCommitCommit", TwoPhaseCommitCommit{})
+	d.declareProtocolChannel(prefix+"TwoPhaseCommitAbort", TwoPhaseCommitAbort{})
+	return d
+}
+
+// Two-phase commit, where every node may coordinate txns and take part
+// in the txns of others.  A coordinator prepares each txn added to its
+// TwoPhaseCommitTxn input at every addr in its TwoPhaseCommitParticipant
+// relation, and records a TwoPhaseCommitDecision once every participant
+// voted yes, or any voted no, or TwoPhaseCommitTimeout ticks passed.  A
+// participant votes no on the txns in its TwoPhaseCommitRefuse relation,
+// and keeps each txn's state in its TwoPhaseCommitState.
+func TwoPhaseCommitInit(d *D, prefix string) *D {
+	d.checkUndeclared("TwoPhaseCommitInit", prefix, "TwoPhaseCommitTxn",
+		"TwoPhaseCommitParticipant", "TwoPhaseCommitRefuse",
+		"TwoPhaseCommitDecision", "TwoPhaseCommitState")
+	d = TwoPhaseCommitProtocolInit(d, prefix)
+
+	tprepare := d.Relations[prefix+"TwoPhaseCommitPrepare"]
+	tvote := d.Relations[prefix+"TwoPhaseCommitVote"]
+	tcommit := d.Relations[prefix+"TwoPhaseCommitCommit"]
+	tabort := d.Relations[prefix+"TwoPhaseCommitAbort"]
+
+	txn := d.Input(d.DeclareLSet(prefix+"TwoPhaseCommitTxn", "txnString"))
+	participant := d.DeclareLSet(prefix+"TwoPhaseCommitParticipant", "addrString")
+	refuse := d.DeclareLSet(prefix+"TwoPhaseCommitRefuse", "txnString")
+
+	newLMax := func() Lattice { return d.NewLMax() }
+
+	// Coordinator.
+
+	// Key: txn, val: LMax of twoPhase_ABORTED or twoPhase_COMMITTED.
+	decision := d.DeclareLMapOf(prefix+"TwoPhaseCommitDecision", newLMax)
+
+	// Key: txn, val: LMax of the tick when it was prepared.  As it and
+	// the decision are only changed asynchronously, the joins below may
+	// read them as of the tick's start, to act just once per txn.
+	started := d.DeclareLMapOf(prefix+"twoPhaseCommitStarted", newLMax)
+	sent := d.DeclareLSet(prefix+"twoPhaseCommitSent", "txnString")
+
+	MultiTallyInit(d, prefix+"tallyYes/")
+	tallyYesVote := d.Relations[prefix+"tallyYes/MultiTallyVote"].(*LSet)
+	tallyYesNeed := d.Scratch(d.Relations[prefix+"tallyYes/MultiTallyNeed"])
+	tallyYesDone := d.Relations[prefix+"tallyYes/MultiTallyDone"].(*LMap)
+
+	d.Join(func() int { return participant.Size() }).Into(tallyYesNeed)
+
+	d.Join(txn, participant, func(t *string, p *string) *TwoPhaseCommitPrepare {
+		if started.HasKey(*t) {
+			return nil
+		}
+		return &TwoPhaseCommitPrepare{To: *p, From: d.Addr, Txn: *t}
+	}).IntoAsync(tprepare)
+
+	d.Join(txn, func(t *string) *LMapEntry {
+		if started.HasKey(*t) {
+			return nil
+		}
+		return &LMapEntry{*t, NewLMax(d, int(d.Ticks()))}
+	}).IntoAsync(started)
+
+	d.Join(tvote, func(v *TwoPhaseCommitVote) *MultiTallyVote {
+		if !v.Yes || !started.HasKey(v.Txn) {
+			return nil
+		}
+		return &MultiTallyVote{Race: v.Txn, Voter: v.From}
+	}).Into(tallyYesVote)
+
+	d.Join(tallyYesDone, func(e *LMapEntry) *LMapEntry {
+		if !e.Val.(*LBool).Bool() || decision.HasKey(e.Key) {
+			return nil
+		}
+		return &LMapEntry{e.Key, NewLMax(d, twoPhase_COMMITTED)}
+	}).IntoAsync(decision)
+
+	d.Join(tvote, func(v *TwoPhaseCommitVote) *LMapEntry {
+		if v.Yes || !started.HasKey(v.Txn) || decision.HasKey(v.Txn) {
+			return nil
+		}
+		return &LMapEntry{v.Txn, NewLMax(d, twoPhase_ABORTED)}
+	}).IntoAsync(decision)
+
+	d.Join(started, func(e *LMapEntry) *LMapEntry {
+		if decision.HasKey(e.Key) ||
+			d.Ticks()-int64(e.Val.(*LMax).Int()) < TwoPhaseCommitTimeout {
+			return nil
+		}
+		return &LMapEntry{e.Key, NewLMax(d, twoPhase_ABORTED)}
+	}).IntoAsync(decision)
+
+	d.Join(decision, participant, func(e *LMapEntry, p *string) *TwoPhaseCommitCommit {
+		if sent.Contains(e.Key) || e.Val.(*LMax).Int() != twoPhase_COMMITTED {
+			return nil
+		}
+		return &TwoPhaseCommitCommit{To: *p, From: d.Addr, Txn: e.Key}
+	}).IntoAsync(tcommit)
+
+	d.Join(decision, participant, func(e *LMapEntry, p *string) *TwoPhaseCommitAbort {
+		if sent.Contains(e.Key) || e.Val.(*LMax).Int() != twoPhase_ABORTED {
+			return nil
+		}
+		return &TwoPhaseCommitAbort{To: *p, From: d.Addr, Txn: e.Key}
+	}).IntoAsync(tabort)
+
+	d.Join(decision, func(e *LMapEntry) *string {
+		return &e.Key
+	}).IntoAsync(sent)
+
+	// Participant.
+
+	// Key: txn, val: LMax of twoPhase_PREPARED, ABORTED or COMMITTED.
+	state := d.DeclareLMapOf(prefix+"TwoPhaseCommitState", newLMax)
+
+	d.Join(tprepare, func(p *TwoPhaseCommitPrepare) *TwoPhaseCommitVote {
+		return &TwoPhaseCommitVote{To: p.From, From: d.Addr, Txn: p.Txn,
+			Yes: !refuse.Contains(p.Txn)}
+	}).IntoAsync(tvote)
+
+	d.Join(tprepare, func(p *TwoPhaseCommitPrepare) *LMapEntry {
+		if refuse.Contains(p.Txn) {
+			return &LMapEntry{p.Txn, NewLMax(d, twoPhase_ABORTED)}
+		}
+		return &LMapEntry{p.Txn, NewLMax(d, twoPhase_PREPARED)}
+	}).Into(state)
+
+	d.Join(tcommit, func(c *TwoPhaseCommitCommit) *LMapEntry {
+		return &LMapEntry{c.Txn, NewLMax(d, twoPhase_COMMITTED)}
+	}).Into(state)
+
+	d.Join(tabort, func(a *TwoPhaseCommitAbort) *LMapEntry {
+		return &LMapEntry{a.Txn, NewLMax(d, twoPhase_ABORTED)}
+	}).Into(state)
+
+	return d
+}
+
+func init() {
+	TwoPhaseCommitInit(NewD(""), "")
+}
+
+// Returns the coordinator's decision on a txn, with ok of false while
+// it's undecided.
+func TwoPhaseCommitDecided(d *D, prefix string, txn string) (commit bool, ok bool) {
+	v, ok := d.Relations[prefix+"TwoPhaseCommitDecision"].(*LMap).AtLMax(txn)
+	if !ok {
+		return false, false
+	}
+	return v.Int() == twoPhase_COMMITTED, true
+}
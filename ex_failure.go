@@ -0,0 +1,67 @@
+package gdec
+
+import (
+	"fmt"
+	"time"
+)
+
+type FailureDetectorHeartbeat struct {
+	To   string
+	From string
+}
+
+// Detects failed peers by their heartbeats.  Every period, a node sends
+// a heartbeat to each addr in its FailureDetectorPeer relation.  A peer
+// is in the FailureDetectorAlive output while a heartbeat from it has
+// arrived within the last timeout ticks, and is otherwise in the
+// FailureDetectorSuspected output, which it leaves as soon as its
+// heartbeats resume.  A peer never heard from is suspected once the D
+// has run for timeout ticks, and a node never suspects itself.
+func FailureDetectorInit(d *D, prefix string, period time.Duration, timeout int64) *D {
+	if timeout <= 0 {
+		panic(fmt.Sprintf("FailureDetectorInit() needs a positive timeout: %d", timeout))
+	}
+	d.checkUndeclared("FailureDetectorInit", prefix, "FailureDetectorPeer",
+		"FailureDetectorAlive", "FailureDetectorSuspected", "failureDetectorHeard")
+	hb := d.declareProtocolChannel(prefix+"FailureDetectorHeartbeat",
+		FailureDetectorHeartbeat{})
+
+	peer := d.DeclareLSet(prefix+"FailureDetectorPeer", "addrString")
+	alive := d.Output(d.DeclareLSet(prefix+"FailureDetectorAlive", "addrString"))
+	suspected := d.Output(d.DeclareLSet(prefix+"FailureDetectorSuspected", "addrString"))
+
+	heard := d.DeclareLMap(prefix + "failureDetectorHeard") // Key: addr, val: LMax of tick.
+	beat := d.DeclarePeriodic(prefix+"failureDetectorBeat", period)
+
+	d.Join(beat, peer, func(b *bool, p *string) *FailureDetectorHeartbeat {
+		if !*b || *p == d.Addr {
+			return nil
+		}
+		return &FailureDetectorHeartbeat{To: *p, From: d.Addr}
+	}).IntoAsync(hb)
+
+	d.Join(hb, func(h *FailureDetectorHeartbeat) *LMapEntry {
+		return &LMapEntry{h.From, NewLMax(d, int(d.Ticks()))}
+	}).Into(heard)
+
+	d.Join(peer, heard, func(p *string, e *LMapEntry) *string {
+		if e.Key == *p && int64(e.Val.(*LMax).Int()) > d.Ticks()-timeout {
+			return p
+		}
+		return nil
+	}).Into(alive)
+	d.Join(peer, func(p *string) *string {
+		if *p == d.Addr || d.Ticks() < timeout {
+			return p
+		}
+		return nil
+	}).Into(alive)
+
+	d.Join(peer).Minus(alive.(*LSet)).Into(suspected)
+
+	return d
+}
+
+func init() {
+	FailureDetectorInit(NewD(""), "", time.Second, 1)
+}
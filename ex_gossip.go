@@ -0,0 +1,120 @@
+package gdec
+
+import (
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"reflect"
+	"time"
+)
+
+// Invoked periodically on random peers, to compare their states.
+type GossipDigest struct {
+	To     string
+	From   string
+	Digest string // Hash of the sender's state.
+}
+
+type GossipState struct { // Response, when the digests differ.
+	To     string
+	From   string
+	Digest string // Hash of Val.
+	Pull   bool   // True asks the receiver to respond with its own state.
+	Val    Lattice
+}
+
+// Anti-entropy gossip, which spreads the state of the shared LSet or
+// LMap to every node.  Every interval, a node sends a digest of its
+// state to fanout peers, chosen at random via d.Rand from its
+// GossipPeer relation.  A peer with a different digest responds with
+// its state, and the node responds in turn with its own, and each
+// merges what it receives, so the merges being idempotent means that
+// just the differences have any effect.
+func GossipInit(d *D, prefix string, shared Relation,
+	interval time.Duration, fanout int) *D {
+	if fanout <= 0 {
+		panic(fmt.Sprintf("GossipInit() needs a positive fanout: %d", fanout))
+	}
+	d.checkUndeclared("GossipInit", prefix, "GossipPeer", "gossipTarget")
+	gdigest := d.declareProtocolChannel(prefix+"GossipDigest", GossipDigest{})
+	gstate := d.declareProtocolChannel(prefix+"GossipState", GossipState{})
+
+	peer := d.DeclareLSet(prefix+"GossipPeer", "addrString")
+	target := d.Scratch(d.DeclareLSet(prefix+"gossipTarget", "addrString"))
+	round := d.DeclarePeriodic(prefix+"gossipRound", interval)
+
+	snapshot := shared.(Lattice).Snapshot
+	digest := func() string {
+		j, err := json.Marshal(RelationValue(shared))
+		if err != nil {
+			panic(fmt.Sprintf("GossipInit() could not digest relation: %s, err: %v",
+				d.relationLabel(shared), err))
+		}
+		h := fnv.New64a()
+		h.Write(j)
+		return fmt.Sprintf("%016x", h.Sum64())
+	}
+
+	d.JoinFlat(round, func(b *bool) *LSet {
+		if !*b {
+			return nil
+		}
+		var peers []string
+		for _, p := range sortedTuples(peer) {
+			if p.(string) != d.Addr {
+				peers = append(peers, p.(string))
+			}
+		}
+		rv := d.NewLSet(reflect.TypeOf(""))
+		for i, j := range d.random().Perm(len(peers)) {
+			if i >= fanout {
+				break
+			}
+			rv.DirectAdd(peers[j])
+		}
+		return rv
+	}).Into(target)
+
+	d.Join(target, func(p *string) *GossipDigest {
+		return &GossipDigest{To: *p, From: d.Addr, Digest: digest()}
+	}).IntoAsync(gdigest)
+
+	d.Join(gdigest, func(g *GossipDigest) *GossipState {
+		dg := digest()
+		if g.Digest == dg {
+			return nil
+		}
+		return &GossipState{To: g.From, From: d.Addr, Digest: dg, Pull: true, Val: snapshot()}
+	}).IntoAsync(gstate)
+
+	d.Join(gstate, func(g *GossipState) *GossipState {
+		dg := digest()
+		if !g.Pull || g.Digest == dg {
+			return nil
+		}
+		return &GossipState{To: g.From, From: d.Addr, Digest: dg, Val: snapshot()}
+	}).IntoAsync(gstate)
+
+	switch s := shared.(type) {
+	case *LSet:
+		d.JoinFlat(gstate, func(g *GossipState) *LSet {
+			v, _ := g.Val.(*LSet)
+			return v
+		}).Into(s)
+	case *LMap:
+		d.JoinFlat(gstate, func(g *GossipState) *LMap {
+			v, _ := g.Val.(*LMap)
+			return v
+		}).Into(s)
+	default:
+		panic(fmt.Sprintf("GossipInit() shared relation: %s, type: %T"+
+			", is not an LSet or LMap", d.relationLabel(shared), shared))
+	}
+
+	return d
+}
+
+func init() {
+	d := NewD("")
+	GossipInit(d, "", d.DeclareLSet("gossipShared", ""), time.Second, 1)
+}
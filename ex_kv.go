@@ -1,11 +1,28 @@
 package gdec
 
+import (
+	"time"
+)
+
 type KVPut struct {
 	ReqId      int64  `gdec:"key"`
 	Addr       string `gdec:"key,addr"`
 	ClientAddr string
 	Key        string
 	Val        Lattice
+	Expires    int64 // Unix nanos when the key expires, or 0 for never.
+}
+
+// How often a KV replica removes expired keys, which reads mask in the
+// meantime.
+var KVExpireSweepPeriod = time.Second
+
+// Returns a copy of the put that expires once ttl has passed on d's
+// clock.  Replicas compare the expiry against their own clocks, so
+// they only agree on what's expired when they share a clock.
+func KVPutWithTTL(d *D, put KVPut, ttl time.Duration) *KVPut {
+	put.Expires = d.Now().Add(ttl).UnixNano()
+	return &put
 }
 
 type KVPutResponse struct {
@@ -30,10 +47,10 @@ type KVGetResponse struct {
 }
 
 func KVProtocolInit(d *D, prefix string) *D {
-	d.DeclareChannel(prefix+"KVPut", KVPut{})
-	d.DeclareChannel(prefix+"KVPutResponse", KVPutResponse{})
-	d.DeclareChannel(prefix+"KVGet", KVGet{})
-	d.DeclareChannel(prefix+"KVGetResponse", KVGetResponse{})
+	d.declareProtocolChannel(prefix+"KVPut", KVPut{})
+	d.declareProtocolChannel(prefix+"KVPutResponse", KVPutResponse{})
+	d.declareProtocolChannel(prefix+"KVGet", KVGet{})
+	d.declareProtocolChannel(prefix+"KVGetResponse", KVGetResponse{})
 	return d
 }
 
@@ -41,6 +58,13 @@ func KVProtocolInit(d *D, prefix string) *D {
 // monotonically increasing LMap's.
 
 func KVInit(d *D, prefix string) *D {
+	return kvInit(d, prefix, false)
+}
+
+// When versioned, each key's value is kept in an MVReg, see
+// ReplicatedKVInit().
+func kvInit(d *D, prefix string, versioned bool) *D {
+	d.checkUndeclared("KVInit", prefix, "kvMap")
 	KVProtocolInit(d, prefix)
 
 	kvput := d.Relations[prefix+"KVPut"]
@@ -49,19 +73,69 @@ func KVInit(d *D, prefix string) *D {
 	kvgetr := d.Relations[prefix+"KVGetResponse"]
 
 	kvmap := d.DeclareLMap(prefix + "kvMap")
+	kvexpires := d.DeclareLMap(prefix + "kvExpires") // Val: LMax of unix nanos.
+	kvsweep := d.DeclarePeriodic(prefix+"kvExpireSweep", KVExpireSweepPeriod)
+
+	// A key's expiry is the latest of its puts' expiries, and puts
+	// without an expiry don't clear it.
+	expired := func(key string) bool {
+		e, ok := kvexpires.AtLMax(key)
+		return ok && int64(e.Int()) <= d.Now().UnixNano()
+	}
+	expire := func(key string) {
+		if expired(key) {
+			kvmap.Remove(key)
+			kvexpires.Remove(key)
+		}
+	}
+
+	// Expired keys are removed before a put, so the put starts afresh.
+	d.Join(kvput, func(k *KVPut) { expire(k.Key) })
+
+	d.Join(kvsweep, func(b *bool) {
+		if *b {
+			for _, key := range kvexpires.Keys() {
+				expire(key)
+			}
+		}
+	})
+
+	d.Join(kvput, func(k *KVPut) *LMapEntry {
+		if k.Expires == 0 {
+			return nil
+		}
+		return &LMapEntry{k.Key, NewLMax(d, int(k.Expires))}
+	}).Into(kvexpires)
 
 	d.Join(kvput, func(k *KVPut) *KVPutResponse {
 		return &KVPutResponse{k.ReqId, k.ClientAddr, d.Addr}
 	}).IntoAsync(kvputr)
 
 	d.Join(kvget, func(k *KVGet) *KVGetResponse {
+		if expired(k.Key) {
+			return &KVGetResponse{k.ReqId, k.ClientAddr, d.Addr, k.Key, nil}
+		}
 		return &KVGetResponse{k.ReqId, k.ClientAddr, d.Addr, k.Key,
 			kvmap.At(k.Key)}
 	}).IntoAsync(kvgetr)
 
+	if !versioned {
+		d.Join(kvput, func(k *KVPut) *LMapEntry {
+			return &LMapEntry{k.Key, k.Val}
+		}).Into(kvmap)
+		return d
+	}
+
+	// A put supersedes the values that this replica has seen for the
+	// key, so it's evaluated once per tick, against the last tick's map.
 	d.Join(kvput, func(k *KVPut) *LMapEntry {
-		return &LMapEntry{k.Key, k.Val}
-	}).Into(kvmap)
+		r := d.NewMVReg()
+		if cur, ok := kvmap.At(k.Key).(*MVReg); ok {
+			r.DirectMerge(cur)
+		}
+		r.Set(d.Addr, k.Val)
+		return &LMapEntry{k.Key, r}
+	}).IntoAsync(kvmap)
 
 	return d
 }
@@ -72,26 +146,48 @@ type KVReplReq struct {
 }
 
 type KVReplMap struct {
-	Addr  string `gdec:"key,addr"`
-	KVMap *LMap
+	Addr      string `gdec:"key,addr"`
+	KVMap     *LMap
+	KVExpires *LMap
 }
 
+// A KV replica that exchanges its map with other replicas.  Each key's
+// value is an MVReg, whose version vectors track which replica's puts
+// have seen which, so concurrent puts to a key on different replicas
+// are kept as siblings.  Gets return the MVReg, so a client can resolve
+// siblings with another put, and ReplicatedKVConflict lists the keys
+// that currently have siblings.
 func ReplicatedKVInit(d *D, prefix string) *D {
-	KVInit(d, prefix)
+	d.checkUndeclared("ReplicatedKVInit", prefix, "KVReplReq", "KVReplMap")
+	kvInit(d, prefix, true)
 
 	kvreplReq := d.DeclareChannel(prefix+"KVReplReq", KVReplReq{})
 	kvreplMap := d.DeclareChannel(prefix+"KVReplMap", KVReplMap{})
+	conflict := d.Scratch(d.DeclareLSet(prefix+"ReplicatedKVConflict", "keyString"))
 
 	kvmap := d.Relations[prefix+"kvMap"].(*LMap)
+	kvexpires := d.Relations[prefix+"kvExpires"].(*LMap)
+
+	d.Join(kvmap, func(e *LMapEntry) *string {
+		if r, ok := e.Val.(*MVReg); ok && r.Conflicted() {
+			return &e.Key
+		}
+		return nil
+	}).Into(conflict)
 
 	d.Join(kvreplReq, func(r *KVReplReq) *KVReplMap {
-		return &KVReplMap{r.TargetAddr, kvmap.Snapshot().(*LMap)}
+		return &KVReplMap{r.TargetAddr, kvmap.Snapshot().(*LMap),
+			kvexpires.Snapshot().(*LMap)}
 	}).IntoAsync(kvreplMap)
 
 	d.JoinFlat(kvreplMap, func(r *KVReplMap) *LMap {
 		return r.KVMap
 	}).Into(kvmap)
 
+	d.JoinFlat(kvreplMap, func(r *KVReplMap) *LMap {
+		return r.KVExpires
+	}).Into(kvexpires)
+
 	return d
 }
 
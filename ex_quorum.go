@@ -0,0 +1,250 @@
+package gdec
+
+import (
+	"fmt"
+	"reflect"
+)
+
+// A Quorum decides whether a set of voters is a quorum.  The quorums
+// of a Quorum should pairwise intersect, so that two quorums, like a
+// write's and a later read's, always share a voter.
+type Quorum interface {
+	HasQuorum(voters *LSet) bool
+}
+
+// Any n distinct voters, for when membership is implicit.
+func CountQuorum(n int) Quorum {
+	if n <= 0 {
+		panic(fmt.Sprintf("CountQuorum() needs a positive count: %d", n))
+	}
+	return countQuorum(n)
+}
+
+type countQuorum int
+
+func (q countQuorum) HasQuorum(voters *LSet) bool { return voters.Size() >= int(q) }
+
+// A majority of the members.
+func MajorityQuorum(members ...string) Quorum {
+	weights := map[string]int{}
+	for _, m := range members {
+		weights[m] = 1
+	}
+	return WeightedQuorum(weights)
+}
+
+// A majority of the current members of an LSet of addrs, so that the
+// quorum follows membership changes, as in Raft.
+func MajorityQuorumOf(member *LSet) Quorum {
+	return majorityOf{member}
+}
+
+type majorityOf struct{ member *LSet }
+
+func (q majorityOf) HasQuorum(voters *LSet) bool {
+	n := 0
+	for x := range voters.Scan() {
+		if q.member.Contains(x) {
+			n++
+		}
+	}
+	return n > q.member.Size()/2
+}
+
+// Members whose weights, summed, are more than half the total weight.
+// Voters that aren't members don't count.
+func WeightedQuorum(weights map[string]int) Quorum {
+	total := 0
+	for m, w := range weights {
+		if w < 0 {
+			panic(fmt.Sprintf("WeightedQuorum() member: %s, has a negative weight: %d",
+				m, w))
+		}
+		total += w
+	}
+	if total == 0 {
+		panic("WeightedQuorum() needs a positive total weight")
+	}
+	return weightedQuorum{weights, total}
+}
+
+type weightedQuorum struct {
+	weights map[string]int
+	total   int
+}
+
+func (q weightedQuorum) HasQuorum(voters *LSet) bool {
+	sum := 0
+	for x := range voters.Scan() {
+		if m, ok := x.(string); ok {
+			sum += q.weights[m]
+		}
+	}
+	return sum*2 > q.total
+}
+
+// Members arranged in rows, where a quorum is every member of some row
+// plus at least one member of each row, so that a quorum can be far
+// smaller than a majority, while any two quorums still intersect in
+// the full row of either.
+func GridQuorum(rows [][]string) Quorum {
+	if len(rows) == 0 {
+		panic("GridQuorum() needs at least one row")
+	}
+	for i, r := range rows {
+		if len(r) == 0 {
+			panic(fmt.Sprintf("GridQuorum() row: %d, is empty", i))
+		}
+	}
+	return gridQuorum(rows)
+}
+
+type gridQuorum [][]string
+
+func (q gridQuorum) HasQuorum(voters *LSet) bool {
+	fullRow := false
+	for _, r := range q {
+		n := 0
+		for _, m := range r {
+			if voters.Contains(m) {
+				n++
+			}
+		}
+		if n == 0 {
+			return false
+		}
+		fullRow = fullRow || n == len(r)
+	}
+	return fullRow
+}
+
+// Tallies votes for multiple, in-flight races, like MultiTallyInit(),
+// but a race is done once its voters are a quorum of q.
+func QuorumTallyInit(d *D, prefix string, q Quorum) *D {
+	d.checkUndeclared("QuorumTallyInit", prefix, "QuorumTallyVote",
+		"QuorumTallyDone", "quorumTallyVoters")
+	tvote := d.Input(d.DeclareLSet(prefix+"QuorumTallyVote", MultiTallyVote{}))
+	tdone := d.Output(d.DeclareLMapOf(prefix+"QuorumTallyDone", // Key: raceStr.
+		func() Lattice { return d.NewLBool() }))
+
+	tvoters := d.DeclareLMapOf(prefix+"quorumTallyVoters", // Key: raceStr, val: LSet[voterStr].
+		func() Lattice { return d.NewLSet(reflect.TypeOf("")) })
+
+	d.Join(tvote, func(tvote *MultiTallyVote) *LMapEntry {
+		return &LMapEntry{tvote.Race, NewLSetOne(d, tvote.Voter)}
+	}).Into(tvoters)
+
+	d.Join(tvoters, func(m *LMapEntry) *LMapEntry {
+		return &LMapEntry{m.Key, NewLBool(d, q.HasQuorum(m.Val.(*LSet)))}
+	}).Into(tdone)
+
+	return d
+}
+
+func init() {
+	QuorumTallyInit(NewD(""), "", CountQuorum(1))
+}
+
+// Returns the voters of a race, which is empty for an unknown race.
+func QuorumTallyVoters(d *D, prefix string, race string) *LSet {
+	return LMapAt[*LSet](d.Relations[prefix+"quorumTallyVoters"].(*LMap), race)
+}
+
+type QuorumWrite struct {
+	Id      string // Operation id.
+	Key     string
+	Val     string
+	Version int // Higher versions are later writes.
+}
+
+type QuorumWriteAck struct {
+	Id      string
+	Replica string
+}
+
+type QuorumRead struct {
+	Id  string
+	Key string
+}
+
+type QuorumReadAck struct {
+	Id      string
+	Replica string
+	Val     string // The replica's latest value for the read's key.
+	Version int
+}
+
+type QuorumReadResult struct {
+	Id      string
+	Key     string
+	Val     string
+	Version int
+}
+
+// Coordinates quorum writes and reads against replicas, which are
+// outside the module.  A write in QuorumWrite shows up in QuorumDurable
+// once writeQuorum distinct replicas have acked it via QuorumWriteAck.
+// A read in QuorumRead shows up in QuorumReadResult once readQuorum
+// distinct replicas have responded via QuorumReadAck, with the highest
+// versioned value among the responses, and again if later responses
+// have a higher version.  With N replicas, a read sees the latest
+// durable value when readQuorum + writeQuorum > N.
+func QuorumInit(d *D, prefix string, readQuorum, writeQuorum int) *D {
+	if readQuorum <= 0 || writeQuorum <= 0 {
+		panic(fmt.Sprintf("QuorumInit() quorums should be positive"+
+			", readQuorum: %d, writeQuorum: %d", readQuorum, writeQuorum))
+	}
+	d.checkUndeclared("QuorumInit", prefix, "QuorumWrite", "QuorumRead")
+
+	write := d.DeclareLSet(prefix+"QuorumWrite", QuorumWrite{})
+	writeAck := d.DeclareLSet(prefix+"QuorumWriteAck", QuorumWriteAck{})
+	durable := d.DeclareLSet(prefix+"QuorumDurable", QuorumWrite{})
+
+	read := d.DeclareLSet(prefix+"QuorumRead", QuorumRead{})
+	readAck := d.DeclareLSet(prefix+"QuorumReadAck", QuorumReadAck{})
+	result := d.DeclareLSet(prefix+"QuorumReadResult", QuorumReadResult{})
+
+	readBest := d.DeclareLMap(prefix + "quorumReadBest") // Key: id, val: LWWReg.
+
+	// Acks are counted per operation id.
+	wp, rp := prefix+"quorumWrite.", prefix+"quorumRead."
+	QuorumTallyInit(d, wp, CountQuorum(writeQuorum))
+	QuorumTallyInit(d, rp, CountQuorum(readQuorum))
+
+	d.Join(writeAck, func(a *QuorumWriteAck) *MultiTallyVote {
+		return &MultiTallyVote{a.Id, a.Replica}
+	}).Into(d.Relations[wp+"QuorumTallyVote"])
+
+	d.Join(write, d.Relations[wp+"QuorumTallyDone"],
+		func(w *QuorumWrite, m *LMapEntry) *QuorumWrite {
+			if m.Key == w.Id && m.Val.(*LBool).Bool() {
+				return w
+			}
+			return nil
+		}).Into(durable)
+
+	d.Join(readAck, func(a *QuorumReadAck) *MultiTallyVote {
+		return &MultiTallyVote{a.Id, a.Replica}
+	}).Into(d.Relations[rp+"QuorumTallyVote"])
+
+	d.Join(readAck, func(a *QuorumReadAck) *LMapEntry {
+		r := d.NewLWWReg()
+		r.Set(int64(a.Version), a.Val)
+		return &LMapEntry{a.Id, r}
+	}).Into(readBest)
+
+	d.Join(read, d.Relations[rp+"QuorumTallyDone"],
+		func(q *QuorumRead, m *LMapEntry) *QuorumReadResult {
+			if m.Key != q.Id || !m.Val.(*LBool).Bool() {
+				return nil
+			}
+			b := readBest.At(q.Id).(*LWWReg)
+			return &QuorumReadResult{q.Id, q.Key, b.Value(), int(b.Timestamp())}
+		}).Into(result)
+
+	return d
+}
+
+func init() {
+	QuorumInit(NewD(""), "", 2, 2)
+}
@@ -2,7 +2,11 @@ package gdec
 
 import (
 	"fmt"
+	"reflect"
+	"sort"
 	"strconv"
+	"strings"
+	"time"
 )
 
 // Invoked by candidates to gather votes.
@@ -12,6 +16,7 @@ type RaftVoteReq struct {
 	Term         int    // Candidate's term.
 	LastLogTerm  int    // Term of candidate's last log entry.
 	LastLogIndex int    // Index of candidate's last log entry.
+	PreVote      bool   // True asks if a vote would be granted, see RaftPreVote.
 }
 
 type RaftVoteRes struct { // Response.
@@ -19,17 +24,19 @@ type RaftVoteRes struct { // Response.
 	From    string
 	Term    int  // Current term, for candidate to update itself.
 	Granted bool // True means candidate received vote.
+	PreVote bool // Echoes the request's PreVote.
 }
 
 // Invoked by leaders to replicate log entries.
 type RaftAddEntryReq struct {
 	To           string
-	From         string // Leader's addr, allowing follower to redirect clients.
-	Term         int    // Leader's term.
-	PrevLogTerm  int    // Term of log entry immediately preceding this one.
-	PrevLogIndex int    // Index of log entry immediately preceding this one.
-	Entry        string // Log entry to store (empty for heartbeat).
-	CommitIndex  int    // Last entry known to be commited.
+	From         string      // Leader's addr, allowing follower to redirect clients.
+	Term         int         // Leader's term.
+	PrevLogTerm  int         // Term of log entry immediately preceding these.
+	PrevLogIndex int         // Index of log entry immediately preceding these.
+	Entries      []RaftEntry // Log entries to store, in order (empty for heartbeat).
+	CommitIndex  int         // Last entry known to be commited.
+	Sent         int64       // Leader's tick time, in unix nanos, for leases.
 }
 
 type RaftAddEntryRes struct { // Response.
@@ -38,6 +45,111 @@ type RaftAddEntryRes struct { // Response.
 	Term  int  // Current term, for leader to update itself.
 	Ok    bool // True if had entry matching PrevLogIndex/Term.
 	Index int
+	Sent  int64 // Echoes the request's Sent.
+}
+
+// Invoked by leaders to send a snapshot to followers that are behind
+// the leader's compacted log.
+type RaftInstallSnapshotReq struct {
+	To        string
+	From      string   // Leader's addr.
+	Term      int      // Leader's term.
+	LastIndex int      // Snapshot replaces all entries up through this index.
+	LastTerm  int      // Term of the entry at LastIndex.
+	Data      []byte   // Snapshot of the state machine.
+	Members   []string // Membership as of LastIndex.
+}
+
+type RaftInstallSnapshotRes struct { // Response.
+	To    string
+	From  string
+	Term  int // Current term, for leader to update itself.
+	Index int // LastIndex of the installed snapshot, or 0 if rejected.
+}
+
+// Invoked by a leader transferring leadership, once the target has
+// caught up, so it starts an election right away instead of waiting out
+// its election timeout, see RaftTransferLeader().
+type RaftTimeoutNowReq struct {
+	To   string
+	From string // Leader's addr.
+	Term int    // Leader's term.
+}
+
+// Invoked by clients to submit a command.
+type RaftClientReq struct {
+	To      string
+	From    string // Client's addr.
+	Id      string // Chosen by the client to match responses.
+	Command string // Command for state machine.
+}
+
+type RaftClientRes struct { // Response.
+	To     string
+	From   string
+	Id     string
+	Ok     bool   // True means the command committed.
+	Leader string // When not ok, the known leader to redirect to, if any.
+	Index  int    // When ok, the log index of the command.
+}
+
+// Invoked by clients for a linearizable read, which a leader allows
+// once a heartbeat round confirms that it still leads, and its state
+// machine has caught up, without appending the read to its log.
+type RaftReadIndexReq struct {
+	To   string
+	From string // Client's addr.
+	Id   string // Chosen by the client to match responses.
+}
+
+type RaftReadIndexRes struct { // Response.
+	To     string
+	From   string
+	Id     string
+	Ok     bool   // True means the read may proceed.
+	Leader string // When not ok, the known leader to redirect to, if any.
+	Index  int    // When ok, the state machine has applied at least this index.
+}
+
+// A read-index request received by a leader, awaiting confirmation.
+type RaftReadPending struct {
+	Index int   // Read once applied through this index.
+	Term  int   // Leader's term when the read was received.
+	Sent  int64 // Heartbeats sent from this tick time on confirm leadership.
+	Req   RaftReadIndexReq
+}
+
+// A client request appended by a leader, awaiting commit.
+type RaftClientPending struct {
+	Index int
+	Term  int
+	Req   RaftClientReq
+}
+
+// An operator's request that a leader hand leadership to a member.
+type RaftTransferLeadership struct {
+	To string
+}
+
+// A leadership transfer in progress, during which the leader accepts no
+// new entries, see RaftTransferLeader().
+type raftTransfer struct {
+	Term    int
+	To      string
+	Started int64 // Unix nanos.
+}
+
+// The leader that a node knows of in its current term, see
+// RaftLeaderOf().  An empty Leader means none is known, as during an
+// election.
+type RaftLeaderHint struct {
+	Leader string
+	Term   int
+}
+
+func raftLeaderHintLess(a, b interface{}) bool {
+	x, y := a.(RaftLeaderHint), b.(RaftLeaderHint)
+	return x.Term < y.Term || (x.Term == y.Term && x.Leader < y.Leader)
 }
 
 type RaftVote struct {
@@ -51,37 +163,209 @@ type RaftEntry struct {
 	Entry string // Command for state machine.
 }
 
+type RaftSnapshot struct {
+	Index   int      // Last entry included in the snapshot.
+	Term    int      // Term of the entry at Index.
+	Data    []byte   // Snapshot of the state machine as of Index.
+	Members []string // Membership as of Index.
+}
+
+// Optional snapshotting of the state machine, allowing the log to be
+// compacted.
+type RaftSnapshotter struct {
+	// Snapshot once this many entries are applied beyond the last snapshot.
+	Threshold int
+
+	// Captures the state machine, as of the last applied entry.
+	Snapshot func() []byte
+
+	// Replaces the state machine with a snapshot from a leader.
+	Restore func(data []byte)
+}
+
 type RaftLogState struct {
 	LastTerm        int
 	LastIndex       int
 	LastCommitIndex int
 }
 
+// The kinds of a raftState.
 const (
-	// The 'kind' of a state are in the lowest bits.
 	state_FOLLOWER  = 0
 	state_CANDIDATE = 1
 	state_LEADER    = 2
 	state_STEP_DOWN = 3 // Must be largest for LMax precedence.
+)
 
-	state_KIND_MASK    = 0x0000000f
-	state_VERSION_MASK = 0xfffffff0 // Highest bits are version for precedence.
-	state_VERSION_NEXT = 0x00000010
+func raftStateKindName(kind int) string {
+	switch kind {
+	case state_FOLLOWER:
+		return "follower"
+	case state_CANDIDATE:
+		return "candidate"
+	case state_LEADER:
+		return "leader"
+	}
+	return "stepping down"
+}
+
+// A change of a node's state kind, see RaftOnTransition().
+type RaftTransition struct {
+	Addr string
+	From string // Like "follower", "candidate" or "leader".
+	To   string
+	Term int // The term as of the change.
+	Tick int64
+}
+
+// A node's state, where a step down bumps the version, so that the
+// resulting follower state takes precedence, see raftStateLess().
+type raftState struct {
+	Version int
+	Kind    int
+}
+
+// A leader's nextIndex for a follower, where each update bumps the
+// version, like a raftState's, so that backing off to a lower index
+// still takes precedence, see raftNextIndexLess().
+type raftNextIndex struct {
+	Version int
+	Index   int
+}
+
+var (
+	// Election timeouts are randomized in [min, max) so that
+	// candidates don't keep splitting the vote in lockstep.
+	RaftElectionTimeoutMin = 150 * time.Millisecond
+	RaftElectionTimeoutMax = 300 * time.Millisecond
+	RaftHeartbeatPeriod    = 50 * time.Millisecond
+
+	// A leader serves reads until this long after the send time of the
+	// latest heartbeats acked by a quorum.  Followers won't elect a new
+	// leader until RaftElectionTimeoutMin after their last heartbeat, so
+	// this is shorter, leaving a margin for clock drift.
+	RaftLeaseDuration = 135 * time.Millisecond
+
+	// When true, RaftInit() nodes that time out first ask for pre-votes,
+	// and only start an election, incrementing their term, once a quorum
+	// would grant it.  Nodes that have heard from a leader within
+	// RaftElectionTimeoutMin don't grant pre-votes, so a node rejoining
+	// from a partition can't disrupt a stable leader.
+	RaftPreVote = false
+
+	// The most entries that a RaftInit() leader has in flight to a
+	// follower, past the follower's last acked entry, so a far behind
+	// or slow follower is caught up a window at a time instead of in
+	// one huge request, resent on every heartbeat until acked.  Zero
+	// means no limit.
+	RaftMaxInFlight = 256
 )
 
-func stateKind(s int) int        { return s & state_KIND_MASK }
-func stateVersion(s int) int     { return s & state_VERSION_MASK }
-func stateVersionNext(s int) int { return stateVersion(s) + state_VERSION_NEXT }
+// Configuration entries are log entries that add or remove a member.
+// They're applied to the member set when they commit, instead of being
+// passed to the apply callback.
+const (
+	raftConfig_ADD    = "raft/config/add:"
+	raftConfig_REMOVE = "raft/config/remove:"
+)
+
+// Appended by a leader that has no entry of its own term, so that a
+// read-index read can learn what's committed.  It's not applied.
+const raftNoOp_ENTRY = "raft/noop"
+
+func RaftConfigEntry(addr string, add bool) string {
+	if add {
+		return raftConfig_ADD + addr
+	}
+	return raftConfig_REMOVE + addr
+}
+
+func parseRaftConfigEntry(entry string) (addr string, add bool, ok bool) {
+	if strings.HasPrefix(entry, raftConfig_ADD) {
+		return entry[len(raftConfig_ADD):], true, true
+	}
+	if strings.HasPrefix(entry, raftConfig_REMOVE) {
+		return entry[len(raftConfig_REMOVE):], false, true
+	}
+	return "", false, false
+}
+
+// Orders raftNextIndexes by version and then index.
+func raftNextIndexLess(a, b interface{}) bool {
+	x, y := a.(raftNextIndex), b.(raftNextIndex)
+	return x.Version < y.Version || (x.Version == y.Version && x.Index < y.Index)
+}
+
+func newRaftNextIndex(d *D, n raftNextIndex) *LMaxBy {
+	m := d.NewLMaxBy(reflect.TypeOf(n), raftNextIndexLess)
+	m.DirectAdd(n)
+	return m
+}
+
+func nextIndexOf(v Lattice) raftNextIndex { return v.(*LMaxBy).Value().(raftNextIndex) }
+
+// Returns the next version of a nextIndex, at index.
+func nextIndexVersionNext(d *D, v Lattice, index int) *LMaxBy {
+	return newRaftNextIndex(d, raftNextIndex{nextIndexOf(v).Version + 1, index})
+}
+
+// Orders raftStates by version and then kind.
+func raftStateLess(a, b interface{}) bool {
+	x, y := a.(raftState), b.(raftState)
+	return x.Version < y.Version || (x.Version == y.Version && x.Kind < y.Kind)
+}
+
+// RaftOnTransition registers f to be invoked during Tick() whenever the
+// RaftInit() node's state changes kind, as on becoming a candidate and
+// then leader, so tests can assert on the sequence of transitions
+// instead of polling the state on every tick.  A step down bumps the
+// state's version, which isn't a transition unless the kind changes.
+func RaftOnTransition(d *D, prefix string, f func(RaftTransition)) {
+	curTerm := d.Relations[prefix+"raftCurTerm"].(*LMax)
+	curState := d.Relations[prefix+"raftCurState"].(*LMaxBy)
+	kind := curState.Value().(raftState).Kind
+	d.OnChange(prefix+"raftCurState", func(added interface{}) {
+		next := curState.Value().(raftState).Kind
+		if next == kind {
+			return
+		}
+		f(RaftTransition{Addr: d.Addr, From: raftStateKindName(kind),
+			To: raftStateKindName(next), Term: curTerm.Int(), Tick: d.Ticks()})
+		kind = next
+	})
+}
+
+func RaftClientInit(d *D, prefix string) *D {
+	d.declareProtocolChannel(prefix+"RaftClientReq", RaftClientReq{})
+	d.declareProtocolChannel(prefix+"RaftClientRes", RaftClientRes{})
+	d.declareProtocolChannel(prefix+"RaftReadIndexReq", RaftReadIndexReq{})
+	d.declareProtocolChannel(prefix+"RaftReadIndexRes", RaftReadIndexRes{})
+	return d
+}
 
 func RaftProtocolInit(d *D, prefix string) *D {
-	d.DeclareChannel(prefix+"RaftVoteReq", RaftVoteReq{})
-	d.DeclareChannel(prefix+"RaftVoteRes", RaftVoteRes{})
-	d.DeclareChannel(prefix+"RaftAddEntryReq", RaftAddEntryReq{})
-	d.DeclareChannel(prefix+"RaftAddEntryRes", RaftAddEntryRes{})
+	RaftClientInit(d, prefix)
+	d.declareProtocolChannel(prefix+"RaftVoteReq", RaftVoteReq{})
+	d.declareProtocolChannel(prefix+"RaftVoteRes", RaftVoteRes{})
+	d.declareProtocolChannel(prefix+"RaftAddEntryReq", RaftAddEntryReq{})
+	d.declareProtocolChannel(prefix+"RaftAddEntryRes", RaftAddEntryRes{})
+	d.declareProtocolChannel(prefix+"RaftInstallSnapshotReq", RaftInstallSnapshotReq{})
+	d.declareProtocolChannel(prefix+"RaftInstallSnapshotRes", RaftInstallSnapshotRes{})
+	d.declareProtocolChannel(prefix+"RaftTimeoutNowReq", RaftTimeoutNowReq{})
 	return d
 }
 
-func RaftInit(d *D, prefix string) *D {
+// The apply callback, if non-nil, is invoked exactly once per committed
+// log entry, in index order.
+func RaftInit(d *D, prefix string, apply func(entry string)) *D {
+	return RaftInitSnapshotter(d, prefix, apply, nil)
+}
+
+// Like RaftInit, but with an optional snapshotter so that applied log
+// entries are compacted away.
+func RaftInitSnapshotter(d *D, prefix string, apply func(entry string),
+	snapshotter *RaftSnapshotter) *D {
+	d.checkUndeclared("RaftInit", prefix, "raftMember", "raftCurTerm")
 	d = RaftProtocolInit(d, prefix)
 
 	rvote := d.Relations[prefix+"RaftVoteReq"]
@@ -90,98 +374,287 @@ func RaftInit(d *D, prefix string) *D {
 	radd := d.Relations[prefix+"RaftAddEntryReq"]
 	raddr := d.Relations[prefix+"RaftAddEntryRes"]
 
+	rsnap := d.Relations[prefix+"RaftInstallSnapshotReq"]
+	rsnapr := d.Relations[prefix+"RaftInstallSnapshotRes"]
+
+	rclient := d.Relations[prefix+"RaftClientReq"]
+	rclientr := d.Relations[prefix+"RaftClientRes"]
+
+	rread := d.Relations[prefix+"RaftReadIndexReq"]
+	rreadr := d.Relations[prefix+"RaftReadIndexRes"]
+
+	rtimeout := d.Relations[prefix+"RaftTimeoutNowReq"]
+
 	member := d.DeclareLSet(prefix+"raftMember", "addrString")
 
 	curTerm := d.DeclareLMax(prefix + "raftCurTerm")
-	curState := d.DeclareLMax(prefix + "raftCurState")
+	curState := d.DeclareLMaxBy(prefix+"raftCurState", raftState{}, raftStateLess)
+
+	// Log state transitions, see SetLogger().  The term changes on the
+	// same tick, before the state, as its join is declared first.
+	RaftOnTransition(d, prefix, func(tr RaftTransition) {
+		if d.LogEnabled(LogInfo) {
+			d.Log(LogInfo, "raft became "+tr.To,
+				"addr", d.Addr, "prefix", prefix, "term", tr.Term)
+		}
+	})
 
 	nextTerm := d.Scratch(d.DeclareLMax(prefix + "raftNextTerm"))
 	nextState := d.Scratch(d.DeclareLMax(prefix + "raftNextState"))
 
-	alarm := d.Scratch(d.DeclareLBool(prefix + "raftAlarm"))           // TODO: periodic.
-	alarmReset := d.Scratch(d.DeclareLBool(prefix + "raftAlarmReset")) // TODO: periodic.
-	heartbeat := d.Scratch(d.DeclareLBool(prefix + "raftHeartbeat"))   // TODO: periodic.
+	alarm := d.DeclareRandomPeriodic(prefix+"raftAlarm",
+		RaftElectionTimeoutMin, RaftElectionTimeoutMax)
+	alarmReset := d.Scratch(d.DeclareLBool(prefix + "raftAlarmReset")).(*LBool)
+	heartbeat := d.DeclarePeriodic(prefix+"raftHeartbeat", RaftHeartbeatPeriod)
 
 	MultiTallyInit(d, prefix+"tallyLeader/")
 	tallyLeaderVote := d.Relations[prefix+"tallyLeader/MultiTallyVote"].(*LSet)
-	tallyLeaderNeed := d.Relations[prefix+"tallyLeader/MultiTallyNeed"].(*LMax)
+	tallyLeaderNeed := d.Scratch(d.Relations[prefix+"tallyLeader/MultiTallyNeed"])
 	tallyLeaderDone := d.Relations[prefix+"tallyLeader/MultiTallyDone"].(*LMap)
 
+	// Pre-votes are tallied by the term that would be started.
+	preVote := RaftPreVote
+	MultiTallyInit(d, prefix+"tallyPreVote/")
+	tallyPreVoteVote := d.Relations[prefix+"tallyPreVote/MultiTallyVote"].(*LSet)
+	tallyPreVoteNeed := d.Scratch(d.Relations[prefix+"tallyPreVote/MultiTallyNeed"])
+	tallyPreVoteDone := d.Relations[prefix+"tallyPreVote/MultiTallyDone"].(*LMap)
+	preVoteTerm := d.DeclareLMax(prefix + "raftPreVoteTerm")
+	leaderContact := d.DeclareLMax(prefix + "raftLeaderContact") // Unix nanos.
+
 	goodCandidate := d.Scratch(d.DeclareLSet(prefix+"raftGoodCandidate", RaftVoteReq{}))
 	bestCandidate := d.Scratch(d.DeclareLMaxString(prefix + "raftBestCandidate"))
 
-	// TODO: optimization to instead use LMap["term", LSet[RaftVote]].
-	votedFor := d.DeclareLSet(prefix+"raftVotedFor", RaftVote{})
+	// Indexed by term, as it keeps the votes of every term, until
+	// d.Compact() drops those of terms older than the latest vote.
+	votedFor := d.DeclareLSet(prefix+"raftVotedFor", RaftVote{}).DeclareIndex("Term").
+		DeclareDominated(func(a, b interface{}) bool {
+			return a.(*RaftVote).Term < b.(*RaftVote).Term
+		})
 	votedForInCurTerm := d.Scratch(d.DeclareLSet(prefix+"raftVotedForInCurTerm", "addrString"))
 
 	// Key: "index", val: LSet[RaftEntry].
 	logEntry := d.DeclareLMap(prefix + "raftEntry")
-	logState := d.DeclareLSet(prefix+"raftLogState", RaftLogState{}) // TODO: sub-module.
-	logAdd := d.DeclareLSet(prefix+"raftLogAdd", RaftEntry{})        // TODO: sub-module.
-	logCommit := d.DeclareLMax(prefix + "raftLogCommit")             // TODO: sub-module.
+	logState := d.Scratch(d.DeclareLSet(prefix+"raftLogState", RaftLogState{})) // TODO: sub-module.
+	logAdd := d.Scratch(d.DeclareLSet(prefix+"raftLogAdd", RaftEntry{}))        // TODO: sub-module.
+	logCommit := d.DeclareLMax(prefix + "raftLogCommit")                        // TODO: sub-module.
+	logApplied := d.DeclareLMax(prefix + "raftLogApplied")                      // TODO: sub-module.
+
+	// Entries proposed for the leader to append to its log.
+	propose := d.Scratch(d.DeclareLSet(prefix+"raftPropose", "entryString"))
+
+	// Leaders seen, with the highest term being the known leader.
+	leader := d.DeclareLSet(prefix+"raftLeader", RaftVote{})
+	leaderHint := d.Output(d.DeclareLMaxBy(prefix+"RaftLeaderHint",
+		RaftLeaderHint{}, raftLeaderHintLess))
+
+	// Key: "addr", val: LMax of the latest Sent acked in the current term.
+	leaseAck := d.DeclareLMap(prefix + "raftLeaseAck")
+	canServeReads := d.Output(d.DeclareLBool(prefix + "RaftCanServeReads"))
+	clientPending := d.DeclareLSet(prefix+"raftClientPending", RaftClientPending{})
+
+	// Read-index reads awaiting a heartbeat round, and those that may
+	// proceed this tick.
+	readPending := d.DeclareLSet(prefix+"raftReadPending", RaftReadPending{})
+	readReady := d.Output(d.DeclareLSet(prefix+"RaftReadIndexReady", RaftReadIndexRes{}))
+
+	majority := MajorityQuorumOf(member)
+
+	// Operator requests to transfer leadership, and the transfers that
+	// they started, per term.
+	transferReq := d.Scratch(d.DeclareLSet(prefix+"RaftTransferLeadership",
+		RaftTransferLeadership{}))
+	transfer := d.DeclareLSet(prefix+"raftTransfer", raftTransfer{}).DeclareIndex("Term")
+
+	// Returns the latest transfer started in the term, unless it's had
+	// RaftElectionTimeoutMax to finish, after which the leader gives up
+	// on it and accepts entries again.
+	activeTransfer := func(t int) *raftTransfer {
+		var rv *raftTransfer
+		for _, x := range transfer.Lookup("Term", t) {
+			if tr := x.(*raftTransfer); rv == nil || tr.Started > rv.Started {
+				rv = tr
+			}
+		}
+		if rv == nil || !d.TickTime().Before(time.Unix(0, rv.Started).
+			Add(RaftElectionTimeoutMax)) {
+			return nil
+		}
+		return rv
+	}
 
-	nextIndex := d.DeclareLMap(prefix + "raftNextIndex") // Key: "addr", val: LMax.
+	nextIndex := d.DeclareLMap(prefix + "raftNextIndex") // Key: "addr", val: LMaxBy[raftNextIndex].
 
-	MultiTallyInit(d, prefix+"tallyCommit/")
-	tallyCommitVote := d.Relations[prefix+"tallyCommit/MultiTallyVote"].(*LSet)
-	tallyCommitNeed := d.Relations[prefix+"tallyCommit/MultiTallyNeed"].(*LMax)
-	tallyCommitDone := d.Relations[prefix+"tallyCommit/MultiTallyDone"].(*LMap)
+	// Only the latest snapshot is kept, with log entries at or below
+	// its index compacted away.
+	snapshot := d.DeclareLSet(prefix+"raftSnapshot", RaftSnapshot{})
+	snapshotAdd := d.Scratch(d.DeclareLSet(prefix+"raftSnapshotAdd", RaftSnapshot{}))
+	// A snapshot loaded by RaftPersist(), to restore the state machine from.
+	snapshotLoad := d.Scratch(d.DeclareLSet(prefix+"raftSnapshotLoad", RaftSnapshot{}))
+
+	// Like raftEntryAt, but the latest snapshot stands in for the
+	// entries that it compacted.
+	entryAt := func(index int) *RaftEntry {
+		if e := raftEntryAt(logEntry, index); e != nil {
+			return e
+		}
+		if s := latestRaftSnapshot(snapshot); s != nil && s.Index == index {
+			return &RaftEntry{Term: s.Term, Index: s.Index}
+		}
+		return nil
+	}
+
+	// Index 0 is a sentinel that every log agrees on, so the first real
+	// entry always has a matching previous entry.
+	logEntry.DirectAdd(&LMapEntry{indexToKey(0), NewLSetOne(d, &RaftEntry{})})
+
+	// Unlike nextIndex, which is a guess that backs off, a follower's
+	// matchIndex only grows, with its acks during the leader's term.
+	matchIndex := d.DeclareLMap(prefix + "raftMatchIndex") // Key: "addr", val: LMax.
 
 	// ------------------------------------------------------------------------
 
-	d.Join(func() int { return member.Size() / 2 }).Into(tallyLeaderNeed)
-	d.Join(func() int { return member.Size() / 2 }).Into(tallyCommitNeed)
+	// The needs are scratch, so they follow membership changes.  A
+	// candidate votes for itself.
+	d.Join(func() int { return member.Size()/2 + 1 }).Into(tallyLeaderNeed)
+	d.Join(func() int { return member.Size()/2 + 1 }).Into(tallyPreVoteNeed)
 
 	// Initialize our scratch next term/state.
 	d.Join(curTerm).Into(nextTerm)
-	d.Join(curState, func(s *int) int { return stateKind(*s) }).Into(nextState)
+	d.Join(curState, func(s *raftState) int { return s.Kind }).Into(nextState)
 
 	// Incorporate next term and next state asynchronously.
 	d.Join(nextTerm).IntoAsync(curTerm)
-	d.Join(nextState, curState, func(n *int, s *int) int {
-		if *n == state_STEP_DOWN {
-			return stateVersionNext(*s) + state_FOLLOWER
-		}
-		return stateVersion(*s) + stateKind(*n)
-	}).IntoAsync(curState)
+	d.Join(nextState, curState, nextTerm, curTerm,
+		func(n *int, s *raftState, nt *int, t *int) raftState {
+			if *n == state_STEP_DOWN {
+				return raftState{s.Version + 1, state_FOLLOWER}
+			}
+			if *n == state_LEADER && *nt > *t {
+				// Won the old term's race while starting a new one, which
+				// hasn't been won.
+				return raftState{s.Version, state_CANDIDATE}
+			}
+			return raftState{s.Version, *n}
+		}).IntoAsync(curState)
 
 	// Any incoming higher terms take precendence.
-	d.Join(rvote, func(r *RaftVoteReq) int { return r.Term }).Into(nextTerm)
+	d.Join(rvote, func(r *RaftVoteReq) int {
+		if r.PreVote {
+			return 0 // A pre-vote's term hasn't been started.
+		}
+		return r.Term
+	}).Into(nextTerm)
 	d.Join(rvoter, func(r *RaftVoteRes) int { return r.Term }).Into(nextTerm)
 	d.Join(radd, func(r *RaftAddEntryReq) int { return r.Term }).Into(nextTerm)
 	d.Join(raddr, func(r *RaftAddEntryRes) int { return r.Term }).Into(nextTerm)
+	d.Join(rsnap, func(r *RaftInstallSnapshotReq) int { return r.Term }).Into(nextTerm)
+	d.Join(rsnapr, func(r *RaftInstallSnapshotRes) int { return r.Term }).Into(nextTerm)
+	d.Join(rtimeout, func(r *RaftTimeoutNowReq) int { return r.Term }).Into(nextTerm)
 
 	// Any incoming higher terms can make us step down.
 	d.Join(rvote, curTerm, curState,
-		func(r *RaftVoteReq, t *int, s *int) int { return caseStepDown(r.Term, *t, *s) }).
-		Into(nextState)
+		func(r *RaftVoteReq, t *int, s *raftState) int {
+			if r.PreVote {
+				return s.Kind
+			}
+			return caseStepDown(r.Term, *t, s.Kind)
+		}).Into(nextState)
 	d.Join(rvoter, curTerm, curState,
-		func(r *RaftVoteRes, t *int, s *int) int { return caseStepDown(r.Term, *t, *s) }).
+		func(r *RaftVoteRes, t *int, s *raftState) int { return caseStepDown(r.Term, *t, s.Kind) }).
 		Into(nextState)
 	d.Join(radd, curTerm, curState,
-		func(r *RaftAddEntryReq, t *int, s *int) int { return caseStepDown(r.Term, *t, *s) }).
+		func(r *RaftAddEntryReq, t *int, s *raftState) int { return caseStepDown(r.Term, *t, s.Kind) }).
 		Into(nextState)
 	d.Join(raddr, curTerm, curState,
-		func(r *RaftAddEntryRes, t *int, s *int) int { return caseStepDown(r.Term, *t, *s) }).
+		func(r *RaftAddEntryRes, t *int, s *raftState) int { return caseStepDown(r.Term, *t, s.Kind) }).
+		Into(nextState)
+	d.Join(rsnap, curTerm, curState,
+		func(r *RaftInstallSnapshotReq, t *int, s *raftState) int { return caseStepDown(r.Term, *t, s.Kind) }).
+		Into(nextState)
+	d.Join(rsnapr, curTerm, curState,
+		func(r *RaftInstallSnapshotRes, t *int, s *raftState) int { return caseStepDown(r.Term, *t, s.Kind) }).
+		Into(nextState)
+	d.Join(rtimeout, curTerm, curState,
+		func(r *RaftTimeoutNowReq, t *int, s *raftState) int { return caseStepDown(r.Term, *t, s.Kind) }).
 		Into(nextState)
 
-	// Timeout means we should become a candidate.
-	d.Join(alarm, curTerm, curState, func(alarm *bool, t *int, s *int) {
-		// Move to candidate state, with a new term, self-vote, and alarm reset.
-		if *alarm && stateKind(*s) != state_LEADER {
-			d.Add(nextTerm, *t+1)
-			d.Add(nextState, state_CANDIDATE)
-			d.Add(tallyLeaderVote, &MultiTallyVote{termToKey(*t + 1), d.Addr})
-			// TODO: d.Add(resetAlarm, true)
-			// TODO: remove uncommitted logs.
-			return
+	// Move to candidate state, with a new term, self-vote, and alarm reset.
+	becomeCandidate := func(t int) {
+		d.Add(nextTerm, t+1)
+		d.Add(nextState, state_CANDIDATE)
+		d.Add(tallyLeaderVote, &MultiTallyVote{termToKey(t + 1), d.Addr})
+		d.Add(votedFor, &RaftVote{t + 1, d.Addr}) // So we don't vote twice.
+		d.Add(alarmReset, true)
+	}
+
+	// Timeout means we should become a candidate, or with pre-votes,
+	// first ask whether we could win.
+	d.Join(alarm, curTerm, curState, func(alarm *bool, t *int, s *raftState) {
+		if *alarm && s.Kind != state_LEADER {
+			if !preVote {
+				becomeCandidate(*t)
+				return
+			}
+			d.Add(preVoteTerm, *t+1)
+			d.Add(tallyPreVoteVote, &MultiTallyVote{termToKey(*t + 1), d.Addr})
+			d.Add(alarmReset, true)
+		}
+	})
+
+	d.Join(curTerm, curState, preVoteTerm, func(t *int, s *raftState, p *int) {
+		if *p == *t+1 && s.Kind != state_LEADER {
+			if LMapAt[*LBool](tallyPreVoteDone, termToKey(*p)).Bool() {
+				becomeCandidate(*t)
+			}
 		}
 	})
 
+	// Send pre-vote requests, for the term that we'd start.
+	d.Join(heartbeat, member, curTerm, curState, preVoteTerm, logState,
+		func(h *bool, a *string, t *int, s *raftState, p *int,
+			l *RaftLogState) *RaftVoteReq {
+			if *p == *t+1 && s.Kind != state_LEADER &&
+				!MultiTallyHasVoteFrom(d, prefix+"tallyPreVote/", termToKey(*p), *a) {
+				return &RaftVoteReq{To: *a, From: d.Addr, Term: *p,
+					LastLogTerm: l.LastTerm, LastLogIndex: l.LastIndex, PreVote: true}
+			}
+			return nil
+		}).IntoAsync(rvote)
+
+	d.Join(curTerm, preVoteTerm, rvoter,
+		func(t *int, p *int, r *RaftVoteRes) *MultiTallyVote {
+			if r.PreVote && r.Granted && *p == *t+1 {
+				return &MultiTallyVote{termToKey(*p), r.From}
+			}
+			return nil
+		}).Into(tallyPreVoteVote)
+
+	// Grant a pre-vote to a good candidate for a later term, unless we
+	// still hear from a leader.
+	d.Join(rvote, curTerm, curState, logState, leaderContact,
+		func(r *RaftVoteReq, t *int, s *raftState, l *RaftLogState, c *int) *RaftVoteRes {
+			if !r.PreVote {
+				return nil
+			}
+			recent := d.TickTime().Sub(time.Unix(0, int64(*c))) < RaftElectionTimeoutMin
+			granted := r.Term > *t && s.Kind != state_LEADER && !recent &&
+				(r.LastLogTerm > l.LastTerm ||
+					(r.LastLogTerm == l.LastTerm && r.LastLogIndex >= l.LastIndex))
+			return &RaftVoteRes{To: r.From, From: r.To, Term: *t, Granted: granted,
+				PreVote: true}
+		}).IntoAsync(rvoter)
+
+	d.Join(radd, curTerm, func(r *RaftAddEntryReq, t *int) int {
+		if r.Term >= *t {
+			return int(d.TickTime().UnixNano())
+		}
+		return 0
+	}).Into(leaderContact)
+
 	// Send vote requests.
 	d.Join(heartbeat, member, curTerm, curState, logState,
-		func(h *bool, a *string, t *int, s *int, l *RaftLogState) *RaftVoteReq {
-			if stateKind(*s) == state_CANDIDATE &&
+		func(h *bool, a *string, t *int, s *raftState, l *RaftLogState) *RaftVoteReq {
+			if s.Kind == state_CANDIDATE &&
 				!MultiTallyHasVoteFrom(d, prefix+"tallyLeader/", termToKey(*t), *a) {
 				return &RaftVoteReq{To: *a, From: d.Addr, Term: *t,
 					LastLogTerm: l.LastTerm, LastLogIndex: l.LastIndex}
@@ -191,9 +664,9 @@ func RaftInit(d *D, prefix string) *D {
 
 	// Tally votes when we're a candidate.
 	d.Join(curTerm, curState, rvoter,
-		func(curTerm *int, curState *int, r *RaftVoteRes) *MultiTallyVote {
+		func(curTerm *int, curState *raftState, r *RaftVoteRes) *MultiTallyVote {
 			// Record granted vote if we're still a candidate in the same term.
-			if stateKind(*curState) == state_CANDIDATE &&
+			if curState.Kind == state_CANDIDATE && !r.PreVote &&
 				r.Term == *curTerm && r.Granted {
 				return &MultiTallyVote{termToKey(r.Term), r.From}
 			}
@@ -201,30 +674,32 @@ func RaftInit(d *D, prefix string) *D {
 		}).Into(tallyLeaderVote)
 
 	d.Join(curTerm, curState,
-		func(curTerm *int, curState *int) int {
+		func(curTerm *int, curState *raftState) int {
 			// Become leader if we won the race.
-			if stateKind(*curState) == state_CANDIDATE {
-				won := tallyLeaderDone.At(termToKey(*curTerm)).(*LBool)
-				if won != nil && won.Bool() {
+			if curState.Kind == state_CANDIDATE {
+				if LMapAt[*LBool](tallyLeaderDone, termToKey(*curTerm)).Bool() {
 					return state_LEADER
 				}
 			}
-			return stateKind(*curState)
+			return curState.Kind
 		}).Into(nextState)
 
 	// Cast votes.
-	d.Join(curTerm, votedFor,
-		func(curTerm *int, votedFor *RaftVote) *string {
-			// Remember who we voted for in the current term.
-			if *curTerm == votedFor.Term {
-				return &votedFor.Candidate
-			}
-			return nil
-		}).Into(votedForInCurTerm)
+	d.JoinFlat(curTerm, func(curTerm *int) *LSet {
+		// Remember who we voted for in the current term.
+		rv := d.NewLSet(votedForInCurTerm.TupleType())
+		for _, v := range votedFor.Lookup("Term", *curTerm) {
+			rv.DirectAdd(v.(*RaftVote).Candidate)
+		}
+		return rv
+	}).Into(votedForInCurTerm)
 
 	d.Join(rvote, logState,
 		func(rvote *RaftVoteReq, logState *RaftLogState) *RaftVoteReq {
 			// Good candidate only if candidate's log is at or beyond our log.
+			if rvote.PreVote {
+				return nil
+			}
 			if rvote.LastLogTerm > logState.LastTerm ||
 				(rvote.LastLogTerm == logState.LastTerm &&
 					rvote.LastLogIndex >= logState.LastIndex) {
@@ -238,12 +713,18 @@ func RaftInit(d *D, prefix string) *D {
 
 	d.Join(rvote, bestCandidate, curTerm,
 		func(r *RaftVoteReq, b *string, t *int) *RaftVoteRes {
+			if r.PreVote {
+				return nil
+			}
 			// Grant vote if we hadn't voted yet or if we already voted for the candidate.
 			granted := r.Term >= *t &&
 				((votedForInCurTerm.(*LSet).Size() == 0 && r.From == *b) ||
 					(votedForInCurTerm.(*LSet).Contains(r.From)))
+			if granted {
+				d.Add(alarmReset, true) // Give the candidate time to win.
+			}
 			return &RaftVoteRes{To: r.From, From: r.To, Term: *t, Granted: granted}
-		}).IntoAsync(rvoter) // TODO: reset timer if we grant a vote to a candidate.
+		}).IntoAsync(rvoter)
 
 	d.Join(bestCandidate, curTerm,
 		func(bestCandidate *string, curTerm *int) *RaftVote {
@@ -254,101 +735,596 @@ func RaftInit(d *D, prefix string) *D {
 			return nil
 		}).IntoAsync(votedFor)
 
-	// Send heartbeats.
-	d.Join(heartbeat, member, curTerm, curState, logState,
-		func(h *bool, a *string, t *int, s *int, l *RaftLogState) *RaftAddEntryReq {
-			if stateKind(*s) != state_LEADER {
-				return nil
-			}
-			return &RaftAddEntryReq{To: *a, From: d.Addr, Term: *t,
-				PrevLogTerm: l.LastTerm, PrevLogIndex: l.LastIndex,
-				Entry: "", CommitIndex: l.LastCommitIndex}
-		}).IntoAsync(radd)
-
 	// Handle add entry requests.
 	d.Join(radd, curTerm,
 		func(radd *RaftAddEntryReq, curTerm *int) bool {
 			// Reset alarm if term is current or our term is stale.
-			// TODO: random alarm timeout.
 			return radd.Term >= *curTerm
 		}).Into(alarmReset)
+	d.Join(rsnap, curTerm,
+		func(r *RaftInstallSnapshotReq, curTerm *int) bool {
+			return r.Term >= *curTerm
+		}).Into(alarmReset)
 
-	d.Join(radd, curTerm, logState,
-		func(r *RaftAddEntryReq, t *int, ls *RaftLogState) *RaftAddEntryRes {
-			// Fail response if previous entry doesn't exist in our log.
-			if r.PrevLogIndex <= ls.LastIndex {
-				return nil
-			}
-			return &RaftAddEntryRes{To: r.From, From: r.To, Term: *t,
-				Ok: false, Index: r.PrevLogIndex}
-		}).IntoAsync(raddr)
+	d.Join(alarmReset, func(r *bool) {
+		if *r {
+			d.ResetPeriodic(alarm) // Re-arms with a newly randomized timeout.
+		}
+	})
 
-	d.Join(radd, curState, logEntry, func(r *RaftAddEntryReq, s *int, m *LMapEntry) {
-		// Send ok response only if log terms match.  And,
-		// update entries if terms match, replacing/clearing later entries.
-		if r.Entry == "" || stateKind(*s) == state_LEADER ||
-			keyToIndex(m.Key) != r.PrevLogIndex {
+	d.Join(radd, curTerm, curState, func(r *RaftAddEntryReq, t *int, s *raftState) {
+		// Reject if our term is newer, or if our log doesn't have an
+		// entry matching PrevLogIndex/PrevLogTerm, so the leader backs
+		// off.  Otherwise accept the entry, replying ok unless it's a
+		// heartbeat.  A rejection's Index is where the leader should
+		// retry: just past our log when it's too short, or else the
+		// first of our entries in the conflicting term, so the leader
+		// skips back a whole term per round trip.
+		if s.Kind == state_LEADER {
+			return
+		}
+		reject := &RaftAddEntryRes{To: r.From, From: r.To, Term: *t,
+			Ok: false, Index: r.PrevLogIndex + 1, Sent: r.Sent}
+		if r.Term < *t {
+			d.Add(raddr, reject)
 			return
 		}
-		e := maxRaftEntry(m.Val.(*LSet))
+		e := entryAt(r.PrevLogIndex)
 		if e == nil {
+			s := latestRaftSnapshot(snapshot)
+			if s != nil && r.PrevLogIndex < s.Index {
+				// Already compacted, so the leader can skip ahead.
+				d.Add(raddr, &RaftAddEntryRes{To: r.From, From: r.To, Term: r.Term,
+					Ok: true, Index: s.Index, Sent: r.Sent})
+				return
+			}
+			last := 0 // Our log is too short.
+			if s != nil {
+				last = s.Index
+			}
+			for i := last + 1; entryAt(i) != nil && i < r.PrevLogIndex; i++ {
+				last = i
+			}
+			reject.Index = last + 1
+			d.Add(raddr, reject)
+			return
+		}
+		if e.Term != r.PrevLogTerm {
+			i := r.PrevLogIndex
+			for ; i > 1; i-- {
+				if p := entryAt(i - 1); p == nil || p.Term != e.Term {
+					break
+				}
+			}
+			reject.Index = i
+			d.Add(raddr, reject)
 			return
 		}
+		// Only commit up through what's known to match the leader.
+		last := r.PrevLogIndex + len(r.Entries)
+		commit := last
+		if r.CommitIndex < commit {
+			commit = r.CommitIndex
+		}
+		d.Add(logCommit, commit)
+		// The first conflicting entry means it and all that follow it
+		// are stale, while entries that match are kept, as a delayed
+		// request mustn't truncate what a later one added.
+		for k, e := range r.Entries {
+			i := r.PrevLogIndex + 1 + k
+			if c := raftEntryAt(logEntry, i); c != nil && c.Term != e.Term {
+				for _, k := range logEntry.Keys() {
+					if keyToIndex(k) >= i {
+						logEntry.Remove(k)
+					}
+				}
+				break
+			}
+		}
+		for k, e := range r.Entries {
+			d.Add(logAdd, &RaftEntry{Term: e.Term, Index: r.PrevLogIndex + 1 + k,
+				Entry: e.Entry})
+		}
+		// Ack heartbeats too, as the leader's lease depends on them.
 		d.Add(raddr, &RaftAddEntryRes{To: r.From, From: r.To, Term: r.Term,
-			Ok: r.PrevLogTerm == e.Term, Index: r.PrevLogIndex + 1})
-		if r.PrevLogTerm == e.Term {
-			d.Add(logAdd, &RaftEntry{
-				Term: r.Term, Index: r.PrevLogIndex + 1, Entry: r.Entry})
+			Ok: true, Index: last, Sent: r.Sent})
+	})
+
+	// Leaders append proposals, then client commands, to their log.  A
+	// configuration entry is dropped while another is uncommitted, so
+	// that two concurrent membership changes can't both commit.
+	d.Join(curTerm, curState, logState, func(t *int, s *raftState, ls *RaftLogState) {
+		if s.Kind != state_LEADER || activeTransfer(*t) != nil {
+			return // Proposals are dropped during a transfer.
+		}
+		var entries []string
+		for x := range propose.Scan() {
+			entries = append(entries, x.(string))
+		}
+		sort.Strings(entries)
+		var reqs []*RaftClientReq
+		for x := range rclient.Scan() {
+			reqs = append(reqs, x.(*RaftClientReq))
+		}
+		sort.Slice(reqs, func(i, j int) bool {
+			return reqs[i].From+"/"+reqs[i].Id < reqs[j].From+"/"+reqs[j].Id
+		})
+		pending := false
+		for i := ls.LastCommitIndex + 1; i <= ls.LastIndex; i++ {
+			if e := raftEntryAt(logEntry, i); e != nil {
+				_, _, isConfig := parseRaftConfigEntry(e.Entry)
+				pending = pending || isConfig
+			}
+		}
+		i := ls.LastIndex
+		for _, entry := range entries {
+			if _, _, isConfig := parseRaftConfigEntry(entry); isConfig {
+				if pending {
+					continue
+				}
+				pending = true
+			}
+			i++
+			d.Add(logAdd, &RaftEntry{Term: *t, Index: i, Entry: entry})
+		}
+		for _, r := range reqs {
+			i++
+			d.Add(logAdd, &RaftEntry{Term: *t, Index: i, Entry: r.Command})
+			d.Add(clientPending, &RaftClientPending{Index: i, Term: *t, Req: *r})
 		}
 	})
 
-	d.Join(radd, func(r *RaftAddEntryReq) int { return r.CommitIndex }).
-		Into(logCommit) // TODO: commit entries before (or at?) this point?
+	// Track the leader, so followers can redirect clients.
+	d.Join(radd, func(r *RaftAddEntryReq) *RaftVote {
+		return &RaftVote{r.Term, r.From}
+	}).Into(leader)
+	d.Join(curTerm, curState, func(t *int, s *raftState) *RaftVote {
+		if s.Kind == state_LEADER {
+			return &RaftVote{*t, d.Addr}
+		}
+		return nil
+	}).Into(leader)
+
+	// Unlike the known leader, the hint is only of the current term, so
+	// it's cleared once a node times out and starts a new term.  A
+	// leader of a later term counts, as its term is taken next tick.
+	// Aggregating each leader's latest term first means the hint is
+	// derived once the leaders seen settle, rather than on each step.
+	leaderTerm := d.Scratch(d.DeclareLSet(prefix+"raftLeaderTerm", AggResult{}))
+	d.JoinAgg(leader, func(x interface{}) string { return x.(*RaftVote).Candidate },
+		AggMax, func(x interface{}) int { return x.(*RaftVote).Term }).Into(leaderTerm)
+	d.Join(leaderTerm, curTerm, func(v *AggResult, t *int) RaftLeaderHint {
+		if v.Val < *t {
+			return RaftLeaderHint{}
+		}
+		return RaftLeaderHint{v.Key, v.Val}
+	}).Into(leaderHint)
 
-	// Update followers.
+	d.Join(rclient, curTerm, curState, func(r *RaftClientReq, t *int, s *raftState) *RaftClientRes {
+		if s.Kind == state_LEADER {
+			if tr := activeTransfer(*t); tr != nil {
+				return &RaftClientRes{To: r.From, From: d.Addr, Id: r.Id, Leader: tr.To}
+			}
+			return nil // Replied to once committed.
+		}
+		return &RaftClientRes{To: r.From, From: d.Addr, Id: r.Id,
+			Leader: raftKnownLeader(leader)}
+	}).IntoAsync(rclientr)
 
-	d.Join(heartbeat, curTerm, curState, logEntry, logState, nextIndex,
-		func(h *bool, t *int, s *int,
-			le *LMapEntry, ls *RaftLogState,
-			n *LMapEntry) *RaftAddEntryReq {
-			if !*h || stateKind(*s) != state_LEADER {
+	// A leader transfers leadership by appending nothing new until the
+	// target acks its last entry, and then telling the target to start
+	// an election, which its caught up log lets it win.
+	d.Join(transferReq, curTerm, curState,
+		func(r *RaftTransferLeadership, t *int, s *raftState) *raftTransfer {
+			if s.Kind != state_LEADER || r.To == d.Addr || !member.Contains(r.To) {
 				return nil
 			}
-			e := maxRaftEntry(le.Val.(*LSet))
-			if e == nil || e.Index != n.Val.(*LMax).Int()-1 {
+			return &raftTransfer{Term: *t, To: r.To, Started: d.TickTime().UnixNano()}
+		}).Into(transfer)
+	d.Join(raddr, curTerm, curState, logState,
+		func(r *RaftAddEntryRes, t *int, s *raftState, ls *RaftLogState) *RaftTimeoutNowReq {
+			tr := activeTransfer(*t)
+			if s.Kind != state_LEADER || tr == nil || tr.To != r.From ||
+				!r.Ok || r.Term != *t || r.Index < ls.LastIndex {
 				return nil
 			}
-			// TODO: feels like we don't get all the logs to the follower.
-			return &RaftAddEntryReq{To: n.Key, From: d.Addr, Term: *t,
-				PrevLogTerm: e.Term, PrevLogIndex: keyToIndex(le.Key),
-				Entry: e.Entry, CommitIndex: ls.LastCommitIndex}
-		}).IntoAsync(radd)
+			return &RaftTimeoutNowReq{To: r.From, From: d.Addr, Term: *t}
+		}).IntoAsync(rtimeout)
 
-	d.Join(raddr, func(r *RaftAddEntryRes) *MultiTallyVote {
-		if r.Ok {
-			return &MultiTallyVote{indexToKey(r.Index), r.From}
+	// Skips pre-votes, as the leader asked for the election.
+	d.Join(rtimeout, curTerm, curState, func(r *RaftTimeoutNowReq, t *int, s *raftState) {
+		if r.Term == *t && s.Kind == state_FOLLOWER {
+			becomeCandidate(*t)
 		}
-		return nil
-	}).Into(tallyCommitVote)
+	})
 
-	d.Join(tallyCommitDone, func(m *LMapEntry) int {
-		if m.Val.(*LBool).Bool() {
-			return keyToIndex(m.Key)
+	// Reply to clients once their commands commit, or redirect them if
+	// their entries were replaced by another leader's.
+	d.Join(logCommit, func(c *int) {
+		var done []interface{}
+		for x := range clientPending.Scan() {
+			if p := x.(*RaftClientPending); p.Index <= *c {
+				done = append(done, p)
+			}
 		}
-		return 0
-	}).Into(logCommit) // TODO: commit entries before (or at?) this point?
+		for _, x := range done {
+			p := x.(*RaftClientPending)
+			res := &RaftClientRes{To: p.Req.From, From: d.Addr, Id: p.Req.Id}
+			if e := entryAt(p.Index); e != nil && e.Term == p.Term {
+				res.Ok, res.Index = true, p.Index
+			} else {
+				res.Leader = raftKnownLeader(leader)
+			}
+			d.Add(rclientr, res)
+			clientPending.Remove(p)
+		}
+	})
+
+	// The log only changes between ticks, so there's a single log state
+	// per tick.
+	d.Join(logAdd, func(e *RaftEntry) *LMapEntry {
+		return &LMapEntry{indexToKey(e.Index), NewLSetOne(d, e)}
+	}).IntoAsync(logEntry)
+
+	d.Join(logCommit, func(c *int) *RaftLogState {
+		ls := &RaftLogState{LastCommitIndex: *c}
+		if s := latestRaftSnapshot(snapshot); s != nil {
+			ls.LastTerm, ls.LastIndex = s.Term, s.Index
+		}
+		for x := range logEntry.Scan() {
+			m := x.(*LMapEntry)
+			if i := keyToIndex(m.Key); i > ls.LastIndex {
+				if e := maxRaftEntry(m.Val.(*LSet)); e != nil {
+					ls.LastTerm, ls.LastIndex = e.Term, i
+				}
+			}
+		}
+		return ls
+	}).Into(logState)
+
+	// Update followers, sending each the entries from its nextIndex on,
+	// in one batch, or an empty heartbeat if it's caught up.  As a
+	// follower's nextIndex only advances on its acks, capping a batch
+	// caps the entries in flight.
+	maxInFlight := RaftMaxInFlight
+
+	d.Join(curState, member, logState,
+		func(s *raftState, a *string, ls *RaftLogState) *LMapEntry {
+			if s.Kind != state_LEADER || nextIndex.At(*a) != nil {
+				return nil
+			}
+			return &LMapEntry{*a, newRaftNextIndex(d, raftNextIndex{Index: ls.LastIndex + 1})}
+		}).Into(nextIndex)
+
+	d.Join(heartbeat, curTerm, curState, logState, nextIndex,
+		func(h *bool, t *int, s *raftState,
+			ls *RaftLogState, n *LMapEntry) *RaftAddEntryReq {
+			if !*h || s.Kind != state_LEADER {
+				return nil
+			}
+			i := nextIndexOf(n.Val).Index
+			prev := entryAt(i - 1)
+			if prev == nil {
+				return nil // Compacted, so the follower needs a snapshot.
+			}
+			r := &RaftAddEntryReq{To: n.Key, From: d.Addr, Term: *t,
+				PrevLogTerm: prev.Term, PrevLogIndex: i - 1,
+				CommitIndex: ls.LastCommitIndex}
+			last := ls.LastIndex
+			if maxInFlight > 0 && last > i-1+maxInFlight {
+				last = i - 1 + maxInFlight
+			}
+			for ; i <= last; i++ {
+				e := raftEntryAt(logEntry, i)
+				if e == nil {
+					break
+				}
+				r.Entries = append(r.Entries, *e)
+			}
+			return r
+		}).IntoAsync(radd).StampTime("Sent")
+
+	d.Join(heartbeat, curTerm, curState, nextIndex,
+		func(h *bool, t *int, s *raftState, n *LMapEntry) *RaftInstallSnapshotReq {
+			if !*h || s.Kind != state_LEADER {
+				return nil
+			}
+			snap := latestRaftSnapshot(snapshot)
+			if snap == nil || nextIndexOf(n.Val).Index-1 >= snap.Index {
+				return nil
+			}
+			return &RaftInstallSnapshotReq{To: n.Key, From: d.Addr, Term: *t,
+				LastIndex: snap.Index, LastTerm: snap.Term, Data: snap.Data,
+				Members: snap.Members}
+		}).IntoAsync(rsnap)
+
+	// Track the latest acked heartbeat times for the leader's lease.
+	d.Join(raddr, curTerm, curState,
+		func(r *RaftAddEntryRes, t *int, s *raftState) *LMapEntry {
+			if !r.Ok || r.Term != *t || s.Kind != state_LEADER {
+				return nil
+			}
+			return &LMapEntry{r.From, NewLMax(d, int(r.Sent))}
+		}).Into(leaseAck)
+	d.Join(curState, func(s *raftState) {
+		if s.Kind != state_LEADER { // Acks and progress are per term.
+			for _, k := range leaseAck.Keys() {
+				leaseAck.Remove(k)
+			}
+			for _, k := range matchIndex.Keys() {
+				matchIndex.Remove(k)
+			}
+			for _, k := range nextIndex.Keys() { // Re-initialized on winning.
+				nextIndex.Remove(k)
+			}
+		}
+	})
+
+	// A leader serves reads while the Sent acked by a quorum, counting
+	// itself, is within the lease duration.
+	d.Join(curState, func(s *raftState) bool {
+		if s.Kind != state_LEADER {
+			return false
+		}
+		need := member.Size() / 2
+		var acks []int
+		for _, a := range raftMembers(member) {
+			if n, ok := leaseAck.AtLMax(a); ok && a != d.Addr {
+				acks = append(acks, n.Int())
+			}
+		}
+		if need == 0 {
+			return true
+		}
+		if len(acks) < need {
+			return false
+		}
+		sort.Sort(sort.Reverse(sort.IntSlice(acks)))
+		return d.TickTime().Before(time.Unix(0, int64(acks[need-1])).
+			Add(RaftLeaseDuration))
+	}).Into(canServeReads)
+
+	// A leader takes a read-index read at its last log index, which
+	// covers its commit index, and entries of earlier terms that an
+	// earlier leader might have committed without our knowing yet.
+	// Non-leaders redirect the client.
+	d.Join(rread, curState, func(r *RaftReadIndexReq, s *raftState) *RaftReadIndexRes {
+		if s.Kind == state_LEADER {
+			return nil
+		}
+		return &RaftReadIndexRes{To: r.From, From: d.Addr, Id: r.Id,
+			Leader: raftKnownLeader(leader)}
+	}).IntoAsync(rreadr)
+	d.Join(rread, curTerm, curState, logState,
+		func(r *RaftReadIndexReq, t *int, s *raftState, ls *RaftLogState) *RaftReadPending {
+			if s.Kind != state_LEADER {
+				return nil
+			}
+			return &RaftReadPending{Index: ls.LastIndex, Term: *t,
+				Sent: d.TickTime().UnixNano(), Req: *r}
+		}).Into(readPending)
+
+	// Start a heartbeat round now rather than at the next period.
+	d.Join(rread, curState, func(r *RaftReadIndexReq, s *raftState) bool {
+		return s.Kind == state_LEADER
+	}).Into(heartbeat)
+
+	// Entries of earlier terms only commit along with one of ours.
+	d.Join(readPending, curTerm, logState,
+		func(p *RaftReadPending, t *int, ls *RaftLogState) {
+			if p.Term != *t || ls.LastCommitIndex >= p.Index {
+				return
+			}
+			if e := entryAt(ls.LastIndex); e != nil && e.Term != *t {
+				d.Add(propose, raftNoOp_ENTRY)
+			}
+		})
+
+	// Allow reads once a quorum, counting ourselves, acked heartbeats
+	// sent since the read arrived, and we've applied through its index.
+	// Reads fail if we stop leading first.
+	d.Join(logApplied, curTerm, curState, func(a *int, t *int, s *raftState) {
+		var pending []*RaftReadPending
+		for x := range readPending.Scan() {
+			pending = append(pending, x.(*RaftReadPending))
+		}
+		for _, p := range pending {
+			res := &RaftReadIndexRes{To: p.Req.From, From: d.Addr, Id: p.Req.Id}
+			if s.Kind != state_LEADER || p.Term != *t {
+				res.Leader = raftKnownLeader(leader)
+			} else {
+				acked := NewLSetOne(d, d.Addr)
+				for _, m := range raftMembers(member) {
+					if n, ok := leaseAck.AtLMax(m); ok && int64(n.Int()) >= p.Sent {
+						acked.DirectAdd(m)
+					}
+				}
+				if !majority.HasQuorum(acked) || *a < p.Index {
+					continue
+				}
+				res.Ok, res.Index = true, *a
+				d.Add(readReady, res)
+			}
+			d.Add(rreadr, res)
+			readPending.Remove(p)
+		}
+	})
+
+	d.Join(raddr, curTerm, curState,
+		func(r *RaftAddEntryRes, t *int, s *raftState) *LMapEntry {
+			if !r.Ok || r.Term != *t || s.Kind != state_LEADER {
+				return nil
+			}
+			return &LMapEntry{r.From, NewLMax(d, r.Index)}
+		}).Into(matchIndex)
+
+	// Commit the highest index that a majority of members has, the
+	// leader's own log counting while it's a member, which is the
+	// median matchIndex for an odd number of members.  Only entries
+	// from the current term are committed by counting replicas,
+	// carrying any earlier entries along with them.  Otherwise, an older
+	// term's entry might be committed and then overwritten (see Figure
+	// 8 of the Raft paper).
+	d.Join(curTerm, curState, logState, func(t *int, s *raftState, ls *RaftLogState) int {
+		if s.Kind != state_LEADER {
+			return 0
+		}
+		var matched []int
+		for _, a := range raftMembers(member) {
+			if a == d.Addr {
+				matched = append(matched, ls.LastIndex)
+			} else if n, ok := matchIndex.AtLMax(a); ok {
+				matched = append(matched, n.Int())
+			} else {
+				matched = append(matched, 0)
+			}
+		}
+		if len(matched) == 0 {
+			return 0
+		}
+		need := len(matched)/2 + 1
+		sort.Sort(sort.Reverse(sort.IntSlice(matched)))
+		i := matched[need-1]
+		if e := entryAt(i); e == nil || e.Term != *t {
+			return 0
+		}
+		return i
+	}).IntoAsync(logCommit)
+
+	d.JoinOn([]string{"From", "Key"}, raddr, nextIndex,
+		func(r *RaftAddEntryRes, n *LMapEntry) *LMapEntry {
+			// Advance a follower's nextIndex on success, else back off
+			// to where the follower's rejection says to retry.
+			i := r.Index + 1
+			if !r.Ok {
+				i = r.Index
+				if i < 1 {
+					i = 1
+				}
+			}
+			return &LMapEntry{n.Key, nextIndexVersionNext(d, n.Val, i)}
+		}).IntoAsync(nextIndex)
+
+	d.JoinOn([]string{"From", "Key"}, rsnapr, nextIndex,
+		func(r *RaftInstallSnapshotRes, n *LMapEntry) *LMapEntry {
+			if r.Index <= 0 {
+				return nil
+			}
+			return &LMapEntry{n.Key, nextIndexVersionNext(d, n.Val, r.Index+1)}
+		}).IntoAsync(nextIndex)
+
+	// Send committed logs into the state machine to execute.
+	d.Join(logCommit, logApplied, func(c *int, a *int) {
+		last := 0
+		if s := latestRaftSnapshot(snapshot); s != nil {
+			last = s.Index
+		}
+		for i := *a + 1; i <= *c; i++ {
+			e := raftEntryAt(logEntry, i)
+			if e == nil {
+				return // Wait until we have the entry.
+			}
+			if addr, add, ok := parseRaftConfigEntry(e.Entry); ok {
+				if add {
+					member.DirectAdd(addr)
+				} else {
+					member.Remove(addr)
+				}
+			} else if apply != nil && e.Entry != raftNoOp_ENTRY {
+				apply(e.Entry)
+			}
+			d.Add(logApplied, i)
+			if snapshotter != nil && snapshotter.Threshold > 0 &&
+				i-last >= snapshotter.Threshold {
+				d.Add(snapshotAdd, &RaftSnapshot{Index: i, Term: e.Term,
+					Data: snapshotter.Snapshot(), Members: raftMembers(member)})
+				last = i
+			}
+		}
+	})
+
+	d.Join(snapshotAdd).IntoAsync(snapshot)
+
+	// Compact the log up through the latest snapshot.
+	d.Join(func() {
+		s := latestRaftSnapshot(snapshot)
+		if s == nil {
+			return
+		}
+		var older []interface{}
+		for x := range snapshot.Scan() {
+			if x.(*RaftSnapshot).Index < s.Index {
+				older = append(older, x)
+			}
+		}
+		for _, x := range older {
+			snapshot.Remove(x)
+		}
+		for _, k := range logEntry.Keys() {
+			if keyToIndex(k) <= s.Index {
+				logEntry.Remove(k)
+			}
+		}
+	})
+
+	// Install snapshots from the leader that are beyond our log.
+	d.Join(rsnap, curTerm, logApplied,
+		func(r *RaftInstallSnapshotReq, t *int, a *int) {
+			if r.Term < *t || *a >= r.LastIndex {
+				return
+			}
+			// Keep any entries following a matching entry, else
+			// discard the whole log.
+			if e := entryAt(r.LastIndex); e == nil || e.Term != r.LastTerm {
+				for _, k := range logEntry.Keys() {
+					logEntry.Remove(k)
+				}
+			}
+			d.Add(snapshotAdd, &RaftSnapshot{Index: r.LastIndex,
+				Term: r.LastTerm, Data: r.Data, Members: r.Members})
+			if r.Members != nil {
+				for _, a := range raftMembers(member) {
+					member.Remove(a)
+				}
+				for _, a := range r.Members {
+					member.DirectAdd(a)
+				}
+			}
+			d.Add(logCommit, r.LastIndex)
+			d.Add(logApplied, r.LastIndex)
+			if snapshotter != nil && snapshotter.Restore != nil {
+				snapshotter.Restore(r.Data)
+			}
+		})
 
-	// TODO: update nextIndex <+- (raddr * nextIndex) {|a,n|
-	//    a.success? [a.from, i.index + 1] : [a.from, i.index - 1]}
+	// Restore the state machine from a loaded snapshot, which stands for
+	// the entries that it covers, as they're compacted away.
+	d.Join(snapshotLoad, logApplied, func(s *RaftSnapshot, a *int) {
+		if *a >= s.Index {
+			return
+		}
+		d.Add(logCommit, s.Index)
+		d.Add(logApplied, s.Index)
+		if snapshotter != nil && snapshotter.Restore != nil {
+			snapshotter.Restore(s.Data)
+		}
+	})
 
-	// TODO: send committed logs into the state machine to execute
-	//    machine.execute <= logger.commited_logs
+	d.Join(rsnap, curTerm,
+		func(r *RaftInstallSnapshotReq, t *int) *RaftInstallSnapshotRes {
+			if r.Term < *t {
+				return &RaftInstallSnapshotRes{To: r.From, From: r.To, Term: *t}
+			}
+			return &RaftInstallSnapshotRes{To: r.From, From: r.To, Term: *t,
+				Index: r.LastIndex}
+		}).IntoAsync(rsnapr)
 
 	return d
 }
 
 func init() {
-	RaftInit(NewD(""), "")
+	RaftInit(NewD(""), "", nil)
+	RegisterStateLMaxBy(raftNextIndex{}, raftNextIndexLess)
 }
 
 func termToKey(term int) string   { return fmt.Sprintf("%d", term) }
@@ -362,11 +1338,71 @@ func keyToIndex(key string) int {
 	return index
 }
 
-func caseStepDown(term, curTerm, curState int) int {
+func caseStepDown(term, curTerm, curKind int) int {
 	if term > curTerm {
 		return state_STEP_DOWN
 	}
-	return stateKind(curState)
+	return curKind
+}
+
+func raftEntryAt(logEntry *LMap, index int) *RaftEntry {
+	entries, ok := logEntry.AtLSet(indexToKey(index))
+	if !ok {
+		return nil
+	}
+	return maxRaftEntry(entries)
+}
+
+// Proposes adding or removing a member, which takes effect once the
+// configuration entry commits.  Only a leader appends proposals.
+func RaftProposeMember(d *D, prefix string, addr string, add bool) {
+	d.AddNext(d.Relations[prefix+"raftPropose"], RaftConfigEntry(addr, add))
+}
+
+// Asks a leader to hand leadership to the member at addr, such as before
+// taking the leader down for an upgrade.  If the target doesn't take
+// over within RaftElectionTimeoutMax, the leader carries on.
+func RaftTransferLeader(d *D, prefix string, addr string) {
+	d.AddNext(d.Relations[prefix+"RaftTransferLeadership"], &RaftTransferLeadership{To: addr})
+}
+
+// RaftLeaderOf returns the leader that the RaftInit() node knows of in
+// its current term, as of its last tick.
+func RaftLeaderOf(d *D, prefix string) RaftLeaderHint {
+	return d.Relations[prefix+"RaftLeaderHint"].(*LMaxBy).Value().(RaftLeaderHint)
+}
+
+func raftKnownLeader(leader *LSet) string {
+	var max *RaftVote
+	for x := range leader.Scan() {
+		if v := x.(*RaftVote); max == nil || v.Term > max.Term ||
+			(v.Term == max.Term && v.Candidate > max.Candidate) {
+			max = v
+		}
+	}
+	if max == nil {
+		return ""
+	}
+	return max.Candidate
+}
+
+func raftMembers(member *LSet) []string {
+	var rv []string
+	for x := range member.Scan() {
+		rv = append(rv, x.(string))
+	}
+	sort.Strings(rv)
+	return rv
+}
+
+func latestRaftSnapshot(snapshot *LSet) *RaftSnapshot {
+	var latest *RaftSnapshot
+	for x := range snapshot.Scan() {
+		if s := x.(*RaftSnapshot); latest == nil || s.Index > latest.Index {
+			latest = s
+		}
+	}
+	return latest
 }
 
 func maxRaftEntry(entries *LSet) *RaftEntry {
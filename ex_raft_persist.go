@@ -0,0 +1,379 @@
+package gdec
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+// RaftPersistence durably records what a Raft node promises to others,
+// its current term, its votes and its log, so that a restarted node
+// keeps those promises, see RaftPersist().  Each method returns only
+// once what it was given is durable.
+type RaftPersistence interface {
+	SaveTerm(term int) error
+	SaveVote(vote RaftVote) error
+
+	// AppendEntries records that the log from index from on is entries,
+	// discarding any earlier saved entries from there on.
+	AppendEntries(from int, entries []RaftEntry) error
+
+	// SaveSnapshot records the latest snapshot, superseding earlier ones.
+	SaveSnapshot(snap RaftSnapshot) error
+
+	// LoadAll returns what was saved, with the log ordered by index, and
+	// the latest snapshot, if any.
+	LoadAll() (term int, votes []RaftVote, entries []RaftEntry,
+		snap *RaftSnapshot, err error)
+}
+
+// RaftPersist restores a RaftInit() node's term, votes, log and latest
+// snapshot from p, before its first tick, and from then on records them
+// to p at the end of each tick, before the messages that depend on
+// them, like a vote or an ack of appended entries, are sent.  If
+// recording fails, the tick's messages are dropped, and the Raft
+// protocol resends what's still needed.  A restored snapshot replaces
+// the membership, and at the first tick, is handed to the
+// RaftSnapshotter's Restore, as when installed from a leader.
+func RaftPersist(d *D, prefix string, p RaftPersistence) error {
+	curTerm := d.Relations[prefix+"raftCurTerm"].(*LMax)
+	votedFor := d.Relations[prefix+"raftVotedFor"].(*LSet)
+	logEntry := d.Relations[prefix+"raftEntry"].(*LMap)
+	snapshot := d.Relations[prefix+"raftSnapshot"].(*LSet)
+	member := d.Relations[prefix+"raftMember"].(*LSet)
+
+	term, votes, entries, snap, err := p.LoadAll()
+	if err != nil {
+		return err
+	}
+	curTerm.DirectAdd(term)
+	savedVotes := map[RaftVote]bool{}
+	for _, v := range votes {
+		v := v
+		votedFor.DirectAdd(&v)
+		savedVotes[v] = true
+	}
+	savedSnap := 0 // The index of the latest saved snapshot.
+	if snap != nil {
+		snapshot.DirectAdd(snap)
+		if snap.Members != nil {
+			for _, a := range raftMembers(member) {
+				member.Remove(a)
+			}
+			for _, a := range snap.Members {
+				member.DirectAdd(a)
+			}
+		}
+		d.AddNext(d.Relations[prefix+"raftSnapshotLoad"], snap)
+		savedSnap = snap.Index
+	}
+	saved := map[int]RaftEntry{} // Key: index.
+	for _, e := range entries {
+		e := e
+		if e.Index > savedSnap { // Else compacted away.
+			logEntry.DirectAdd(&LMapEntry{indexToKey(e.Index), NewLSetOne(d, &e)})
+		}
+		saved[e.Index] = e
+	}
+
+	d.BeforeEmit(func() error {
+		t := curTerm.Int()
+		for _, x := range d.Pending(curTerm) {
+			if n, ok := x.(int); ok && n > t {
+				t = n
+			}
+		}
+		if t > term {
+			if err := p.SaveTerm(t); err != nil {
+				return err
+			}
+			term = t
+		}
+
+		var vs []RaftVote
+		for x := range votedFor.Scan() {
+			vs = append(vs, *x.(*RaftVote))
+		}
+		for _, x := range d.Pending(votedFor) {
+			if v, ok := x.(*RaftVote); ok {
+				vs = append(vs, *v)
+			}
+		}
+		for _, v := range vs {
+			if !savedVotes[v] {
+				if err := p.SaveVote(v); err != nil {
+					return err
+				}
+				savedVotes[v] = true
+			}
+		}
+
+		// The latest snapshot as of the next tick goes first, so that a
+		// crash never leaves a log truncated without the snapshot that
+		// replaced it.
+		latest := latestRaftSnapshot(snapshot)
+		for _, x := range d.Pending(snapshot) {
+			if s, ok := x.(*RaftSnapshot); ok && (latest == nil || s.Index > latest.Index) {
+				latest = s
+			}
+		}
+		if latest != nil && latest.Index > savedSnap {
+			if err := p.SaveSnapshot(*latest); err != nil {
+				return err
+			}
+			savedSnap = latest.Index
+		}
+
+		// The log as of the next tick, which pending entries extend or,
+		// after a conflict, replace.
+		log := map[int]RaftEntry{}
+		for _, k := range logEntry.Keys() {
+			if e := raftEntryAt(logEntry, keyToIndex(k)); e != nil && e.Index > 0 {
+				log[e.Index] = *e
+			}
+		}
+		for _, x := range d.Pending(logEntry) {
+			if m, ok := x.(*LMapEntry); ok {
+				if e := maxRaftEntry(m.Val.(*LSet)); e != nil && e.Index > 0 {
+					if cur, ok := log[e.Index]; !ok || cur.Term < e.Term ||
+						(cur.Term == e.Term && cur.Entry < e.Entry) {
+						log[e.Index] = *e
+					}
+				}
+			}
+		}
+		last := savedSnap // Entries compacted away aren't truncated.
+		for i := range log {
+			if i > last {
+				last = i
+			}
+		}
+		from := 0 // The first index to record, else 0.
+		for i, e := range log {
+			if s, ok := saved[i]; (!ok || s != e) && (from == 0 || i < from) {
+				from = i
+			}
+		}
+		for i := range saved {
+			if i > last && (from == 0 || last+1 < from) {
+				from = last + 1 // Truncated.
+			}
+		}
+		if from == 0 {
+			return nil
+		}
+		var es []RaftEntry
+		for i := from; i <= last; i++ {
+			if e, ok := log[i]; ok {
+				es = append(es, e)
+			}
+		}
+		if err := p.AppendEntries(from, es); err != nil {
+			return err
+		}
+		for i := range saved {
+			if i >= from {
+				delete(saved, i)
+			}
+		}
+		for _, e := range es {
+			saved[e.Index] = e
+		}
+		return nil
+	})
+	return nil
+}
+
+// A RaftPersistence that appends records to a file, syncing each, so
+// that a crash loses at most a record that was being written, which
+// LoadAll() ignores, as nothing that depended on it was sent.  Saving a
+// snapshot compacts the file, dropping the entries that it covers.
+type RaftFileLog struct {
+	path string
+	f    *os.File
+}
+
+// One line of a RaftFileLog.
+type raftFileRecord struct {
+	Term     int           `json:",omitempty"`
+	Vote     *RaftVote     `json:",omitempty"`
+	From     int           `json:",omitempty"`
+	Entries  []RaftEntry   `json:",omitempty"`
+	Snapshot *RaftSnapshot `json:",omitempty"`
+}
+
+// OpenRaftFileLog opens the file at path, creating it if need be, for
+// appending records after those already there.
+func OpenRaftFileLog(path string) (*RaftFileLog, error) {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return &RaftFileLog{path: path, f: f}, nil
+}
+
+func (l *RaftFileLog) Close() error {
+	return l.f.Close()
+}
+
+func (l *RaftFileLog) append(r *raftFileRecord) error {
+	b, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+	if _, err := l.f.Write(append(b, '\n')); err != nil {
+		return err
+	}
+	return l.f.Sync()
+}
+
+func (l *RaftFileLog) SaveTerm(term int) error {
+	return l.append(&raftFileRecord{Term: term})
+}
+
+func (l *RaftFileLog) SaveVote(vote RaftVote) error {
+	return l.append(&raftFileRecord{Vote: &vote})
+}
+
+func (l *RaftFileLog) AppendEntries(from int, entries []RaftEntry) error {
+	if from <= 0 {
+		return fmt.Errorf("RaftFileLog.AppendEntries() from: %d, should be positive", from)
+	}
+	return l.append(&raftFileRecord{From: from, Entries: entries})
+}
+
+func (l *RaftFileLog) SaveSnapshot(snap RaftSnapshot) error {
+	if err := l.append(&raftFileRecord{Snapshot: &snap}); err != nil {
+		return err
+	}
+	return l.compact()
+}
+
+// Rewrites the file with just what LoadAll() returns, less the entries
+// that the snapshot covers, so that the file doesn't grow without
+// bound.  The rewrite is to a temporary file that's renamed over the
+// log, so a crash leaves either the old file or the compacted one.
+func (l *RaftFileLog) compact() error {
+	term, votes, entries, snap, err := l.LoadAll()
+	if err != nil {
+		return err
+	}
+	var recs []*raftFileRecord
+	if term > 0 {
+		recs = append(recs, &raftFileRecord{Term: term})
+	}
+	for _, v := range votes {
+		v := v
+		recs = append(recs, &raftFileRecord{Vote: &v})
+	}
+	from := 1
+	if snap != nil {
+		recs = append(recs, &raftFileRecord{Snapshot: snap})
+		from = snap.Index + 1
+	}
+	var es []RaftEntry
+	for _, e := range entries {
+		if e.Index >= from {
+			es = append(es, e)
+		}
+	}
+	if len(es) > 0 {
+		recs = append(recs, &raftFileRecord{From: from, Entries: es})
+	}
+
+	// Opened for appending, as it's the log from the rename on.
+	tmp := l.path + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_RDWR|os.O_CREATE|os.O_TRUNC|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(f)
+	for _, r := range recs {
+		var b []byte
+		if b, err = json.Marshal(r); err != nil {
+			break
+		}
+		if _, err = w.Write(append(b, '\n')); err != nil {
+			break
+		}
+	}
+	if err == nil {
+		err = w.Flush()
+	}
+	if err == nil {
+		err = f.Sync()
+	}
+	if err == nil {
+		err = os.Rename(tmp, l.path)
+	}
+	if err != nil {
+		f.Close()
+		os.Remove(tmp)
+		return err
+	}
+	if dir, err := os.Open(filepath.Dir(l.path)); err == nil {
+		dir.Sync() // Makes the rename durable, where supported.
+		dir.Close()
+	}
+	l.f.Close()
+	l.f = f
+	return nil
+}
+
+func (l *RaftFileLog) LoadAll() (term int, votes []RaftVote, entries []RaftEntry,
+	snap *RaftSnapshot, err error) {
+	if _, err = l.f.Seek(0, io.SeekStart); err != nil {
+		return 0, nil, nil, nil, err
+	}
+	log := map[int]RaftEntry{}
+	r := bufio.NewReader(l.f)
+	for off := int64(0); ; {
+		line, err := r.ReadBytes('\n')
+		if errors.Is(err, io.EOF) {
+			if len(line) > 0 { // A torn write, cut so appends don't follow it.
+				if err := l.f.Truncate(off); err != nil {
+					return 0, nil, nil, nil, err
+				}
+			}
+			break
+		}
+		if err != nil {
+			return 0, nil, nil, nil, err
+		}
+		off += int64(len(line))
+		var rec raftFileRecord
+		if err := json.Unmarshal(line, &rec); err != nil {
+			return 0, nil, nil, nil, fmt.Errorf("RaftFileLog.LoadAll() bad record: %q, err: %v",
+				line, err)
+		}
+		switch {
+		case rec.Vote != nil:
+			votes = append(votes, *rec.Vote)
+		case rec.Snapshot != nil:
+			if snap == nil || rec.Snapshot.Index > snap.Index {
+				snap = rec.Snapshot
+			}
+		case rec.From > 0:
+			for i := range log {
+				if i >= rec.From {
+					delete(log, i)
+				}
+			}
+			for _, e := range rec.Entries {
+				log[e.Index] = e
+			}
+		case rec.Term > term:
+			term = rec.Term
+		}
+	}
+	for _, e := range log {
+		entries = append(entries, e)
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Index < entries[j].Index })
+	return term, votes, entries, snap, nil
+}
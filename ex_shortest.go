@@ -1,5 +1,10 @@
 package gdec
 
+import (
+	"reflect"
+	"sort"
+)
+
 type ShortestPathLink struct {
 	From string
 	To   string
@@ -13,20 +18,73 @@ type ShortestPath struct {
 	Cost int
 }
 
+// Additive costs, where lower is better.
 func ShortestPathInit(d *D, prefix string) *D {
+	return ShortestPathInitWith(d, prefix,
+		func(a, b int) int { return a + b },
+		func(a, b int) bool { return a < b })
+}
+
+// Computes the best path for each (From, To) pair, where combine gives
+// the cost of a link followed by a path, and better returns true when
+// cost a beats cost b.  For example, widest paths combine with min and
+// prefer larger costs.  The ShortestPath relation is an LMap keyed by
+// LMapKey() of the (From, To) pair, so it only holds the best path per
+// pair.
+//
+// Paths never revisit a node, except to close a cycle where From equals
+// To, and cycles aren't extended, so evaluation always terminates.  The
+// nodes of any cycle that improves on itself, like one with a negative
+// total cost, are listed in the ShortestPathNegativeCycle relation, as
+// best paths that use such a cycle are not well defined.
+func ShortestPathInitWith(d *D, prefix string,
+	combine func(a, b int) int, better func(a, b int) bool) *D {
+	d.checkUndeclared("ShortestPathInit", prefix, "ShortestPathLink",
+		"ShortestPath", "ShortestPathNegativeCycle")
 	links := d.DeclareLSet(prefix+"ShortestPathLink", ShortestPathLink{})
-	paths := d.DeclareLSet(prefix+"ShortestPath", ShortestPath{})
+	paths := d.DeclareLMapOf(prefix+"ShortestPath", func() Lattice {
+		return &shortestPathBest{d: d, better: better}
+	})
+	negCycle := d.DeclareLSet(prefix+"ShortestPathNegativeCycle", "nodeString")
 
-	d.Join(links, func(link *ShortestPathLink) *ShortestPath {
-		return &ShortestPath{From: link.From, To: link.To, Cost: link.Cost}
-	}).Into(paths)
+	best := func(p *ShortestPath, route []string) *LMapEntry {
+		return &LMapEntry{LMapKey(shortestPathKey{p.From, p.To}),
+			&shortestPathBest{d: d, better: better, path: p, route: route}}
+	}
 
-	d.Join(links, paths, func(link *ShortestPathLink, path *ShortestPath) *ShortestPath {
-		if link.To != path.From {
+	d.Join(links, func(link *ShortestPathLink) *LMapEntry {
+		return best(&ShortestPath{From: link.From, To: link.To, Cost: link.Cost},
+			[]string{link.From, link.To})
+	}).SemiNaive().Into(paths)
+
+	d.Join(links, paths, func(link *ShortestPathLink, m *LMapEntry) *LMapEntry {
+		b := m.Val.(*shortestPathBest)
+		path := b.path
+		if link.To != path.From || path.From == path.To {
 			return nil
 		}
-		return &ShortestPath{link.From, path.To, link.To, link.Cost + path.Cost}
-	}).Into(paths)
+		for _, n := range b.route[1:] {
+			if n == link.From && n != path.To {
+				return nil // Revisits a node, other than closing a cycle.
+			}
+		}
+		return best(&ShortestPath{link.From, path.To, link.To,
+			combine(link.Cost, path.Cost)},
+			append([]string{link.From}, b.route...))
+	}).SemiNaive().Into(paths)
+
+	d.JoinFlat(paths, func(m *LMapEntry) *LSet {
+		b := m.Val.(*shortestPathBest)
+		c := b.path.Cost
+		if b.path.From != b.path.To || !better(combine(c, c), c) {
+			return nil
+		}
+		nodes := d.NewLSet(negCycle.TupleType())
+		for _, n := range b.route {
+			nodes.DirectAdd(n)
+		}
+		return nodes
+	}).SemiNaive().Into(negCycle)
 
 	return d
 }
@@ -34,3 +92,113 @@ func ShortestPathInit(d *D, prefix string) *D {
 func init() {
 	ShortestPathInit(NewD(""), "")
 }
+
+// Returns the best path from one node to another, or nil.
+func ShortestPathGet(d *D, prefix string, from, to string) *ShortestPath {
+	paths := d.Relations[prefix+"ShortestPath"].(*LMap)
+	b, ok := paths.AtKey(shortestPathKey{from, to}).(*shortestPathBest)
+	if !ok || b.path == nil {
+		return nil
+	}
+	return b.path
+}
+
+// Returns the best path for each (From, To) pair, ordered by From and
+// then To.
+func ShortestPaths(d *D, prefix string) []*ShortestPath {
+	paths := d.Relations[prefix+"ShortestPath"].(*LMap)
+	rv := make([]*ShortestPath, 0, paths.Len())
+	for _, k := range paths.Keys() {
+		if b, ok := paths.At(k).(*shortestPathBest); ok && b.path != nil {
+			rv = append(rv, b.path)
+		}
+	}
+	sort.Slice(rv, func(i, j int) bool { // Keys sort by their JSON.
+		return rv[i].From < rv[j].From ||
+			(rv[i].From == rv[j].From && rv[i].To < rv[j].To)
+	})
+	return rv
+}
+
+// The key of a pair's best path, whose parts may hold any separator.
+type shortestPathKey struct {
+	From string
+	To   string
+}
+
+// Holds the best path for a pair, so it's a lattice ordered by better,
+// with ties broken by Next so that all replicas agree.
+type shortestPathBest struct {
+	d       *D
+	better  func(a, b int) bool
+	path    *ShortestPath
+	route   []string // Nodes of the path, from From to To.
+	scratch bool
+}
+
+func (m *shortestPathBest) TupleType() reflect.Type {
+	var x *ShortestPath
+	return reflect.TypeOf(x).Elem()
+}
+
+func (m *shortestPathBest) DeclareScratch() {
+	m.scratch = true
+}
+
+func (m *shortestPathBest) isScratch() bool { return m.scratch }
+
+func (m *shortestPathBest) startTick() {
+	if m.scratch {
+		m.Clear()
+	}
+}
+
+func (m *shortestPathBest) Clear() bool {
+	changed := m.path != nil
+	z := m.Zero().(*shortestPathBest)
+	m.path, m.route = z.path, z.route
+	m.d.cleared(m)
+	return changed
+}
+
+func (m *shortestPathBest) DirectAdd(v interface{}) bool {
+	p := v.(*ShortestPath)
+	return m.merge(p, []string{p.From, p.To})
+}
+
+func (m *shortestPathBest) DirectMerge(rel Relation) bool {
+	r := rel.(*shortestPathBest)
+	if r.path == nil {
+		return false
+	}
+	return m.merge(r.path, r.route)
+}
+
+func (m *shortestPathBest) merge(p *ShortestPath, route []string) bool {
+	if m.path == nil || m.better(p.Cost, m.path.Cost) ||
+		(p.Cost == m.path.Cost && p.Next < m.path.Next) {
+		m.path, m.route = p, route
+		return true
+	}
+	return false
+}
+
+func (m *shortestPathBest) Scan() chan interface{} {
+	ch := make(chan interface{})
+	go func() {
+		if m.path != nil {
+			ch <- m.path
+		}
+		close(ch)
+	}()
+	return ch
+}
+
+func (m *shortestPathBest) Zero() Lattice {
+	return &shortestPathBest{d: m.d, better: m.better}
+}
+
+func (m *shortestPathBest) Snapshot() Lattice {
+	return &shortestPathBest{d: m.d, better: m.better, path: m.path,
+		route: m.route}
+}
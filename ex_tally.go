@@ -1,15 +1,22 @@
 package gdec
 
+import (
+	"reflect"
+)
+
 // Simple vote tally/counter.
 func TallyInit(d *D, prefix string) *D {
+	d.checkUndeclared("TallyInit", prefix,
+		"TallyVote", "TallyNeed", "TallyDone", "tallyTotal")
 	tvote := d.Input(d.DeclareLSet(prefix+"TallyVote", "voterString"))
 	tneed := d.DeclareLMax(prefix + "TallyNeed")
 	tdone := d.Output(d.DeclareLBool(prefix + "TallyDone"))
 
 	ttotal := d.DeclareLSet(prefix+"tallyTotal", "voterString")
 
-	d.Join(tvote).Into(ttotal)
-	d.Join(func() bool { return ttotal.Size() >= tneed.Int() }).Into(tdone)
+	d.Join(tvote).Into(ttotal).Name("tallyTotal")
+	d.Join(func() bool { return ttotal.Size() >= tneed.Int() }).Into(tdone).
+		Name("tallyDone")
 
 	return d
 }
@@ -25,18 +32,24 @@ type MultiTallyVote struct {
 
 // Multiple tally/counters, when there are multiple, in-flight races (or contests).
 func MultiTallyInit(d *D, prefix string) *D {
+	d.checkUndeclared("MultiTallyInit", prefix, "MultiTallyVote",
+		"MultiTallyNeed", "MultiTallyDone", "multiTallyTotal")
 	tvote := d.Input(d.DeclareLSet(prefix+"MultiTallyVote", MultiTallyVote{}))
 	tneed := d.DeclareLMax(prefix + "MultiTallyNeed")
-	tdone := d.Output(d.DeclareLMap(prefix + "MultiTallyDone")) // Key: raceStr, val: LBool.
+	tdone := d.Output(d.DeclareLMapOf(prefix+"MultiTallyDone", // Key: raceStr.
+		func() Lattice { return d.NewLBool() }))
 
-	ttotal := d.DeclareLMap(prefix + "multiTallyTotal") // Key: raceStr, val: LSet[voterStr].
+	ttotal := d.DeclareLMapOf(prefix+"multiTallyTotal", // Key: raceStr, val: LSet[voterStr].
+		func() Lattice { return d.NewLSet(reflect.TypeOf("")) })
 
 	d.Join(tvote, func(tvote *MultiTallyVote) *LMapEntry {
 		return &LMapEntry{tvote.Race, NewLSetOne(d, tvote.Voter)}
 	}).Into(ttotal)
 
 	d.Join(ttotal, func(m *LMapEntry) *LMapEntry {
-		if m.Val.(*LSet).Size() >= tneed.Int() {
+		// An unset need never completes a race, so that a scratch need
+		// isn't seen as zero before it's computed.
+		if tneed.Int() > 0 && m.Val.(*LSet).Size() >= tneed.Int() {
 			return &LMapEntry{m.Key, NewLBool(d, true)}
 		}
 		return &LMapEntry{m.Key, NewLBool(d, false)}
@@ -49,14 +62,11 @@ func init() {
 	MultiTallyInit(NewD(""), "")
 }
 
+// Returns the voters of a race, which is empty for an unknown race.
 func MultiTallyVoters(d *D, prefix string, race string) *LSet {
-	return d.Relations[prefix+"multiTallyTotal"].(*LMap).At(race).(*LSet)
+	return LMapAt[*LSet](d.Relations[prefix+"multiTallyTotal"].(*LMap), race)
 }
 
 func MultiTallyHasVoteFrom(d *D, prefix string, race string, voter string) bool {
-	s := MultiTallyVoters(d, prefix, race)
-	if s != nil {
-		return s.Contains(voter)
-	}
-	return false
+	return MultiTallyVoters(d, prefix, race).Contains(voter)
 }
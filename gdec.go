@@ -2,7 +2,10 @@ package gdec
 
 import (
 	"fmt"
+	"math/rand"
 	"reflect"
+	"sync"
+	"time"
 )
 
 type D struct {
@@ -12,6 +15,83 @@ type D struct {
 	ticks     int64
 	next      []relationChange
 	immediate []relationChange
+
+	// Used to fire periodics.  Tests may replace this with a fake clock.
+	Now       func() time.Time
+	periodics []*periodic
+	tickTime  time.Time // Now() at the start of the current tick.
+
+	// Used for randomized periodics and by modules, like the peers
+	// picked by GossipInit().  Tests may replace this with a seeded
+	// source for reproducible runs, which embedded D's also use.
+	Rand *rand.Rand
+
+	transport Transport
+	inboundM  sync.Mutex
+	inbound   []relationChange // Protected by inboundM.
+	delayed   []delayedChange  // Protected by inboundM.
+
+	// Lazily computed from Joins, see stratify().
+	strata     [][]*joinDeclaration
+	asyncJoins []*joinDeclaration
+	reads      map[Relation]stratumRead // See checkImmediate().
+
+	naive bool // When true, disables semi-naive evaluation.
+
+	// When true, LSet and LMap Scan()'s yield tuples sorted by key, an
+	// LSet's key being its tuple's JSON, so that joins process tuples in
+	// the same order on every run and every replica, at some cost.
+	SortedScan bool
+
+	// When above 1, the joins of each fixpoint step run concurrently on
+	// up to Workers goroutines, see executeJoins().  Joins whose
+	// selectWhere funcs invoke d.Add() and friends, or that aren't
+	// otherwise safe to run concurrently, need Workers of 0 or 1.
+	Workers int
+
+	// When true, joins read the relations that no join derives, like
+	// inputs and state that selectWhere funcs update directly, from
+	// snapshots, so results don't depend on join declaration order.
+	// See snapshotReads().
+	SnapshotReads bool
+	readSnapshots map[Relation]Relation // Key: base relation.
+
+	// Counts changes during the current tick that matter for
+	// quiescence, see RunUntilQuiescent().
+	tickChanges int
+	tickChanged map[Relation]bool // When non-nil, what tickChanges counted.
+
+	trace    bool // When true, join outputs are recorded, see EnableTrace().
+	traceLog []TraceEntry
+
+	onChange map[Relation][]func(added interface{}) // See OnChange().
+
+	seeds map[Relation][]interface{} // See Seed().
+
+	beforeEmit []func() error // See BeforeEmit().
+
+	metrics         bool // When true, see EnableMetrics().
+	relationChanges map[Relation]int64
+
+	scanStats bool // When true, see EnableScanStats().
+
+	recording    *recording // See StartRecording().
+	recordingErr error
+	replay       []*replayTick // Remaining ticks, during Replay().
+
+	embeddedIn *D // See Embed().
+
+	logger Logger // See SetLogger().
+
+	checkDeterminism bool // When true, see CheckDeterminism().
+
+	collectErrors bool // When true, see CollectErrors().
+	errsM         sync.Mutex
+	errs          []error // Protected by errsM.
+
+	// Changes in next before this position are from the last tick's
+	// joins, and the rest were added externally, such as by AddNext().
+	nextMark int
 }
 
 type Relation interface {
@@ -20,6 +100,7 @@ type Relation interface {
 	// Used at declaration time, marks the relation as "scratch",
 	// so it'll reset to zero at the start of each tick.
 	DeclareScratch()
+	isScratch() bool
 
 	// Invoked at the start of each tick.  Implementations marked as
 	// scratch should reset to zero.
@@ -31,6 +112,13 @@ type Relation interface {
 
 	DirectAdd(tuple interface{}) bool // Returns true if Relation changed.
 	DirectMerge(rel Relation) bool    // Returns true if Relation changed.
+
+	// Resets the relation to zero, as if it were scratch, returning
+	// true if it changed.  Joins reading or writing it are then fully
+	// evaluated at the next tick, rederiving what its sources still
+	// hold.  It's a non-monotonic escape hatch, see ClearAll(), so use
+	// it between ticks.
+	Clear() bool
 }
 
 func NewD(addr string) *D {
@@ -40,6 +128,8 @@ func NewD(addr string) *D {
 		Joins:     []*joinDeclaration{},
 		next:      []relationChange{},
 		immediate: []relationChange{},
+		Now:       time.Now,
+		Rand:      rand.New(rand.NewSource(time.Now().UnixNano())),
 	}
 }
 
@@ -50,15 +140,76 @@ func (d *D) DeclareChannel(name string, x interface{}) *LSet {
 	return c
 }
 
+// What a bounded channel does with a tuple sent while it's full.
+type DropPolicy int
+
+const (
+	DropOldest DropPolicy = iota // Makes room by dropping the oldest tuple.
+	DropNewest                   // Drops the tuple being sent.
+)
+
+// DeclareBoundedChannel is like DeclareChannel, but buffers at most max
+// tuples waiting to be sent, such as while their destination is
+// unreachable, dropping tuples according to the policy.  See Dropped().
+func (d *D) DeclareBoundedChannel(name string, x interface{}, max int,
+	policy DropPolicy) *LSet {
+	if max <= 0 {
+		panic(fmt.Sprintf("DeclareBoundedChannel() max: %d"+
+			", should be positive, name: %s", max, name))
+	}
+	c := d.DeclareChannel(name, x)
+	c.outboxMax = max
+	c.outboxDrop = policy
+	return c
+}
+
 func (d *D) DeclareRelation(name string, x Relation) Relation {
-	if d.Relations[name] != nil {
-		panic(fmt.Sprintf("relation redeclared, name: %s"+
-			", relation: %#v", name, x))
+	r, err := d.DeclareRelationSafe(name, x)
+	if err != nil {
+		panic(err.Error())
+	}
+	return r
+}
+
+// Like DeclareRelation, but returns an error instead of panicking when
+// the name is already taken, so library code can detect collisions.
+func (d *D) DeclareRelationSafe(name string, x Relation) (Relation, error) {
+	if prev := d.Relations[name]; prev != nil {
+		return nil, fmt.Errorf("relation redeclared, name: %s"+
+			", existing: %T, tuple type: %v, new: %T, tuple type: %v",
+			name, prev, prev.TupleType(), x, x.TupleType())
 	}
 	d.Relations[name] = x
-	return x
+	return x, nil
 }
 
+// Used by protocol initializers, which declare only channels, so they
+// may be invoked more than once on the same prefix, such as by both a
+// client and a server.  An existing channel is reused if its tuple type
+// matches.
+func (d *D) declareProtocolChannel(name string, x interface{}) *LSet {
+	if c, ok := d.Relations[name].(*LSet); ok && c.channel &&
+		c.TupleType() == reflect.TypeOf(x) {
+		return c
+	}
+	return d.DeclareChannel(name, x)
+}
+
+// Used by initializers to check that a prefix isn't already in use
+// before declaring any joins.
+func (d *D) checkUndeclared(init string, prefix string, names ...string) {
+	for _, name := range names {
+		if d.Relations[prefix+name] != nil {
+			panic(fmt.Sprintf("%s() prefix: %q, already initialized"+
+				", relation: %s", init, prefix, prefix+name))
+		}
+	}
+}
+
+// Join declares a join of the relations in vars, optionally followed
+// by a selectWhereFunc, whose params bind to the sources by position,
+// so a relation can appear more than once, like links joined with
+// links for reachability, with each occurrence its own param.
 func (d *D) Join(vars ...interface{}) *joinDeclaration {
 	var r *Relation
 	rt := reflect.TypeOf(r).Elem()
@@ -66,21 +217,23 @@ func (d *D) Join(vars ...interface{}) *joinDeclaration {
 	var joinNum int
 	var selectWhereFunc interface{}
 
+	bad := &joinDeclaration{d: d} // Never registered.
+
 	for i, x := range vars {
 		if x == nil {
-			panic("nil passed as Join() param")
+			return bad.fail("nil passed as Join() param")
 		}
 		xt := reflect.TypeOf(x)
 		if xt.Kind() == reflect.Func {
 			if i < len(vars)-1 {
-				panic(fmt.Sprintf("func not last Join() param: %#v",
+				return bad.fail(fmt.Sprintf("func not last Join() param: %#v",
 					vars))
 			}
 			selectWhereFunc = x
 		} else if xt.Implements(rt) {
 			joinNum = i + 1
 		} else {
-			panic(fmt.Sprintf("unexpected Join() param type: %#v, %v",
+			return bad.fail(fmt.Sprintf("unexpected Join() param type: %#v, %v",
 				x, xt))
 		}
 	}
@@ -93,13 +246,13 @@ func (d *D) Join(vars ...interface{}) *joinDeclaration {
 	if selectWhereFunc != nil {
 		mft := reflect.TypeOf(selectWhereFunc)
 		if mft.NumIn() != joinNum {
-			panic(fmt.Sprintf("selectWhereFunc should take %v args"+
+			return bad.fail(fmt.Sprintf("selectWhereFunc should take %v args"+
 				", selectWhereFunc: %v", joinNum, mft))
 		}
 		for i, x := range sources {
 			rt := reflect.PtrTo(x.TupleType())
 			if rt != mft.In(i) {
-				panic(fmt.Sprintf("selectWhereFunc param #%v type"+
+				return bad.fail(fmt.Sprintf("selectWhereFunc param #%v type"+
 					" %v does not match, expected: %v, selectWhereFunc: %v",
 					i, mft.In(i), rt, mft))
 			}
@@ -112,31 +265,125 @@ func (d *D) Join(vars ...interface{}) *joinDeclaration {
 		selectWhereFunc: selectWhereFunc,
 	}
 	d.Joins = append(d.Joins, jd)
+	d.strata = nil
 	return jd
 }
 
+// JoinOn is like Join, but equijoins the sources on the named field of
+// each source's tuples, so the selectWhereFunc is only invoked on
+// combinations of tuples whose key fields are equal.  A field of ""
+// means that source isn't part of the key.
+func (d *D) JoinOn(fields []string, vars ...interface{}) *joinDeclaration {
+	jd := d.Join(vars...)
+	if jd.err != nil {
+		return jd
+	}
+	if len(fields) != len(jd.sources) {
+		return jd.fail(fmt.Sprintf("JoinOn() needs a field per source"+
+			", fields: %v, sources: %d", fields, len(jd.sources)))
+	}
+	for i, f := range fields {
+		if f == "" {
+			continue
+		}
+		t := jd.sources[i].TupleType()
+		if t.Kind() == reflect.Ptr {
+			t = t.Elem()
+		}
+		if t.Kind() != reflect.Struct {
+			return jd.fail(fmt.Sprintf("JoinOn() source #%d tuple type: %v"+
+				", is not a struct", i, t))
+		}
+		if _, ok := t.FieldByName(f); !ok {
+			return jd.fail(fmt.Sprintf("JoinOn() source #%d tuple type: %v"+
+				", has no field: %s", i, t, f))
+		}
+	}
+	jd.on = fields
+	return jd
+}
+
+// JoinFlat is like Join(), but its selectWhereFunc produces a relation
+// of the same type as the join's Into(), or a slice of them, which are
+// merged into it, instead of tuples to add.  That's handy for building
+// sub-lattices on the fly, like an LMap of an LSet to accumulate into
+// an LMapOf().
 func (d *D) JoinFlat(vars ...interface{}) *joinDeclaration {
 	jd := d.Join(vars...)
 	jd.selectWhereFlat = true
 	return jd
 }
 
+// Add, and Merge(), are for selectWhere funcs that write to relations
+// other than their join's Into(), and take effect during the current
+// tick, as the join's own results do, through the fixpoint loop.  So
+// the write must not reach a relation that an earlier stratum, which
+// has already reached its fixpoint, reads, else those reads would miss
+// it.  That's checked, see checkImmediate().  AddNext(), and
+// MergeNext(), instead take effect at the start of the next tick, like
+// IntoAsync() results, so they're always safe.
 func (d *D) Add(r Relation, v interface{}) {
+	d = d.host()
 	d.immediate = append(d.immediate, relationChange{r, v, true})
 }
 
+// AddAll is like Add() for each tuple, growing the pending changes once.
+func (d *D) AddAll(r Relation, tuples []interface{}) {
+	d = d.host()
+	if n := len(d.immediate) + len(tuples); n > cap(d.immediate) {
+		immediate := make([]relationChange, len(d.immediate), n)
+		copy(immediate, d.immediate)
+		d.immediate = immediate
+	}
+	for _, v := range tuples {
+		d.immediate = append(d.immediate, relationChange{r, v, true})
+	}
+}
+
 func (d *D) AddNext(r Relation, v interface{}) {
+	d = d.host()
 	d.next = append(d.next, relationChange{r, v, true})
 }
 
+// Pending returns what will be added to r at the start of the next
+// tick, from IntoAsync() joins, AddNext() and MergeNext(), with a
+// relation standing for each merge.
+func (d *D) Pending(r Relation) []interface{} {
+	var rv []interface{}
+	for _, c := range d.host().next {
+		if c.into == r {
+			rv = append(rv, c.arg)
+		}
+	}
+	return rv
+}
+
 func (d *D) Merge(r Relation, v interface{}) {
+	d = d.host()
 	d.immediate = append(d.immediate, relationChange{r, v, false})
 }
 
 func (d *D) MergeNext(r Relation, v interface{}) {
+	d = d.host()
 	d.next = append(d.next, relationChange{r, v, false})
 }
 
+// Seed adds tuples to r at declaration time, for static config like a
+// member set, so they're there from the first tick on.  A non-scratch r
+// keeps them like any other tuples, while a scratch r gets them again
+// at the start of every tick, as a constant input.  Returns r.
+func (d *D) Seed(r Relation, tuples ...interface{}) Relation {
+	for _, v := range tuples {
+		r.DirectAdd(v)
+	}
+	d = d.host()
+	if d.seeds == nil {
+		d.seeds = map[Relation][]interface{}{}
+	}
+	d.seeds[r] = append(d.seeds[r], tuples...)
+	return r
+}
+
 type joinDeclaration struct {
 	d               *D
 	name            string
@@ -145,6 +392,39 @@ type joinDeclaration struct {
 	selectWhereFlat bool
 	async           bool
 	into            Relation
+	minus           []containser // Negated sources, see Minus().
+	semiNaive       bool
+	maintained      bool     // Fully evaluated since stratify(), see maintainable().
+	disabled        bool     // See DisableJoin().
+	on              []string // Key field per source, see JoinOn().
+
+	// Used instead of selectWhereFunc by typed joins, see Join2().
+	call      func(join []interface{}, deref bool) interface{}
+	callOut   reflect.Type
+	callDeref bool
+
+	agg *joinAgg // Used instead of selectWhereFunc, see JoinAgg().
+
+	err error // Non-nil when the declaration was misused, see fail().
+
+	buffered bool             // When true, results go to out, see executeJoins().
+	out      []relationChange // Buffered results.
+
+	stamps []joinStamp // See StampTick() and StampTime().
+
+	evals    int64 // See EnableMetrics().
+	evalTime time.Duration
+
+	scanned []int64 // By source, see EnableScanStats().
+	passed  []int64
+	indexed []int64
+	combos  int64
+	results int64
+}
+
+type containser interface {
+	Relation
+	Contains(v interface{}) bool
 }
 
 func (jd *joinDeclaration) Name(name string) *joinDeclaration {
@@ -152,6 +432,69 @@ func (jd *joinDeclaration) Name(name string) *joinDeclaration {
 	return jd
 }
 
+// DisableJoin stops the joins labeled name, by their Name(), else by
+// "join#" and their position in d.Joins, from running, from the next
+// tick on, until EnableJoin().  What they derived before remains.
+func (d *D) DisableJoin(name string) {
+	d.setJoinDisabled(name, true)
+}
+
+// EnableJoin undoes DisableJoin().  The joins are then fully evaluated
+// again, so they see any tuples that arrived while they were disabled.
+func (d *D) EnableJoin(name string) {
+	d.setJoinDisabled(name, false)
+}
+
+func (d *D) setJoinDisabled(name string, disabled bool) {
+	d = d.host()
+	found := false
+	for _, jd := range d.Joins {
+		if jd.label() == name {
+			jd.disabled, jd.maintained = disabled, false
+			found = true
+		}
+	}
+	if !found {
+		msg := fmt.Sprintf("no join labeled: %s", name)
+		if !d.collectErrors {
+			panic(msg)
+		}
+		d.recordErr(&JoinError{Join: name, Msg: msg})
+	}
+}
+
+// Returns the join's Name(), else "join#" and its position.
+func (jd *joinDeclaration) label() string {
+	if jd.name != "" {
+		return jd.name
+	}
+	for i, x := range jd.d.Joins {
+		if x == jd {
+			return fmt.Sprintf("join#%d", i)
+		}
+	}
+	return "join#?"
+}
+
+// Minus drops join results that are contained in rel.  Joins are
+// stratified so that rel reaches its fixpoint within a tick before any
+// join that negates it runs.
+func (jd *joinDeclaration) Minus(rel Relation) *joinDeclaration {
+	if jd.err != nil {
+		return jd
+	}
+	c, ok := rel.(containser)
+	if !ok {
+		return jd.fail(fmt.Sprintf("Minus() param: %#v, does not support Contains()", rel))
+	}
+	if jd.selectWhereFlat {
+		return jd.fail(fmt.Sprintf("Minus() not supported on JoinFlat(): %#v", jd))
+	}
+	jd.minus = append(jd.minus, c)
+	jd.d.strata = nil
+	return jd
+}
+
 func (jd *joinDeclaration) IntoAsync(dest interface{}) *joinDeclaration {
 	jd.async = true
 	jd.Into(dest)
@@ -159,41 +502,124 @@ func (jd *joinDeclaration) IntoAsync(dest interface{}) *joinDeclaration {
 }
 
 func (jd *joinDeclaration) Into(dest interface{}) *joinDeclaration {
+	if jd.err != nil {
+		return jd
+	}
 	var r *Relation
 	rt := reflect.TypeOf(r).Elem()
 
 	dt := reflect.TypeOf(dest)
-	if !dt.Implements(rt) {
-		panic(fmt.Sprintf("Into() param: %#v, type: %v"+
+	if dt == nil || !dt.Implements(rt) {
+		return jd.fail(fmt.Sprintf("Into() param: %#v, type: %v"+
 			", does not implement Relation", dest, dt))
 	}
 
+	if c, ok := dest.(*LSet); ok && c.constant != nil {
+		return jd.fail(fmt.Sprintf("Into() join: %s, relation: %s, is a constant"+
+			", see DeclareConst()", jd.label(), jd.d.relationLabel(c)))
+	}
+
 	jd.into = dest.(Relation)
+	if m, ok := jd.into.(*RetractSet); ok {
+		defer func() {
+			m.derived = m.derived || jd.err == nil // See RetractSet.
+		}()
+	}
 
 	var out reflect.Type
-	if jd.selectWhereFunc != nil {
-		out = reflect.TypeOf(jd.selectWhereFunc).Out(0)
+	if jd.agg != nil {
+		out = reflect.TypeOf(&AggResult{})
+	} else if jd.call != nil {
+		out = reflect.PtrTo(jd.callOut)
+		if !acceptsTuple(jd.into, out) && acceptsTuple(jd.into, jd.callOut) {
+			out = jd.callOut
+			jd.callDeref = true
+		}
+	} else if jd.selectWhereFunc != nil {
+		ft := reflect.TypeOf(jd.selectWhereFunc)
+		if ft.NumOut() != 1 {
+			return jd.fail(fmt.Sprintf("Into() join: %s, selectWhereFunc: %v"+
+				", should have 1 result", jd.label(), ft))
+		}
+		out = ft.Out(0)
+	} else if jd.selectWhereFlat {
+		return jd.fail(fmt.Sprintf("Into() join: %s, JoinFlat() needs a"+
+			" selectWhereFunc that produces relations", jd.label()))
 	} else if len(jd.sources) == 1 {
-		out = reflect.PtrTo(jd.sources[0].TupleType())
+		// The source's tuples are added as they're scanned.
+		src := jd.sources[0]
+		sf, df := tupleFormOf(src), tupleFormOf(jd.into)
+		if src.TupleType() != jd.into.TupleType() ||
+			(sf != tupleForm_EITHER && df != tupleForm_EITHER && sf != df) {
+			return jd.fail(fmt.Sprintf("Into() join: %s, source: %s, type: %T"+
+				", tuples cannot be added to relation: %s, type: %v"+
+				", which wants: %s", jd.label(), jd.d.relationLabel(src), src,
+				jd.d.relationLabel(jd.into), dt, wantedTuple(jd.into)))
+		}
+		return jd
 	} else {
-		panic(fmt.Sprintf("unexpected Into() join declaration: %#v", jd))
+		return jd.fail(fmt.Sprintf("Into() join: %s, needs a selectWhereFunc"+
+			" to combine %d sources", jd.label(), len(jd.sources)))
 	}
 	if jd.selectWhereFlat {
-		if out != dt {
-			panic(fmt.Sprintf("Into() param: %#v, type: %v, does not match"+
-				" output type: %v", dest, dt, out))
-		}
-	} else {
-		if out != jd.into.TupleType() &&
-			out != reflect.PtrTo(jd.into.TupleType()) {
-			panic(fmt.Sprintf("Into() param: %#v, type: %v, does not match"+
-				" tuple type: %v", dest, dt, out))
+		if out != dt && out != reflect.SliceOf(dt) {
+			return jd.fail(fmt.Sprintf("Into() join: %s, output type: %v"+
+				", does not match relation: %s, type: %v, or a slice of them",
+				jd.label(), out, jd.d.relationLabel(jd.into), dt))
 		}
+	} else if !acceptsTuple(jd.into, out) {
+		return jd.fail(fmt.Sprintf("Into() join: %s, output type: %v"+
+			", cannot be added to relation: %s, type: %v, which wants: %s",
+			jd.label(), out, jd.d.relationLabel(jd.into), dt,
+			wantedTuple(jd.into)))
 	}
 
 	return jd
 }
 
+// How a relation's DirectAdd() wants its tuples, and how its Scan()
+// yields them.  Scalar lattices use their tuple type, entry based
+// lattices use pointers to their entries, and sets take either.
+const (
+	tupleForm_EITHER = iota
+	tupleForm_VALUE
+	tupleForm_PTR
+)
+
+func tupleFormOf(r Relation) int {
+	switch r.(type) {
+	case *LMax, *LMaxString, *LMinString, *LBool, *LMaxFloat, *LMinFloat, *LMaxBy:
+		return tupleForm_VALUE
+	case *LMap, *GCounter, *PNCounter, *LWWReg, *MVReg, *VectorClock, *LHLL,
+		*LBloom:
+		return tupleForm_PTR
+	}
+	return tupleForm_EITHER
+}
+
+// Returns whether a relation's DirectAdd() accepts tuples of type t.
+func acceptsTuple(r Relation, t reflect.Type) bool {
+	tt := r.TupleType()
+	switch tupleFormOf(r) {
+	case tupleForm_VALUE:
+		return t == tt
+	case tupleForm_PTR:
+		return t == reflect.PtrTo(tt)
+	}
+	return t == tt || t == reflect.PtrTo(tt)
+}
+
+func wantedTuple(r Relation) string {
+	tt := r.TupleType()
+	switch tupleFormOf(r) {
+	case tupleForm_VALUE:
+		return tt.String()
+	case tupleForm_PTR:
+		return reflect.PtrTo(tt).String()
+	}
+	return fmt.Sprintf("%v or %v", tt, reflect.PtrTo(tt))
+}
+
 func (d *D) Scratch(r Relation) Relation { // Concise readability sugar.
 	r.DeclareScratch()
 	return r
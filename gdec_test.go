@@ -1,8 +1,19 @@
 package gdec
 
 import (
+	"bytes"
 	"fmt"
+	"io"
+	"math"
+	"math/rand"
+	"net"
+	"os"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 )
 
 func TestNewD(t *testing.T) {
@@ -21,6 +32,116 @@ func TestReplicatedKV(t *testing.T) {
 	fmt.Printf("%#v\n", d)
 }
 
+func TestKVPutWithTTL(t *testing.T) {
+	c := &fakeClock{now: time.Unix(1000, 0)}
+	d := KVInit(NewD("a"), "")
+	d.Now = c.Now
+	kvmap := d.Relations["kvMap"].(*LMap)
+
+	get := func() Lattice {
+		d.AddNext(d.Relations["KVGet"], &KVGet{1, "a", "client", "k"})
+		d.Tick()
+		for _, x := range d.Relations["KVGetResponse"].(*LSet).Drain() {
+			return x.(*KVGetResponse).Val
+		}
+		t.Fatalf("expected a get response")
+		return nil
+	}
+
+	put := KVPutWithTTL(d, KVPut{1, "a", "client", "k", NewLMax(d, 7), 0},
+		10*time.Second)
+	d.AddNext(d.Relations["KVPut"], put)
+	d.Tick()
+	if v, ok := get().(*LMax); !ok || v.Int() != 7 {
+		t.Errorf("expected value before expiry, got: %v", v)
+	}
+
+	c.Advance(5 * time.Second)
+	if v, ok := get().(*LMax); !ok || v.Int() != 7 {
+		t.Errorf("expected value before expiry, got: %v", v)
+	}
+
+	c.Advance(5 * time.Second)
+	if v := get(); v != nil {
+		t.Errorf("expected no value after expiry, got: %v", v)
+	}
+	if kvmap.At("k") != nil {
+		t.Errorf("expected sweep to remove expired key")
+	}
+
+	// A put without a TTL never expires.
+	d.AddNext(d.Relations["KVPut"],
+		&KVPut{2, "a", "client", "k", NewLMax(d, 3), 0})
+	d.Tick()
+	c.Advance(time.Hour)
+	if v, ok := get().(*LMax); !ok || v.Int() != 3 {
+		t.Errorf("expected fresh value without expiry, got: %v", v)
+	}
+}
+
+func TestReplicatedKVConflict(t *testing.T) {
+	ds := map[string]*D{}
+	for _, a := range []string{"a", "b"} {
+		ds[a] = ReplicatedKVInit(NewD(a), "")
+	}
+	put := func(a string, reqId int64, v int) {
+		d := ds[a]
+		d.AddNext(d.Relations["KVPut"],
+			&KVPut{reqId, a, "client", "k", NewLMax(d, v), 0})
+		d.Tick()
+		d.Tick()
+	}
+	replicate := func(from, to string) {
+		d := ds[to]
+		m := ds[from].Relations["kvMap"].(*LMap).Snapshot().(*LMap)
+		d.AddNext(d.Relations["KVReplMap"], &KVReplMap{to, m, d.NewLMap()})
+		d.Tick()
+	}
+	conflicted := func(a string) bool {
+		return ds[a].Relations["ReplicatedKVConflict"].(*LSet).Contains("k")
+	}
+	get := func(a string) []Lattice {
+		d := ds[a]
+		d.AddNext(d.Relations["KVGet"], &KVGet{1, a, "client", "k"})
+		d.Tick()
+		for _, x := range d.Relations["KVGetResponse"].(*LSet).Drain() {
+			return x.(*KVGetResponse).Val.(*MVReg).Values()
+		}
+		return nil
+	}
+
+	// A put that has seen an earlier put supersedes it.
+	put("a", 1, 1)
+	replicate("a", "b")
+	put("b", 2, 2)
+	replicate("b", "a")
+	if vals := get("a"); conflicted("a") || len(vals) != 1 ||
+		vals[0].(*LMax).Int() != 2 {
+		t.Errorf("expected causal put to supersede, got: %v", vals)
+	}
+
+	// Concurrent puts are kept as siblings on both replicas.
+	put("a", 3, 3)
+	put("b", 4, 4)
+	replicate("a", "b")
+	replicate("b", "a")
+	for _, a := range []string{"a", "b"} {
+		if vals := get(a); !conflicted(a) || len(vals) != 2 {
+			t.Errorf("expected conflict on: %s, got: %v", a, vals)
+		}
+	}
+
+	// A put that has seen both siblings resolves the conflict.
+	put("b", 5, 5)
+	replicate("b", "a")
+	for _, a := range []string{"a", "b"} {
+		if vals := get(a); conflicted(a) || len(vals) != 1 ||
+			vals[0].(*LMax).Int() != 5 {
+			t.Errorf("expected resolved value on: %s, got: %v", a, vals)
+		}
+	}
+}
+
 func TestTally(t *testing.T) {
 	d := TallyInit(NewD("tallyTest"), "")
 
@@ -78,6 +199,277 @@ func TestTally(t *testing.T) {
 	}
 }
 
+func TestLMapOf(t *testing.T) {
+	d := NewD("")
+	m := d.DeclareLMapOf("m", func() Lattice { return d.NewLMax() })
+
+	if LMapAt[*LMax](m, "a").Int() != 0 || m.Len() != 0 {
+		t.Errorf("expected missing key to give a fresh value that's not added")
+	}
+	if !m.DirectAdd(&LMapEntry{"a", NewLMax(d, 3)}) ||
+		LMapAt[*LMax](m, "a").Int() != 3 {
+		t.Errorf("expected typed add to work")
+	}
+	if LMapAt[*LMax](m.Snapshot().(*LMap), "b").Int() != 0 {
+		t.Errorf("expected snapshot to keep the value type")
+	}
+
+	for _, f := range []func(){
+		func() { m.DirectAdd(&LMapEntry{"b", NewLBool(d, true)}) },
+		func() { LMapAt[*LBool](m, "a") },
+		func() { LMapAt[*LMax](d.DeclareLMap("untyped"), "a") },
+	} {
+		func() {
+			defer func() {
+				if recover() == nil {
+					t.Errorf("expected panic on wrong value type")
+				}
+			}()
+			f()
+		}()
+	}
+}
+
+func TestLMapOfAutoInit(t *testing.T) {
+	d := NewD("")
+	sets := d.DeclareLMapOf("sets", func() Lattice { return d.NewLSet(reflect.TypeOf("")) })
+	bools := d.DeclareLMapOf("bools", func() Lattice { return d.NewLBool() })
+	if s, ok := sets.AtOrZero("x").(*LSet); !ok || s.Size() != 0 || sets.HasKey("x") {
+		t.Errorf("expected a missing key to give an empty LSet, not added")
+	}
+	if b, ok := bools.AtOrZero("x").(*LBool); !ok || b.Bool() || bools.Len() != 0 {
+		t.Errorf("expected a missing key to give a false LBool, not added")
+	}
+	if sets.At("x") != nil || d.DeclareLMap("untyped").AtOrZero("x") != nil {
+		t.Errorf("expected a missing key to give nil, for At() or an untyped LMap")
+	}
+
+	// The first value for a key is merged into a fresh one, rather than
+	// kept, so later merges don't alter what a join produced.
+	v := NewLSetOne(d, "a")
+	if !sets.DirectAdd(&LMapEntry{"x", v}) || !sets.HasKey("x") {
+		t.Errorf("expected a new key to be a change")
+	}
+	if !sets.DirectAdd(&LMapEntry{"x", NewLSetOne(d, "b")}) ||
+		LMapAt[*LSet](sets, "x").Size() != 2 || v.Size() != 1 {
+		t.Errorf("expected merges into the auto created value only, got: %v, %v",
+			RelationValue(sets), v.m)
+	}
+	if !bools.DirectAdd(&LMapEntry{"y", NewLBool(d, false)}) || !bools.HasKey("y") {
+		t.Errorf("expected a new key with a bottom value to be added")
+	}
+
+	// Joins into auto created entries.
+	votes := d.DeclareLSet("votes", MultiTallyVote{})
+	d.Join(votes, func(v *MultiTallyVote) *LMapEntry {
+		return &LMapEntry{v.Race, NewLSetOne(d, v.Voter)}
+	}).Into(sets)
+	votes.DirectAdd(&MultiTallyVote{"x", "c"})
+	votes.DirectAdd(&MultiTallyVote{"z", "c"})
+	d.Tick()
+	if LMapAt[*LSet](sets, "x").Size() != 3 || LMapAt[*LSet](sets, "z").Size() != 1 {
+		t.Errorf("expected joined votes merged, got: %v", RelationValue(sets))
+	}
+}
+
+type testTermIndex struct {
+	Term  int
+	Index int
+}
+
+type testPair struct {
+	A, B string
+}
+
+func TestLMapKey(t *testing.T) {
+	d := NewD("")
+	tallies := d.DeclareLMapOf("tallies", func() Lattice { return d.NewLSet(reflect.TypeOf("")) })
+	votes := d.DeclareLSet("votes", RaftVote{})
+	d.Join(votes, func(v *RaftVote) *LMapEntry {
+		return &LMapEntry{LMapKey(testTermIndex{v.Term, len(v.Candidate)}), NewLSetOne(d, v.Candidate)}
+	}).Into(tallies)
+	votes.DirectAdd(&RaftVote{1, "a"})
+	votes.DirectAdd(&RaftVote{1, "b"})
+	votes.DirectAdd(&RaftVote{1, "cc"})
+	votes.DirectAdd(&RaftVote{11, "d"})
+	d.Tick()
+
+	if n := tallies.AtKey(testTermIndex{1, 1}).(*LSet).Size(); n != 2 {
+		t.Errorf("expected 2 votes at (1, 1), got: %d", n)
+	}
+	if tallies.AtKey(testTermIndex{11, 1}).(*LSet).Size() != 1 ||
+		tallies.AtKey(testTermIndex{1, 11}) != nil {
+		t.Errorf("expected (11, 1) and (1, 11) distinct, got: %v", tallies.Keys())
+	}
+	var got []testTermIndex
+	for _, k := range tallies.Keys() {
+		got = append(got, LMapKeyOf[testTermIndex](k))
+	}
+	exp := []testTermIndex{{1, 1}, {1, 2}, {11, 1}}
+	if !reflect.DeepEqual(got, exp) {
+		t.Errorf("expected keys to decode: %v, got: %v", exp, got)
+	}
+
+	// Joining with a separator collides, while composite keys don't.
+	x, y := testPair{"a,b", "c"}, testPair{"a", "b,c"}
+	if x.A+","+x.B != y.A+","+y.B || LMapKey(x) == LMapKey(y) {
+		t.Errorf("expected only the concatenated keys to collide")
+	}
+	if LMapKey(x) != LMapKey(&testPair{"a,b", "c"}) {
+		t.Errorf("expected a pointer's key to be its value's")
+	}
+
+	defer func() {
+		if recover() == nil {
+			t.Errorf("expected decoding a mismatched key to panic")
+		}
+	}()
+	LMapKeyOf[testTermIndex]("nope")
+}
+
+func TestEmbed(t *testing.T) {
+	d := NewD("a")
+	x, y := TallyInit(NewD("a"), ""), TallyInit(NewD("a"), "")
+	d.Embed(x, "x/")
+	d.Embed(y, "y/")
+	if d.Relations["x/TallyDone"] != x.Relations["TallyDone"] ||
+		d.Relations["y/TallyDone"] == nil {
+		t.Fatalf("expected relations to move under prefixes, got: %v", d.Relations)
+	}
+	d.Relations["x/TallyNeed"].DirectAdd(1)
+	d.Relations["y/TallyNeed"].DirectAdd(2)
+
+	d.AddNext(d.Relations["x/TallyVote"], "v0")
+	d.AddNext(d.Relations["y/TallyVote"], "v0")
+	d.Tick()
+	if !d.Relations["x/TallyDone"].(*LBool).Bool() ||
+		d.Relations["y/TallyDone"].(*LBool).Bool() {
+		t.Errorf("expected only x to be done")
+	}
+	d.AddNext(d.Relations["y/TallyVote"], "v1")
+	d.Tick()
+	if d.Relations["x/TallyDone"].(*LBool).Bool() != true ||
+		!d.Relations["y/TallyDone"].(*LBool).Bool() {
+		t.Errorf("expected y to be done too")
+	}
+	if d.Relations["x/tallyTotal"].(*LSet).Size() != 1 {
+		t.Errorf("expected x's votes to be independent of y's")
+	}
+
+	// Raft's join funcs use the sub D that they were declared with.
+	r := RaftInit(NewD("a"), "", nil)
+	r.Relations["raftMember"].(*LSet).DirectAdd("a")
+	d.Embed(r, "r/")
+	d.AddNext(d.Relations["r/raftAlarm"], true)
+	for i := 0; i < 3; i++ {
+		d.Tick()
+	}
+	if s := d.Relations["r/raftCurState"].(*LMaxBy).Value().(raftState); s.Kind != state_LEADER {
+		t.Errorf("expected embedded single node raft to lead, got: %d", s)
+	}
+
+	for _, f := range []func(){
+		func() { d.Embed(x, "z/") },
+		func() { x.Tick() },
+		func() { d.Embed(TallyInit(NewD("a"), ""), "x/") },
+	} {
+		func() {
+			defer func() {
+				if recover() == nil {
+					t.Errorf("expected panic on reuse of an embedded sub")
+				}
+			}()
+			f()
+		}()
+	}
+}
+
+func TestEmbedHostSettings(t *testing.T) {
+	d := NewD("a")
+	sub := NewD("a")
+	src := sub.DeclareLSet("src", "")
+	copied := sub.DeclareLSet("copied", "")
+	sub.Join(src).Name("copy").Into(copied)
+	var exp []string
+	for i := 0; i < 20; i++ {
+		exp = append(exp, fmt.Sprintf("x%02d", i))
+		src.DirectAdd(exp[i])
+	}
+	d.Embed(sub, "s/")
+	d.SortedScan = true
+	d.CollectErrors()
+
+	var got []string
+	for x := range src.Scan() {
+		got = append(got, x.(string))
+	}
+	if !reflect.DeepEqual(got, exp) {
+		t.Errorf("expected the host's sorted scans, got: %v", got)
+	}
+	sub.DisableJoin("copy")
+	sub.DisableJoin("nope")
+	d.Tick()
+	if copied.Size() != 0 {
+		t.Errorf("expected the embedded join disabled, got: %v", copied.m)
+	}
+	if errs := sub.Errors(); len(errs) != 1 || len(d.Errors()) != 1 ||
+		!strings.Contains(errs[0].Error(), "no join labeled: nope") {
+		t.Errorf("expected the host to collect the error, got: %v", errs)
+	}
+}
+
+func TestRelationValue(t *testing.T) {
+	d := NewD("a")
+	lmax := d.DeclareLMax("lmax")
+	lmax.DirectAdd(3)
+	lmaxs := d.DeclareLMaxString("lmaxs")
+	lmaxs.DirectAdd("s")
+	lbool := d.DeclareLBool("lbool")
+	lbool.DirectAdd(true)
+	lmaxf := d.DeclareLMaxFloat("lmaxf")
+	lmaxf.DirectAdd(1.5)
+	gc := d.DeclareGCounter("gc")
+	gc.Inc("a", 2)
+	pn := d.DeclarePNCounter("pn")
+	pn.Inc("a", 5)
+	pn.Dec("b", 1)
+	lww := d.DeclareLWWReg("lww")
+	lww.Set(1, "w")
+	lset := d.DeclareLSet("lset", "")
+	lset.DirectAdd("y")
+	lset.DirectAdd("x")
+	lmap := d.DeclareLMap("lmap")
+	lmap.DirectAdd(&LMapEntry{"k", NewLMax(d, 7)})
+	lmap.DirectAdd(&LMapEntry{"j", NewLSetOne(d, "z")})
+	mv := d.DeclareMVReg("mv")
+	mv.Set("a", NewLMax(d, 1))
+	ring := d.DeclareLRing("ring", testRingEntry{}, 2, "Index")
+	ring.DirectAdd(&testRingEntry{2, "b"})
+	ring.DirectAdd(&testRingEntry{1, "a"})
+
+	for _, c := range []struct {
+		r   Relation
+		exp interface{}
+	}{
+		{lmax, 3},
+		{lmaxs, "s"},
+		{lbool, true},
+		{lmaxf, 1.5},
+		{gc, 2},
+		{pn, 4},
+		{lww, "w"},
+		{lset, []interface{}{"x", "y"}},
+		{lmap, map[string]interface{}{"k": 7, "j": []interface{}{"z"}}},
+		{mv, []interface{}{1}},
+		{ring, []interface{}{&testRingEntry{1, "a"}, &testRingEntry{2, "b"}}},
+		{lset.Filter(func(x interface{}) bool { return x == "y" }), []interface{}{"y"}},
+	} {
+		if got := RelationValue(c.r); !reflect.DeepEqual(got, c.exp) {
+			t.Errorf("expected %T value: %#v, got: %#v", c.r, c.exp, got)
+		}
+	}
+}
+
 func TestMultiTally(t *testing.T) {
 	d := MultiTallyInit(NewD("multiTallyTest"), "")
 
@@ -122,48 +514,5707 @@ func TestMultiTally(t *testing.T) {
 	}
 }
 
+func TestJoinFlat(t *testing.T) {
+	d := NewD("a")
+	votes := d.DeclareLSet("votes", MultiTallyVote{})
+	total := d.DeclareLMapOf("total", func() Lattice { return d.NewLSet(reflect.TypeOf("")) })
+	names := d.DeclareLSet("names", "")
+
+	// Like multiTallyTotal, but merging a whole LMap per vote.
+	d.JoinFlat(votes, func(v *MultiTallyVote) *LMap {
+		m := d.NewLMap()
+		m.DirectAdd(&LMapEntry{v.Race, NewLSetOne(d, v.Voter)})
+		return m
+	}).Into(total)
+	d.JoinFlat(votes, func(v *MultiTallyVote) []*LSet {
+		return []*LSet{NewLSetOne(d, v.Race), NewLSetOne(d, v.Voter), nil}
+	}).Into(names)
+
+	votes.DirectAdd(&MultiTallyVote{"A", "a0"})
+	votes.DirectAdd(&MultiTallyVote{"A", "a1"})
+	votes.DirectAdd(&MultiTallyVote{"B", "b0"})
+	d.Tick()
+	a, _ := total.AtLSet("A")
+	b, _ := total.AtLSet("B")
+	if a.Size() != 2 || !a.Contains("a1") || b.Size() != 1 || !b.Contains("b0") {
+		t.Errorf("expected voters accumulated by race, got: %v", RelationValue(total))
+	}
+	if names.Size() != 5 || !names.Contains("B") || !names.Contains("a0") {
+		t.Errorf("expected each of the merged relations, got: %v", RelationValue(names))
+	}
+
+	d = NewD("a")
+	d.CollectErrors()
+	src := d.DeclareLSet("src", 0)
+	strs := d.DeclareLSet("strs", "")
+	d.JoinFlat(src, func(x *int) *LMax { return nil }).Into(strs)
+	d.JoinFlat(src).Into(strs)
+	d.JoinFlat(src, func(x *int) *LSet { return NewLSetOne(d, *x) }).Into(strs)
+	src.DirectAdd(1)
+	d.Tick()
+	errs := d.Errors()
+	if len(errs) != 3 || strs.Size() != 0 ||
+		!strings.Contains(errs[0].Error(), "*gdec.LMax") ||
+		!strings.Contains(errs[1].Error(), "needs a selectWhereFunc") ||
+		!strings.Contains(errs[2].Error(), "tuple type: int") {
+		t.Errorf("expected JoinFlat() misuse to be reported, got: %v", errs)
+	}
+}
+
 func TestShortestPath(t *testing.T) {
 	d := ShortestPathInit(NewD(""), "")
 	links := d.Relations["ShortestPathLink"].(*LSet)
-	paths := d.Relations["ShortestPath"].(*LSet)
+	paths := d.Relations["ShortestPath"].(*LMap)
 
 	links.DirectAdd(&ShortestPathLink{From: "a", To: "b", Cost: 10})
 	links.DirectAdd(&ShortestPathLink{From: "b", To: "c", Cost: 10})
 	if links.Size() != 2 {
 		t.Errorf("expected 2 links, got: %v", links.Size())
 	}
-	if paths.Size() != 0 {
-		t.Errorf("expected 0 links, got: %v", paths.Size())
+	if paths.Len() != 0 {
+		t.Errorf("expected 0 paths, got: %v", paths.Len())
 	}
 
 	d.Tick()
 	if d.ticks != 1 {
 		t.Errorf("expected 1 ticks, got: %v", d.ticks)
 	}
-	if paths.Size() != 3 {
-		t.Errorf("expected 3 links, got: %v, paths: %#v", paths.Size(), paths.m)
+	if paths.Len() != 3 {
+		t.Errorf("expected 3 paths, got: %v, paths: %v", paths.Len(), paths.Keys())
+	}
+	if p := ShortestPathGet(d, "", "a", "c"); p == nil ||
+		*p != (ShortestPath{From: "a", To: "c", Next: "b", Cost: 20}) {
+		t.Errorf("expected path a->c via b, got: %#v", p)
+	}
+
+	d = ShortestPathInit(NewD(""), "")
+	links = d.Relations["ShortestPathLink"].(*LSet)
+	paths = d.Relations["ShortestPath"].(*LMap)
+	links.DirectAdd(&ShortestPathLink{From: "a", To: "b", Cost: 10})
+	links.DirectAdd(&ShortestPathLink{From: "b", To: "c", Cost: 10})
+	links.DirectAdd(&ShortestPathLink{From: "a", To: "b", Cost: 1})
+	d.Tick()
+	if paths.Len() != 3 {
+		t.Errorf("expected 3 paths, got: %v, paths: %v", paths.Len(), paths.Keys())
+	}
+	if p := ShortestPathGet(d, "", "a", "c"); p == nil || p.Cost != 11 {
+		t.Errorf("expected a->c at cost 11, got: %#v", p)
+	}
+	if p := ShortestPathGet(d, "", "a", "b"); p == nil || p.Cost != 1 {
+		t.Errorf("expected a->b at cost 1, got: %#v", p)
 	}
-	if !paths.Contains(&ShortestPath{From: "a", To: "c", Next: "b", Cost: 20}) {
-		t.Errorf("expected paths to contain a->b")
+
+	b, err := d.MarshalState()
+	if err != nil {
+		t.Fatalf("expected paths to marshal, err: %v", err)
+	}
+	d2 := ShortestPathInit(NewD(""), "")
+	if err = d2.UnmarshalState(b); err != nil {
+		t.Fatalf("expected paths to unmarshal, err: %v", err)
+	}
+	if b2, err := d2.MarshalState(); err != nil || string(b) != string(b2) {
+		t.Errorf("expected round trip to match, err: %v\n%s\n%s", err, b, b2)
+	}
+	if p := ShortestPathGet(d2, "", "a", "c"); p == nil || p.Cost != 11 {
+		t.Errorf("expected a->c restored at cost 11, got: %#v", p)
+	}
+	d2.AddNext(d2.Relations["ShortestPathLink"], &ShortestPathLink{From: "a", To: "c", Cost: 5})
+	d2.Tick()
+	if p := ShortestPathGet(d2, "", "a", "c"); p == nil || p.Cost != 5 {
+		t.Errorf("expected a restored path to be improved on, got: %#v", p)
 	}
 
+	// Node names that hold a comma don't collide.
 	d = ShortestPathInit(NewD(""), "")
 	links = d.Relations["ShortestPathLink"].(*LSet)
-	paths = d.Relations["ShortestPath"].(*LSet)
+	links.DirectAdd(&ShortestPathLink{From: "a,b", To: "c", Cost: 1})
+	links.DirectAdd(&ShortestPathLink{From: "a", To: "b,c", Cost: 2})
+	d.Tick()
+	if p := ShortestPathGet(d, "", "a,b", "c"); p == nil || p.Cost != 1 {
+		t.Errorf("expected a,b->c at cost 1, got: %#v", p)
+	}
+	if p := ShortestPathGet(d, "", "a", "b,c"); p == nil || p.Cost != 2 {
+		t.Errorf("expected a->b,c at cost 2, got: %#v", p)
+	}
+	if ps := ShortestPaths(d, ""); len(ps) != 2 || ps[0].From != "a" {
+		t.Errorf("expected both paths, ordered by From, got: %+v", ps)
+	}
+}
+
+func TestQuery(t *testing.T) {
+	d := ShortestPathInit(NewD(""), "")
+	d.AddNext(d.Relations["ShortestPathLink"], &ShortestPathLink{From: "a", To: "b", Cost: 10})
+	d.AddNext(d.Relations["ShortestPathLink"], &ShortestPathLink{From: "b", To: "c", Cost: 10})
+	d.AddNext(d.Relations["ShortestPathLink"], &ShortestPathLink{From: "a", To: "b", Cost: 1})
+	d.Tick()
+	if n := len(d.Query("ShortestPath")); n != 3 {
+		t.Errorf("expected 3 paths, got: %v, paths: %+v", n, d.Query("ShortestPath"))
+	}
+	if !d.Has("ShortestPathLink", ShortestPathLink{From: "a", To: "b", Cost: 1}) ||
+		d.Has("ShortestPathLink", ShortestPathLink{From: "a", To: "c", Cost: 1}) {
+		t.Errorf("expected links queried by value, got: %+v", d.Query("ShortestPathLink"))
+	}
+	exp := []ShortestPath{
+		{From: "a", To: "b", Cost: 1},
+		{From: "a", To: "c", Next: "b", Cost: 11},
+		{From: "b", To: "c", Cost: 10},
+	}
+	if got := QueryOf[ShortestPath](d, "ShortestPath"); !reflect.DeepEqual(got, exp) {
+		t.Errorf("expected paths: %+v, got: %+v", exp, got)
+	}
+	var viaGet []ShortestPath
+	for _, p := range ShortestPaths(d, "") {
+		viaGet = append(viaGet, *p)
+	}
+	if !reflect.DeepEqual(viaGet, exp) {
+		t.Errorf("expected queries to match ShortestPaths(), got: %+v", viaGet)
+	}
+	if d.Has("ShortestPath", ShortestPath{From: "a", To: "b", Cost: 10}) {
+		t.Errorf("expected the worse a->b path absent")
+	}
+	if len(QueryOf[ShortestPathLink](d, "ShortestPath")) != 0 {
+		t.Errorf("expected tuples of other types skipped")
+	}
+}
+
+func TestShortestPathWith(t *testing.T) {
+	graph := func(d *D) {
+		links := d.Relations["ShortestPathLink"].(*LSet)
+		links.DirectAdd(&ShortestPathLink{From: "a", To: "b", Cost: 10})
+		links.DirectAdd(&ShortestPathLink{From: "b", To: "c", Cost: 10})
+		links.DirectAdd(&ShortestPathLink{From: "a", To: "b", Cost: 1})
+		links.DirectAdd(&ShortestPathLink{From: "a", To: "c", Cost: 3})
+		links.DirectAdd(&ShortestPathLink{From: "c", To: "a", Cost: 2}) // Cycle.
+	}
+
+	shortest := ShortestPathInit(NewD(""), "")
+	graph(shortest)
+	shortest.Tick()
+	if p := ShortestPathGet(shortest, "", "a", "c"); p == nil ||
+		*p != (ShortestPath{From: "a", To: "c", Cost: 3}) {
+		t.Errorf("expected direct a->c to be shortest, got: %#v", p)
+	}
+	if p := ShortestPathGet(shortest, "", "b", "a"); p == nil || p.Cost != 12 {
+		t.Errorf("expected b->a at cost 12, got: %#v", p)
+	}
+
+	// Widest path, where a path is as wide as its narrowest link.
+	widest := ShortestPathInitWith(NewD(""), "",
+		func(a, b int) int {
+			if a < b {
+				return a
+			}
+			return b
+		},
+		func(a, b int) bool { return a > b })
+	graph(widest)
+	widest.Tick()
+	if p := ShortestPathGet(widest, "", "a", "c"); p == nil ||
+		*p != (ShortestPath{From: "a", To: "c", Next: "b", Cost: 10}) {
+		t.Errorf("expected a->c via b to be widest, got: %#v", p)
+	}
+	if p := ShortestPathGet(widest, "", "b", "a"); p == nil || p.Cost != 2 {
+		t.Errorf("expected b->a width of 2, got: %#v", p)
+	}
+	if ShortestPathGet(widest, "", "c", "d") != nil {
+		t.Errorf("expected no path to an unknown node")
+	}
+}
+
+func TestShortestPathOnlyOptimal(t *testing.T) {
+	d := ShortestPathInit(NewD(""), "")
+	links := d.Relations["ShortestPathLink"].(*LSet)
 	links.DirectAdd(&ShortestPathLink{From: "a", To: "b", Cost: 10})
 	links.DirectAdd(&ShortestPathLink{From: "b", To: "c", Cost: 10})
 	links.DirectAdd(&ShortestPathLink{From: "a", To: "b", Cost: 1})
+	if !d.RunUntilQuiescent(10) {
+		t.Fatalf("expected convergence")
+	}
+
+	var ac []ShortestPath
+	for _, p := range ShortestPaths(d, "") {
+		if p.From == "a" && p.To == "c" {
+			ac = append(ac, *p)
+		}
+	}
+	if fmt.Sprintf("%v", ac) != "[{a c b 11}]" {
+		t.Errorf("expected only the cost 11 a->c path, got: %v", ac)
+	}
+
+	// A dense, cyclic graph stays bounded by the number of node pairs.
+	d = ShortestPathInit(NewD(""), "")
+	links = d.Relations["ShortestPathLink"].(*LSet)
+	nodes := []string{"a", "b", "c", "d"}
+	for i, from := range nodes {
+		for j, to := range nodes {
+			links.DirectAdd(&ShortestPathLink{From: from, To: to, Cost: 1 + (i+j)%3})
+		}
+	}
+	if !d.RunUntilQuiescent(10) {
+		t.Fatalf("expected convergence on a cyclic graph")
+	}
+	if n := len(ShortestPaths(d, "")); n != len(nodes)*len(nodes) {
+		t.Errorf("expected a path per node pair, got: %d", n)
+	}
+}
+
+func TestShortestPathCycles(t *testing.T) {
+	d := ShortestPathInit(NewD(""), "")
+	links := d.Relations["ShortestPathLink"].(*LSet)
+	negCycle := d.Relations["ShortestPathNegativeCycle"].(*LSet)
+	links.DirectAdd(&ShortestPathLink{From: "a", To: "b", Cost: 1})
+	links.DirectAdd(&ShortestPathLink{From: "b", To: "c", Cost: 1})
+	links.DirectAdd(&ShortestPathLink{From: "c", To: "a", Cost: 1})
+	if !d.RunUntilQuiescent(10) {
+		t.Fatalf("expected a benign cycle to terminate")
+	}
+	if p := ShortestPathGet(d, "", "a", "a"); p == nil || p.Cost != 3 {
+		t.Errorf("expected a->a around the cycle at cost 3, got: %#v", p)
+	}
+	if negCycle.Size() != 0 {
+		t.Errorf("expected no negative cycle, got: %v", negCycle.m)
+	}
+
+	d = ShortestPathInit(NewD(""), "")
+	links = d.Relations["ShortestPathLink"].(*LSet)
+	negCycle = d.Relations["ShortestPathNegativeCycle"].(*LSet)
+	links.DirectAdd(&ShortestPathLink{From: "a", To: "b", Cost: 1})
+	links.DirectAdd(&ShortestPathLink{From: "b", To: "c", Cost: -3})
+	links.DirectAdd(&ShortestPathLink{From: "c", To: "a", Cost: 1})
+	links.DirectAdd(&ShortestPathLink{From: "c", To: "d", Cost: 1})
+	links.DirectAdd(&ShortestPathLink{From: "d", To: "d", Cost: -1})
+	if !d.RunUntilQuiescent(10) {
+		t.Fatalf("expected a negative cycle to terminate")
+	}
+	for _, n := range []string{"a", "b", "c", "d"} {
+		if !negCycle.Contains(n) {
+			t.Errorf("expected %s in a negative cycle, got: %v", n, negCycle.m)
+		}
+	}
+	if negCycle.Size() != 4 {
+		t.Errorf("expected only cycle nodes, got: %v", negCycle.m)
+	}
+	if p := ShortestPathGet(d, "", "a", "d"); p == nil || p.Cost != -1 {
+		t.Errorf("expected simple a->d path at cost -1, got: %#v", p)
+	}
+}
+
+type testMsg struct {
+	To   string
+	Body string
+}
+
+func TestChannel(t *testing.T) {
+	d := NewD("a")
+	src := d.DeclareLSet("src", testMsg{})
+	out := d.DeclareChannel("out", testMsg{})
+	seen := d.DeclareLSet("seen", testMsg{})
+
+	d.Join(src).IntoAsync(out)
+	d.Join(out).Into(seen)
+
+	src.DirectAdd(&testMsg{"b", "hi"})
+	d.Tick()
+	if out.Size() != 0 {
+		t.Errorf("expected channel to be empty in the sending tick")
+	}
+	if seen.Size() != 0 {
+		t.Errorf("expected no tuples seen in the sending tick")
+	}
+	msgs := out.Drain()
+	if len(msgs) != 1 || msgs[0].(*testMsg).Body != "hi" {
+		t.Errorf("expected 1 drainable msg, got: %#v", msgs)
+	}
+	if len(out.Drain()) != 0 {
+		t.Errorf("expected drain to clear the outbox")
+	}
+
+	d.Tick()
+	if out.Size() != 0 {
+		t.Errorf("expected drained tuples to not loop back")
+	}
+	out.Drain()
+
+	d = NewD("a")
+	src = d.DeclareLSet("src", testMsg{})
+	out = d.DeclareChannel("out", testMsg{})
+	seen = d.DeclareLSet("seen", testMsg{})
+	d.Join(src).IntoAsync(out)
+	d.Join(out).Into(seen)
+
+	src.DirectAdd(&testMsg{"a", "hi"})
+	d.Tick()
+	d.Tick()
+	if !seen.Contains(&testMsg{"a", "hi"}) {
+		t.Errorf("expected undrained tuple to be seen on the next tick")
+	}
+	if out.Size() != 1 {
+		t.Errorf("expected channel to hold previous tick's tuple")
+	}
+}
+
+// Records the order of sends.
+type sendOrder struct {
+	sent []string
+}
+
+func (s *sendOrder) Send(to, relName string, tuple interface{}) error {
+	s.sent = append(s.sent, fmt.Sprintf("%s %s", relName, tuple.(*testMsg).Body))
+	return nil
+}
+
+func TestChannelSendOrder(t *testing.T) {
+	var first []string
+	for run := 0; run < 5; run++ {
+		d := NewD("a")
+		s := &sendOrder{}
+		d.SetTransport(s)
+		var names []string
+		for i := 0; i < 10; i++ {
+			names = append(names, fmt.Sprintf("c%d", i))
+			d.DeclareChannel(names[i], testMsg{})
+		}
+		d.Join(func() {
+			if d.Ticks() > 0 {
+				return
+			}
+			for i := len(names) - 1; i >= 0; i-- {
+				d.AddNext(d.Relations[names[i]], &testMsg{"b", "x"})
+			}
+			batch := d.NewLSet(reflect.TypeOf(testMsg{}))
+			for _, body := range []string{"q", "p", "s", "r"} {
+				batch.DirectAdd(&testMsg{"b", body})
+			}
+			d.MergeNext(d.Relations["c0"], batch)
+		})
+		d.Tick()
+		if run == 0 {
+			first = s.sent
+			if len(first) != 14 || first[0] != "c0 x" || first[len(first)-1] != "c9 x" {
+				t.Errorf("expected sends ordered by channel, got: %v", first)
+			}
+		} else if !reflect.DeepEqual(s.sent, first) {
+			t.Errorf("expected the same send order on every run, got: %v, first: %v",
+				s.sent, first)
+		}
+	}
+}
+
+func newRaftCluster(tr *MemTransport, addrs ...string) map[string]*D {
+	ds := map[string]*D{}
+	for _, a := range addrs {
+		d := RaftInit(NewD(a), "", nil)
+		tr.Register(d)
+		for _, m := range addrs {
+			d.Relations["raftMember"].(*LSet).DirectAdd(m)
+		}
+		ds[a] = d
+	}
+	return ds
+}
+
+func TestSeed(t *testing.T) {
+	d := RaftInit(NewD("a"), "", nil)
+	members := d.Seed(d.Relations["raftMember"], "a", "b", "c").(*LSet)
+	if members.Size() != 3 {
+		t.Errorf("expected members seeded before the first tick, got: %v", members.m)
+	}
 	d.Tick()
-	if paths.Size() != 5 {
-		t.Errorf("expected 5 links, got: %v, paths: %#v", paths.Size(), paths.m)
+	need := d.Relations["tallyLeader/MultiTallyNeed"].(*LMax)
+	if d.Ticks() != 1 || members.Size() != 3 || need.Int() != 2 {
+		t.Errorf("expected seeded members seen on tick 0, got need: %d", need.Int())
+	}
+
+	config := d.Scratch(d.DeclareLSet("config", "kv")).(*LSet)
+	d.Seed(config, "x=1")
+	seen := d.DeclareLMax("seen")
+	d.Join(config, func(kv *string) int { return int(d.Ticks()) }).Into(seen)
+	for i := 0; i < 3; i++ {
+		d.Tick()
+		if config.Size() != 1 || !config.Contains("x=1") || seen.Int() != int(d.Ticks())-1 {
+			t.Errorf("expected scratch seeds on every tick, got: %v, seen: %d",
+				config.m, seen.Int())
+		}
+	}
+}
+
+func TestMemTransportRaftVoteReq(t *testing.T) {
+	tr := NewMemTransport()
+	addrs := []string{"a", "b", "c"}
+	ds := newRaftCluster(tr, addrs...)
+
+	ds["a"].AddNext(ds["a"].Relations["raftAlarm"], true)
+	got := map[string]bool{}
+	for i := 0; i < 5; i++ { // A majority of votes takes a few rounds.
+		for _, a := range addrs {
+			ds[a].AddNext(ds[a].Relations["raftHeartbeat"], true)
+			ds[a].Tick()
+			for x := range ds[a].Relations["RaftVoteReq"].Scan() {
+				r := x.(*RaftVoteReq)
+				if r.To != a {
+					t.Errorf("vote req delivered to wrong node: %s, %#v", a, r)
+				}
+				got[r.From+"->"+r.To] = true
+			}
+		}
+	}
+	if !got["a->b"] || !got["a->c"] {
+		t.Errorf("expected vote reqs from a to cross to b and c, got: %v", got)
+	}
+	if ds["a"].Relations["raftCurState"].(*LMaxBy).Value().(raftState).Kind != state_LEADER {
+		t.Errorf("expected a to become leader")
+	}
+}
+
+func TestMemTransportUnknownRel(t *testing.T) {
+	tr := NewMemTransport()
+	d := NewD("a")
+	tr.Register(d)
+	if tr.Send("a", "nope", &testMsg{"a", "x"}) == nil {
+		t.Errorf("expected error for unknown relation")
+	}
+	if tr.Send("z", "nope", &testMsg{"z", "x"}) == nil {
+		t.Errorf("expected error for unknown destAddr")
+	}
+}
+
+func TestMemTransportReachableDelay(t *testing.T) {
+	tr := NewMemTransport()
+	ds := map[string]*D{}
+	seen := map[string]*LSet{}
+	for _, a := range []string{"a", "b"} {
+		d := NewD(a)
+		src := d.Scratch(d.DeclareLSet("src", testMsg{}))
+		ch := d.DeclareChannel("ch", testMsg{})
+		seen[a] = d.DeclareLSet("seen", testMsg{})
+		d.Join(src).IntoAsync(ch)
+		d.Join(ch).Into(seen[a])
+		tr.Register(d)
+		ds[a] = d
+	}
+	send := func(body string) {
+		ds["a"].AddNext(ds["a"].Relations["src"], &testMsg{"b", body})
+		ds["a"].Tick()
+	}
+
+	tr.SetReachable("a", "b", false)
+	send("dropped")
+	tr.SetReachable("a", "b", true)
+	send("ok")
+	ds["b"].Tick()
+	if seen["b"].Size() != 1 || !seen["b"].Contains(&testMsg{"b", "ok"}) {
+		t.Errorf("expected only the reachable msg, got: %v", seen["b"].m)
 	}
-	if !paths.Contains(&ShortestPath{From: "a", To: "c", Next: "b", Cost: 20}) {
-		t.Errorf("expected paths to contain a->b")
+
+	tr.AddDelay("a", "b", 2)
+	send("late")
+	for i := 0; i < 3; i++ {
+		if seen["b"].Contains(&testMsg{"b", "late"}) {
+			t.Errorf("expected delayed msg to not show up at tick: %d", i)
+		}
+		ds["b"].Tick()
+	}
+	if !seen["b"].Contains(&testMsg{"b", "late"}) {
+		t.Errorf("expected delayed msg to show up 2 ticks later")
+	}
+}
+
+func TestMemTransportRaftPartitionHeal(t *testing.T) {
+	tr := NewMemTransport()
+	addrs := []string{"a", "b", "c", "d", "e"}
+	ds := newRaftCluster(tr, addrs...)
+	c := &fakeClock{now: time.Unix(1000, 0)}
+	for i, a := range addrs {
+		ds[a].Now = c.Now
+		ds[a].Rand = rand.New(rand.NewSource(int64(i)))
+	}
+	leaders := map[int]string{} // Key: term.
+	leaderOf := func(a string) (bool, int) {
+		s := ds[a].Relations["raftCurState"].(*LMaxBy).Value().(raftState)
+		return s.Kind == state_LEADER,
+			ds[a].Relations["raftCurTerm"].(*LMax).Int()
+	}
+	rounds := func(n int) {
+		for i := 0; i < n; i++ {
+			c.Advance(RaftHeartbeatPeriod)
+			for _, a := range addrs {
+				ds[a].Tick()
+			}
+			for _, a := range addrs {
+				if isLeader, term := leaderOf(a); isLeader {
+					if x, ok := leaders[term]; ok && x != a {
+						t.Fatalf("expected one leader per term: %d, got: %s and %s",
+							term, x, a)
+					}
+					leaders[term] = a
+				}
+			}
+		}
+	}
+	partition := func(group []string, ok bool) {
+		for _, a := range group {
+			for _, b := range addrs {
+				tr.SetReachable(a, b, ok)
+				tr.SetReachable(b, a, ok)
+			}
+		}
+	}
+
+	ds["a"].AddNext(ds["a"].Relations["raftAlarm"], true)
+	rounds(10)
+	if isLeader, _ := leaderOf("a"); !isLeader {
+		t.Fatalf("expected a to lead")
+	}
+
+	partition([]string{"a", "b"}, false)
+	rounds(20)
+	newLeader, newTerm := "", 0
+	for _, a := range []string{"c", "d", "e"} {
+		if isLeader, term := leaderOf(a); isLeader {
+			newLeader, newTerm = a, term
+		}
+	}
+	if newLeader == "" || newTerm <= 1 {
+		t.Fatalf("expected a new leader in the majority, got: %q", newLeader)
+	}
+	if isLeader, _ := leaderOf("a"); !isLeader {
+		t.Errorf("expected partitioned a to still think it leads")
+	}
+
+	partition([]string{"a", "b"}, true)
+	rounds(20)
+	for _, a := range []string{"a", "b"} {
+		if isLeader, term := leaderOf(a); isLeader || term < newTerm {
+			t.Errorf("expected %s to step down and catch up to term: %d, got: %d",
+				a, newTerm, term)
+		}
 	}
-	if !paths.Contains(&ShortestPath{From: "a", To: "c", Next: "b", Cost: 11}) {
-		t.Errorf("expected paths to contain a->b")
+}
+
+func TestTCPTransport(t *testing.T) {
+	tr := NewTCPTransport(map[string]string{
+		"a": "127.0.0.1:0",
+		"b": "127.0.0.1:0",
+	})
+	defer tr.Close()
+
+	ds := map[string]*D{}
+	for _, addr := range []string{"a", "b"} {
+		d := RaftProtocolInit(NewD(addr), "")
+		src := d.DeclareLSet("src", RaftAddEntryReq{})
+		d.Join(src).IntoAsync(d.Relations["RaftAddEntryReq"])
+		if err := tr.Listen(d); err != nil {
+			t.Fatalf("expected listen to work, err: %v", err)
+		}
+		ds[addr] = d
+	}
+	if tr.Addr("a") == "127.0.0.1:0" {
+		t.Errorf("expected registry to record the real port")
+	}
+
+	ds["a"].Relations["src"].DirectAdd(&RaftAddEntryReq{To: "b", From: "a",
+		Term: 1, Entries: []RaftEntry{{Term: 1, Index: 1, Entry: "x"}}})
+	ds["b"].Relations["src"].DirectAdd(&RaftAddEntryReq{To: "a", From: "b",
+		Term: 2, Entries: []RaftEntry{{Term: 2, Index: 1, Entry: "y"}}})
+	ds["a"].Tick()
+	ds["b"].Tick()
+
+	for _, c := range []struct{ addr, from, entry string }{
+		{"a", "b", "y"},
+		{"b", "a", "x"},
+	} {
+		var got *RaftAddEntryReq
+		deadline := time.Now().Add(5 * time.Second)
+		for got == nil && time.Now().Before(deadline) {
+			time.Sleep(10 * time.Millisecond)
+			ds[c.addr].Tick()
+			for x := range ds[c.addr].Relations["RaftAddEntryReq"].Scan() {
+				if r := x.(*RaftAddEntryReq); r.From == c.from {
+					got = r
+				}
+			}
+		}
+		if got == nil || len(got.Entries) != 1 || got.Entries[0].Entry != c.entry ||
+			got.To != c.addr {
+			t.Errorf("expected %s to receive from %s, got: %#v",
+				c.addr, c.from, got)
+		}
+	}
+}
+
+func TestTCPTransportCodecs(t *testing.T) {
+	for _, codec := range []Codec{GobCodec{}, JSONCodec{}} {
+		tr := NewTCPTransportCodec(map[string]string{
+			"a": "127.0.0.1:0",
+			"b": "127.0.0.1:0",
+		}, codec)
+		ds := map[string]*D{}
+		for _, addr := range []string{"a", "b"} {
+			d := RaftProtocolInit(NewD(addr), "")
+			if err := tr.Listen(d); err != nil {
+				t.Fatalf("expected listen to work, err: %v", err)
+			}
+			ds[addr] = d
+		}
+		exp := RaftVoteReq{To: "b", From: "a", Term: 3,
+			LastLogTerm: 2, LastLogIndex: 7, PreVote: true}
+		x := exp
+		if err := tr.Send("b", "RaftVoteReq", &x); err != nil {
+			t.Fatalf("expected send to work, codec: %T, err: %v", codec, err)
+		}
+		var got *RaftVoteReq
+		deadline := time.Now().Add(5 * time.Second)
+		for got == nil && time.Now().Before(deadline) {
+			time.Sleep(10 * time.Millisecond)
+			ds["b"].Tick()
+			for x := range ds["b"].Relations["RaftVoteReq"].Scan() {
+				got = x.(*RaftVoteReq)
+			}
+		}
+		if got == nil || *got != exp {
+			t.Errorf("expected round trip, codec: %T, got: %#v", codec, got)
+		}
+		tr.Close()
+	}
+}
+
+func TestTCPTransportUnreachable(t *testing.T) {
+	tr := NewTCPTransport(map[string]string{"z": "127.0.0.1:1"})
+	if tr.Send("z", "RaftAddEntryReq", &RaftAddEntryReq{To: "z"}) == nil {
+		t.Errorf("expected error sending to unreachable node")
+	}
+	if tr.Send("nope", "RaftAddEntryReq", &RaftAddEntryReq{To: "nope"}) == nil {
+		t.Errorf("expected error sending to unknown node")
+	}
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("expected listen to work, err: %v", err)
 	}
-	if paths.Contains(&ShortestPath{From: "a", To: "c", Next: "b", Cost: 1}) {
-		t.Errorf("expected paths to to not contain a->b at the wrong cost")
+	defer ln.Close()
+	tr = NewTCPTransport(map[string]string{"y": ln.Addr().String()})
+	tr.DialTimeout = time.Nanosecond
+	err = tr.Send("y", "RaftAddEntryReq", &RaftAddEntryReq{To: "y"})
+	if ne, ok := err.(net.Error); !ok || !ne.Timeout() {
+		t.Errorf("expected the dial to time out, got: %v", err)
+	}
+}
+
+func TestTCPTransportStalledPeer(t *testing.T) {
+	stalled, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("expected listen to work, err: %v", err)
+	}
+	defer stalled.Close()
+	held := make(chan net.Conn, 10) // Accepted, but never read.
+	go func() {
+		for {
+			c, err := stalled.Accept()
+			if err != nil {
+				return
+			}
+			held <- c
+		}
+	}()
+	defer func() {
+		for len(held) > 0 {
+			(<-held).Close()
+		}
+	}()
+	reading, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("expected listen to work, err: %v", err)
+	}
+	defer reading.Close()
+	go func() {
+		for {
+			c, err := reading.Accept()
+			if err != nil {
+				return
+			}
+			go io.Copy(io.Discard, c)
+		}
+	}()
+
+	tr := NewTCPTransportCodec(map[string]string{
+		"s": stalled.Addr().String(), "r": reading.Addr().String()}, JSONCodec{})
+	defer tr.Close()
+	tr.WriteTimeout = 500 * time.Millisecond
+	big := &testMsg{"s", strings.Repeat("x", 1<<20)}
+	stalledErr := make(chan error)
+	go func() {
+		for {
+			if err := tr.Send("s", "m", big); err != nil {
+				stalledErr <- err
+				return
+			}
+		}
+	}()
+	time.Sleep(100 * time.Millisecond) // Fills the socket buffers.
+
+	start := time.Now()
+	for i := 0; i < 10; i++ {
+		if err := tr.Send("r", "m", &testMsg{"r", "x"}); err != nil {
+			t.Fatalf("expected sends to a reading peer to work, err: %v", err)
+		}
+	}
+	if elapsed := time.Since(start); elapsed > 250*time.Millisecond {
+		t.Errorf("expected sends to a reading peer to not wait on a stalled one"+
+			", took: %v", elapsed)
+	}
+
+	err = <-stalledErr
+	if ne, ok := err.(net.Error); !ok || !ne.Timeout() {
+		t.Errorf("expected the stalled send to time out, got: %v", err)
+	}
+	tr.m.Lock()
+	_, ok := tr.conns[stalled.Addr().String()]
+	tr.m.Unlock()
+	if ok {
+		t.Errorf("expected the stalled connection to be dropped")
+	}
+}
+
+type fakeClock struct {
+	now time.Time
+}
+
+func (c *fakeClock) Now() time.Time { return c.now }
+
+func (c *fakeClock) Advance(dur time.Duration) { c.now = c.now.Add(dur) }
+
+func TestPeriodic(t *testing.T) {
+	c := &fakeClock{now: time.Unix(1000, 0)}
+	d := NewD("a")
+	d.Now = c.Now
+	p := d.DeclarePeriodic("p", 10*time.Second)
+	fired := d.DeclareLMax("fired")
+	d.Join(p, func(p *bool) int {
+		if *p {
+			return int(d.ticks)
+		}
+		return 0
+	}).Into(fired)
+
+	for i, exp := range []struct {
+		advance time.Duration
+		fire    bool
+	}{
+		{0, false},
+		{5 * time.Second, false},
+		{5 * time.Second, true},
+		{0, false},
+		{9 * time.Second, false},
+		{1 * time.Second, true},
+		{25 * time.Second, true},
+		{1 * time.Second, false},
+	} {
+		c.Advance(exp.advance)
+		d.Tick()
+		if p.Bool() != exp.fire {
+			t.Errorf("tick %d: expected periodic fired %v, got %v",
+				i, exp.fire, p.Bool())
+		}
+	}
+	if fired.Int() != 6 {
+		t.Errorf("expected last firing seen by a join on tick 6, got: %v",
+			fired.Int())
+	}
+}
+
+func TestRandomPeriodic(t *testing.T) {
+	c := &fakeClock{now: time.Unix(1000, 0)}
+	d := NewD("a")
+	d.Now = c.Now
+	d.Rand = rand.New(rand.NewSource(1))
+	p := d.DeclareRandomPeriodic("p", 100*time.Millisecond, 200*time.Millisecond)
+
+	periods := map[time.Duration]bool{}
+	for i := 0; i < 20; i++ {
+		d.Tick()
+		last := c.now
+		for !p.Bool() {
+			c.Advance(time.Millisecond)
+			d.Tick()
+		}
+		elapsed := c.now.Sub(last)
+		if elapsed < 100*time.Millisecond || elapsed > 200*time.Millisecond {
+			t.Errorf("expected randomized period in range, got: %v", elapsed)
+		}
+		periods[elapsed] = true
+	}
+	if len(periods) < 2 {
+		t.Errorf("expected periods to be randomized, got: %v", periods)
+	}
+
+	c.Advance(99 * time.Millisecond)
+	d.ResetPeriodic(p) // Re-arms, so the elapsed 99ms no longer counts.
+	c.Advance(99 * time.Millisecond)
+	d.Tick()
+	if p.Bool() {
+		t.Errorf("expected reset periodic to not fire yet")
+	}
+}
+
+func TestRandSeeded(t *testing.T) {
+	run := func(seed int64, embed bool) []string {
+		c := &fakeClock{now: time.Unix(1000, 0)}
+		d := NewD("a")
+		d.Now = c.Now
+		d.Rand = rand.New(rand.NewSource(seed))
+		g, prefix := d, ""
+		if embed {
+			g, prefix = NewD("a"), "g/" // Its own Rand is ignored once embedded.
+		}
+		GossipInit(g, "", g.DeclareLSet("shared", ""), time.Hour, 2)
+		for _, p := range []string{"b", "c", "d", "e", "f"} {
+			g.Relations["GossipPeer"].(*LSet).DirectAdd(p)
+		}
+		if embed {
+			d.Embed(g, prefix)
+		}
+		p := d.DeclareRandomPeriodic("p", 100*time.Millisecond, 200*time.Millisecond)
+		target := d.Relations[prefix+"gossipTarget"]
+		round := d.Relations[prefix+"gossipRound"]
+
+		var choices []string
+		for i := 0; i < 20; i++ {
+			d.AddNext(round, true)
+			c.Advance(10 * time.Millisecond)
+			d.Tick()
+			choices = append(choices, fmt.Sprintf("%v %v", RelationValue(target), p.Bool()))
+		}
+		return choices
+	}
+	a, b := run(42, false), run(42, false)
+	if !reflect.DeepEqual(a, b) {
+		t.Errorf("expected the same seed to make the same choices, got: %v, %v", a, b)
+	}
+	if !reflect.DeepEqual(a, run(42, true)) {
+		t.Errorf("expected an embedded module to use its host's Rand")
+	}
+	if reflect.DeepEqual(a, run(43, false)) {
+		t.Errorf("expected another seed to make other choices")
+	}
+}
+
+func TestRaftElection(t *testing.T) {
+	c := &fakeClock{now: time.Unix(1000, 0)}
+	tr := NewMemTransport()
+	addrs := []string{"a", "b", "c", "d", "e"}
+	ds := newRaftCluster(tr, addrs...)
+	for i, a := range addrs {
+		ds[a].Now = c.Now
+		ds[a].Rand = rand.New(rand.NewSource(int64(i)))
+	}
+
+	leaders := func() (rv []string) {
+		for _, a := range addrs {
+			s := ds[a].Relations["raftCurState"].(*LMaxBy).Value().(raftState)
+			if s.Kind == state_LEADER {
+				rv = append(rv, a)
+			}
+		}
+		return rv
+	}
+
+	var elected []string
+	for i := 0; i < 100 && len(elected) == 0; i++ {
+		c.Advance(10 * time.Millisecond)
+		for _, a := range addrs {
+			ds[a].Tick()
+		}
+		elected = leaders()
+	}
+	if len(elected) != 1 {
+		t.Fatalf("expected exactly one leader, got: %v", elected)
+	}
+
+	// Heartbeats from the leader should keep re-arming the followers'
+	// randomized alarms, so leadership stays stable.
+	for i := 0; i < 100; i++ {
+		c.Advance(10 * time.Millisecond)
+		for _, a := range addrs {
+			ds[a].Tick()
+		}
+		if l := leaders(); len(l) != 1 || l[0] != elected[0] {
+			t.Fatalf("expected stable leader %v, got: %v", elected, l)
+		}
+	}
+}
+
+func TestClusterRaftElection(t *testing.T) {
+	clock := &fakeClock{now: time.Unix(1000, 0)}
+	addrs := []string{"c", "a", "e", "b", "d"}
+	c := NewCluster()
+	for i, a := range addrs {
+		d := RaftInit(NewD(a), "", nil)
+		d.Now = clock.Now
+		d.Rand = rand.New(rand.NewSource(int64(i)))
+		for _, m := range addrs {
+			d.Relations["raftMember"].(*LSet).DirectAdd(m)
+		}
+		c.Add(d)
+	}
+	if c.Nodes[0].Addr != "a" || c.Node("e") == nil || c.Node("x") != nil {
+		t.Errorf("expected nodes ordered by addr")
+	}
+	c.Rand = c.Node("a").Rand // Shake out tick order dependence.
+
+	leaders := func() (rv []string) {
+		for _, d := range c.Nodes {
+			s := d.Relations["raftCurState"].(*LMaxBy).Value().(raftState)
+			if s.Kind == state_LEADER {
+				rv = append(rv, d.Addr)
+			}
+		}
+		return rv
+	}
+	var elected []string
+	for i := 0; i < 100 && len(elected) == 0; i++ {
+		clock.Advance(10 * time.Millisecond)
+		c.Tick()
+		elected = leaders()
+	}
+	if len(elected) != 1 {
+		t.Fatalf("expected exactly one leader, got: %v", elected)
+	}
+	for i := 0; i < 100; i++ {
+		clock.Advance(10 * time.Millisecond)
+		c.Tick()
+		if l := leaders(); len(l) != 1 || l[0] != elected[0] {
+			t.Fatalf("expected stable leader %v, got: %v", elected, l)
+		}
+	}
+}
+
+func TestClusterLockstep(t *testing.T) {
+	// Each node forwards a token to the next, and a token sent on one
+	// round must only arrive on the next, whatever the tick order.
+	for seed := int64(0); seed < 5; seed++ {
+		c := NewCluster()
+		for _, a := range []string{"a", "b", "c"} {
+			d := NewD(a)
+			in := d.DeclareChannel("token", testToken{})
+			got := d.DeclareLMax("got")
+			next := map[string]string{"a": "b", "b": "c", "c": "a"}[a]
+			d.Join(in, func(x *testToken) *testToken {
+				return &testToken{To: next, Hops: x.Hops + 1}
+			}).Into(in)
+			d.Join(in, func(x *testToken) int { return x.Hops }).Into(got)
+			c.Add(d)
+		}
+		c.Rand = rand.New(rand.NewSource(seed))
+		c.Node("a").AddNext(c.Node("a").Relations["token"], &testToken{To: "a"})
+		for i := 0; i < 7; i++ {
+			c.Tick()
+		}
+		hops := RelationValue(c.Node("a").Relations["got"]).(int) // a sees 0, 3 and 6.
+		if hops != 6 {
+			t.Errorf("seed: %d, expected a token hop per round, got: %d", seed, hops)
+		}
+	}
+}
+
+type testToken struct {
+	To   string
+	Hops int
+}
+
+type testLogger struct {
+	m       sync.Mutex
+	min     LogLevel
+	records []string
+}
+
+func (l *testLogger) Enabled(level LogLevel) bool { return level >= l.min }
+
+func (l *testLogger) Log(level LogLevel, msg string, keyvals ...interface{}) {
+	l.m.Lock()
+	l.records = append(l.records, fmt.Sprintf("%s: %s %v", level, msg, keyvals))
+	l.m.Unlock()
+}
+
+func TestLoggerRaftLeader(t *testing.T) {
+	clock := &fakeClock{now: time.Unix(1000, 0)}
+	addrs := []string{"a", "b", "c"}
+	c := NewCluster()
+	loggers := map[string]*testLogger{}
+	for i, a := range addrs {
+		d := RaftInit(NewD(a), "", nil)
+		d.Now = clock.Now
+		d.Rand = rand.New(rand.NewSource(int64(i)))
+		for _, m := range addrs {
+			d.Relations["raftMember"].(*LSet).DirectAdd(m)
+		}
+		loggers[a] = &testLogger{min: LogInfo}
+		d.SetLogger(loggers[a])
+		c.Add(d)
+	}
+	leader := ""
+	for i := 0; i < 100 && leader == ""; i++ {
+		clock.Advance(10 * time.Millisecond)
+		c.Tick()
+		for _, d := range c.Nodes {
+			if d.Relations["raftCurState"].(*LMaxBy).Value().(raftState).Kind == state_LEADER {
+				leader = d.Addr
+			}
+		}
+	}
+	if leader == "" {
+		t.Fatalf("expected a leader")
+	}
+	term := c.Node(leader).Relations["raftCurTerm"].(*LMax).Int()
+	exp := fmt.Sprintf("info: raft became leader [addr %s prefix  term %d]", leader, term)
+	found := false
+	for _, r := range loggers[leader].records {
+		found = found || r == exp
+	}
+	if !found {
+		t.Errorf("expected: %q, got: %q", exp, loggers[leader].records)
+	}
+
+	// Disabled levels don't allocate.
+	d := c.Node(leader)
+	if n := testing.AllocsPerRun(100, func() {
+		if d.LogEnabled(LogDebug) {
+			d.Log(LogDebug, "never", "term", term)
+		}
+	}); n != 0 {
+		t.Errorf("expected no allocations for a disabled level, got: %v", n)
+	}
+	d.SetLogger(nil)
+	d.Log(LogError, "dropped") // No-op without a Logger.
+}
+
+func TestRaftOnTransition(t *testing.T) {
+	clock := &fakeClock{now: time.Unix(1000, 0)}
+	addrs := []string{"a", "b", "c"}
+	c := NewCluster()
+	var transitions []RaftTransition
+	for i, a := range addrs {
+		d := RaftInit(NewD(a), "", nil)
+		d.Now = clock.Now
+		d.Rand = rand.New(rand.NewSource(int64(i)))
+		for _, m := range addrs {
+			d.Seed(d.Relations["raftMember"], m)
+		}
+		RaftOnTransition(d, "", func(tr RaftTransition) {
+			transitions = append(transitions, tr)
+		})
+		c.Add(d)
+	}
+	var leader *RaftTransition
+	for i := 0; i < 100 && leader == nil; i++ {
+		clock.Advance(10 * time.Millisecond)
+		c.Tick()
+		for j := range transitions {
+			if transitions[j].To == "leader" {
+				leader = &transitions[j]
+			}
+		}
+	}
+	if leader == nil {
+		t.Fatalf("expected a leader, got: %#v", transitions)
+	}
+	var seq []string
+	for _, tr := range transitions {
+		if tr.Addr == leader.Addr {
+			seq = append(seq, tr.From+"->"+tr.To)
+		}
+	}
+	exp := []string{"follower->candidate", "candidate->leader"}
+	if !reflect.DeepEqual(seq, exp) {
+		t.Errorf("expected: %v, got: %v", exp, seq)
+	}
+	d := c.Node(leader.Addr)
+	if leader.Term != d.Relations["raftCurTerm"].(*LMax).Int() ||
+		leader.Tick != d.Ticks()-1 {
+		t.Errorf("expected the leader's term and tick, got: %#v", leader)
+	}
+	for _, tr := range transitions {
+		if tr.Addr != leader.Addr && tr.To == "leader" {
+			t.Errorf("expected one leader, got: %#v", tr)
+		}
+	}
+}
+
+func TestRaftTransferLeader(t *testing.T) {
+	clock := &fakeClock{now: time.Unix(1000, 0)}
+	addrs := []string{"a", "b", "c"}
+	c := NewCluster()
+	var transitions []RaftTransition
+	for i, a := range addrs {
+		d := RaftInit(NewD(a), "", nil)
+		d.Now = clock.Now
+		d.Rand = rand.New(rand.NewSource(int64(i)))
+		for _, m := range addrs {
+			d.Seed(d.Relations["raftMember"], m)
+		}
+		RaftOnTransition(d, "", func(tr RaftTransition) {
+			transitions = append(transitions, tr)
+		})
+		c.Add(d)
+	}
+	isLeader := func(d *D) bool {
+		return d.Relations["raftCurState"].(*LMaxBy).Value().(raftState).Kind == state_LEADER
+	}
+	var old *D
+	for i := 0; i < 100 && old == nil; i++ {
+		clock.Advance(10 * time.Millisecond)
+		c.Tick()
+		for _, d := range c.Nodes {
+			if isLeader(d) {
+				old = d
+			}
+		}
+	}
+	if old == nil {
+		t.Fatalf("expected a leader")
+	}
+	for i := 0; i < 10; i++ { // Settle, so followers have heard from it.
+		clock.Advance(10 * time.Millisecond)
+		c.Tick()
+	}
+	target := "a"
+	if old.Addr == target {
+		target = "b"
+	}
+	term := old.Relations["raftCurTerm"].(*LMax).Int()
+	transitions = nil
+
+	RaftTransferLeader(old, "", target)
+	old.AddNext(old.Relations["raftPropose"], "x")
+	start := clock.now
+	for i := 0; i < 100 && !isLeader(c.Node(target)); i++ {
+		clock.Advance(10 * time.Millisecond)
+		c.Tick()
+	}
+	if !isLeader(c.Node(target)) {
+		t.Fatalf("expected %s to take over, got: %#v", target, transitions)
+	}
+	if took := clock.now.Sub(start); took >= RaftElectionTimeoutMin {
+		t.Errorf("expected a transfer quicker than an election timeout, took: %v", took)
+	}
+	if isLeader(old) {
+		t.Errorf("expected the old leader to step down")
+	}
+	for _, tr := range transitions {
+		if tr.To == "leader" && (tr.Addr != target || tr.Term != term+1) {
+			t.Errorf("expected only %s to lead, in term %d, got: %#v",
+				target, term+1, tr)
+		}
+	}
+	if e := raftEntryAt(old.Relations["raftEntry"].(*LMap), 1); e != nil &&
+		e.Entry == "x" {
+		t.Errorf("expected no entries accepted during the transfer")
+	}
+}
+
+func TestRaftLeaderHint(t *testing.T) {
+	clock := &fakeClock{now: time.Unix(1000, 0)}
+	addrs := []string{"a", "b", "c"}
+	c := NewCluster()
+	for i, a := range addrs {
+		d := RaftInit(NewD(a), "", nil)
+		d.Now = clock.Now
+		d.Rand = rand.New(rand.NewSource(int64(i)))
+		for _, m := range addrs {
+			d.Seed(d.Relations["raftMember"], m)
+		}
+		c.Add(d)
+	}
+	kind := func(d *D) int {
+		return d.Relations["raftCurState"].(*LMaxBy).Value().(raftState).Kind
+	}
+	run := func(done func() bool) {
+		for i := 0; i < 200 && !done(); i++ {
+			clock.Advance(10 * time.Millisecond)
+			c.Tick()
+		}
+	}
+	leaderOf := func(nodes []string) *D {
+		for _, a := range nodes {
+			if kind(c.Node(a)) == state_LEADER {
+				return c.Node(a)
+			}
+		}
+		return nil
+	}
+	agreed := func(nodes []string, l *D) bool {
+		term := l.Relations["raftCurTerm"].(*LMax).Int()
+		for _, a := range nodes {
+			if RaftLeaderOf(c.Node(a), "") != (RaftLeaderHint{l.Addr, term}) {
+				return false
+			}
+		}
+		return true
+	}
+
+	run(func() bool { return leaderOf(addrs) != nil })
+	old := leaderOf(addrs)
+	if old == nil {
+		t.Fatalf("expected a leader")
+	}
+	run(func() bool { return agreed(addrs, old) })
+	if !agreed(addrs, old) {
+		t.Fatalf("expected every node's hint to be %s", old.Addr)
+	}
+
+	// Followers cut off from the leader time out, clearing their hints.
+	c.Transport.Isolate(old.Addr, true)
+	var rest []string
+	for _, a := range addrs {
+		if a != old.Addr {
+			rest = append(rest, a)
+		}
+	}
+	var candidate *D
+	run(func() bool {
+		for _, a := range rest {
+			if kind(c.Node(a)) == state_CANDIDATE {
+				candidate = c.Node(a)
+			}
+		}
+		return candidate != nil
+	})
+	if candidate == nil {
+		t.Fatalf("expected an election")
+	}
+	if h := RaftLeaderOf(candidate, ""); h.Leader != "" {
+		t.Errorf("expected a candidate's hint cleared, got: %#v", h)
+	}
+
+	run(func() bool { l := leaderOf(rest); return l != nil && agreed(rest, l) })
+	l := leaderOf(rest)
+	if l == nil || !agreed(rest, l) {
+		t.Fatalf("expected the rest to agree on a new leader, got: %v, %v",
+			RaftLeaderOf(c.Node(rest[0]), ""), RaftLeaderOf(c.Node(rest[1]), ""))
+	}
+	if h := RaftLeaderOf(old, ""); h.Leader != old.Addr {
+		t.Errorf("expected the isolated leader to still think it leads, got: %#v", h)
+	}
+}
+
+func TestRaftPersist(t *testing.T) {
+	clock := &fakeClock{now: time.Unix(1000, 0)}
+	dir := t.TempDir()
+	addrs := []string{"a", "b", "c"}
+	c := NewCluster()
+	logs := map[string]*RaftFileLog{}
+	for i, a := range addrs {
+		d := RaftInit(NewD(a), "", nil)
+		d.Now = clock.Now
+		d.Rand = rand.New(rand.NewSource(int64(i)))
+		for _, m := range addrs {
+			d.Seed(d.Relations["raftMember"], m)
+		}
+		l, err := OpenRaftFileLog(dir + "/" + a + ".log")
+		if err != nil {
+			t.Fatalf("expected open to work, err: %v", err)
+		}
+		defer l.Close()
+		if err := RaftPersist(d, "", l); err != nil {
+			t.Fatalf("expected an empty log to load, err: %v", err)
+		}
+		logs[a] = l
+		c.Add(d)
+	}
+	kind := func(d *D) int {
+		return d.Relations["raftCurState"].(*LMaxBy).Value().(raftState).Kind
+	}
+	var leader *D
+	for i := 0; i < 100 && leader == nil; i++ {
+		clock.Advance(10 * time.Millisecond)
+		c.Tick()
+		for _, d := range c.Nodes {
+			if kind(d) == state_LEADER {
+				leader = d
+			}
+		}
+	}
+	if leader == nil {
+		t.Fatalf("expected a leader")
+	}
+	for _, e := range []string{"x", "y", "z"} {
+		leader.AddNext(leader.Relations["raftPropose"], e)
+	}
+	for i := 0; i < 50; i++ {
+		clock.Advance(10 * time.Millisecond)
+		c.Tick()
+	}
+
+	// Restart each node from its file, as a fresh D.
+	for _, old := range c.Nodes {
+		l, err := OpenRaftFileLog(dir + "/" + old.Addr + ".log")
+		if err != nil {
+			t.Fatalf("expected reopen to work, err: %v", err)
+		}
+		defer l.Close()
+		d := RaftInit(NewD(old.Addr), "", nil)
+		if err := RaftPersist(d, "", l); err != nil {
+			t.Fatalf("expected the log to load, err: %v", err)
+		}
+		if exp, got := old.Relations["raftCurTerm"].(*LMax).Int(),
+			d.Relations["raftCurTerm"].(*LMax).Int(); exp < 1 || got != exp {
+			t.Errorf("expected %s's term: %d, got: %d", old.Addr, exp, got)
+		}
+		if exp, got := sortedTuples(old.Relations["raftVotedFor"]),
+			sortedTuples(d.Relations["raftVotedFor"]); len(exp) == 0 ||
+			!reflect.DeepEqual(exp, got) {
+			t.Errorf("expected %s's votes: %v, got: %v", old.Addr, exp, got)
+		}
+		oldLog, log := old.Relations["raftEntry"].(*LMap), d.Relations["raftEntry"].(*LMap)
+		if oldLog.Len() != 4 || log.Len() != oldLog.Len() { // With index 0.
+			t.Errorf("expected %s's %d entries, got: %d", old.Addr, oldLog.Len(), log.Len())
+		}
+		for i := 1; i < oldLog.Len(); i++ {
+			if exp, got := raftEntryAt(oldLog, i), raftEntryAt(log, i); got == nil || *got != *exp {
+				t.Errorf("expected %s's entry %d: %#v, got: %#v", old.Addr, i, exp, got)
+			}
+		}
+	}
+}
+
+func TestRaftPersistSnapshot(t *testing.T) {
+	path := t.TempDir() + "/b.log"
+	var restored []string
+	node := func() *D {
+		d := RaftInitSnapshotter(NewD("b"), "", nil, &RaftSnapshotter{
+			Restore: func(data []byte) { restored = append(restored, string(data)) },
+		})
+		d.Seed(d.Relations["raftMember"], "a", "b", "c")
+		l, err := OpenRaftFileLog(path)
+		if err != nil {
+			t.Fatalf("expected open to work, err: %v", err)
+		}
+		t.Cleanup(func() { l.Close() })
+		if err := RaftPersist(d, "", l); err != nil {
+			t.Fatalf("expected load to work, err: %v", err)
+		}
+		return d
+	}
+
+	d := node()
+	logEntry := d.Relations["raftEntry"].(*LMap)
+	for i := 1; i <= 3; i++ { // Stale entries, which the snapshot replaces.
+		logEntry.DirectAdd(&LMapEntry{indexToKey(i),
+			NewLSetOne(d, &RaftEntry{Term: 1, Index: i, Entry: "old"})})
+	}
+	d.Tick()
+	d.Deliver("RaftInstallSnapshotReq", &RaftInstallSnapshotReq{To: "b", From: "a",
+		Term: 2, LastIndex: 5, LastTerm: 2, Data: []byte("s5"), Members: []string{"a", "b"}})
+	d.Tick()
+	d.Tick()
+	if s := latestRaftSnapshot(d.Relations["raftSnapshot"].(*LSet)); s == nil || s.Index != 5 {
+		t.Fatalf("expected the snapshot installed, got: %#v", s)
+	}
+
+	// Restarted, b has the snapshot, with its membership and state
+	// machine, rather than the entries it replaced.
+	restored = nil
+	d = node()
+	d.Tick()
+	snap := latestRaftSnapshot(d.Relations["raftSnapshot"].(*LSet))
+	if snap == nil || snap.Index != 5 || string(snap.Data) != "s5" {
+		t.Errorf("expected the snapshot restored, got: %#v", snap)
+	}
+	if fmt.Sprintf("%v", restored) != "[s5]" {
+		t.Errorf("expected the state machine restored once, got: %v", restored)
+	}
+	if n := d.Relations["raftLogApplied"].(*LMax).Int(); n != 5 {
+		t.Errorf("expected entries through 5 applied, got: %d", n)
+	}
+	if got := raftMembers(d.Relations["raftMember"].(*LSet)); fmt.Sprintf("%v", got) != "[a b]" {
+		t.Errorf("expected the snapshot's members, got: %v", got)
+	}
+	for i := 1; i <= 3; i++ {
+		if e := raftEntryAt(d.Relations["raftEntry"].(*LMap), i); e != nil && e.Entry == "old" {
+			t.Errorf("expected stale entry %d gone, got: %#v", i, e)
+		}
+	}
+}
+
+func TestRaftFileLogCompact(t *testing.T) {
+	path := t.TempDir() + "/b.log"
+	l, err := OpenRaftFileLog(path)
+	if err != nil {
+		t.Fatalf("expected open to work, err: %v", err)
+	}
+	defer func() { l.Close() }()
+	var es []RaftEntry
+	for i := 1; i <= 100; i++ {
+		es = append(es, RaftEntry{Term: 2, Index: i, Entry: strings.Repeat("x", 100)})
+	}
+	if err := l.SaveTerm(2); err != nil {
+		t.Fatalf("expected save to work, err: %v", err)
+	}
+	if err := l.SaveVote(RaftVote{2, "a"}); err != nil {
+		t.Fatalf("expected save to work, err: %v", err)
+	}
+	if err := l.AppendEntries(1, es); err != nil {
+		t.Fatalf("expected append to work, err: %v", err)
+	}
+	before, _ := os.Stat(path)
+
+	if err := l.SaveSnapshot(RaftSnapshot{Term: 2, Index: 98, Data: []byte("s98")}); err != nil {
+		t.Fatalf("expected snapshot to save, err: %v", err)
+	}
+	after, _ := os.Stat(path)
+	if after.Size() >= before.Size()/10 {
+		t.Errorf("expected the file compacted, size before: %d, after: %d",
+			before.Size(), after.Size())
+	}
+	if err := l.AppendEntries(101, []RaftEntry{{Term: 3, Index: 101, Entry: "y"}}); err != nil {
+		t.Fatalf("expected appends to the compacted file, err: %v", err)
+	}
+
+	l.Close()
+	if l, err = OpenRaftFileLog(path); err != nil {
+		t.Fatalf("expected reopen to work, err: %v", err)
+	}
+	term, votes, entries, snap, err := l.LoadAll()
+	if err != nil || term != 2 || fmt.Sprintf("%v", votes) != "[{2 a}]" {
+		t.Errorf("expected term and votes kept, got: %d, %v, err: %v", term, votes, err)
+	}
+	if snap == nil || snap.Index != 98 || string(snap.Data) != "s98" {
+		t.Errorf("expected the snapshot kept, got: %#v", snap)
+	}
+	var got []int
+	for _, e := range entries {
+		got = append(got, e.Index)
+	}
+	if fmt.Sprintf("%v", got) != "[99 100 101]" {
+		t.Errorf("expected just the entries past the snapshot, got: %v", got)
+	}
+}
+
+// Records the order of a node's saves and sends.
+type persistOrder struct {
+	events []string
+	fail   bool
+}
+
+func (p *persistOrder) Send(to, relName string, tuple interface{}) error {
+	if r, ok := tuple.(*RaftVoteRes); ok && r.Granted {
+		p.events = append(p.events, fmt.Sprintf("send grant %d", r.Term))
+	}
+	return nil
+}
+
+func (p *persistOrder) SaveTerm(term int) error {
+	if p.fail {
+		return fmt.Errorf("disk full")
+	}
+	p.events = append(p.events, fmt.Sprintf("term %d", term))
+	return nil
+}
+
+func (p *persistOrder) SaveVote(v RaftVote) error {
+	if p.fail {
+		return fmt.Errorf("disk full")
+	}
+	p.events = append(p.events, fmt.Sprintf("vote %d %s", v.Term, v.Candidate))
+	return nil
+}
+
+func (p *persistOrder) AppendEntries(from int, entries []RaftEntry) error { return nil }
+
+func (p *persistOrder) SaveSnapshot(snap RaftSnapshot) error { return nil }
+
+func (p *persistOrder) LoadAll() (int, []RaftVote, []RaftEntry, *RaftSnapshot, error) {
+	return 2, nil, nil, nil, nil // As if restarted in term 2.
+}
+
+func TestRaftPersistBeforeSend(t *testing.T) {
+	for _, fail := range []bool{false, true} {
+		p := &persistOrder{fail: fail}
+		d := RaftInit(NewD("a"), "", nil)
+		d.Seed(d.Relations["raftMember"], "a", "b", "c")
+		d.SetTransport(p)
+		d.SetLogger(&testLogger{min: LogError}) // Quiets the drops.
+		if err := RaftPersist(d, "", p); err != nil {
+			t.Fatalf("expected load to work, err: %v", err)
+		}
+		d.Deliver("RaftVoteReq", &RaftVoteReq{To: "a", From: "b", Term: 2})
+		d.Tick()
+		exp := []string{"vote 2 b", "send grant 2"}
+		if fail {
+			exp = nil
+		}
+		if !reflect.DeepEqual(p.events, exp) {
+			t.Errorf("expected fail: %v, events: %v, got: %v", fail, exp, p.events)
+		}
+	}
+}
+
+func TestRaftApply(t *testing.T) {
+	var applied []string
+	d := RaftInit(NewD("a"), "", func(entry string) {
+		applied = append(applied, entry)
+	})
+	member := d.Relations["raftMember"].(*LSet)
+	for _, m := range []string{"a", "b", "c"} {
+		member.DirectAdd(m)
+	}
+	d.Relations["raftCurTerm"].DirectAdd(1)
+	d.Relations["raftCurState"].DirectAdd(raftState{Kind: state_LEADER})
+
+	logEntry := d.Relations["raftEntry"].(*LMap)
+	for i, entry := range []string{"x", "y", "z"} {
+		logEntry.DirectAdd(&LMapEntry{indexToKey(i + 1),
+			NewLSetOne(d, &RaftEntry{Term: 1, Index: i + 1, Entry: entry})})
+	}
+	matchIndex := d.Relations["raftMatchIndex"]
+
+	d.Tick()
+	if len(applied) != 0 {
+		t.Errorf("expected nothing applied before commit, got: %v", applied)
+	}
+
+	d.AddNext(matchIndex, &LMapEntry{"b", NewLMax(d, 2)})
+	d.Tick()
+	d.Tick()
+	if fmt.Sprintf("%v", applied) != "[x y]" {
+		t.Errorf("expected x and y applied in order, got: %v", applied)
+	}
+
+	d.AddNext(matchIndex, &LMapEntry{"c", NewLMax(d, 3)})
+	for i := 0; i < 3; i++ {
+		d.Tick()
+	}
+	if fmt.Sprintf("%v", applied) != "[x y z]" {
+		t.Errorf("expected x, y, z applied once each, got: %v", applied)
+	}
+
+	d.AddNext(matchIndex, &LMapEntry{"b", NewLMax(d, 4)})
+	d.AddNext(matchIndex, &LMapEntry{"c", NewLMax(d, 4)})
+	d.Tick()
+	d.Tick()
+	if fmt.Sprintf("%v", applied) != "[x y z]" {
+		t.Errorf("expected missing entries to not be applied, got: %v", applied)
+	}
+}
+
+func TestRaftNextIndexCatchUp(t *testing.T) {
+	c := &fakeClock{now: time.Unix(1000, 0)}
+	tr := NewMemTransport()
+	addrs := []string{"a", "b", "c"}
+	ds := newRaftCluster(tr, addrs...)
+	for i, a := range addrs {
+		ds[a].Now = c.Now
+		ds[a].Rand = rand.New(rand.NewSource(int64(i)))
+		ds[a].Relations["raftCurTerm"].DirectAdd(2)
+	}
+	leader := ds["a"]
+	leader.Relations["raftCurState"].DirectAdd(raftState{Kind: state_LEADER})
+	leaderLog := leader.Relations["raftEntry"].(*LMap)
+	for i, entry := range []string{"w", "x", "y", "z"} {
+		leaderLog.DirectAdd(&LMapEntry{indexToKey(i + 1),
+			NewLSetOne(leader, &RaftEntry{Term: 1 + i/2, Index: i + 1, Entry: entry})})
+	}
+
+	converged := func(a string) bool {
+		log := ds[a].Relations["raftEntry"].(*LMap)
+		for i := 0; i <= 5; i++ {
+			le, fe := raftEntryAt(leaderLog, i), raftEntryAt(log, i)
+			if (le == nil) != (fe == nil) || (le != nil && *le != *fe) {
+				return false
+			}
+		}
+		return true
+	}
+
+	for i := 0; i < 100 && !(converged("b") && converged("c")); i++ {
+		c.Advance(10 * time.Millisecond)
+		for _, a := range addrs {
+			ds[a].Tick()
+		}
+	}
+	for i := 0; i < 10; i++ { // Let the last responses reach the leader.
+		c.Advance(10 * time.Millisecond)
+		for _, a := range addrs {
+			ds[a].Tick()
+		}
+	}
+	for _, a := range []string{"b", "c"} {
+		if !converged(a) {
+			t.Errorf("expected follower %s log to converge to the leader's", a)
+		}
+		n := leader.Relations["raftNextIndex"].(*LMap).At(a)
+		if n == nil {
+			t.Fatalf("expected a nextIndex for %s", a)
+		}
+		if nextIndexOf(n).Index != 5 {
+			t.Errorf("expected nextIndex for %s to be 5, got: %v",
+				a, nextIndexOf(n))
+		}
+	}
+	if leader.Relations["raftCurState"].(*LMaxBy).Value().(raftState).Kind != state_LEADER {
+		t.Errorf("expected a to remain leader")
+	}
+}
+
+func TestRaftNextIndexReset(t *testing.T) {
+	d := RaftInit(NewD("a"), "", nil)
+	for _, m := range []string{"a", "b"} {
+		d.Relations["raftMember"].DirectAdd(m)
+	}
+	d.Relations["raftCurTerm"].DirectAdd(1)
+	for i, entry := range []string{"x", "y"} {
+		d.Relations["raftEntry"].DirectAdd(&LMapEntry{indexToKey(i + 1),
+			NewLSetOne(d, &RaftEntry{Term: 1, Index: i + 1, Entry: entry})})
+	}
+	nextIndex := d.Relations["raftNextIndex"].(*LMap)
+	nextIndex.DirectAdd(&LMapEntry{"b", newRaftNextIndex(d, raftNextIndex{Index: 10})})
+
+	d.Tick()
+	if nextIndex.Len() != 0 {
+		t.Errorf("expected a follower to drop its nextIndex, got: %v",
+			RelationValue(nextIndex))
+	}
+
+	d.Relations["raftCurState"].DirectAdd(raftState{1, state_LEADER})
+	d.Tick()
+	if n := nextIndex.At("b"); n == nil || nextIndexOf(n).Index != 3 {
+		t.Errorf("expected a new leader to start b's nextIndex past its log"+
+			", got: %v", RelationValue(nextIndex))
+	}
+}
+
+func TestRaftBatchCatchUp(t *testing.T) {
+	c := &fakeClock{now: time.Unix(1000, 0)}
+	tr := NewMemTransport()
+	addrs := []string{"a", "b", "c"}
+	ds := newRaftCluster(tr, addrs...)
+	for i, a := range addrs {
+		ds[a].Now = c.Now
+		ds[a].Rand = rand.New(rand.NewSource(int64(i)))
+		ds[a].Relations["raftCurTerm"].DirectAdd(2)
+	}
+	leader := ds["a"]
+	leader.Relations["raftCurState"].DirectAdd(raftState{Kind: state_LEADER})
+	for _, a := range []string{"a", "c"} { // Only b is behind, by 100.
+		for i := 1; i <= 100; i++ {
+			ds[a].Relations["raftEntry"].DirectAdd(&LMapEntry{indexToKey(i),
+				NewLSetOne(ds[a], &RaftEntry{Term: 2, Index: i, Entry: fmt.Sprintf("e%d", i)})})
+		}
+	}
+	nextIndex := leader.Relations["raftNextIndex"].(*LMap)
+
+	maxBatch := 0
+	ds["b"].OnChange("RaftAddEntryReq", func(added interface{}) {
+		if n := len(added.(*RaftAddEntryReq).Entries); n > maxBatch {
+			maxBatch = n
+		}
+	})
+	log := ds["b"].Relations["raftEntry"].(*LMap)
+	ticks := 0
+	for ; ticks < 50 && raftEntryAt(log, 100) == nil; ticks++ {
+		c.Advance(10 * time.Millisecond)
+		for _, a := range addrs {
+			ds[a].Tick()
+		}
+	}
+	// A heartbeat is every 5 ticks.  b rejects the first, which starts
+	// past b's empty log, and its rejection sends the leader straight
+	// back to index 1, so the second heartbeat's entries land a tick later.
+	if ticks > 12 {
+		t.Errorf("expected b to catch up on the second heartbeat, took: %d ticks", ticks)
+	}
+	if maxBatch != 100 {
+		t.Errorf("expected all 100 entries in one request, got: %d", maxBatch)
+	}
+	for i := 1; i <= 100; i++ {
+		if e := raftEntryAt(log, i); e == nil || e.Entry != fmt.Sprintf("e%d", i) {
+			t.Fatalf("expected entry %d in order, got: %#v", i, e)
+		}
+	}
+	for i := 0; i < 10; i++ {
+		c.Advance(10 * time.Millisecond)
+		for _, a := range addrs {
+			ds[a].Tick()
+		}
+	}
+	if n := nextIndex.At("b"); n == nil || nextIndexOf(n).Index != 101 {
+		t.Errorf("expected b's nextIndex past the batch, got: %v", RelationValue(nextIndex))
+	}
+	if ci := ds["b"].Relations["raftLogCommit"].(*LMax).Int(); ci != 100 {
+		t.Errorf("expected b to commit the batch, got: %d", ci)
+	}
+}
+
+func TestRaftMaxInFlight(t *testing.T) {
+	defer func(v int) { RaftMaxInFlight = v }(RaftMaxInFlight)
+	RaftMaxInFlight = 10
+
+	c := &fakeClock{now: time.Unix(1000, 0)}
+	tr := NewMemTransport()
+	addrs := []string{"a", "b", "c"}
+	ds := newRaftCluster(tr, addrs...)
+	for i, a := range addrs {
+		ds[a].Now = c.Now
+		ds[a].Rand = rand.New(rand.NewSource(int64(i)))
+		ds[a].Relations["raftCurTerm"].DirectAdd(2)
+	}
+	leader := ds["a"]
+	leader.Relations["raftCurState"].DirectAdd(raftState{Kind: state_LEADER})
+	for _, a := range []string{"a", "c"} {
+		for i := 1; i <= 100; i++ {
+			ds[a].Relations["raftEntry"].DirectAdd(&LMapEntry{indexToKey(i),
+				NewLSetOne(ds[a], &RaftEntry{Term: 2, Index: i, Entry: fmt.Sprintf("e%d", i)})})
+		}
+	}
+	nextIndex := leader.Relations["raftNextIndex"].(*LMap)
+	nextIndex.DirectAdd(&LMapEntry{"b", newRaftNextIndex(leader, raftNextIndex{Index: 1})})
+	nextIndex.DirectAdd(&LMapEntry{"c", newRaftNextIndex(leader, raftNextIndex{Index: 101})})
+	tr.AddDelay("a", "b", 3) // A slow follower.
+	tr.AddDelay("b", "a", 3)
+
+	acked, reqs := 0, 0 // As seen by the leader.
+	leader.OnChange("RaftAddEntryRes", func(added interface{}) {
+		if r := added.(*RaftAddEntryRes); r.From == "b" && r.Ok && r.Index > acked {
+			acked = r.Index
+		}
+	})
+	ds["b"].OnChange("RaftAddEntryReq", func(added interface{}) {
+		r := added.(*RaftAddEntryReq)
+		if len(r.Entries) > 0 {
+			reqs++
+		}
+		if last := r.PrevLogIndex + len(r.Entries); last > acked+10 {
+			t.Errorf("expected at most 10 entries past b's acks, acked: %d, got: %d",
+				acked, last)
+		}
+	})
+	log := ds["b"].Relations["raftEntry"].(*LMap)
+	for i := 0; i < 500 && raftEntryAt(log, 100) == nil; i++ {
+		c.Advance(10 * time.Millisecond)
+		for _, a := range addrs {
+			ds[a].Tick()
+		}
+	}
+	if raftEntryAt(log, 100) == nil {
+		t.Fatalf("expected b to converge despite the window")
+	}
+	if reqs < 10 {
+		t.Errorf("expected the 100 entries sent a window at a time, got: %d requests", reqs)
+	}
+}
+
+func TestRaftAddEntryConsistencyCheck(t *testing.T) {
+	d := RaftInit(NewD("b"), "", nil)
+	d.Relations["raftCurTerm"].DirectAdd(2)
+	d.Relations["raftEntry"].DirectAdd(&LMapEntry{indexToKey(1),
+		NewLSetOne(d, &RaftEntry{Term: 1, Index: 1, Entry: "x"})})
+	raddr := d.Relations["RaftAddEntryRes"].(*LSet)
+
+	tests := []struct {
+		prevIndex, prevTerm int
+		ok                  bool
+		index               int // Where the leader should go on.
+	}{
+		{3, 2, false, 2}, // Our log is shorter than PrevLogIndex.
+		{1, 2, false, 1}, // Our entry at PrevLogIndex has another term.
+		{1, 1, true, 2},
+	}
+	for _, test := range tests {
+		d.Deliver("RaftAddEntryReq", &RaftAddEntryReq{To: "b", From: "a",
+			Term: 2, PrevLogTerm: test.prevTerm, PrevLogIndex: test.prevIndex,
+			Entries: []RaftEntry{{Term: 2, Index: test.prevIndex + 1, Entry: "y"}}})
+		d.Tick()
+		res := raddr.Drain()
+		if len(res) == 0 {
+			t.Fatalf("expected a response for %+v", test)
+		}
+		for _, x := range res { // The same response might be sent repeatedly.
+			r := x.(*RaftAddEntryRes)
+			if r.To != "a" || r.Ok != test.ok || r.Index != test.index {
+				t.Errorf("expected ok: %v for %+v, got: %#v", test.ok, test, r)
+			}
+		}
+	}
+}
+
+func TestRaftTruncateConflict(t *testing.T) {
+	var applied []string
+	d := RaftInit(NewD("b"), "", func(entry string) {
+		applied = append(applied, entry)
+	})
+	d.Relations["raftCurTerm"].DirectAdd(2)
+	log := d.Relations["raftEntry"].(*LMap)
+	for i, entry := range []string{"x", "stale", "staler"} {
+		log.DirectAdd(&LMapEntry{indexToKey(i + 1),
+			NewLSetOne(d, &RaftEntry{Term: 1, Index: i + 1, Entry: entry})})
+	}
+
+	d.Deliver("RaftAddEntryReq", &RaftAddEntryReq{To: "b", From: "a",
+		Term: 2, PrevLogTerm: 1, PrevLogIndex: 1,
+		Entries: []RaftEntry{{Term: 2, Index: 2, Entry: "y"}}, CommitIndex: 3})
+	d.Tick()
+	d.Tick()
+
+	if e := raftEntryAt(log, 2); e == nil || e.Entry != "y" || e.Term != 2 {
+		t.Errorf("expected stale entry replaced by leader's, got: %#v", e)
+	}
+	if s, _ := log.AtLSet(indexToKey(2)); s == nil || s.Size() != 1 {
+		t.Errorf("expected only the leader's entry at index 2")
+	}
+	if raftEntryAt(log, 3) != nil {
+		t.Errorf("expected entries after the conflict to be removed")
+	}
+	if c := d.Relations["raftLogCommit"].(*LMax).Int(); c != 2 {
+		t.Errorf("expected commit to be limited to matched entries, got: %d", c)
+	}
+	if fmt.Sprintf("%v", applied) != "[x y]" {
+		t.Errorf("expected stale entries to never be applied, got: %v", applied)
+	}
+}
+
+// Figure 8 of the Raft paper: a leader must not commit an entry from an
+// earlier term just because a majority has it, since a later leader
+// could still overwrite it.
+func TestRaftCommitCurrentTermOnly(t *testing.T) {
+	var applied []string
+	d := RaftInit(NewD("a"), "", func(entry string) {
+		applied = append(applied, entry)
+	})
+	for _, m := range []string{"a", "b", "c", "d", "e"} {
+		d.Relations["raftMember"].DirectAdd(m)
+	}
+	d.Relations["raftCurTerm"].DirectAdd(4)
+	d.Relations["raftCurState"].DirectAdd(raftState{Kind: state_LEADER})
+	logEntry := d.Relations["raftEntry"].(*LMap)
+	logEntry.DirectAdd(&LMapEntry{indexToKey(1),
+		NewLSetOne(d, &RaftEntry{Term: 1, Index: 1, Entry: "x"})})
+	logEntry.DirectAdd(&LMapEntry{indexToKey(2),
+		NewLSetOne(d, &RaftEntry{Term: 2, Index: 2, Entry: "old"})})
+	logCommit := d.Relations["raftLogCommit"].(*LMax)
+	matchIndex := d.Relations["raftMatchIndex"]
+
+	// The term 2 entry reaches a majority, but isn't committed.
+	d.AddNext(matchIndex, &LMapEntry{"b", NewLMax(d, 2)})
+	d.AddNext(matchIndex, &LMapEntry{"c", NewLMax(d, 2)})
+	d.Tick()
+	d.Tick()
+	if logCommit.Int() != 0 || len(applied) != 0 {
+		t.Errorf("expected old term entry to not commit, commit: %d, applied: %v",
+			logCommit.Int(), applied)
+	}
+
+	// A current term entry reaching a majority commits both.
+	logEntry.DirectAdd(&LMapEntry{indexToKey(3),
+		NewLSetOne(d, &RaftEntry{Term: 4, Index: 3, Entry: "new"})})
+	d.AddNext(matchIndex, &LMapEntry{"b", NewLMax(d, 3)})
+	d.AddNext(matchIndex, &LMapEntry{"c", NewLMax(d, 3)})
+	d.Tick()
+	d.Tick()
+	if logCommit.Int() != 3 {
+		t.Errorf("expected current term entry to commit, got: %d", logCommit.Int())
+	}
+	if fmt.Sprintf("%v", applied) != "[x old new]" {
+		t.Errorf("expected earlier entries applied with it, got: %v", applied)
+	}
+}
+
+func TestRaftMatchIndexCommit(t *testing.T) {
+	d := RaftInit(NewD("a"), "", nil)
+	for _, m := range []string{"a", "b", "c", "d", "e"} {
+		d.Relations["raftMember"].DirectAdd(m)
+	}
+	d.Relations["raftCurTerm"].DirectAdd(4)
+	d.Relations["raftCurState"].DirectAdd(raftState{Kind: state_LEADER})
+	for i := 1; i <= 5; i++ {
+		d.Relations["raftEntry"].DirectAdd(&LMapEntry{indexToKey(i),
+			NewLSetOne(d, &RaftEntry{Term: 4, Index: i, Entry: fmt.Sprintf("e%d", i)})})
+	}
+	logCommit := d.Relations["raftLogCommit"].(*LMax)
+	matchIndex := d.Relations["raftMatchIndex"].(*LMap)
+
+	// No single index has 2 acks, as per-index tallying needs, but a
+	// majority of a, b and c has replicated through index 3.
+	for _, ack := range []*RaftAddEntryRes{
+		{To: "a", From: "b", Term: 4, Ok: true, Index: 5},
+		{To: "a", From: "c", Term: 4, Ok: true, Index: 3},
+		{To: "a", From: "d", Term: 4, Ok: true, Index: 1},
+		{To: "a", From: "z", Term: 4, Ok: true, Index: 5}, // Not a member.
+		{To: "a", From: "e", Term: 3, Ok: true, Index: 5}, // Stale term.
+	} {
+		d.Deliver("RaftAddEntryRes", ack)
+	}
+	d.Tick()
+	d.Tick()
+	if n, _ := matchIndex.AtLMax("c"); n == nil || n.Int() != 3 {
+		t.Errorf("expected c's matchIndex of 3, got: %v", n)
+	}
+	if logCommit.Int() != 3 {
+		t.Errorf("expected commit at the median matchIndex of 3, got: %d", logCommit.Int())
+	}
+
+	// A lower, late ack doesn't move a matchIndex back.
+	d.Deliver("RaftAddEntryRes", &RaftAddEntryRes{To: "a", From: "c", Term: 4, Ok: true, Index: 2})
+	d.Deliver("RaftAddEntryRes", &RaftAddEntryRes{To: "a", From: "e", Term: 4, Ok: true, Index: 4})
+	d.Tick()
+	d.Tick()
+	if n, _ := matchIndex.AtLMax("c"); n == nil || n.Int() != 3 {
+		t.Errorf("expected c's matchIndex to stay 3, got: %v", n)
+	}
+	if logCommit.Int() != 4 {
+		t.Errorf("expected commit to advance to 4, got: %d", logCommit.Int())
+	}
+}
+
+func TestRaftSnapshotCatchUp(t *testing.T) {
+	c := &fakeClock{now: time.Unix(1000, 0)}
+	tr := NewMemTransport()
+	addrs := []string{"a", "b"}
+	ds := map[string]*D{}
+	applied := map[string][]string{}
+	for i, a := range addrs {
+		a := a
+		d := RaftInitSnapshotter(NewD(a), "", func(entry string) {
+			applied[a] = append(applied[a], entry)
+		}, &RaftSnapshotter{
+			Threshold: 4,
+			Snapshot: func() []byte {
+				return []byte(strings.Join(applied[a], ","))
+			},
+			Restore: func(data []byte) {
+				applied[a] = strings.Split(string(data), ",")
+			},
+		})
+		tr.Register(d)
+		for _, m := range addrs {
+			d.Relations["raftMember"].DirectAdd(m)
+		}
+		d.Now = c.Now
+		d.Rand = rand.New(rand.NewSource(int64(i)))
+		d.Relations["raftCurTerm"].DirectAdd(2)
+		ds[a] = d
+	}
+
+	// The leader has committed and applied entries before the follower
+	// hears from it, so it compacts its log.
+	leader := ds["a"]
+	leader.Relations["raftCurState"].DirectAdd(raftState{Kind: state_LEADER})
+	leaderLog := leader.Relations["raftEntry"].(*LMap)
+	entries := []string{"p", "q", "r", "s", "t", "u", "v", "w", "x", "y"}
+	for i, entry := range entries {
+		leaderLog.DirectAdd(&LMapEntry{indexToKey(i + 1),
+			NewLSetOne(leader, &RaftEntry{Term: 1, Index: i + 1, Entry: entry})})
+	}
+	leader.Relations["raftLogCommit"].DirectAdd(len(entries))
+	leader.Tick()
+	leader.Tick()
+
+	snap := latestRaftSnapshot(leader.Relations["raftSnapshot"].(*LSet))
+	if snap == nil || snap.Index != 8 || string(snap.Data) != "p,q,r,s,t,u,v,w" {
+		t.Fatalf("expected leader snapshot at 8, got: %#v", snap)
+	}
+	if raftEntryAt(leaderLog, 8) != nil || raftEntryAt(leaderLog, 9) == nil {
+		t.Errorf("expected leader log compacted through 8, keys: %v",
+			leaderLog.Keys())
+	}
+
+	for i := 0; i < 100 && len(applied["b"]) < len(entries); i++ {
+		c.Advance(10 * time.Millisecond)
+		for _, a := range addrs {
+			ds[a].Tick()
+		}
+	}
+	if strings.Join(applied["b"], ",") != strings.Join(entries, ",") {
+		t.Errorf("expected follower to catch up via snapshot, got: %v",
+			applied["b"])
+	}
+	fsnap := latestRaftSnapshot(ds["b"].Relations["raftSnapshot"].(*LSet))
+	if fsnap == nil || fsnap.Index != 8 {
+		t.Errorf("expected follower to install the snapshot, got: %#v", fsnap)
+	}
+	if fmt.Sprintf("%v", applied["a"]) != fmt.Sprintf("%v", entries) {
+		t.Errorf("expected leader to apply each entry once, got: %v", applied["a"])
+	}
+}
+
+func TestRaftAddMember(t *testing.T) {
+	c := &fakeClock{now: time.Unix(1000, 0)}
+	tr := NewMemTransport()
+	addrs := []string{"a", "b", "c"}
+	ds := newRaftCluster(tr, addrs...)
+	ds["d"] = RaftInit(NewD("d"), "", nil) // Knows the current config.
+	tr.Register(ds["d"])
+	for _, m := range addrs {
+		ds["d"].Relations["raftMember"].DirectAdd(m)
+	}
+	for i, a := range append(addrs, "d") {
+		ds[a].Now = c.Now
+		ds[a].Rand = rand.New(rand.NewSource(int64(i)))
+	}
+
+	leader := func(running []string) string {
+		for _, a := range running {
+			if ds[a].Relations["raftCurState"].(*LMaxBy).Value().(raftState).Kind == state_LEADER {
+				return a
+			}
+		}
+		return ""
+	}
+	run := func(running []string, done func() bool) {
+		for i := 0; i < 200 && !done(); i++ {
+			c.Advance(10 * time.Millisecond)
+			for _, a := range running {
+				ds[a].Tick()
+			}
+		}
+	}
+	isMember := func(a, m string) bool {
+		return ds[a].Relations["raftMember"].(*LSet).Contains(m)
+	}
+
+	run(addrs, func() bool { return leader(addrs) != "" })
+	l := leader(addrs)
+	if l == "" {
+		t.Fatalf("expected a leader")
+	}
+
+	// Concurrent changes, where only the first may commit.
+	RaftProposeMember(ds[l], "", "d", true)
+	RaftProposeMember(ds[l], "", "e", true)
+	run(addrs, func() bool { return isMember(l, "d") })
+	if !isMember(l, "d") || isMember(l, "e") {
+		t.Fatalf("expected only d to be added, got: %v",
+			raftMembers(ds[l].Relations["raftMember"].(*LSet)))
+	}
+
+	all := append(addrs, "d")
+	run(all, func() bool { return isMember("d", "d") })
+	if !isMember("d", "d") {
+		t.Fatalf("expected d to learn of its membership")
+	}
+
+	// Without the old leader, a new leader needs a vote from d.
+	var rest []string
+	for _, a := range all {
+		if a != l {
+			rest = append(rest, a)
+		}
+	}
+	run(rest, func() bool { return leader(rest) != "" })
+	nl := leader(rest)
+	if nl == "" {
+		t.Fatalf("expected a new leader")
+	}
+	term := ds[nl].Relations["raftCurTerm"].(*LMax).Int()
+	if !MultiTallyHasVoteFrom(ds[nl], "tallyLeader/", termToKey(term), "d") {
+		t.Errorf("expected d to vote for new leader %s", nl)
+	}
+}
+
+func TestRaftClientRedirect(t *testing.T) {
+	c := &fakeClock{now: time.Unix(1000, 0)}
+	tr := NewMemTransport()
+	addrs := []string{"a", "b", "c"}
+	ds := newRaftCluster(tr, addrs...)
+	for i, a := range addrs {
+		ds[a].Now = c.Now
+		ds[a].Rand = rand.New(rand.NewSource(int64(i)))
+	}
+	client := RaftClientInit(NewD("z"), "")
+	send := client.Scratch(client.DeclareLSet("send", RaftClientReq{}))
+	client.Join(send).IntoAsync(client.Relations["RaftClientReq"])
+	tr.Register(client)
+
+	leader := ""
+	for i := 0; i < 100 && leader == ""; i++ {
+		c.Advance(10 * time.Millisecond)
+		for _, a := range addrs {
+			ds[a].Tick()
+			if ds[a].Relations["raftCurState"].(*LMaxBy).Value().(raftState).Kind == state_LEADER {
+				leader = a
+			}
+		}
+	}
+	if leader == "" {
+		t.Fatalf("expected a leader")
+	}
+	follower := "a"
+	if follower == leader {
+		follower = "b"
+	}
+
+	var redirects []string
+	var ack *RaftClientRes
+	client.AddNext(send,
+		&RaftClientReq{To: follower, From: "z", Id: "1", Command: "set x"})
+	for i := 0; i < 100 && ack == nil; i++ {
+		c.Advance(10 * time.Millisecond)
+		for _, a := range addrs {
+			ds[a].Tick()
+		}
+		client.Tick()
+		for x := range client.Relations["RaftClientRes"].Scan() {
+			r := x.(*RaftClientRes)
+			if r.Ok {
+				ack = r
+			} else {
+				to := r.From // Retry until the leader is known.
+				if r.Leader != "" {
+					redirects = append(redirects, r.Leader)
+					to = r.Leader
+				}
+				client.AddNext(send,
+					&RaftClientReq{To: to, From: "z", Id: "1", Command: "set x"})
+			}
+		}
+	}
+	if fmt.Sprintf("%v", redirects) != fmt.Sprintf("[%s]", leader) {
+		t.Errorf("expected one redirect to leader %s, got: %v", leader, redirects)
+	}
+	if ack == nil || ack.From != leader || ack.Id != "1" {
+		t.Fatalf("expected an ack from the leader, got: %#v", ack)
+	}
+	e := raftEntryAt(ds[leader].Relations["raftEntry"].(*LMap), ack.Index)
+	if e == nil || e.Entry != "set x" {
+		t.Errorf("expected command at index %d, got: %#v", ack.Index, e)
+	}
+	if ds[leader].Relations["raftLogCommit"].(*LMax).Int() < ack.Index {
+		t.Errorf("expected command to be committed")
+	}
+}
+
+func TestRaftReadIndex(t *testing.T) {
+	c := &fakeClock{now: time.Unix(1000, 0)}
+	tr := NewMemTransport()
+	addrs := []string{"a", "b", "c"}
+	ds := map[string]*D{}
+	applied := map[string][]string{}
+	for i, a := range addrs {
+		a := a
+		d := RaftInit(NewD(a), "", func(entry string) {
+			applied[a] = append(applied[a], entry)
+		})
+		d.Now = c.Now
+		d.Rand = rand.New(rand.NewSource(int64(i)))
+		tr.Register(d)
+		for _, m := range addrs {
+			d.Relations["raftMember"].(*LSet).DirectAdd(m)
+		}
+		ds[a] = d
+	}
+	client := RaftClientInit(NewD("z"), "")
+	write := client.Scratch(client.DeclareLSet("write", RaftClientReq{}))
+	read := client.Scratch(client.DeclareLSet("read", RaftReadIndexReq{}))
+	client.Join(write).IntoAsync(client.Relations["RaftClientReq"])
+	client.Join(read).IntoAsync(client.Relations["RaftReadIndexReq"])
+	tr.Register(client)
+
+	round := func() {
+		c.Advance(10 * time.Millisecond)
+		for _, a := range addrs {
+			ds[a].Tick()
+		}
+		client.Tick()
+	}
+	// Reads the leader's applied entries as of when it allows the read.
+	readFrom := func(to string) (res *RaftReadIndexRes, seen []string) {
+		client.AddNext(read, &RaftReadIndexReq{To: to, From: "z", Id: "r"})
+		for i := 0; i < 50 && res == nil; i++ {
+			round()
+			for x := range ds[to].Relations["RaftReadIndexReady"].Scan() {
+				if x.(*RaftReadIndexRes).Id == "r" {
+					seen = append([]string(nil), applied[to]...)
+				}
+			}
+			for x := range client.Relations["RaftReadIndexRes"].Scan() {
+				res = x.(*RaftReadIndexRes)
+			}
+		}
+		return res, seen
+	}
+
+	leader := ""
+	for i := 0; i < 100 && leader == ""; i++ {
+		round()
+		for _, a := range addrs {
+			if ds[a].Relations["raftCurState"].(*LMaxBy).Value().(raftState).Kind == state_LEADER {
+				leader = a
+			}
+		}
+	}
+	if leader == "" {
+		t.Fatalf("expected a leader")
+	}
+
+	res, _ := readFrom(leader)
+	if res == nil || !res.Ok || res.From != leader {
+		t.Fatalf("expected leader to allow a read, got: %#v", res)
+	}
+
+	var ack *RaftClientRes
+	client.AddNext(write, &RaftClientReq{To: leader, From: "z", Id: "w", Command: "set x"})
+	for i := 0; i < 50 && ack == nil; i++ {
+		round()
+		for x := range client.Relations["RaftClientRes"].Scan() {
+			ack = x.(*RaftClientRes)
+		}
+	}
+	if ack == nil || !ack.Ok {
+		t.Fatalf("expected the write to commit, got: %#v", ack)
+	}
+
+	res, seen := readFrom(leader)
+	if res == nil || !res.Ok || res.Index < ack.Index {
+		t.Fatalf("expected read at or after index %d, got: %#v", ack.Index, res)
+	}
+	if fmt.Sprintf("%v", seen) != "[set x]" {
+		t.Errorf("expected read to observe the committed write, got: %v", seen)
+	}
+	if n := len(ds[leader].Relations["raftReadPending"].(*LSet).m); n != 0 {
+		t.Errorf("expected no pending reads, got: %d", n)
+	}
+
+	follower := "a"
+	if follower == leader {
+		follower = "b"
+	}
+	res, _ = readFrom(follower)
+	if res == nil || res.Ok || res.Leader != leader {
+		t.Errorf("expected follower to reject and redirect, got: %#v", res)
+	}
+
+	// A new leader that doesn't yet know the write committed appends a
+	// no-op, which isn't applied, before allowing the read.
+	ack = nil
+	client.AddNext(write, &RaftClientReq{To: leader, From: "z", Id: "w2", Command: "set y"})
+	for i := 0; i < 50 && ack == nil; i++ {
+		round()
+		for x := range client.Relations["RaftClientRes"].Scan() {
+			ack = x.(*RaftClientRes)
+		}
+	}
+	tr.Isolate(leader, true)
+	old := leader
+	leader = ""
+	for i := 0; i < 100 && leader == ""; i++ {
+		round()
+		for _, a := range addrs {
+			if a != old &&
+				ds[a].Relations["raftCurState"].(*LMaxBy).Value().(raftState).Kind == state_LEADER {
+				leader = a
+			}
+		}
+	}
+	res, seen = readFrom(leader)
+	if res == nil || !res.Ok || fmt.Sprintf("%v", seen) != "[set x set y]" {
+		t.Errorf("expected new leader's read to observe the write, got: %#v, %v",
+			res, seen)
+	}
+	entries := ds[leader].Relations["raftEntry"].(*LMap)
+	if e := raftEntryAt(entries, entries.Len()-1); e == nil || e.Entry != raftNoOp_ENTRY {
+		t.Errorf("expected new leader to append a no-op, got: %#v", e)
+	}
+}
+
+func TestGCounter(t *testing.T) {
+	addrs := []string{"a", "b", "c"}
+	cs := map[string]*GCounter{}
+	for _, a := range addrs {
+		cs[a] = NewD(a).DeclareGCounter("count")
+	}
+	cs["a"].Inc("a", 2)
+	cs["b"].Inc("b", 3)
+	cs["b"].Inc("b", 1)
+	cs["c"].Inc("c", 5)
+	if cs["c"].Inc("c", 0) {
+		t.Errorf("expected zero delta to not change the counter")
+	}
+
+	// Merge in different orders, with repeats, to check commutativity
+	// and idempotence.
+	cs["a"].DirectMerge(cs["b"])
+	cs["a"].DirectMerge(cs["c"])
+	cs["a"].DirectMerge(cs["b"])
+	cs["c"].DirectMerge(cs["a"].Snapshot().(*GCounter))
+	cs["b"].DirectMerge(cs["c"])
+	cs["b"].DirectMerge(cs["a"])
+	for _, a := range addrs {
+		if cs[a].Value() != 11 {
+			t.Errorf("expected %s to converge to 11, got: %v", a, cs[a].Value())
+		}
+	}
+	if cs["a"].DirectMerge(cs["b"]) {
+		t.Errorf("expected merging a converged replica to not change")
+	}
+
+	func() {
+		defer func() {
+			if recover() == nil {
+				t.Errorf("expected negative delta to panic")
+			}
+		}()
+		cs["a"].Inc("a", -1)
+	}()
+}
+
+func TestGCounterJoin(t *testing.T) {
+	d := NewD("a")
+	src := d.DeclareGCounter("src")
+	dst := d.DeclareGCounter("dst")
+	d.Join(src).Into(dst)
+	src.Inc("a", 1)
+	src.Inc("b", 2)
+	d.Tick()
+	if dst.Value() != 3 {
+		t.Errorf("expected joined counter to be 3, got: %v", dst.Value())
+	}
+	d.Tick()
+	if dst.Value() != 3 {
+		t.Errorf("expected rejoining to be idempotent, got: %v", dst.Value())
+	}
+}
+
+func TestVectorClock(t *testing.T) {
+	d := NewD("a")
+	a, b, c := d.NewVectorClock(), d.NewVectorClock(), d.NewVectorClock()
+	a.Tick("a")
+	a.Tick("a")
+	if a.Get("a") != 2 || a.Get("b") != 0 {
+		t.Errorf("expected a's own count to be 2, got: %v", a.Value())
+	}
+
+	b.Tick("b")
+	if a.HappensBefore(b) || b.HappensBefore(a) || !a.Concurrent(b) {
+		t.Errorf("expected a and b to be concurrent")
+	}
+
+	// b receives from a.
+	if !b.Merge(a) || b.Merge(a) {
+		t.Errorf("expected only the first merge to change b")
+	}
+	b.Tick("b")
+	if !a.HappensBefore(b) || b.HappensBefore(a) || a.Concurrent(b) {
+		t.Errorf("expected a to happen before b, got: %v, %v", a.Value(), b.Value())
+	}
+
+	// c receives from b, so transitively after a.
+	c.Tick("c")
+	c.Merge(b)
+	c.Tick("c")
+	if !a.HappensBefore(c) || !b.HappensBefore(c) || c.HappensBefore(a) {
+		t.Errorf("expected a and b to happen before c, got: %v", c.Value())
+	}
+
+	a.Tick("a")
+	if !a.Concurrent(c) || a.HappensBefore(c) {
+		t.Errorf("expected a's new event to be concurrent with c")
+	}
+	if a.HappensBefore(a) || a.Concurrent(a) || !a.Equal(a.Snapshot().(*VectorClock)) {
+		t.Errorf("expected a clock to equal itself")
+	}
+}
+
+type vcMsg struct {
+	Body  string
+	Clock *VectorClock
+}
+
+func TestVectorClockInTuples(t *testing.T) {
+	d := NewD("a")
+	in := d.DeclareLSet("in", vcMsg{})
+	out := d.DeclareVectorClock("out")
+	d.JoinFlat(in, func(m *vcMsg) *VectorClock { return m.Clock }).Into(out)
+
+	x, y := d.NewVectorClock(), d.NewVectorClock()
+	x.Tick("a")
+	y.Tick("b")
+	in.DirectAdd(&vcMsg{"hi", x})
+	in.DirectAdd(&vcMsg{"hi", y})
+	if in.Size() != 2 {
+		t.Errorf("expected tuples differing by clock to be distinct")
+	}
+	d.Tick()
+	if out.Get("a") != 1 || out.Get("b") != 1 {
+		t.Errorf("expected joined clocks to merge, got: %v", out.Value())
+	}
+}
+
+func TestLHLL(t *testing.T) {
+	d := NewD("a")
+	a := d.DeclareLHLL("a")
+	if a.Estimate() != 0 || !IsZero(a) {
+		t.Errorf("expected an empty sketch to estimate 0, got: %d", a.Estimate())
+	}
+	within := func(got, exp int) bool {
+		return math.Abs(float64(got-exp)) <= 0.03*float64(exp) // ~4 std errors.
+	}
+	for i := 0; i < 100000; i++ {
+		a.DirectAdd(fmt.Sprintf("x%d", i))
+		a.DirectAdd(fmt.Sprintf("x%d", i)) // Duplicates don't count.
+	}
+	if !within(a.Estimate(), 100000) {
+		t.Errorf("expected about 100000, got: %d", a.Estimate())
+	}
+
+	b := d.NewLHLL(LHLLPrecision)
+	for i := 50000; i < 150000; i++ {
+		b.DirectAdd(fmt.Sprintf("x%d", i))
+	}
+	u := a.Snapshot().(*LHLL)
+	if !u.DirectMerge(b) || u.DirectMerge(b) || !within(u.Estimate(), 150000) {
+		t.Errorf("expected the merge to estimate the union, got: %d", u.Estimate())
+	}
+	if a.DirectMerge(a.Snapshot().(Relation)) {
+		t.Errorf("expected merging itself to change nothing")
+	}
+
+	small := d.NewLHLL(LHLLPrecision)
+	for i := 0; i < 100; i++ {
+		small.DirectAdd(&RaftVote{i, "a"})
+	}
+	if !within(small.Estimate(), 100) {
+		t.Errorf("expected small counts to be close, got: %d", small.Estimate())
+	}
+
+	// Joins count elements by their registers.
+	ids := d.DeclareLSet("ids", "id")
+	c := d.DeclareLHLL("c")
+	d.Join(ids, func(id *string) *LHLLRegister { return c.Register(*id) }).Into(c)
+	for i := 0; i < 1000; i++ {
+		ids.DirectAdd(fmt.Sprintf("id%d", i))
+	}
+	d.Tick()
+	if !within(c.Estimate(), 1000) || RelationValue(c) != c.Estimate() {
+		t.Errorf("expected joined ids counted, got: %d", c.Estimate())
+	}
+
+	defer func() {
+		if recover() == nil {
+			t.Errorf("expected merging sketches of different precision to panic")
+		}
+	}()
+	a.DirectMerge(d.NewLHLL(10))
+}
+
+func TestLBloom(t *testing.T) {
+	d := NewD("a")
+	const size, hashes, n = 10000, 5, 1000
+	a := d.DeclareLBloom("a", size, hashes)
+	for i := 0; i < n; i++ {
+		a.DirectAdd(fmt.Sprintf("req%d", i))
+	}
+	for i := 0; i < n; i++ {
+		if !a.MayContain(fmt.Sprintf("req%d", i)) {
+			t.Fatalf("expected no false negatives, missing: req%d", i)
+		}
+	}
+	fp := 0
+	for i := n; i < n+100000; i++ {
+		if a.MayContain(fmt.Sprintf("req%d", i)) {
+			fp++
+		}
+	}
+	exp := math.Pow(1-math.Exp(-hashes*n/float64(size)), hashes) // ~0.0094.
+	if rate := float64(fp) / 100000; rate < exp/2 || rate > exp*2 {
+		t.Errorf("expected false positive rate near: %v, got: %v", exp, rate)
+	}
+
+	b := d.NewLBloom(size, hashes)
+	b.DirectAdd(&RaftVote{1, "x"})
+	if !b.MayContain(&RaftVote{1, "x"}) || b.MayContain(&RaftVote{2, "x"}) {
+		t.Errorf("expected elements hashed by value")
+	}
+	u := a.Snapshot().(*LBloom)
+	if !u.DirectMerge(b) || u.DirectMerge(b) || u.DirectMerge(a) ||
+		!u.MayContain(&RaftVote{1, "x"}) || !u.MayContain("req0") {
+		t.Errorf("expected an idempotent merge holding both filters")
+	}
+	if u.Count() > a.Count()+b.Count() || u.Count() < a.Count() {
+		t.Errorf("expected merged bits to be the union, got: %d", u.Count())
+	}
+
+	// Joins add elements by merging filters of them, and the set bits
+	// round trip through Scan().
+	ids := d.DeclareLSet("ids", "id")
+	c := d.DeclareLBloom("c", size, hashes)
+	d.JoinFlat(ids, func(id *string) *LBloom { return c.Of(*id) }).Into(c)
+	ids.DirectAdd("id0")
+	d.Tick()
+	cp := d.NewLBloom(size, hashes)
+	for x := range c.Scan() {
+		cp.DirectAdd(x)
+	}
+	if !c.MayContain("id0") || !cp.MayContain("id0") || cp.Count() != c.Count() {
+		t.Errorf("expected joined ids added, got bits: %d", c.Count())
+	}
+}
+
+func TestPNCounter(t *testing.T) {
+	addrs := []string{"a", "b", "c"}
+	cs := map[string]*PNCounter{}
+	for _, a := range addrs {
+		cs[a] = NewD(a).DeclarePNCounter("count")
+	}
+	cs["a"].Inc("a", 5)
+	cs["b"].Dec("b", 2)
+	cs["a"].DirectMerge(cs["b"])
+	cs["c"].Dec("c", 4)
+	cs["b"].Inc("b", 1)
+	cs["c"].DirectMerge(cs["a"])
+	cs["a"].Dec("a", 1)
+	cs["b"].DirectMerge(cs["c"])
+	cs["b"].DirectMerge(cs["a"])
+	cs["a"].DirectMerge(cs["b"])
+	cs["c"].DirectMerge(cs["b"])
+	cs["c"].DirectMerge(cs["a"])
+	for _, a := range addrs {
+		if cs[a].Value() != -1 {
+			t.Errorf("expected %s to converge to -1, got: %v", a, cs[a].Value())
+		}
+	}
+
+	d := NewD("d")
+	dst := d.DeclarePNCounter("dst")
+	n := 0
+	for x := range cs["a"].Scan() {
+		dst.DirectAdd(x)
+		dst.DirectAdd(x)
+		n++
+	}
+	if n != 5 {
+		t.Errorf("expected 5 scanned entries, got: %v", n)
+	}
+	if dst.Value() != -1 {
+		t.Errorf("expected scanned entries to rebuild -1, got: %v", dst.Value())
+	}
+}
+
+type testRingEntry struct {
+	Index int
+	Msg   string
+}
+
+func TestLRing(t *testing.T) {
+	d := NewD("a")
+	r := d.DeclareLRing("r", testRingEntry{}, 3, "Index")
+	indexes := func(m *LRing) (rv []int) {
+		for _, x := range m.Tuples() {
+			rv = append(rv, x.(*testRingEntry).Index)
+		}
+		return rv
+	}
+	for i := 1; i <= 5; i++ {
+		if !r.DirectAdd(&testRingEntry{i, "m"}) {
+			t.Errorf("expected newer entry %d to change the ring", i)
+		}
+	}
+	if got := indexes(r); !reflect.DeepEqual(got, []int{3, 4, 5}) {
+		t.Errorf("expected window to slide to 3,4,5, got: %v", got)
+	}
+	if r.DirectAdd(&testRingEntry{2, "m"}) || r.DirectAdd(&testRingEntry{5, "m"}) {
+		t.Errorf("expected older or existing entries to not change the ring")
+	}
+
+	o := d.NewLRing(reflect.TypeOf(testRingEntry{}), 3, "Index")
+	for _, i := range []int{1, 4, 6, 7} {
+		o.DirectAdd(&testRingEntry{i, "o"})
+	}
+	a, b := r.Snapshot().(*LRing), o.Snapshot().(*LRing)
+	if !a.DirectMerge(o) || !b.DirectMerge(r) {
+		t.Errorf("expected merges to change")
+	}
+	exp := []int{5, 6, 7}
+	if !reflect.DeepEqual(indexes(a), exp) || !reflect.DeepEqual(a.Tuples(), b.Tuples()) {
+		t.Errorf("expected merges to converge on top 3: %v, got: %v and %v",
+			exp, a.Tuples(), b.Tuples())
+	}
+	if a.DirectMerge(b) || a.DirectMerge(o) {
+		t.Errorf("expected re-merge to be idempotent")
+	}
+
+	s := d.DeclareLSet("s", testRingEntry{})
+	d.Join(s).Into(r)
+	d.AddNext(s, &testRingEntry{9, "s"})
+	d.Tick()
+	if got := indexes(r); !reflect.DeepEqual(got, []int{4, 5, 9}) {
+		t.Errorf("expected joined entry in window, got: %v", got)
+	}
+
+	defer func() {
+		if recover() == nil {
+			t.Errorf("expected panic on a non-integer key")
+		}
+	}()
+	d.DeclareLRing("bad", testRingEntry{}, 3, "Msg")
+}
+
+type testHeartbeat struct {
+	From string
+	Tick int64
+}
+
+func TestLWindow(t *testing.T) {
+	d := NewD("a")
+	recv := d.DeclareLSet("recv", "")
+	recv.DeclareScratch()
+	win := d.DeclareLWindow("win", testHeartbeat{}, 3, "Tick")
+	rates := d.DeclareLSet("rates", AggResult{})
+	rates.DeclareScratch()
+	d.Join(recv, func(from *string) *testHeartbeat {
+		return &testHeartbeat{From: *from}
+	}).StampTick("Tick").Into(win)
+	d.JoinAgg(win, func(x interface{}) string {
+		return x.(*testHeartbeat).From
+	}, AggCount, nil).Into(rates)
+
+	sent := [][]string{{"b", "c"}, {"b"}, {"b"}, {}, {"c"}, {}}
+	for tick, froms := range sent {
+		for _, from := range froms {
+			d.Add(recv, from)
+		}
+		d.Tick()
+		for _, x := range win.Tuples() {
+			if h := x.(*testHeartbeat); h.Tick <= int64(tick)-3 {
+				t.Errorf("tick %d: expected old heartbeat evicted: %#v", tick, h)
+			}
+		}
+	}
+	if win.Size() != 1 || !rates.Contains(AggResult{"c", 1}) || rates.Size() != 1 {
+		t.Errorf("expected just c's recent heartbeat, got: %v, %v",
+			RelationValue(win), RelationValue(rates))
+	}
+
+	if win.DirectAdd(&testHeartbeat{"b", 1}) {
+		t.Errorf("expected a heartbeat older than the window to be ignored")
+	}
+	d.Tick()
+	d.Tick()
+	if win.Size() != 0 {
+		t.Errorf("expected empty window, got: %v", RelationValue(win))
+	}
+}
+
+func TestLWWReg(t *testing.T) {
+	d := NewD("a")
+	r := d.DeclareLWWReg("r")
+	if !r.Set(10, "b") {
+		t.Errorf("expected first set to change")
+	}
+	if r.Set(5, "z") {
+		t.Errorf("expected older timestamp to lose")
+	}
+	if r.Set(10, "a") {
+		t.Errorf("expected tie to keep the larger value")
+	}
+	if !r.Set(10, "c") {
+		t.Errorf("expected tie to pick the larger value")
+	}
+	if r.Value() != "c" || r.Timestamp() != 10 {
+		t.Errorf("expected c@10, got: %v@%v", r.Value(), r.Timestamp())
+	}
+
+	o := d.NewLWWReg()
+	o.Set(11, "a")
+	if !r.DirectMerge(o) || r.Value() != "a" || r.Timestamp() != 11 {
+		t.Errorf("expected merge to take the newer a@11, got: %v@%v",
+			r.Value(), r.Timestamp())
+	}
+	if r.DirectMerge(o) || o.DirectMerge(r) {
+		t.Errorf("expected re-merge to be idempotent")
+	}
+
+	s := d.Scratch(d.DeclareLWWReg("s")).(*LWWReg)
+	d.Join(r).Into(s)
+	d.Tick()
+	if s.Value() != "a" {
+		t.Errorf("expected joined register to be a, got: %v", s.Value())
+	}
+	r2 := d.Scratch(d.DeclareLWWReg("r2")).(*LWWReg)
+	r2.Set(3, "x")
+	d.Tick()
+	if r2.Value() != "" || r2.Timestamp() != 0 {
+		t.Errorf("expected scratch register to reset")
+	}
+}
+
+func TestORSet(t *testing.T) {
+	a := NewD("a").DeclareORSet("s", "elemString")
+	b := NewD("b").DeclareORSet("s", "elemString")
+
+	a.Add("x")
+	a.Add("y")
+	b.DirectMerge(a)
+	if !b.Contains("x") || !b.Contains("y") || b.Size() != 2 {
+		t.Errorf("expected b to have x and y")
+	}
+
+	// Concurrent remove at a and re-add at b, so add wins.
+	a.Remove("x")
+	if a.Contains("x") {
+		t.Errorf("expected x removed at a")
+	}
+	b.Add("x")
+	a.DirectMerge(b)
+	b.DirectMerge(a)
+	if !a.Contains("x") || !b.Contains("x") {
+		t.Errorf("expected concurrent add to win")
+	}
+
+	// A remove that observed every add does delete.
+	b.Remove("y")
+	a.DirectMerge(b)
+	if a.Contains("y") || b.Contains("y") || a.Size() != 1 {
+		t.Errorf("expected y removed everywhere")
+	}
+
+	if a.DirectMerge(b) || b.DirectMerge(a) {
+		t.Errorf("expected re-merge to be idempotent")
+	}
+
+	d := NewD("c")
+	src := d.DeclareLSet("src", "elemString")
+	dst := d.DeclareORSet("dst", "elemString")
+	d.Join(src).Into(dst)
+	src.DirectAdd("z")
+	d.Tick()
+	d.Tick()
+	if !dst.Contains("z") || dst.Size() != 1 || len(dst.adds["\"z\""]) != 1 {
+		t.Errorf("expected join into ORSet to add z just once")
+	}
+}
+
+func TestORSetRestoredSeq(t *testing.T) {
+	d := NewD("a")
+	s := d.DeclareORSet("s", "elemString")
+	s.Add("x")
+	s.Add("y")
+	b, err := d.MarshalState()
+	if err != nil {
+		t.Fatalf("expected marshal to work, err: %v", err)
+	}
+
+	// A restart that restores the state, where reissuing a token could
+	// make a remove of one add delete another.
+	d2 := NewD("a")
+	s2 := d2.DeclareORSet("s", "elemString")
+	if err = d2.UnmarshalState(b); err != nil {
+		t.Fatalf("expected unmarshal to work, err: %v", err)
+	}
+	s2.Add("z")
+	if !s2.adds[`"z"`]["a/s/3"] {
+		t.Errorf("expected a fresh token for z, got: %v", s2.adds[`"z"`])
+	}
+
+	// A restart without the state, which learns its tokens by merging.
+	d3 := NewD("a")
+	s3 := d3.DeclareORSet("s", "elemString")
+	s3.DirectMerge(s)
+	s3.Add("z")
+	if !s3.adds[`"z"`]["a/s/3"] {
+		t.Errorf("expected merged tokens to not be reissued, got: %v", s3.adds[`"z"`])
+	}
+}
+
+func TestRetractSetPolicy(t *testing.T) {
+	for _, c := range []struct {
+		policy RetractPolicy
+		want   bool
+	}{{RetractAddWins, true}, {RetractRemoveWins, false}} {
+		a := NewD("a").DeclareRetractSet("s", "elemString", c.policy)
+		b := NewD("b").DeclareRetractSet("s", "elemString", c.policy)
+		a.Add("x")
+		b.DirectMerge(a)
+		a.Remove("x") // Concurrent with b's re-add.
+		b.Add("x")
+		a.DirectMerge(b)
+		b.DirectMerge(a)
+		if a.Contains("x") != c.want || b.Contains("x") != c.want {
+			t.Errorf("policy: %d, expected x present: %v, got: %v, %v",
+				c.policy, c.want, a.Contains("x"), b.Contains("x"))
+		}
+		a.Remove("x")
+		a.Add("x") // Sequential adds and removes apply in order.
+		if !a.Contains("x") || a.Remove("x") && a.Contains("x") {
+			t.Errorf("policy: %d, expected sequential add then remove", c.policy)
+		}
+	}
+}
+
+func TestRetractSetJoin(t *testing.T) {
+	type edge struct{ From, To string }
+
+	d := NewD("")
+	edges := d.DeclareRetractSet("edges", edge{}, RetractAddWins)
+	reach := d.DeclareRetractSet("reach", edge{}, RetractAddWins)
+	fromA := d.DeclareRetractSet("fromA", "", RetractAddWins)
+	seen := d.DeclareLSet("seen", edge{})
+	d.Join(edges).Into(reach)
+	d.Join(edges, reach, func(e *edge, r *edge) *edge {
+		if e.To != r.From {
+			return nil
+		}
+		return &edge{e.From, r.To}
+	}).Into(reach)
+	d.Join(reach, func(r *edge) string {
+		if r.From != "a" {
+			return ""
+		}
+		return r.To
+	}).Into(fromA)
+	d.Join(reach).Into(seen) // Grow-only, so never retracts.
+
+	edges.Add(edge{"a", "b"})
+	edges.Add(edge{"b", "c"})
+	edges.Add(edge{"c", "d"})
+	d.Tick()
+	if reach.Size() != 6 || !reach.Contains(edge{"a", "d"}) ||
+		!fromA.Contains("d") {
+		t.Errorf("expected transitive closure, got: %v", RelationValue(reach))
+	}
+
+	edges.Remove(edge{"b", "c"})
+	d.Tick()
+	for _, e := range []edge{{"a", "c"}, {"a", "d"}, {"b", "c"}, {"b", "d"}} {
+		if reach.Contains(e) {
+			t.Errorf("expected retracted edge to remove: %v", e)
+		}
+	}
+	if reach.Size() != 2 || fromA.Contains("c") || fromA.Contains("d") ||
+		!fromA.Contains("b") {
+		t.Errorf("expected dependent retractions, reach: %v, fromA: %v",
+			RelationValue(reach), RelationValue(fromA))
+	}
+	if seen.Size() != 6 {
+		t.Errorf("expected grow-only relation to keep tuples, got: %d", seen.Size())
+	}
+	if !d.RunUntilQuiescent(5) {
+		t.Errorf("expected settled retractions to quiesce")
+	}
+
+	edges.Add(edge{"b", "c"})
+	d.Tick()
+	if reach.Size() != 6 || !fromA.Contains("d") {
+		t.Errorf("expected re-added edge to rederive, got: %v", RelationValue(reach))
+	}
+}
+
+func TestMinus(t *testing.T) {
+	d := NewD("a")
+	all := d.DeclareLSet("all", "numString")
+	excludeSrc := d.DeclareLSet("excludeSrc", "numString")
+	exclude := d.DeclareLSet("exclude", "numString")
+	dest := d.DeclareLSet("dest", "numString")
+
+	// Declared before exclude is computed, so a naive evaluation would
+	// let "2" into dest before exclude has it.
+	d.Join(all).Minus(exclude).Into(dest)
+	d.Join(excludeSrc).Into(exclude)
+
+	for _, x := range []string{"1", "2", "3"} {
+		all.DirectAdd(x)
+	}
+	excludeSrc.DirectAdd("2")
+	d.Tick()
+	if dest.Size() != 2 || dest.Contains("2") ||
+		!dest.Contains("1") || !dest.Contains("3") {
+		t.Errorf("expected dest to be all minus exclude, got: %#v", dest.m)
+	}
+
+	if !all.Remove("1") || all.Remove("1") || all.Contains("1") {
+		t.Errorf("expected LSet.Remove to remove once")
+	}
+}
+
+func TestMinusUnstratifiable(t *testing.T) {
+	d := NewD("a")
+	x := d.DeclareLSet("x", "numString")
+	y := d.DeclareLSet("y", "numString")
+	d.Join(x).Minus(y).Into(y)
+	defer func() {
+		if recover() == nil {
+			t.Errorf("expected cycle through Minus() to panic")
+		}
+	}()
+	d.Tick()
+}
+
+func TestAddVersusAddNext(t *testing.T) {
+	d := NewD("a")
+	src := d.DeclareLSet("src", "numString")
+	now := d.DeclareLSet("now", "numString")
+	later := d.DeclareLSet("later", "numString")
+	seen := d.DeclareLSet("seen", "numString")
+	d.Join(src, func(s *string) {
+		d.Add(now, *s)
+		d.AddNext(later, *s)
+	})
+	d.Join(now).Into(seen)
+	d.Join(later).Into(seen)
+
+	src.DirectAdd("1")
+	d.Tick()
+	if !now.Contains("1") || !seen.Contains("1") || later.Size() != 0 {
+		t.Errorf("expected Add() to be seen by joins within the tick" +
+			", and AddNext() not")
+	}
+	d.Tick()
+	if !later.Contains("1") {
+		t.Errorf("expected AddNext() to take effect at the next tick")
+	}
+}
+
+func TestAddToEarlierStratum(t *testing.T) {
+	setup := func(next bool) (*D, *LSet, *LSet) {
+		d := NewD("a")
+		all := d.DeclareLSet("all", "numString")
+		exclude := d.DeclareLSet("exclude", "numString")
+		dest := d.DeclareLSet("dest", "numString")
+		d.Join(all).Minus(exclude).Into(dest)
+		d.Join(dest, func(s *string) {
+			d.Add(exclude, "1") // Already there, so harmless.
+			if next {
+				d.AddNext(exclude, *s)
+			} else {
+				d.Add(exclude, *s) // Too late for the Minus().
+			}
+		})
+		all.DirectAdd("1")
+		all.DirectAdd("2")
+		exclude.DirectAdd("1")
+		return d, exclude, dest
+	}
+
+	d, exclude, dest := setup(true)
+	d.Tick()
+	d.Tick()
+	if !exclude.Contains("2") || !dest.Contains("2") {
+		t.Errorf("expected AddNext() to an earlier stratum to work")
+	}
+
+	d, exclude, _ = setup(false)
+	d.CollectErrors()
+	d.Tick()
+	if errs := d.Errors(); len(errs) != 1 ||
+		!strings.Contains(errs[0].Error(), "relation: exclude") ||
+		exclude.Contains("2") {
+		t.Errorf("expected Add() to an earlier stratum to be dropped, got: %v", errs)
+	}
+
+	d, _, _ = setup(false)
+	defer func() {
+		if recover() == nil {
+			t.Errorf("expected Add() to an earlier stratum to panic")
+		}
+	}()
+	d.Tick()
+}
+
+func TestShortestPathClosure(t *testing.T) {
+	d := ShortestPathInit(NewD(""), "")
+	links := d.Relations["ShortestPathLink"].(*LSet)
+	paths := d.Relations["ShortestPath"].(*LMap)
+
+	nodes := []string{"a", "b", "c", "d", "e"}
+	for i := 0; i < len(nodes)-1; i++ {
+		links.DirectAdd(&ShortestPathLink{From: nodes[i], To: nodes[i+1], Cost: 1})
+	}
+	d.Tick()
+	if paths.Len() != 10 {
+		t.Errorf("expected full closure of 10 paths in one tick, got: %v",
+			paths.Len())
+	}
+	if p := ShortestPathGet(d, "", "a", "e"); p == nil ||
+		*p != (ShortestPath{From: "a", To: "e", Next: "b", Cost: 4}) {
+		t.Errorf("expected 4 hop path from a to e, got: %#v", p)
+	}
+}
+
+func TestAsyncJoinSeesFixpoint(t *testing.T) {
+	d := NewD("a")
+	src := d.DeclareLSet("src", "numString")
+	count := d.DeclareLMax("count")
+	seen := d.DeclareLSet("seen", 0)
+
+	d.Join(count).IntoAsync(seen)
+	d.Join(src, func(s *string) int { return src.Size() }).Into(count)
+	d.Join(src, func(s *string) *string {
+		if *s == "x" {
+			y := "y"
+			return &y
+		}
+		return nil
+	}).Into(src)
+
+	src.DirectAdd("x")
+	d.Tick()
+	d.Tick()
+	if seen.Size() != 1 || !seen.Contains(2) {
+		t.Errorf("expected async join to only see the fixpoint, got: %#v", seen.m)
+	}
+}
+
+func shortestPathGraph(d *D, r *rand.Rand, numNodes, numLinks int) *LMap {
+	links := d.Relations["ShortestPathLink"].(*LSet)
+	for links.Size() < numLinks {
+		from := r.Intn(numNodes)
+		links.DirectAdd(&ShortestPathLink{
+			From: fmt.Sprintf("n%d", from),
+			To:   fmt.Sprintf("n%d", from+1+r.Intn(3)), // Acyclic.
+			Cost: 1 + r.Intn(10),
+		})
+	}
+	return d.Relations["ShortestPath"].(*LMap)
+}
+
+func TestSemiNaiveMatchesNaive(t *testing.T) {
+	semi := ShortestPathInit(NewD(""), "")
+	naive := ShortestPathInit(NewD(""), "")
+	naive.naive = true
+
+	semiPaths := shortestPathGraph(semi, rand.New(rand.NewSource(1)), 40, 60)
+	naivePaths := shortestPathGraph(naive, rand.New(rand.NewSource(1)), 40, 60)
+	semi.Tick()
+	naive.Tick()
+
+	if semiPaths.Len() == 0 || semiPaths.Len() != naivePaths.Len() {
+		t.Errorf("expected same number of paths, semi: %v, naive: %v",
+			semiPaths.Len(), naivePaths.Len())
+	}
+	for _, k := range naivePaths.Keys() {
+		n := naivePaths.At(k).(*shortestPathBest).path
+		s, ok := semiPaths.At(k).(*shortestPathBest)
+		if !ok || *s.path != *n {
+			t.Errorf("expected semi-naive to have path: %#v", n)
+		}
+	}
+}
+
+func TestIncrementalMatchesFull(t *testing.T) {
+	d := ShortestPathInit(NewD(""), "")
+	links := d.Relations["ShortestPathLink"].(*LSet)
+	evals := 0
+	d.Join(links, func(l *ShortestPathLink) string {
+		evals++
+		return l.From
+	}).SemiNaive().Into(d.DeclareLSet("froms", ""))
+
+	r := rand.New(rand.NewSource(1))
+	for i := 0; i < 30; i++ {
+		from := r.Intn(20)
+		d.AddNext(links, &ShortestPathLink{From: fmt.Sprintf("n%d", from),
+			To: fmt.Sprintf("n%d", (from+1+r.Intn(4))%20), Cost: 1 + r.Intn(10)})
+		before := evals
+		d.Tick()
+		if i > 0 && evals-before > 1 {
+			t.Errorf("tick %d: expected only the new link to be joined, got: %d",
+				i, evals-before)
+		}
+
+		full := ShortestPathInit(NewD(""), "")
+		full.naive = true
+		for _, l := range links.m {
+			full.Relations["ShortestPathLink"].DirectAdd(l)
+		}
+		full.Tick()
+		if !reflect.DeepEqual(ShortestPaths(d, ""), ShortestPaths(full, "")) {
+			t.Fatalf("tick %d: expected incremental paths to match full", i)
+		}
+		if !reflect.DeepEqual(RelationValue(d.Relations["ShortestPathNegativeCycle"]),
+			RelationValue(full.Relations["ShortestPathNegativeCycle"])) {
+			t.Fatalf("tick %d: expected same negative cycles", i)
+		}
+	}
+}
+
+// Adds one link per tick to a large graph, where b.N ticks should
+// cost about b.N times a single small change, not a rebuild.
+func BenchmarkShortestPathAddLinkPerTick(b *testing.B) {
+	d := ShortestPathInit(NewD(""), "")
+	shortestPathGraph(d, rand.New(rand.NewSource(1)), 2000, 1000)
+	d.Tick()
+	links := d.Relations["ShortestPathLink"].(*LSet)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		d.AddNext(links, &ShortestPathLink{From: fmt.Sprintf("x%d", i),
+			To: fmt.Sprintf("y%d", i), Cost: 1}) // Adds a single path.
+		d.Tick()
+	}
+}
+
+func benchmarkShortestPath(b *testing.B, naive bool) {
+	for i := 0; i < b.N; i++ {
+		d := ShortestPathInit(NewD(""), "")
+		d.naive = naive
+		shortestPathGraph(d, rand.New(rand.NewSource(1)), 2000, 1000)
+		d.Tick()
+	}
+}
+
+func testLinks(n int) []interface{} {
+	links := make([]interface{}, n)
+	for i := range links {
+		links[i] = &ShortestPathLink{From: fmt.Sprintf("n%d", i),
+			To: fmt.Sprintf("n%d", i+1), Cost: i}
+	}
+	return links
+}
+
+func TestAddAll(t *testing.T) {
+	links := testLinks(100)
+	links = append(links, links[0]) // A duplicate.
+
+	d := NewD("")
+	one := d.DeclareLSet("one", ShortestPathLink{})
+	all := d.DeclareLSet("all", ShortestPathLink{})
+	direct := d.DeclareLSet("direct", ShortestPathLink{})
+	d.Join(one).Into(d.DeclareLSet("seen", ShortestPathLink{})) // Adds apply in fixpoints.
+	for _, l := range links {
+		d.Add(one, l)
+	}
+	d.AddAll(all, links)
+	d.Tick()
+	if !direct.DirectAddAll(links) || direct.DirectAddAll(links[:1]) {
+		t.Errorf("expected DirectAddAll to report changes")
+	}
+	if one.Size() != 100 || !reflect.DeepEqual(one.m, all.m) ||
+		!reflect.DeepEqual(one.m, direct.m) {
+		t.Errorf("expected same membership, got sizes: %d, %d, %d",
+			one.Size(), all.Size(), direct.Size())
+	}
+}
+
+func benchmarkAddLinks(b *testing.B, all bool) {
+	links := testLinks(10000)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		d := NewD("")
+		r := d.DeclareLSet("links", ShortestPathLink{})
+		d.Join(r).Into(d.DeclareLSet("seen", ShortestPathLink{}))
+		if all {
+			d.AddAll(r, links)
+		} else {
+			for _, l := range links {
+				d.Add(r, l)
+			}
+		}
+		d.Tick()
+	}
+}
+
+func BenchmarkAddLinks(b *testing.B) { benchmarkAddLinks(b, false) }
+
+func BenchmarkAddAllLinks(b *testing.B) { benchmarkAddLinks(b, true) }
+
+func benchmarkDirectAddLinks(b *testing.B, all bool) {
+	links := testLinks(10000)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		r := NewD("").DeclareLSet("links", ShortestPathLink{})
+		if all {
+			r.DirectAddAll(links)
+		} else {
+			for _, l := range links {
+				r.DirectAdd(l)
+			}
+		}
+	}
+}
+
+func BenchmarkDirectAddLinks(b *testing.B) { benchmarkDirectAddLinks(b, false) }
+
+func BenchmarkDirectAddAllLinks(b *testing.B) { benchmarkDirectAddLinks(b, true) }
+
+func BenchmarkShortestPathSemiNaive(b *testing.B) { benchmarkShortestPath(b, false) }
+
+func BenchmarkShortestPathNaive(b *testing.B) { benchmarkShortestPath(b, true) }
+
+// Declares width independent joins that each do some work per tuple
+// of a shared source, fanning back into a single relation.
+func wideFanOut(d *D, width, n int) *LSet {
+	src := d.DeclareLSet("src", 0)
+	all := d.DeclareLSet("all", "")
+	for w := 0; w < width; w++ {
+		w := w
+		out := d.DeclareLSet(fmt.Sprintf("out%d", w), "")
+		d.Join(src, func(x *int) string {
+			h := uint32(*x*width + w)
+			for i := 0; i < 200; i++ {
+				h = h*16777619 ^ uint32(i)
+			}
+			return fmt.Sprintf("%d/%x", w, h%64)
+		}).Into(out)
+		d.Join(out).Into(all)
+	}
+	for i := 0; i < n; i++ {
+		src.DirectAdd(i)
+	}
+	return all
+}
+
+func TestParallelMatchesSerial(t *testing.T) {
+	run := func(workers int) (*D, []interface{}) {
+		d := NewD("")
+		d.Workers = workers
+		d.SortedScan = true
+		wideFanOut(d, 16, 50)
+		shortestPathGraph(ShortestPathInit(d, ""), rand.New(rand.NewSource(1)), 40, 60)
+		groups := d.DeclareLSet("groups", AggResult{})
+		d.JoinAgg(d.Relations["all"], func(s interface{}) string {
+			return strings.SplitN(s.(string), "/", 2)[0]
+		}, AggCount, nil).Into(groups)
+		var changes []interface{}
+		d.OnChange("all", func(added interface{}) {
+			changes = append(changes, added)
+		})
+		d.Tick()
+		d.Tick()
+		return d, changes
+	}
+	serial, serialChanges := run(0)
+	parallel, parallelChanges := run(4)
+
+	if len(serialChanges) == 0 ||
+		!reflect.DeepEqual(serialChanges, parallelChanges) {
+		t.Errorf("expected same changes in the same order, serial: %d"+
+			", parallel: %d", len(serialChanges), len(parallelChanges))
+	}
+	for name, r := range serial.Relations {
+		if !reflect.DeepEqual(RelationValue(r),
+			RelationValue(parallel.Relations[name])) {
+			t.Errorf("expected same %s, serial: %v, parallel: %v", name,
+				RelationValue(r), RelationValue(parallel.Relations[name]))
+		}
+	}
+}
+
+func benchmarkWideFanOut(b *testing.B, workers int) {
+	for i := 0; i < b.N; i++ {
+		d := NewD("")
+		d.Workers = workers
+		wideFanOut(d, 64, 200)
+		d.Tick()
+	}
+}
+
+func BenchmarkWideFanOutSerial(b *testing.B) { benchmarkWideFanOut(b, 0) }
+
+func BenchmarkWideFanOutParallel(b *testing.B) { benchmarkWideFanOut(b, 8) }
+
+func TestLMapTypedAt(t *testing.T) {
+	d := NewD("a")
+	m := d.DeclareLMap("m")
+	if m.Len() != 0 || len(m.Keys()) != 0 {
+		t.Errorf("expected empty map")
+	}
+	if _, ok := m.AtLSet("x"); ok {
+		t.Errorf("expected missing key to not be ok")
+	}
+
+	m.DirectAdd(&LMapEntry{"s", NewLSetOne(d, "v")})
+	m.DirectAdd(&LMapEntry{"n", NewLMax(d, 3)})
+	m.DirectAdd(&LMapEntry{"b", NewLBool(d, true)})
+
+	if s, ok := m.AtLSet("s"); !ok || !s.Contains("v") {
+		t.Errorf("expected LSet at s")
+	}
+	if n, ok := m.AtLMax("n"); !ok || n.Int() != 3 {
+		t.Errorf("expected LMax at n")
+	}
+	if b, ok := m.AtLBool("b"); !ok || !b.Bool() {
+		t.Errorf("expected LBool at b")
+	}
+	if _, ok := m.AtLBool("n"); ok {
+		t.Errorf("expected wrong lattice type to not be ok")
+	}
+	if m.Len() != 3 || fmt.Sprintf("%v", m.Keys()) != "[b n s]" {
+		t.Errorf("expected 3 sorted keys, got: %v", m.Keys())
+	}
+}
+
+type testLeft struct {
+	Id   int
+	Name string
+}
+
+type testRight struct {
+	LeftId int
+	Val    int
+}
+
+func testJoinOnProgram(n int, on, typed bool) (*D, *LSet) {
+	d := NewD("a")
+	left := d.DeclareLSet("left", testLeft{})
+	right := d.DeclareLSet("right", testRight{})
+	out := d.DeclareLSet("out", "nameVal")
+	f := func(l *testLeft, r *testRight) *string {
+		if l.Id != r.LeftId {
+			return nil
+		}
+		s := fmt.Sprintf("%s=%d", l.Name, r.Val)
+		return &s
+	}
+	if on {
+		d.JoinOn([]string{"Id", "LeftId"}, left, right, f).Into(out)
+	} else if typed {
+		Join2(d, left, right, f).Into(out)
+	} else {
+		d.Join(left, right, f).Into(out)
+	}
+	for i := 0; i < n; i++ {
+		left.DirectAdd(&testLeft{i, fmt.Sprintf("n%d", i)})
+		right.DirectAdd(&testRight{i % (n / 2), i})
+	}
+	return d, out
+}
+
+func TestScanStats(t *testing.T) {
+	d, _ := testJoinOnProgram(10, false, false)
+	d.EnableScanStats()
+	d.Tick() // Results change out, so the fixpoint evaluates the join twice.
+	s := d.ScanStats()
+	if len(s) != 1 || len(s[0].Sources) != 2 {
+		t.Fatalf("expected stats for 1 join of 2 sources, got: %#v", s)
+	}
+	l, r := s[0].Sources[0], s[0].Sources[1]
+	if l.Source != "left" || l.Scanned != 20 || l.Passed != 20 {
+		t.Errorf("expected left scanned per evaluation, got: %#v", l)
+	}
+	if r.Source != "right" || r.Scanned != 200 || r.Passed != 200 {
+		t.Errorf("expected right scanned per left tuple, got: %#v", r)
+	}
+	if s[0].Combos != 200 || s[0].Results != 20 {
+		t.Errorf("expected 20 of 200 combos to produce results, got: %#v", s[0])
+	}
+
+	d, _ = testJoinOnProgram(10, true, false)
+	d.EnableScanStats()
+	d.Tick()
+	s = d.ScanStats()
+	l, r = s[0].Sources[0], s[0].Sources[1]
+	if l.Scanned != 20 || l.Passed != 20 || l.Indexed != 0 {
+		t.Errorf("expected left scanned per evaluation, got: %#v", l)
+	}
+	if r.Indexed != 20 || r.Scanned != 20 || r.Passed != 20 {
+		t.Errorf("expected right indexed per evaluation and looked up by key, got: %#v", r)
+	}
+	if s[0].Combos != 20 || s[0].Results != 20 {
+		t.Errorf("expected every keyed combo to produce a result, got: %#v", s[0])
+	}
+
+	d.DisableScanStats()
+	d.Tick()
+	if s2 := d.ScanStats(); s2[0].Combos != s[0].Combos {
+		t.Errorf("expected no counting while disabled, got: %#v", s2[0])
+	}
+}
+
+func TestDeclareConst(t *testing.T) {
+	d := NewD("a")
+	facts := d.DeclareConst("facts", "fact", "sky=blue", "grass=green")
+	perTick := d.Scratch(d.DeclareLSet("perTick", "fact")).(*LSet)
+	d.Join(facts).Into(perTick)
+	if !facts.IsConst() || facts.isScratch() {
+		t.Errorf("expected a non-scratch constant")
+	}
+	for i := 0; i < 3; i++ {
+		d.Tick()
+		if facts.Size() != 2 || perTick.Size() != 2 || !perTick.Contains("sky=blue") {
+			t.Errorf("tick: %d, expected facts on every tick, got: %v, %v",
+				i, facts.m, perTick.m)
+		}
+	}
+
+	facts.Remove("sky=blue")
+	d.Tick()
+	if !facts.Contains("sky=blue") || !perTick.Contains("sky=blue") {
+		t.Errorf("expected a removed fact restored on the next tick")
+	}
+	if facts.DirectAdd("grass=green") {
+		t.Errorf("expected re-adding a fact to change nothing")
+	}
+
+	d.CollectErrors()
+	d.Join(perTick).Into(facts)
+	if errs := d.Errors(); len(errs) != 1 ||
+		!strings.Contains(errs[0].Error(), "is a constant") {
+		t.Errorf("expected Into() a constant to fail, got: %v", errs)
+	}
+	defer func() {
+		if recover() == nil {
+			t.Errorf("expected adding to a constant to panic")
+		}
+	}()
+	facts.DirectAdd("sky=green")
+}
+
+func TestCheckDeterminism(t *testing.T) {
+	d := NewD("a")
+	d.CheckDeterminism()
+	d.CollectErrors()
+	in := d.DeclareLSet("in", "x")
+	out := d.DeclareLSet("out", "y")
+	flat := d.DeclareLSet("flat", "y")
+	calls := 0
+	d.Join(in, func(x *string) *string { return x }).Into(out)
+	d.JoinFlat(in, func(x *string) []*LSet {
+		return []*LSet{NewLSetOne(d, *x+"!"), nil}
+	}).Into(flat)
+	d.Join(in, func(x *string) *string {
+		calls++ // Reads state outside its params.
+		s := fmt.Sprintf("%s%d", *x, calls%2)
+		return &s
+	}).Name("flaky").Into(out)
+	in.DirectAdd("a")
+	d.Tick()
+
+	errs := d.Errors()
+	if len(errs) == 0 {
+		t.Fatalf("expected the nondeterministic join flagged")
+	}
+	for _, err := range errs {
+		if je := err.(*JoinError); je.Join != "flaky" ||
+			!strings.Contains(je.Msg, "nondeterministic join") {
+			t.Errorf("expected only the flaky join flagged, got: %v", err)
+		}
+	}
+	if !flat.Contains("a!") || !out.Contains("a") {
+		t.Errorf("expected results of deterministic joins, got: %v, %v", flat.m, out.m)
+	}
+
+	// Side effects happen as often as without checking, as with Raft's
+	// applying of entries.
+	sideEffects := func(check bool) (int, int) {
+		d := NewD("a")
+		if check {
+			d.CheckDeterminism()
+		}
+		in := d.DeclareLSet("in", "x")
+		out := d.DeclareLSet("out", "y")
+		later := d.DeclareLSet("later", "x")
+		applied := 0
+		d.Join(in, func(x *string) { applied++ })
+		d.Join(in, func(x *string) *string {
+			d.AddNext(later, *x)
+			return x
+		}).Into(out)
+		in.DirectAdd("a")
+		d.Tick()
+		return applied, len(d.Pending(later))
+	}
+	applied, pending := sideEffects(false)
+	if a, p := sideEffects(true); a != applied || p != pending {
+		t.Errorf("expected side effects as without checking: %d, %d, got: %d, %d",
+			applied, pending, a, p)
+	}
+
+	d = NewD("a")
+	d.CheckDeterminism()
+	flaky := d.DeclareLMax("flaky")
+	d.Join(func() int { calls++; return calls % 2 }).Into(flaky)
+	defer func() {
+		if recover() == nil {
+			t.Errorf("expected a nondeterministic join to panic")
+		}
+	}()
+	d.Tick()
+}
+
+func TestDisableJoin(t *testing.T) {
+	d := NewD("a")
+	src := d.DeclareLSet("src", "")
+	dst := d.DeclareLSet("dst", "")
+	dst2 := d.DeclareLSet("dst2", "")
+	d.Join(src).Name("copy").SemiNaive().Into(dst)
+	d.Join(src, func(s *string) *string { return s }).Into(dst2)
+
+	src.DirectAdd("a")
+	d.Tick()
+	d.DisableJoin("copy")
+	d.DisableJoin("join#1")
+	src.DirectAdd("b")
+	d.Tick()
+	if dst.Size() != 1 || dst2.Size() != 1 {
+		t.Errorf("expected disabled joins to not update, got: %v, %v",
+			RelationValue(dst), RelationValue(dst2))
+	}
+
+	d.EnableJoin("copy")
+	d.Tick()
+	if dst.Size() != 2 || !dst.Contains("b") || dst2.Size() != 1 {
+		t.Errorf("expected re-enabled join to catch up, got: %v, %v",
+			RelationValue(dst), RelationValue(dst2))
+	}
+
+	defer func() {
+		if recover() == nil {
+			t.Errorf("expected DisableJoin() of an unknown join to panic")
+		}
+	}()
+	d.DisableJoin("nope")
+}
+
+func TestSnapshotReads(t *testing.T) {
+	// A join that consumes pending tuples directly, like Raft does with
+	// its clientPending, and another join that reads them.
+	run := func(snapshot, consumerFirst bool) int {
+		d := NewD("a")
+		d.SnapshotReads = snapshot
+		done := d.DeclareLSet("done", "")
+		pending := d.DeclareLSet("pending", "")
+		handled := d.DeclareLSet("handled", "")
+		seen := d.DeclareLSet("seen", "")
+		consume := func() {
+			d.Join(done, func(p *string) *string {
+				pending.Remove(*p)
+				return p
+			}).Into(handled)
+		}
+		if consumerFirst {
+			consume()
+		}
+		d.Join(pending).Into(seen)
+		if !consumerFirst {
+			consume()
+		}
+		// A d.Add() goes through the fixpoint, so it's seen regardless.
+		d.Join(handled, func(p *string) { d.Add(pending, "added") })
+		pending.DirectAdd("p")
+		done.DirectAdd("p")
+		d.Tick()
+		if handled.Size() != 1 || !seen.Contains("added") {
+			t.Errorf("expected d.Add() to be seen, got: %v", RelationValue(seen))
+		}
+		return seen.Size()
+	}
+	if run(false, true) == run(false, false) {
+		t.Errorf("expected live reads to depend on join order")
+	}
+	if a, b := run(true, true), run(true, false); a != b || a != 2 {
+		t.Errorf("expected snapshot reads to not depend on join order"+
+			", got: %d, %d", a, b)
+	}
+}
+
+func TestSelfJoin(t *testing.T) {
+	d := NewD("a")
+	links := d.DeclareLSet("links", ShortestPathLink{})
+	twoHop := d.DeclareLSet("twoHop", ShortestPathLink{})
+	twoHopOn := d.DeclareLSet("twoHopOn", ShortestPathLink{})
+	reach := d.DeclareLSet("reach", ShortestPathLink{})
+
+	// The same relation twice, each occurrence bound to its own param.
+	d.Join(links, links, func(a, b *ShortestPathLink) *ShortestPathLink {
+		if a.To != b.From {
+			return nil
+		}
+		return &ShortestPathLink{a.From, b.To, a.Cost + b.Cost}
+	}).Into(twoHop)
+	d.JoinOn([]string{"To", "From"}, links, links,
+		func(a, b *ShortestPathLink) *ShortestPathLink {
+			return &ShortestPathLink{a.From, b.To, a.Cost + b.Cost}
+		}).Into(twoHopOn)
+
+	// Transitive closure, with reach joined to itself.
+	d.Join(links).Into(reach)
+	d.JoinOn([]string{"To", "From"}, reach, reach,
+		func(a, b *ShortestPathLink) *ShortestPathLink {
+			return &ShortestPathLink{a.From, b.To, 0}
+		}).SemiNaive().Into(reach)
+
+	for _, l := range []string{"ab", "bc", "cd"} {
+		links.DirectAdd(&ShortestPathLink{l[:1], l[1:], 0})
+	}
+	d.Tick()
+	exp := []string{"a-c", "b-d"}
+	for _, r := range []*LSet{twoHop, twoHopOn} {
+		var got []string
+		for _, x := range RelationValue(r).([]interface{}) {
+			got = append(got, x.(*ShortestPathLink).From+"-"+x.(*ShortestPathLink).To)
+		}
+		if fmt.Sprintf("%v", got) != fmt.Sprintf("%v", exp) {
+			t.Errorf("expected two hops: %v, got: %v", exp, got)
+		}
+	}
+	if reach.Size() != 6 || !reach.Contains(&ShortestPathLink{"a", "d", 0}) {
+		t.Errorf("expected 6 reachable pairs, got: %v", RelationValue(reach))
+	}
+
+	links.DirectAdd(&ShortestPathLink{"d", "e", 0})
+	d.Tick()
+	if reach.Size() != 10 || !reach.Contains(&ShortestPathLink{"a", "e", 0}) {
+		t.Errorf("expected 10 reachable pairs, got: %v", RelationValue(reach))
+	}
+}
+
+func TestJoinOn(t *testing.T) {
+	d0, out0 := testJoinOnProgram(100, false, false)
+	d1, out1 := testJoinOnProgram(100, true, false)
+	d0.Tick()
+	d1.Tick()
+	if out0.Size() != 100 || out1.Size() != out0.Size() {
+		t.Errorf("expected 100 outputs, got: %v, %v", out0.Size(), out1.Size())
+	}
+	for k := range out0.m {
+		if _, ok := out1.m[k]; !ok {
+			t.Errorf("expected JoinOn to produce: %s", k)
+		}
+	}
+
+	d := NewD("a")
+	left := d.DeclareLSet("left", testLeft{})
+	strs := d.DeclareLSet("strs", "str")
+	for _, fields := range [][]string{{"Id"}, {"Nope", ""}, {"Id", "Id"}} {
+		func() {
+			defer func() {
+				if recover() == nil {
+					t.Errorf("expected bad JoinOn fields to panic: %v", fields)
+				}
+			}()
+			d.JoinOn(fields, left, strs)
+		}()
+	}
+}
+
+func benchmarkJoinOn(b *testing.B, on, typed bool) {
+	for i := 0; i < b.N; i++ {
+		d, _ := testJoinOnProgram(1000, on, typed)
+		d.Tick()
+	}
+}
+
+func BenchmarkJoinCrossProduct(b *testing.B) { benchmarkJoinOn(b, false, false) }
+
+func BenchmarkJoinCrossProductTyped(b *testing.B) { benchmarkJoinOn(b, false, true) }
+
+func BenchmarkJoinOnHash(b *testing.B) { benchmarkJoinOn(b, true, false) }
+
+func TestJoinTyped(t *testing.T) {
+	d0, out0 := testJoinOnProgram(100, false, false)
+	d1, out1 := testJoinOnProgram(100, false, true)
+	d0.Tick()
+	d1.Tick()
+	if out0.Size() != 100 || out1.Size() != out0.Size() {
+		t.Errorf("expected 100 outputs, got: %v, %v", out0.Size(), out1.Size())
+	}
+	for k := range out0.m {
+		if _, ok := out1.m[k]; !ok {
+			t.Errorf("expected typed join to produce: %s", k)
+		}
+	}
+
+	// Scalar sources and destinations, with a recursive join.
+	d := NewD("a")
+	x := d.DeclareLMax("x")
+	y := d.DeclareLMax("y")
+	strs := d.DeclareLSet("strs", "")
+	Join1(d, x, func(v *int) *int {
+		if *v >= 10 {
+			return nil
+		}
+		n := *v + 1
+		return &n
+	}).Into(x)
+	Join2(d, x, strs, func(v *int, s *string) *int {
+		n := *v + len(*s)
+		return &n
+	}).Into(y)
+	x.DirectAdd(1)
+	strs.DirectAdd("abc")
+	d.Tick()
+	if x.Int() != 10 || y.Int() != 13 {
+		t.Errorf("expected typed joins to reach x: 10, y: 13, got: %v, %v",
+			x.Int(), y.Int())
+	}
+
+	defer func() {
+		if r := recover(); r == nil ||
+			!strings.Contains(fmt.Sprintf("%v", r), "source: strs") {
+			t.Errorf("expected mismatched typed join param to panic, got: %v", r)
+		}
+	}()
+	Join1(d, strs, func(v *int) *int { return v })
+}
+
+func TestRunUntilQuiescent(t *testing.T) {
+	d := ShortestPathInit(NewD(""), "")
+	links := d.Relations["ShortestPathLink"].(*LSet)
+	paths := d.Relations["ShortestPath"].(*LMap)
+	links.DirectAdd(&ShortestPathLink{From: "a", To: "b", Cost: 1})
+	links.DirectAdd(&ShortestPathLink{From: "b", To: "c", Cost: 1})
+	links.DirectAdd(&ShortestPathLink{From: "c", To: "d", Cost: 1})
+	if !d.RunUntilQuiescent(10) {
+		t.Errorf("expected ShortestPath to quiesce")
+	}
+	if d.ticks != 2 {
+		t.Errorf("expected quiescence on the tick after the closure, got: %v",
+			d.ticks)
+	}
+	if paths.Len() != 6 {
+		t.Errorf("expected 6 paths, got: %v", paths.Len())
+	}
+
+	c := &fakeClock{now: time.Unix(1000, 0)}
+	d = NewD("a")
+	d.Now = func() time.Time { // Fires the periodic on every tick.
+		c.Advance(time.Second)
+		return c.now
+	}
+	p := d.DeclarePeriodic("p", time.Second)
+	fired := d.Scratch(d.DeclareLBool("fired")).(*LBool)
+	d.Join(p).Into(fired)
+	if !d.RunUntilQuiescent(10) || !p.Bool() || !fired.Bool() {
+		t.Errorf("expected periodic-only changes to still be quiescent")
+	}
+
+	d = NewD("a")
+	n := d.DeclareLMax("n")
+	d.Join(n, func(n *int) int { return *n + 1 }).IntoAsync(n)
+	if d.RunUntilQuiescent(10) {
+		t.Errorf("expected an ever incrementing counter to not quiesce")
+	}
+	if n.Int() != 9 {
+		t.Errorf("expected 9 increments in 10 ticks, got: %v", n.Int())
+	}
+
+	d = NewD("a")
+	n = d.DeclareLMax("n")
+	done := d.DeclareLBool("done")
+	d.Join(n, func(n *int) int { return *n + 1 }).IntoAsync(n)
+	d.Join(n, func(n *int) bool { return *n > 2 }).Into(done)
+	err := d.RunUntilQuiescentErr(10)
+	qe, ok := err.(*QuiescenceError)
+	if !ok {
+		t.Fatalf("expected a QuiescenceError, got: %v", err)
+	}
+	if !reflect.DeepEqual(qe.Changing, []string{"n"}) || qe.Changes["n"] != 3 {
+		t.Errorf("expected only n changing in the last ticks, got: %#v", qe)
+	}
+	if !strings.Contains(err.Error(), "n (3)") {
+		t.Errorf("expected the error to name n, got: %v", err)
+	}
+	if d.tickChanged != nil {
+		t.Errorf("expected change tracking to end with the run")
+	}
+}
+
+func newStateTestD() *D {
+	d := KVInit(NewD("a"), "")
+	TallyInit(d, "")
+	MultiTallyInit(d, "")
+	d.DeclareLMaxString("str")
+	d.DeclareLMinString("minStr")
+	return d
+}
+
+func TestMarshalState(t *testing.T) {
+	d := newStateTestD()
+	kvmap := d.Relations["kvMap"].(*LMap)
+	kvmap.DirectAdd(&LMapEntry{"k1", NewLMax(d, 5)})
+	kvmap.DirectAdd(&LMapEntry{"k2", NewLSetOne(d, "x")})
+	d.Relations["TallyNeed"].DirectAdd(2)
+	d.Relations["str"].DirectAdd("hello")
+	d.Relations["minStr"].DirectAdd("")
+	d.AddNext(d.Relations["MultiTallyVote"], &MultiTallyVote{"A", "a0"})
+	d.AddNext(d.Relations["TallyVote"], "v0")
+	d.Tick()
+
+	b, err := d.MarshalState()
+	if err != nil {
+		t.Fatalf("expected marshal to work, err: %v", err)
+	}
+
+	d2 := newStateTestD()
+	if err = d2.UnmarshalState(b); err != nil {
+		t.Fatalf("expected unmarshal to work, err: %v", err)
+	}
+	b2, err := d2.MarshalState()
+	if err != nil || string(b) != string(b2) {
+		t.Errorf("expected round trip to match, err: %v\n%s\n%s", err, b, b2)
+	}
+
+	kvmap2 := d2.Relations["kvMap"].(*LMap)
+	if n, ok := kvmap2.AtLMax("k1"); !ok || n.Int() != 5 {
+		t.Errorf("expected k1 restored")
+	}
+	if s, ok := kvmap2.AtLSet("k2"); !ok || !s.Contains("x") {
+		t.Errorf("expected k2 restored")
+	}
+	if d2.Relations["str"].(*LMaxString).String() != "hello" {
+		t.Errorf("expected str restored")
+	}
+	if m := d2.Relations["minStr"].(*LMinString); !m.IsSet() || m.String() != "" {
+		t.Errorf("expected set, empty minStr restored")
+	}
+	if !MultiTallyHasVoteFrom(d2, "", "A", "a0") {
+		t.Errorf("expected nested LSet of votes restored")
+	}
+	if _, ok := d2.Relations["KVPut"]; !ok || len(d2.Relations["KVPut"].(*LSet).m) != 0 {
+		t.Errorf("expected channels to be skipped")
+	}
+
+	if NewD("b").UnmarshalState(b) == nil {
+		t.Errorf("expected error restoring into an undeclared schema")
+	}
+}
+
+func TestMarshalStateRaftLeader(t *testing.T) {
+	clock := &fakeClock{now: time.Unix(1000, 0)}
+	tr := NewMemTransport()
+	addrs := []string{"a", "b", "c"}
+	ds := newRaftCluster(tr, addrs...)
+	for i, a := range addrs {
+		ds[a].Now = clock.Now
+		ds[a].Rand = rand.New(rand.NewSource(int64(i)))
+	}
+	var leader *D
+	for i := 0; i < 100 && leader == nil; i++ {
+		clock.Advance(10 * time.Millisecond)
+		for _, a := range addrs {
+			ds[a].Tick()
+		}
+		for _, a := range addrs {
+			if ds[a].Relations["raftCurState"].(*LMaxBy).Value().(raftState).Kind == state_LEADER {
+				leader = ds[a]
+			}
+		}
+	}
+	if leader == nil {
+		t.Fatalf("expected a leader")
+	}
+	leader.Tick()
+	if leader.Relations["raftNextIndex"].(*LMap).Len() == 0 {
+		t.Fatalf("expected the leader to track nextIndex")
+	}
+
+	b, err := leader.MarshalState()
+	if err != nil {
+		t.Fatalf("expected marshal to work, err: %v", err)
+	}
+	d2 := RaftInit(NewD(leader.Addr), "", nil)
+	if err = d2.UnmarshalState(b); err != nil {
+		t.Fatalf("expected unmarshal to work, err: %v", err)
+	}
+	b2, err := d2.MarshalState()
+	if err != nil || string(b) != string(b2) {
+		t.Errorf("expected round trip to match, err: %v\n%s\n%s", err, b, b2)
+	}
+	exp := nextIndexOf(leader.Relations["raftNextIndex"].(*LMap).At("b"))
+	n := d2.Relations["raftNextIndex"].(*LMap).At("b")
+	if n == nil || nextIndexOf(n) != exp {
+		t.Errorf("expected b's nextIndex restored, got: %v", n)
+	}
+	if !n.(*LMaxBy).DirectAdd(raftNextIndex{Version: exp.Version + 1}) {
+		t.Errorf("expected the restored nextIndex to merge by its less func")
+	}
+}
+
+func TestMarshalStateLattices(t *testing.T) {
+	newD := func(bloomSize int) *D {
+		d := NewD("a")
+		d.DeclareGCounter("gc")
+		d.DeclarePNCounter("pn")
+		d.DeclareVectorClock("vc")
+		d.DeclareLWWReg("lww")
+		d.DeclareLMaxFloat("maxf")
+		d.DeclareLMinFloat("minf")
+		d.DeclareMVReg("mv")
+		d.DeclareLRing("ring", testRingEntry{}, 2, "Index")
+		d.DeclareLWindow("win", testHeartbeat{}, 3, "Tick")
+		d.DeclareLTimeWindow("twin", testHeartbeat{}, time.Second, "Tick")
+		d.DeclareRetractSet("rs", "", RetractRemoveWins)
+		d.DeclareORSet("ors", "")
+		d.DeclareLHLL("hll")
+		d.DeclareLBloom("bloom", bloomSize, 3)
+		d.DeclareLMap("nested")
+		return d
+	}
+	d := newD(256)
+	d.Relations["gc"].(*GCounter).Inc("a", 2)
+	d.Relations["pn"].(*PNCounter).Inc("a", 5)
+	d.Relations["pn"].(*PNCounter).Dec("b", 1)
+	d.Relations["vc"].(*VectorClock).Tick("b")
+	d.Relations["lww"].(*LWWReg).Set(3, "w")
+	d.Relations["maxf"].DirectAdd(1.5)
+	d.Relations["mv"].(*MVReg).Set("a", NewLMax(d, 1))
+	d.Relations["mv"].DirectAdd(&MVRegSibling{map[string]int{"b": 1}, NewLMax(d, 2)})
+	for i := 1; i <= 3; i++ {
+		d.Relations["ring"].DirectAdd(&testRingEntry{i, "m"})
+	}
+	d.Relations["win"].DirectAdd(&testHeartbeat{"b", 0})
+	rs := d.Relations["rs"].(*RetractSet)
+	rs.Add("x")
+	rs.Add("y")
+	rs.Remove("y")
+	ors := d.Relations["ors"].(*ORSet)
+	ors.Add("x")
+	ors.Add("y")
+	ors.Remove("y")
+	d.Relations["hll"].DirectAdd("x")
+	d.Relations["bloom"].DirectAdd("x")
+	nested := d.Relations["nested"].(*LMap)
+	for _, name := range []string{"gc", "pn", "vc", "lww", "maxf", "minf", "mv",
+		"ring", "win", "twin", "rs", "ors", "hll", "bloom"} {
+		nested.DirectAdd(&LMapEntry{name, d.Relations[name].(Lattice).Snapshot()})
+	}
+
+	b, err := d.MarshalState()
+	if err != nil {
+		t.Fatalf("expected marshal to work, err: %v", err)
+	}
+	d2 := newD(256)
+	if err = d2.UnmarshalState(b); err != nil {
+		t.Fatalf("expected unmarshal to work, err: %v", err)
+	}
+	b2, err := d2.MarshalState()
+	if err != nil || string(b) != string(b2) {
+		t.Errorf("expected round trip to match, err: %v\n%s\n%s", err, b, b2)
+	}
+	nested2 := d2.Relations["nested"].(*LMap)
+	for name, r := range d.Relations {
+		exp, got := RelationValue(r), RelationValue(d2.Relations[name])
+		if name != "nested" && !reflect.DeepEqual(exp, got) {
+			t.Errorf("expected %s restored as: %#v, got: %#v", name, exp, got)
+		}
+		if v := nested2.At(name); v != nil && !reflect.DeepEqual(exp, RelationValue(v.(Relation))) {
+			t.Errorf("expected nested %s restored as: %#v, got: %#v", name, exp, v)
+		}
+	}
+	if !d2.Relations["ors"].(*ORSet).Contains("x") || d2.Relations["ors"].(*ORSet).Contains("y") {
+		t.Errorf("expected the ORSet's tombstones restored")
+	}
+	if d2.Relations["rs"].(*RetractSet).Add("y"); d2.Relations["rs"].(*RetractSet).Size() != 2 {
+		t.Errorf("expected the RetractSet's clocks restored")
+	}
+	if w := nested2.At("twin").(*LWindow); !w.timed {
+		t.Errorf("expected a nested time window to stay timed")
+	}
+
+	if err = newD(128).UnmarshalState(b); err == nil || !strings.Contains(err.Error(), "bloom") {
+		t.Errorf("expected error restoring a differently shaped LBloom, got: %v", err)
+	}
+}
+
+func TestDot(t *testing.T) {
+	d := TallyInit(NewD(""), "")
+	MultiTallyInit(d, "")
+	d.Join(d.Relations["tallyTotal"]).IntoAsync(d.DeclareLSet("later", "voterString"))
+
+	dot := d.Dot()
+	for _, exp := range []string{
+		"digraph gdec {",
+		`"TallyVote" [label="TallyVote\nLSet", style=dashed];`,
+		`"TallyNeed" [label="TallyNeed\nLMax"];`,
+		`"TallyVote" -> "tallyTotal" [label="tallyTotal"];`,
+		`"MultiTallyVote" -> "multiTallyTotal";`,
+		`"multiTallyTotal" -> "MultiTallyDone";`,
+		`"tallyTotal" -> "later" [label="async"];`,
+	} {
+		if !strings.Contains(dot, exp) {
+			t.Errorf("expected dot to contain: %s, got:\n%s", exp, dot)
+		}
+	}
+}
+
+func TestOnChange(t *testing.T) {
+	d := TallyInit(NewD(""), "")
+	d.Relations["TallyNeed"].DirectAdd(2)
+	var got, total []interface{}
+	d.OnChange("TallyDone", func(added interface{}) { got = append(got, added) })
+	d.OnChange("tallyTotal", func(added interface{}) { total = append(total, added) })
+
+	d.AddNext(d.Relations["TallyVote"], "v0")
+	d.Tick()
+	if len(got) != 0 {
+		t.Errorf("expected no TallyDone hook below the threshold, got: %#v", got)
+	}
+	d.AddNext(d.Relations["TallyVote"], "v0")
+	d.AddNext(d.Relations["TallyVote"], "v1")
+	d.Tick()
+	if len(got) != 1 || got[0] != true {
+		t.Errorf("expected TallyDone hook to fire once with true, got: %#v", got)
+	}
+	if !reflect.DeepEqual(total, []interface{}{"v0", "v1"}) {
+		t.Errorf("expected re-added vote to not fire a hook, got: %#v", total)
+	}
+}
+
+func TestMetrics(t *testing.T) {
+	d := ShortestPathInit(NewD(""), "")
+	d.EnableMetrics()
+	links := d.Relations["ShortestPathLink"]
+	d.AddNext(links, &ShortestPathLink{From: "a", To: "b", Cost: 10})
+	d.AddNext(links, &ShortestPathLink{From: "b", To: "c", Cost: 10})
+	d.AddNext(links, &ShortestPathLink{From: "c", To: "d", Cost: 10})
+	d.Tick()
+
+	m := d.Metrics()
+	if r := m.Relations["ShortestPathLink"]; r.Tuples != 3 || r.Changes != 3 {
+		t.Errorf("expected 3 links and changes, got: %#v", r)
+	}
+	if r := m.Relations["ShortestPath"]; r.Tuples != 6 || r.Changes < 6 {
+		t.Errorf("expected 6 paths and at least as many changes, got: %#v", r)
+	}
+	if len(m.Joins) != len(d.Joins) {
+		t.Fatalf("expected metrics for every join, got: %#v", m.Joins)
+	}
+	for _, j := range m.Joins {
+		if j.Evals <= 0 {
+			t.Errorf("expected join to be evaluated, got: %#v", j)
+		}
+	}
+	if s := m.SlowestJoins(1); len(s) != 1 {
+		t.Errorf("expected 1 slowest join, got: %#v", s)
+	}
+
+	d.DisableMetrics()
+	d.Tick()
+	if m2 := d.Metrics(); m2.Joins[0].Evals != m.Joins[0].Evals {
+		t.Errorf("expected no counting while disabled, got: %#v", m2.Joins[0])
+	}
+}
+
+func TestTrace(t *testing.T) {
+	d := TallyInit(NewD(""), "")
+	d.Relations["TallyNeed"].DirectAdd(1)
+	d.EnableTrace()
+	d.AddNext(d.Relations["TallyVote"], "v0")
+	d.Tick()
+
+	var done *TraceEntry
+	for i, e := range d.Trace() {
+		if e.Into == "TallyDone" && e.Output == true {
+			done = &d.Trace()[i]
+		}
+	}
+	if done == nil {
+		t.Fatalf("expected a trace of TallyDone becoming true, got: %#v", d.Trace())
+	}
+	if done.Join != "tallyDone" || done.Tick != 0 || done.Async {
+		t.Errorf("expected tallyDone join credited, got: %#v", done)
+	}
+
+	var total *TraceEntry
+	for i, e := range d.Trace() {
+		if e.Join == "tallyTotal" {
+			total = &d.Trace()[i]
+		}
+	}
+	if total == nil || len(total.Sources) != 1 ||
+		total.Sources[0] != "v0" {
+		t.Errorf("expected tallyTotal trace with its source vote, got: %#v", total)
+	}
+
+	d.DisableTrace()
+	n := len(d.Trace())
+	d.Tick()
+	if len(d.Trace()) != n {
+		t.Errorf("expected no records while disabled")
+	}
+}
+
+func TestLMaxFloat(t *testing.T) {
+	d := NewD("")
+	m := d.DeclareLMaxFloat("max")
+	if !math.IsInf(m.Float(), -1) {
+		t.Errorf("expected -Inf identity, got: %v", m.Float())
+	}
+	if m.DirectAdd(math.Inf(-1)) {
+		t.Errorf("expected adding the identity to not change")
+	}
+	for _, c := range []struct {
+		v       float64
+		changed bool
+		exp     float64
+	}{
+		{1.5, true, 1.5},
+		{0.5, false, 1.5},
+		{math.NaN(), false, 1.5},
+		{2.25, true, 2.25},
+		{math.Inf(1), true, math.Inf(1)},
+		{3, false, math.Inf(1)},
+	} {
+		if m.DirectAdd(c.v) != c.changed || m.Float() != c.exp {
+			t.Errorf("expected add %v to give %v, changed: %v, got: %v",
+				c.v, c.exp, c.changed, m.Float())
+		}
+	}
+
+	s := d.NewLMaxFloat()
+	if m.DirectMerge(s) || !s.DirectMerge(m) || s.Float() != m.Float() {
+		t.Errorf("expected merge with identity to be a no-op, and back")
+	}
+
+	d.Scratch(m)
+	d.Tick()
+	if !math.IsInf(m.Float(), -1) {
+		t.Errorf("expected scratch to reset to identity, got: %v", m.Float())
+	}
+}
+
+func TestLMinFloat(t *testing.T) {
+	d := NewD("")
+	m := d.DeclareLMinFloat("min")
+	if !math.IsInf(m.Float(), 1) {
+		t.Errorf("expected +Inf identity, got: %v", m.Float())
+	}
+	for _, c := range []struct {
+		v       float64
+		changed bool
+		exp     float64
+	}{
+		{math.Inf(1), false, math.Inf(1)},
+		{math.NaN(), false, math.Inf(1)},
+		{2.5, true, 2.5},
+		{3.5, false, 2.5},
+		{math.NaN(), false, 2.5},
+		{-1, true, -1},
+	} {
+		if m.DirectAdd(c.v) != c.changed || m.Float() != c.exp {
+			t.Errorf("expected add %v to give %v, changed: %v, got: %v",
+				c.v, c.exp, c.changed, m.Float())
+		}
+	}
+
+	src := d.DeclareLSet("weights", 0.0)
+	src.DirectAdd(4.0)
+	src.DirectAdd(0.25)
+	least := d.DeclareLMinFloat("least")
+	d.Join(src, func(w *float64) float64 { return *w }).Into(least)
+	d.Join(src, func(w *float64) float64 { return math.NaN() }).Into(least)
+	d.Tick()
+	if least.Float() != 0.25 {
+		t.Errorf("expected least weight of 0.25, got: %v", least.Float())
+	}
+}
+
+func TestLMaxBy(t *testing.T) {
+	d := NewD("")
+	m := d.DeclareLMaxBy("state", raftState{}, raftStateLess)
+	if m.Value() != (raftState{}) {
+		t.Errorf("expected zero state, got: %v", m.Value())
+	}
+	for _, c := range []struct {
+		v       raftState
+		changed bool
+		exp     raftState
+	}{
+		{raftState{0, state_CANDIDATE}, true, raftState{0, state_CANDIDATE}},
+		{raftState{0, state_FOLLOWER}, false, raftState{0, state_CANDIDATE}},
+		{raftState{0, state_LEADER}, true, raftState{0, state_LEADER}},
+		{raftState{0, state_STEP_DOWN}, true, raftState{0, state_STEP_DOWN}},
+		{raftState{0, state_LEADER}, false, raftState{0, state_STEP_DOWN}},
+		{raftState{1, state_FOLLOWER}, true, raftState{1, state_FOLLOWER}},
+		{raftState{0, state_STEP_DOWN}, false, raftState{1, state_FOLLOWER}},
+	} {
+		if m.DirectAdd(c.v) != c.changed || m.Value() != c.exp {
+			t.Errorf("expected add %v to give %v, changed: %v, got: %v",
+				c.v, c.exp, c.changed, m.Value())
+		}
+	}
+
+	// Merges keep the max, whichever way around.
+	a := d.NewLMaxBy(m.TupleType(), raftStateLess)
+	a.DirectAdd(raftState{2, state_CANDIDATE})
+	b := d.NewLMaxBy(m.TupleType(), raftStateLess)
+	b.DirectAdd(raftState{1, state_STEP_DOWN})
+	ab, ba := a.Snapshot().(*LMaxBy), b.Snapshot().(*LMaxBy)
+	if ab.DirectMerge(b) || ab.Value() != a.Value() {
+		t.Errorf("expected merge of lesser to be a no-op, got: %v", ab.Value())
+	}
+	if !ba.DirectMerge(a) || ba.Value() != a.Value() {
+		t.Errorf("expected merge of greater to win, got: %v", ba.Value())
+	}
+
+	// Joins produce values, and get pointers to them.
+	kinds := d.DeclareLSet("kinds", 0)
+	kinds.DirectAdd(state_LEADER)
+	kinds.DirectAdd(state_STEP_DOWN)
+	best := d.DeclareLMaxBy("best", raftState{}, raftStateLess)
+	d.Join(kinds, func(k *int) raftState { return raftState{3, *k} }).Into(best)
+	bestKind := d.DeclareLMax("bestKind")
+	d.Join(best, func(s *raftState) int { return s.Kind }).Into(bestKind)
+	d.Tick()
+	if best.Value() != (raftState{3, state_STEP_DOWN}) || bestKind.Int() != state_STEP_DOWN {
+		t.Errorf("expected step down to take precedence, got: %v", best.Value())
+	}
+}
+
+func TestLatticeZero(t *testing.T) {
+	d := NewD("")
+	max := d.DeclareLMax("max")
+	maxs := d.DeclareLMaxString("maxs")
+	mins := d.DeclareLMinString("mins")
+	b := d.DeclareLBool("b")
+	set := d.DeclareLSet("set", RaftVote{})
+	m := d.DeclareLMapOf("m", func() Lattice { return d.NewLMax() })
+	maxf := d.DeclareLMaxFloat("maxf")
+	g := d.DeclareGCounter("g")
+	if max.Zero().(*LMax).Int() != 0 ||
+		b.Zero().(*LBool).Bool() != false ||
+		maxs.Zero().(*LMaxString).String() != "" ||
+		mins.Zero().(*LMinString).String() != "" ||
+		set.Zero().(*LSet).Size() != 0 ||
+		m.Zero().(*LMap).Len() != 0 ||
+		!math.IsInf(maxf.Zero().(*LMaxFloat).Float(), -1) ||
+		g.Zero().(*GCounter).Value() != 0 {
+		t.Errorf("expected bottom identities")
+	}
+	if m.Zero().(*LMap).valType != m.valType {
+		t.Errorf("expected Zero() to keep the LMap value type")
+	}
+
+	all := []Lattice{max, maxs, mins, b, set, m, maxf, g}
+	for _, l := range all {
+		if !IsZero(l) {
+			t.Errorf("expected new %T to be zero", l)
+		}
+		l.(Relation).DeclareScratch()
+	}
+	max.DirectAdd(3)
+	maxs.DirectAdd("x")
+	mins.DirectAdd("y")
+	b.DirectAdd(true)
+	set.DirectAdd(&RaftVote{1, "a"})
+	m.DirectAdd(&LMapEntry{"k", NewLMax(d, 1)})
+	maxf.DirectAdd(1.5)
+	g.Inc("a", 2)
+	for _, l := range all {
+		if IsZero(l) {
+			t.Errorf("expected populated %T to not be zero", l)
+		}
+	}
+	d.Tick()
+	for _, l := range all {
+		if !IsZero(l) {
+			t.Errorf("expected scratch %T to reset to zero", l)
+		}
+	}
+}
+
+func TestSortedScan(t *testing.T) {
+	scan := func(order []int) string {
+		d := NewD("")
+		d.SortedScan = true
+		s := d.DeclareLSet("s", RaftVote{})
+		m := d.DeclareLMap("m")
+		for _, i := range order {
+			s.DirectAdd(&RaftVote{Term: i, Candidate: fmt.Sprintf("c%d", i)})
+			m.DirectAdd(&LMapEntry{fmt.Sprintf("k%d", i), NewLMax(d, i)})
+		}
+		var rv []string
+		for i := 0; i < 3; i++ {
+			var got []string
+			for x := range s.Scan() {
+				got = append(got, x.(*RaftVote).Candidate)
+			}
+			for x := range m.Scan() {
+				got = append(got, x.(*LMapEntry).Key)
+			}
+			if i > 0 && strings.Join(got, " ") != rv[0] {
+				t.Errorf("expected repeated scans to match, got: %v, %v", got, rv[0])
+			}
+			rv = append(rv, strings.Join(got, " "))
+		}
+		return rv[0]
+	}
+
+	a := scan([]int{3, 1, 4, 5, 9, 2, 6})
+	b := scan([]int{6, 2, 9, 5, 4, 1, 3})
+	if a != b {
+		t.Errorf("expected scans to match across D's, got: %s, %s", a, b)
+	}
+	if a != "c1 c2 c3 c4 c5 c6 c9 k1 k2 k3 k4 k5 k6 k9" {
+		t.Errorf("expected scans in key order, got: %s", a)
+	}
+}
+
+func TestLMinString(t *testing.T) {
+	d := NewD("")
+	m := d.DeclareLMinString("min")
+	n := 0
+	for range m.Scan() {
+		n++
+	}
+	if n != 0 || m.IsSet() || m.String() != "" {
+		t.Errorf("expected empty LMinString to scan nothing")
+	}
+	if m.DirectMerge(d.NewLMinString()) {
+		t.Errorf("expected merging an empty LMinString to not change")
+	}
+
+	for _, c := range []struct {
+		v       string
+		changed bool
+		exp     string
+	}{
+		{"b", true, "b"},
+		{"c", false, "b"},
+		{"ab", true, "ab"},
+		{"abc", false, "ab"},
+		{"B", true, "B"}, // Byte-wise, so upper case sorts first.
+		{"", true, ""},
+		{"a", false, ""},
+	} {
+		if m.DirectAdd(c.v) != c.changed || m.String() != c.exp {
+			t.Errorf("expected add %q to give %q, changed: %v, got: %q",
+				c.v, c.exp, c.changed, m.String())
+		}
+	}
+
+	addrs := d.DeclareLSet("addrs", "addrString")
+	primary := d.Scratch(d.DeclareLMinString("primary")).(*LMinString)
+	d.Join(addrs).Into(primary)
+	addrs.DirectAdd("10.0.0.2")
+	addrs.DirectAdd("10.0.0.1")
+	d.Tick()
+	if primary.String() != "10.0.0.1" {
+		t.Errorf("expected lowest addr to win, got: %q", primary.String())
+	}
+
+	addrs.Remove("10.0.0.1")
+	d.Tick()
+	if primary.String() != "10.0.0.2" {
+		t.Errorf("expected scratch reset between ticks, got: %q", primary.String())
+	}
+}
+
+func TestIntoValidation(t *testing.T) {
+	type pair struct{ A, B int }
+
+	expectPanic := func(name string, want []string, f func()) {
+		defer func() {
+			r := recover()
+			if r == nil {
+				t.Errorf("%s: expected Into() to panic", name)
+				return
+			}
+			msg := fmt.Sprintf("%v", r)
+			for _, w := range want {
+				if !strings.Contains(msg, w) {
+					t.Errorf("%s: expected panic to mention %q, got: %s",
+						name, w, msg)
+				}
+			}
+		}()
+		f()
+	}
+
+	d := NewD("")
+	nums := d.DeclareLMax("nums")
+	pairs := d.DeclareLSet("pairs", pair{})
+	flag := d.DeclareLBool("flag")
+	m := d.DeclareLMap("m")
+	strs := d.DeclareLSet("strs", "")
+
+	expectPanic("int into LSet", []string{"intoPairs", "int", "pairs", "gdec.pair"},
+		func() {
+			d.Join(nums, func(n *int) int { return *n }).
+				Name("intoPairs").Into(pairs)
+		})
+	expectPanic("*int into LMax", []string{"join#", "*int", "nums", "wants: int"},
+		func() {
+			d.Join(nums, func(n *int) *int { return n }).Into(nums)
+		})
+	expectPanic("bool into LMax", []string{"bool", "nums"},
+		func() {
+			d.Join(flag, func(b *bool) bool { return *b }).Into(nums)
+		})
+	expectPanic("string into LBool", []string{"string", "flag", "wants: bool"},
+		func() {
+			d.Join(strs, func(s *string) string { return *s }).Into(flag)
+		})
+	expectPanic("entry value into LMap", []string{"gdec.LMapEntry", "m", "*gdec.LMapEntry"},
+		func() {
+			d.Join(strs, func(s *string) LMapEntry {
+				return LMapEntry{*s, d.NewLMax()}
+			}).Into(m)
+		})
+	expectPanic("LSet into LMax", []string{"source: strs", "nums"},
+		func() {
+			d.Join(strs).Into(nums)
+		})
+	expectPanic("JoinFlat mismatch", []string{"*gdec.LSet", "nums", "*gdec.LMax"},
+		func() {
+			d.JoinFlat(strs, func(s *string) *LSet { return nil }).Into(nums)
+		})
+	expectPanic("two results", []string{"should have 1 result"},
+		func() {
+			d.Join(nums, func(n *int) (int, bool) { return *n, true }).Into(nums)
+		})
+
+	// Compatible declarations still work.
+	d.Join(nums, func(n *int) int { return *n + 1 }).Into(nums)
+	d.Join(nums, func(n *int) pair { return pair{*n, *n} }).Into(pairs)
+	d.Join(nums, func(n *int) *pair { return &pair{*n, *n} }).Into(pairs)
+	d.Join(strs).Into(strs)
+}
+
+// An LSet whose Scan() also yields a nil tuple.
+type nilScanLSet struct{ *LSet }
+
+func (s nilScanLSet) Scan() chan interface{} {
+	ch := make(chan interface{})
+	go func() {
+		for v := range s.LSet.Scan() {
+			ch <- v
+		}
+		ch <- nil
+		close(ch)
+	}()
+	return ch
+}
+
+func TestCollectErrors(t *testing.T) {
+	d := NewD("")
+	d.CollectErrors()
+	nums := d.DeclareLMax("nums")
+	strs := d.DeclareLSet("strs", "")
+	out := d.DeclareLSet("out", "")
+
+	d.Join(nil).Into(strs)
+	d.Join(nums, func(s *string) int { return 0 }).Into(nums)
+	d.Join(strs, func(s *string) string { return *s }).Name("badInto").Into(nums)
+	d.Join(strs, func(s *string) string { return *s + "!" }).Into(out)
+	if len(d.Joins) != 1 {
+		t.Errorf("expected failed joins to be dropped, got: %d", len(d.Joins))
+	}
+
+	errs := d.Errors()
+	want := [][]string{
+		{"nil passed as Join() param"},
+		{"selectWhereFunc param #0", "*string"},
+		{"badInto", "string", "nums"},
+	}
+	if len(errs) != len(want) {
+		t.Fatalf("expected %d errors, got: %v", len(want), errs)
+	}
+	for i, w := range want {
+		je, ok := errs[i].(*JoinError)
+		if !ok {
+			t.Errorf("expected a *JoinError, got: %#v", errs[i])
+			continue
+		}
+		for _, s := range w {
+			if !strings.Contains(je.Error(), s) {
+				t.Errorf("expected error #%d to mention %q, got: %v", i, s, je)
+			}
+		}
+	}
+	if je := errs[2].(*JoinError); je.Join != "badInto" {
+		t.Errorf("expected join name badInto, got: %q", je.Join)
+	}
+
+	d = NewD("")
+	d.CollectErrors()
+	src := nilScanLSet{d.NewLSet(reflect.TypeOf(""))}
+	d.DeclareRelation("src", src)
+	out = d.DeclareLSet("out", "")
+	d.Join(src, func(s *string) string { return *s }).Name("copy").Into(out)
+	src.DirectAdd("a")
+	d.Tick()
+	if !out.Contains("a") || out.Size() != 1 {
+		t.Errorf("expected non-nil tuples to still join, got: %v", RelationValue(out))
+	}
+	errs = d.Errors()
+	if len(errs) == 0 || !strings.Contains(errs[0].Error(), "nil tuple") ||
+		errs[0].(*JoinError).Join != "copy" {
+		t.Errorf("expected a nil tuple error from join copy, got: %v", errs)
+	}
+
+	d = NewD("")
+	d.CollectErrors()
+	x := d.DeclareLSet("x", "")
+	y := d.DeclareLSet("y", "")
+	out = d.DeclareLSet("out", "")
+	d.Join(x).Into(out)
+	d.Join(x).Minus(y).Name("cycle").Into(y)
+	d.DisableJoin("nope")
+	x.DirectAdd("a")
+	d.Tick()
+	errs = d.Errors()
+	if len(errs) != 2 || !strings.Contains(errs[0].Error(), "no join labeled: nope") ||
+		errs[1].(*JoinError).Join != "cycle" ||
+		!strings.Contains(errs[1].Error(), "not stratifiable") {
+		t.Errorf("expected unknown join and cycle errors, got: %v", errs)
+	}
+	if len(d.Joins) != 1 || y.Size() != 0 || !out.Contains("a") {
+		t.Errorf("expected only the cycle's join dropped, got: %d, %v", len(d.Joins), y.m)
+	}
+}
+
+func TestDeclareRelationSafe(t *testing.T) {
+	d := NewD("")
+	if _, err := d.DeclareRelationSafe("x", d.NewLMax()); err != nil {
+		t.Errorf("expected first declaration to work, got: %v", err)
+	}
+	r, err := d.DeclareRelationSafe("x", d.NewLSet(reflect.TypeOf("")))
+	if r != nil || err == nil {
+		t.Errorf("expected redeclaration to fail, got: %v, %v", r, err)
+	}
+	for _, w := range []string{"name: x", "*gdec.LMax", "*gdec.LSet"} {
+		if !strings.Contains(err.Error(), w) {
+			t.Errorf("expected error to mention %q, got: %v", w, err)
+		}
+	}
+	if _, ok := d.Relations["x"].(*LMax); !ok {
+		t.Errorf("expected original relation to remain")
+	}
+
+	// Protocol initializers may be shared, but a prefix may only be
+	// initialized once.
+	RaftClientInit(d, "a.")
+	RaftInit(d, "a.", nil)
+	RaftInit(d, "b.", nil)
+	func() {
+		defer func() {
+			r := recover()
+			if r == nil || !strings.Contains(fmt.Sprintf("%v", r), "a.raftMember") {
+				t.Errorf("expected RaftInit() to panic on reused prefix, got: %v", r)
+			}
+		}()
+		RaftInit(d, "a.", nil)
+	}()
+}
+
+func TestBoundedChannel(t *testing.T) {
+	for _, c := range []struct {
+		policy DropPolicy
+		expect string
+	}{
+		{DropOldest, "[v2 v3 v4]"},
+		{DropNewest, "[v0 v1 v2]"},
+	} {
+		d := NewD("a")
+		d.SortedScan = true
+		src := d.DeclareLSet("src", "")
+		ch := d.DeclareBoundedChannel("ch", "", 3, c.policy)
+		d.Join(src).IntoAsync(ch)
+		for i := 0; i < 5; i++ {
+			src.DirectAdd(fmt.Sprintf("v%d", i))
+		}
+
+		d.Tick()
+		if ch.Dropped() != 2 {
+			t.Errorf("expected 2 dropped, got: %v", ch.Dropped())
+		}
+		if got := fmt.Sprintf("%v", ch.outbox); got != c.expect {
+			t.Errorf("expected policy: %v, to buffer: %s, got: %s",
+				c.policy, c.expect, got)
+		}
+
+		// The buffered tuples loop back, and the flood continues.
+		d.Tick()
+		if ch.Size() != 3 || ch.Dropped() != 4 {
+			t.Errorf("expected 3 delivered and 4 dropped, got: %v, %v",
+				ch.Size(), ch.Dropped())
+		}
+	}
+
+	d := NewD("a")
+	ch := d.DeclareChannel("ch", "")
+	for i := 0; i < 100; i++ {
+		ch.send(i)
+	}
+	if len(ch.outbox) != 100 || ch.Dropped() != 0 {
+		t.Errorf("expected unbounded channel to keep all tuples")
+	}
+}
+
+func TestChannelDedup(t *testing.T) {
+	d := NewD("a")
+	vreq := RaftProtocolInit(d, "").Relations["RaftVoteReq"].(*LSet)
+	vreq.DeclareDedup(3, "From", "Term")
+
+	req := RaftVoteReq{To: "a", From: "b", Term: 1}
+	for i, expect := range []int{1, 0, 0, 1, 0} {
+		d.Deliver("RaftVoteReq", &req)
+		d.Deliver("RaftVoteReq", &req)
+		d.Tick()
+		if vreq.Size() != expect {
+			t.Errorf("tick: %d, expected %d vote reqs, got: %v",
+				i, expect, vreq.Size())
+		}
+	}
+	if vreq.Suppressed() != 8 {
+		t.Errorf("expected 8 suppressed, got: %v", vreq.Suppressed())
+	}
+
+	// Distinct tuples aren't suppressed, even when they share a key.
+	next := req
+	next.Term = 2
+	other := next
+	other.LastLogIndex = 5
+	d.Deliver("RaftVoteReq", &next)
+	d.Deliver("RaftVoteReq", &other)
+	d.Tick()
+	if vreq.Size() != 2 {
+		t.Errorf("expected distinct vote reqs, got: %v", vreq.Size())
+	}
+
+	defer func() {
+		if recover() == nil {
+			t.Errorf("expected unknown dedup field to panic")
+		}
+	}()
+	vreq.DeclareDedup(3, "Nope")
+}
+
+type causalMsg struct {
+	To    string
+	From  string
+	Body  string
+	Clock *VectorClock
+}
+
+func TestChannelCausal(t *testing.T) {
+	d := NewD("r")
+	ch := d.DeclareChannel("msg", causalMsg{}).DeclareCausal("Clock", "From", 2)
+	seen := map[string]int64{}
+	d.Join(ch, func(m *causalMsg) *causalMsg {
+		if _, ok := seen[m.Body]; !ok {
+			seen[m.Body] = d.Ticks()
+		}
+		return nil
+	}).Into(d.DeclareLSet("sink", causalMsg{}))
+
+	clock := func(vv map[string]int) *VectorClock {
+		c := d.NewVectorClock()
+		for k, v := range vv {
+			c.DirectAdd(&VectorClockEntry{k, v})
+		}
+		return c
+	}
+	m1 := &causalMsg{"r", "a", "m1", clock(map[string]int{"a": 1})}
+	m2 := &causalMsg{"r", "a", "m2", clock(map[string]int{"a": 2})}
+	m3 := &causalMsg{"r", "b", "m3", clock(map[string]int{"a": 2, "b": 1})} // After m2.
+
+	d.Deliver("msg", m3)
+	d.Tick()
+	d.Deliver("msg", m1)
+	d.Tick()
+	if len(seen) != 1 || seen["m1"] != 1 || ch.Held() != 1 {
+		t.Errorf("expected only m1 delivered, m3 held, got: %v, held: %d", seen, ch.Held())
+	}
+	d.Deliver("msg", m2)
+	d.Tick()
+	if seen["m2"] != 2 || seen["m3"] != 2 || ch.Held() != 0 {
+		t.Errorf("expected m2 to release m3, got: %v, held: %d", seen, ch.Held())
+	}
+
+	// Concurrent tuples are delivered as they arrive.
+	d.Deliver("msg", &causalMsg{"r", "c", "c1", clock(map[string]int{"c": 1})})
+	d.Tick()
+	if _, ok := seen["c1"]; !ok {
+		t.Errorf("expected concurrent c1 delivered")
+	}
+
+	// Beyond the bound, the newest held tuples are dropped.
+	for i := 3; i < 6; i++ {
+		d.Deliver("msg", &causalMsg{"r", "c", fmt.Sprintf("c%d", i),
+			clock(map[string]int{"c": i})})
+	}
+	d.Tick()
+	if ch.Held() != 2 || ch.Dropped() != 1 || d.Metrics().Relations["msg"].Held != 2 {
+		t.Errorf("expected 2 held and 1 dropped, got: %d, %d", ch.Held(), ch.Dropped())
+	}
+
+	defer func() {
+		if recover() == nil {
+			t.Errorf("expected a non-clock field to panic")
+		}
+	}()
+	ch.DeclareCausal("Body", "From", 1)
+}
+
+func TestQuorum(t *testing.T) {
+	d := QuorumInit(NewD(""), "", 3, 3) // 5 replicas.
+	write := d.Relations["QuorumWrite"].(*LSet)
+	writeAck := d.Relations["QuorumWriteAck"].(*LSet)
+	durable := d.Relations["QuorumDurable"].(*LSet)
+	read := d.Relations["QuorumRead"].(*LSet)
+	readAck := d.Relations["QuorumReadAck"].(*LSet)
+	result := d.Relations["QuorumReadResult"].(*LSet)
+
+	w1 := &QuorumWrite{"w1", "k", "v1", 1}
+	w2 := &QuorumWrite{"w2", "k", "v2", 2}
+	write.DirectAdd(w1)
+	write.DirectAdd(w2)
+	for i, r := range []string{"r1", "r2", "r2", "r3"} {
+		writeAck.DirectAdd(&QuorumWriteAck{"w1", r})
+		writeAck.DirectAdd(&QuorumWriteAck{"w2", r}) // Dup r2 doesn't count.
+		d.Tick()
+		if durable.Contains(w1) != (i == 3) || durable.Contains(w2) != (i == 3) {
+			t.Errorf("expected writes durable only after 3 acks, acks: %d", i+1)
+		}
+	}
+
+	// r1..r3 have v2, and the stale r4 and r5 still have v1, but any 3
+	// replicas include one that has v2.
+	read.DirectAdd(&QuorumRead{"q1", "k"})
+	for i, r := range []string{"r4", "r5", "r2"} {
+		ver := 1
+		if r == "r2" {
+			ver = 2
+		}
+		readAck.DirectAdd(&QuorumReadAck{"q1", r, fmt.Sprintf("v%d", ver), ver})
+		d.Tick()
+		if (result.Size() == 1) != (i == 2) {
+			t.Errorf("expected read result only after 3 acks, acks: %d", i+1)
+		}
+	}
+	if !result.Contains(&QuorumReadResult{"q1", "k", "v2", 2}) {
+		t.Errorf("expected read to see latest durable value, got: %v", result.m)
+	}
+}
+
+func TestQuorumKinds(t *testing.T) {
+	d := NewD("")
+	voters := func(vs ...string) *LSet {
+		s := d.NewLSet(reflect.TypeOf(""))
+		for _, v := range vs {
+			s.DirectAdd(v)
+		}
+		return s
+	}
+	for _, c := range []struct {
+		name   string
+		q      Quorum
+		voters []string
+		want   bool
+	}{
+		{"majority", MajorityQuorum("a", "b", "c"), []string{"a", "b"}, true},
+		{"minority", MajorityQuorum("a", "b", "c"), []string{"c"}, false},
+		{"non-members", MajorityQuorum("a", "b", "c"), []string{"a", "x", "y"}, false},
+		{"even split", MajorityQuorum("a", "b", "c", "d"), []string{"a", "b"}, false},
+		// a counts double, so a plus any one other is a quorum.
+		{"weighted a+b", WeightedQuorum(map[string]int{"a": 2, "b": 1, "c": 1, "d": 1}),
+			[]string{"a", "b"}, true},
+		{"weighted b+c", WeightedQuorum(map[string]int{"a": 2, "b": 1, "c": 1, "d": 1}),
+			[]string{"b", "c"}, false},
+		{"weighted b+c+d", WeightedQuorum(map[string]int{"a": 2, "b": 1, "c": 1, "d": 1}),
+			[]string{"b", "c", "d"}, true},
+		// A full row plus one of each other row.
+		{"grid row+col", GridQuorum([][]string{{"a", "b", "c"}, {"d", "e", "f"}, {"g", "h", "i"}}),
+			[]string{"a", "b", "c", "e", "i"}, true},
+		{"grid no full row", GridQuorum([][]string{{"a", "b", "c"}, {"d", "e", "f"}, {"g", "h", "i"}}),
+			[]string{"a", "b", "d", "e", "g", "h"}, false},
+		{"grid missing row", GridQuorum([][]string{{"a", "b", "c"}, {"d", "e", "f"}, {"g", "h", "i"}}),
+			[]string{"a", "b", "c", "d", "e", "f"}, false},
+		{"count", CountQuorum(2), []string{"x", "y"}, true},
+	} {
+		if got := c.q.HasQuorum(voters(c.voters...)); got != c.want {
+			t.Errorf("%s: expected HasQuorum(%v): %v, got: %v", c.name, c.voters, c.want, got)
+		}
+	}
+
+	member := d.DeclareLSet("member", "addrString")
+	member.DirectAdd("a")
+	q := MajorityQuorumOf(member)
+	if !q.HasQuorum(voters("a")) {
+		t.Errorf("expected a to be a majority of one")
+	}
+	member.DirectAdd("b")
+	member.DirectAdd("c")
+	if q.HasQuorum(voters("a")) {
+		t.Errorf("expected majority to follow membership")
+	}
+}
+
+func TestQuorumTally(t *testing.T) {
+	d := QuorumTallyInit(NewD(""), "",
+		WeightedQuorum(map[string]int{"a": 2, "b": 1, "c": 1}))
+	vote := d.Relations["QuorumTallyVote"]
+	done := d.Relations["QuorumTallyDone"].(*LMap)
+	d.Join(vote).Into(d.DeclareLSet("seen", MultiTallyVote{}))
+
+	d.Add(vote, &MultiTallyVote{"r1", "b"})
+	d.Add(vote, &MultiTallyVote{"r2", "a"})
+	d.Tick()
+	if LMapAt[*LBool](done, "r1").Bool() || LMapAt[*LBool](done, "r2").Bool() {
+		t.Errorf("expected no race done yet")
+	}
+	d.Add(vote, &MultiTallyVote{"r1", "c"})
+	d.Add(vote, &MultiTallyVote{"r2", "c"})
+	d.Tick()
+	if LMapAt[*LBool](done, "r1").Bool() || !LMapAt[*LBool](done, "r2").Bool() {
+		t.Errorf("expected only r2, with a's double weight, done")
+	}
+	if !QuorumTallyVoters(d, "", "r1").Contains("c") {
+		t.Errorf("expected r1 voters to include c")
+	}
+}
+
+func TestFailureDetector(t *testing.T) {
+	tr := NewMemTransport()
+	addrs := []string{"a", "b", "c"}
+	ds := map[string]*D{}
+	for _, a := range addrs {
+		d := FailureDetectorInit(NewD(a), "", time.Second, 3)
+		tr.Register(d)
+		for _, p := range addrs {
+			d.Relations["FailureDetectorPeer"].(*LSet).DirectAdd(p)
+		}
+		ds[a] = d
+	}
+	round := func() {
+		for _, a := range addrs {
+			ds[a].AddNext(ds[a].Relations["failureDetectorBeat"], true)
+			ds[a].Tick()
+		}
+	}
+	suspected := ds["a"].Relations["FailureDetectorSuspected"].(*LSet)
+	alive := ds["a"].Relations["FailureDetectorAlive"].(*LSet)
+
+	for i := 0; i < 5; i++ {
+		round()
+	}
+	if suspected.Size() != 0 || alive.Size() != 3 {
+		t.Errorf("expected all alive, got suspected: %v", suspected.m)
+	}
+
+	tr.Isolate("c", true)
+	for i := 0; i < 3; i++ { // Including the round that delivers c's last beat.
+		round()
+		if suspected.Contains("c") {
+			t.Errorf("expected c not suspected before the timeout, round: %d", i)
+		}
+	}
+	round()
+	if !suspected.Contains("c") || alive.Contains("c") || suspected.Size() != 1 {
+		t.Errorf("expected only c suspected after the timeout, got: %v",
+			suspected.m)
+	}
+
+	tr.Isolate("c", false)
+	for i := 0; i < 2; i++ {
+		round()
+	}
+	if suspected.Contains("c") || !alive.Contains("c") {
+		t.Errorf("expected c cleared once heartbeats resume")
+	}
+}
+
+func TestTwoPhaseCommit(t *testing.T) {
+	tr := NewMemTransport()
+	addrs := []string{"co", "p1", "p2", "p3"}
+	ds := map[string]*D{}
+	for _, a := range addrs {
+		d := TwoPhaseCommitInit(NewD(a), "")
+		tr.Register(d)
+		ds[a] = d
+	}
+	co := ds["co"]
+	for _, p := range addrs[1:] {
+		co.Relations["TwoPhaseCommitParticipant"].(*LSet).DirectAdd(p)
+	}
+	ds["p2"].Relations["TwoPhaseCommitRefuse"].(*LSet).DirectAdd("t2")
+	rounds := func(n int) {
+		for i := 0; i < n; i++ {
+			for _, a := range addrs {
+				ds[a].Tick()
+			}
+		}
+	}
+	state := func(a, txn string) int {
+		v, _ := ds[a].Relations["TwoPhaseCommitState"].(*LMap).AtLMax(txn)
+		if v == nil {
+			return 0
+		}
+		return v.Int()
+	}
+
+	co.Add(co.Relations["TwoPhaseCommitTxn"], "t1")
+	co.Add(co.Relations["TwoPhaseCommitTxn"], "t2")
+	rounds(5)
+	if commit, ok := TwoPhaseCommitDecided(co, "", "t1"); !ok || !commit {
+		t.Errorf("expected t1 committed, got: %v, %v", commit, ok)
+	}
+	if commit, ok := TwoPhaseCommitDecided(co, "", "t2"); !ok || commit {
+		t.Errorf("expected t2 aborted on p2's no, got: %v, %v", commit, ok)
+	}
+	for _, p := range addrs[1:] {
+		if state(p, "t1") != twoPhase_COMMITTED || state(p, "t2") != twoPhase_ABORTED {
+			t.Errorf("expected %s to commit t1 and abort t2, got: %d, %d",
+				p, state(p, "t1"), state(p, "t2"))
+		}
+	}
+
+	tr.Isolate("p3", true)
+	co.Add(co.Relations["TwoPhaseCommitTxn"], "t3")
+	rounds(int(TwoPhaseCommitTimeout) - 1)
+	if _, ok := TwoPhaseCommitDecided(co, "", "t3"); ok {
+		t.Errorf("expected t3 undecided before the timeout")
+	}
+	rounds(3)
+	if commit, ok := TwoPhaseCommitDecided(co, "", "t3"); !ok || commit {
+		t.Errorf("expected t3 aborted on timeout, got: %v, %v", commit, ok)
+	}
+	if state("p1", "t3") != twoPhase_ABORTED || state("p3", "t3") != 0 {
+		t.Errorf("expected p1 to abort t3, and p3 to never see it, got: %d, %d",
+			state("p1", "t3"), state("p3", "t3"))
+	}
+}
+
+func TestGossip(t *testing.T) {
+	tr := NewMemTransport()
+	addrs := []string{"a", "b", "c", "d", "e"}
+	ds := map[string]*D{}
+	for i, a := range addrs {
+		d := NewD(a)
+		d.Rand = rand.New(rand.NewSource(int64(i)))
+		GossipInit(d, "s/", d.DeclareLSet("fruit", ""), time.Second, 1)
+		GossipInit(d, "m/", d.DeclareLMapOf("score",
+			func() Lattice { return d.NewLMax() }), time.Second, 2)
+		tr.Register(d)
+		for _, p := range addrs {
+			d.Relations["s/GossipPeer"].(*LSet).DirectAdd(p)
+			d.Relations["m/GossipPeer"].(*LSet).DirectAdd(p)
+		}
+		d.Relations["fruit"].(*LSet).DirectAdd("fruit-" + a)
+		d.Relations["score"].(*LMap).DirectAdd(&LMapEntry{a, NewLMax(d, i)})
+		d.Relations["score"].(*LMap).DirectAdd(&LMapEntry{"max", NewLMax(d, i)})
+		ds[a] = d
+	}
+	converged := func() bool {
+		for _, d := range ds {
+			if d.Relations["fruit"].(*LSet).Size() != len(addrs) ||
+				d.Relations["score"].(*LMap).Len() != len(addrs)+1 ||
+				LMapAt[*LMax](d.Relations["score"].(*LMap), "max").Int() != len(addrs)-1 {
+				return false
+			}
+		}
+		return true
+	}
+	for i := 0; i < 50 && !converged(); i++ {
+		for _, a := range addrs {
+			ds[a].AddNext(ds[a].Relations["s/gossipRound"], true)
+			ds[a].AddNext(ds[a].Relations["m/gossipRound"], true)
+			ds[a].Tick()
+		}
+	}
+	if !converged() {
+		t.Errorf("expected gossip to converge")
+	}
+	for _, a := range addrs {
+		if !ds[a].Relations["fruit"].(*LSet).Contains("fruit-e") {
+			t.Errorf("expected %s to have e's fruit", a)
+		}
+	}
+}
+
+func TestDrainAsyncRaftElection(t *testing.T) {
+	tr := NewMemTransport()
+	addrs := []string{"a", "b", "c"}
+	ds := newRaftCluster(tr, addrs...)
+	c := &fakeClock{now: time.Unix(1000, 0)}
+	for _, d := range ds {
+		d.Now = c.Now
+	}
+
+	ds["a"].AddNext(ds["a"].Relations["raftAlarm"], true)
+	if !ds["a"].DrainAsync(tr, 20) {
+		t.Fatalf("expected election traffic to drain")
+	}
+	for _, a := range addrs {
+		expect := state_FOLLOWER
+		if a == "a" {
+			expect = state_LEADER
+		}
+		state := ds[a].Relations["raftCurState"].(*LMaxBy).Value().(raftState)
+		term := ds[a].Relations["raftCurTerm"].(*LMax).Int()
+		if state.Kind != expect || term != 1 {
+			t.Errorf("expected %s to be in state: %d, term: 1, got: %d, %d",
+				a, expect, state.Kind, term)
+		}
+	}
+}
+
+func TestLSetDedupsPointerTuples(t *testing.T) {
+	d := NewD("a")
+	paths := d.DeclareLSet("paths", ShortestPath{})
+	first := &ShortestPath{From: "a", To: "b", Next: "b", Cost: 1}
+	if !paths.DirectAdd(first) {
+		t.Errorf("expected first DirectAdd to change")
+	}
+	if paths.DirectAdd(&ShortestPath{From: "a", To: "b", Next: "b", Cost: 1}) {
+		t.Errorf("expected equal valued pointer DirectAdd to be a no-op")
+	}
+	if paths.Size() != 1 {
+		t.Errorf("expected 1 path, got: %d", paths.Size())
+	}
+	for x := range paths.Scan() {
+		if x != first {
+			t.Errorf("expected the first of equal tuples to be kept")
+		}
+	}
+}
+
+func TestLSetIndex(t *testing.T) {
+	d := NewD("a")
+	votes := d.DeclareLSet("votes", RaftVote{})
+	votes.DirectAdd(&RaftVote{1, "a"})
+	votes.DeclareIndex("Term") // Indexes what's already there.
+	votes.DirectAdd(&RaftVote{2, "b"})
+	votes.DirectAdd(&RaftVote{2, "c"})
+	other := d.DeclareLSet("other", RaftVote{})
+	other.DirectAdd(&RaftVote{2, "d"})
+	votes.DirectMerge(other)
+
+	candidates := func(term int) string {
+		var rv []string
+		for _, v := range votes.Lookup("Term", term) {
+			rv = append(rv, v.(*RaftVote).Candidate)
+		}
+		return fmt.Sprintf("%v", rv)
+	}
+	if candidates(1) != "[a]" || candidates(2) != "[b c d]" || candidates(3) != "[]" {
+		t.Errorf("expected indexed lookups, got: %s, %s", candidates(1), candidates(2))
+	}
+	votes.Remove(&RaftVote{2, "c"})
+	votes.Remove(&RaftVote{1, "a"})
+	if candidates(2) != "[b d]" || votes.ContainsWhere("Term", 1) ||
+		!votes.ContainsWhere("Term", 2) {
+		t.Errorf("expected removes to update the index, got: %s", candidates(2))
+	}
+	if len(votes.Lookup("Candidate", "b")) != 1 || votes.ContainsWhere("Candidate", "c") {
+		t.Errorf("expected unindexed lookups to scan")
+	}
+
+	scratch := d.Scratch(d.DeclareLSet("scratch", RaftVote{})).(*LSet).DeclareIndex("Term")
+	scratch.DirectAdd(&RaftVote{1, "a"})
+	d.Tick()
+	if scratch.ContainsWhere("Term", 1) {
+		t.Errorf("expected scratch reset to clear the index")
+	}
+	scratch.DirectAdd(&RaftVote{1, "b"})
+	if len(scratch.Lookup("Term", 1)) != 1 {
+		t.Errorf("expected index to be maintained after a scratch reset")
+	}
+
+	defer func() {
+		if recover() == nil {
+			t.Errorf("expected DeclareIndex() of a missing field to panic")
+		}
+	}()
+	votes.DeclareIndex("Nope")
+}
+
+func TestCompact(t *testing.T) {
+	d := NewD("a")
+	votes := d.DeclareLSet("votes", RaftVote{}).DeclareIndex("Term").
+		DeclareDominated(func(a, b interface{}) bool {
+			return a.(*RaftVote).Term < b.(*RaftVote).Term
+		})
+	for i, c := range []string{"a", "b", "c", "d"} {
+		votes.DirectAdd(&RaftVote{i / 2, c})
+	}
+	plain := d.DeclareLSet("plain", RaftVote{})
+	plain.DirectAdd(&RaftVote{0, "a"})
+	plain.DirectAdd(&RaftVote{1, "b"})
+	m := d.DeclareLMap("m")
+	m.DirectAdd(&LMapEntry{"x", votes.Snapshot().(*LSet).DeclareDominated(votes.dominated)})
+	m.DirectAdd(&LMapEntry{"y", d.NewLSet(votes.TupleType())})
+
+	if n := d.Compact(); n != 5 {
+		t.Errorf("expected 2 votes, 2 nested votes and 1 bottom entry dropped, got: %d", n)
+	}
+	if votes.Size() != 2 || len(votes.Lookup("Term", 1)) != 2 ||
+		votes.ContainsWhere("Term", 0) {
+		t.Errorf("expected only the latest term's votes kept, got: %#v", votes.m)
+	}
+	if plain.Size() != 2 {
+		t.Errorf("expected an LSet without an order left alone, got: %#v", plain.m)
+	}
+	if m.Len() != 1 || m.At("x").(*LSet).Size() != 2 {
+		t.Errorf("expected nested compaction and bottom entry dropped, got: %v", m.Keys())
+	}
+	if n := d.Compact(); n != 0 {
+		t.Errorf("expected compaction to be idempotent, got: %d", n)
+	}
+
+	// ShortestPath already keeps only the best path per pair, so there's
+	// nothing to drop, and the paths are unchanged.
+	d = ShortestPathInit(NewD(""), "")
+	links := d.Relations["ShortestPathLink"]
+	d.AddNext(links, &ShortestPathLink{From: "a", To: "b", Cost: 10})
+	d.AddNext(links, &ShortestPathLink{From: "b", To: "c", Cost: 10})
+	d.AddNext(links, &ShortestPathLink{From: "a", To: "c", Cost: 30})
+	d.Tick()
+	before := fmt.Sprintf("%+v", ShortestPaths(d, ""))
+	if n := d.Compact(); n != 0 || fmt.Sprintf("%+v", ShortestPaths(d, "")) != before {
+		t.Errorf("expected paths unchanged, dropped: %d, got: %+v", n, ShortestPaths(d, ""))
+	}
+}
+
+func TestClear(t *testing.T) {
+	d := NewD("a")
+	votes := d.DeclareLSet("votes", MultiTallyVote{})
+	sets := d.DeclareLMap("sets")
+	d.Join(votes, func(v *MultiTallyVote) *LMapEntry {
+		return &LMapEntry{v.Race, NewLSetOne(d, v.Voter)}
+	}).Into(sets)
+	votes.DirectAdd(&MultiTallyVote{"x", "c"})
+	votes.DirectAdd(&MultiTallyVote{"z", "c"})
+	d.Tick()
+	if sets.Len() != 2 {
+		t.Errorf("expected 2 races, got: %v", sets.Keys())
+	}
+
+	if !votes.Clear() || !sets.Clear() || votes.Size() != 0 || sets.Len() != 0 {
+		t.Errorf("expected cleared, got: %#v, %v", votes.m, sets.Keys())
+	}
+	if votes.Clear() || sets.Clear() {
+		t.Errorf("expected clearing an empty relation to not change it")
+	}
+	d.Tick()
+	if sets.Len() != 0 {
+		t.Errorf("expected nothing rederived, got: %v", sets.Keys())
+	}
+	votes.DirectAdd(&MultiTallyVote{"y", "d"})
+	d.Tick()
+	if ks := sets.Keys(); len(ks) != 1 || ks[0] != "y" || sets.At("y").(*LSet).Size() != 1 {
+		t.Errorf("expected only the new race, got: %v", ks)
+	}
+
+	max := d.DeclareLMax("max")
+	max.DirectAdd(3)
+	if n := d.ClearAll(); n != 3 || max.Int() != 0 || votes.Size() != 0 || sets.Len() != 0 {
+		t.Errorf("expected 3 relations cleared, got: %d, %d", n, max.Int())
+	}
+	if n := d.ClearAll(); n != 0 {
+		t.Errorf("expected ClearAll() to be idempotent, got: %d", n)
+	}
+
+	// SemiNaive joins that are maintained across ticks rederive what's
+	// cleared from what their sources still hold.
+	d = ShortestPathInit(NewD(""), "")
+	links := d.Relations["ShortestPathLink"]
+	d.AddNext(links, &ShortestPathLink{From: "a", To: "b", Cost: 10})
+	d.AddNext(links, &ShortestPathLink{From: "b", To: "c", Cost: 10})
+	d.Tick()
+	d.Tick()
+	before := ShortestPaths(d, "")
+	if len(before) != 3 {
+		t.Errorf("expected 3 paths, got: %+v", before)
+	}
+	if !d.Relations["ShortestPath"].Clear() || len(ShortestPaths(d, "")) != 0 {
+		t.Errorf("expected paths cleared, got: %+v", ShortestPaths(d, ""))
+	}
+	d.Tick()
+	if got := ShortestPaths(d, ""); !reflect.DeepEqual(got, before) {
+		t.Errorf("expected paths rederived, got: %+v, before: %+v", got, before)
+	}
+	d.ClearAll()
+	d.Tick()
+	if len(ShortestPaths(d, "")) != 0 {
+		t.Errorf("expected nothing left to rederive from, got: %+v", ShortestPaths(d, ""))
+	}
+	d.AddNext(links, &ShortestPathLink{From: "a", To: "b", Cost: 10})
+	d.Tick()
+	if len(ShortestPaths(d, "")) != 1 {
+		t.Errorf("expected only the new path, got: %+v", ShortestPaths(d, ""))
+	}
+}
+
+func TestRaftCompactVotedFor(t *testing.T) {
+	tr := NewMemTransport()
+	addrs := []string{"a", "b", "c"}
+	ds := newRaftCluster(tr, addrs...)
+	votedFor := ds["a"].Relations["raftVotedFor"].(*LSet)
+	votedFor.DirectAdd(&RaftVote{-1, "x"}) // A stale vote, as if from long ago.
+
+	ds["a"].AddNext(ds["a"].Relations["raftAlarm"], true)
+	for i := 0; i < 10; i++ {
+		for _, a := range addrs {
+			ds[a].Tick()
+		}
+	}
+	term := ds["a"].Relations["raftCurTerm"].(*LMax).Int()
+	if n := ds["a"].Compact(); n < 1 || votedFor.ContainsWhere("Term", -1) {
+		t.Errorf("expected the stale vote dropped, dropped: %d", n)
+	}
+	for _, v := range votedFor.Lookup("Candidate", "a") {
+		if v.(*RaftVote).Term != term {
+			t.Errorf("expected only votes of the current term: %d, got: %#v", term, v)
+		}
+	}
+}
+
+func benchmarkLSetLookup(b *testing.B, indexed bool) {
+	d := NewD("a")
+	votes := d.DeclareLSet("votes", RaftVote{})
+	if indexed {
+		votes.DeclareIndex("Term")
+	}
+	for i := 0; i < 10000; i++ {
+		votes.DirectAdd(&RaftVote{i, fmt.Sprintf("c%d", i)})
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if !votes.ContainsWhere("Term", i%10000) {
+			b.Fatalf("expected term: %d", i%10000)
+		}
+	}
+}
+
+func BenchmarkLSetLookupScan(b *testing.B) { benchmarkLSetLookup(b, false) }
+
+func BenchmarkLSetLookupIndexed(b *testing.B) { benchmarkLSetLookup(b, true) }
+
+func TestLSetView(t *testing.T) {
+	d := NewD("a")
+	votes := d.DeclareLSet("votes", RaftVote{})
+	voters := d.DeclareLSet("voters", "")
+
+	cur := votes.Filter(func(x interface{}) bool {
+		return x.(*RaftVote).Term == 2
+	}).Map("", func(x interface{}) interface{} {
+		return x.(*RaftVote).Candidate
+	})
+	d.Join(cur, func(s *string) *string { return s }).Into(voters)
+
+	// Views compose in the join engine's nested loop like any source.
+	old := votes.Filter(func(x interface{}) bool {
+		return x.(*RaftVote).Term == 1
+	})
+	pairs := d.DeclareLSet("pairs", "")
+	d.Join(cur, old, func(s *string, v *RaftVote) *string {
+		p := v.Candidate + "->" + *s
+		return &p
+	}).Into(pairs)
+
+	votes.DirectAdd(&RaftVote{1, "a"})
+	votes.DirectAdd(&RaftVote{2, "b"})
+	votes.DirectAdd(&RaftVote{2, "c"})
+	d.Tick()
+	if voters.Size() != 2 || !voters.Contains("b") || !voters.Contains("c") {
+		t.Errorf("expected term 2 voters, got: %v", voters.m)
+	}
+	if pairs.Size() != 2 || !pairs.Contains("a->b") || !pairs.Contains("a->c") {
+		t.Errorf("expected pairs of views, got: %v", pairs.m)
+	}
+	if votes.Size() != 3 {
+		t.Errorf("expected view to leave its source alone")
+	}
+
+	defer func() {
+		if recover() == nil {
+			t.Errorf("expected DirectAdd() on a view to panic")
+		}
+	}()
+	cur.DirectAdd("x")
+}
+
+func TestJoinAgg(t *testing.T) {
+	d := MultiTallyInit(NewD("a"), "")
+	votes := d.DeclareLSet("votes", MultiTallyVote{})
+	d.Join(votes).Into(d.Relations["MultiTallyVote"])
+
+	counts := d.Scratch(d.DeclareLSet("counts", AggResult{})).(*LSet)
+	d.JoinAgg(votes, func(x interface{}) string {
+		return x.(*MultiTallyVote).Race
+	}, AggCount, nil).Into(counts)
+
+	for _, v := range []MultiTallyVote{{"A", "a0"}, {"A", "a1"}, {"A", "a0"},
+		{"B", "b0"}, {"C", "c0"}, {"C", "c1"}, {"C", "c2"}} {
+		v := v
+		votes.DirectAdd(&v)
+	}
+	d.Tick()
+	if counts.Size() != 3 {
+		t.Errorf("expected a count per race, got: %v", counts.m)
+	}
+	for _, race := range []string{"A", "B", "C"} {
+		n := MultiTallyVoters(d, "", race).Size()
+		if !counts.Contains(&AggResult{race, n}) {
+			t.Errorf("expected count: %d, for race: %s, got: %v",
+				n, race, counts.m)
+		}
+	}
+
+	// Aggregates see the fixpoint of a recursive source.
+	d = ShortestPathInit(NewD(""), "")
+	links := d.Relations["ShortestPathLink"].(*LSet)
+	for _, l := range []ShortestPathLink{{"a", "b", 1}, {"b", "c", 2}, {"c", "d", 3}} {
+		l := l
+		links.DirectAdd(&l)
+	}
+	from := func(x interface{}) string {
+		return x.(*LMapEntry).Val.(*shortestPathBest).path.From
+	}
+	cost := func(x interface{}) int {
+		return x.(*LMapEntry).Val.(*shortestPathBest).path.Cost
+	}
+	out := map[Aggregate]*LSet{}
+	for _, agg := range []Aggregate{AggCount, AggSum, AggMin, AggMax} {
+		out[agg] = d.Scratch(d.DeclareLSet(fmt.Sprintf("agg%d", agg),
+			AggResult{})).(*LSet)
+		d.JoinAgg(d.Relations["ShortestPath"], from, agg, cost).Into(out[agg])
+	}
+	d.Tick()
+	for agg, expect := range map[Aggregate]AggResult{
+		AggCount: {"a", 3}, // a->b, a->c, a->d.
+		AggSum:   {"a", 1 + 3 + 6},
+		AggMin:   {"a", 1},
+		AggMax:   {"a", 6},
+	} {
+		if !out[agg].Contains(&expect) || out[agg].Size() != 3 {
+			t.Errorf("expected aggregate: %d, to have: %v, got: %v",
+				agg, expect, out[agg].m)
+		}
+	}
+}
+
+type testStamped struct {
+	Val  string
+	Tick int64
+	Time int64
+}
+
+func TestStampTick(t *testing.T) {
+	c := &fakeClock{now: time.Unix(1000, 0)}
+	d := NewD("a")
+	d.Now = c.Now
+	src := d.DeclareLSet("src", "")
+	out := d.DeclareLSet("out", testStamped{})
+	d.Join(src, func(s *string) *testStamped {
+		return &testStamped{Val: *s}
+	}).Into(out).StampTick("Tick").StampTime("Time")
+
+	src.DirectAdd("x")
+	for i := 0; i < 3; i++ {
+		d.Tick()
+		c.Advance(time.Second)
+	}
+	if out.Size() != 3 {
+		t.Errorf("expected a stamped tuple per tick, got: %v", out.m)
+	}
+	for i := 0; i < 3; i++ {
+		expect := &testStamped{"x", int64(i), time.Unix(1000+int64(i), 0).UnixNano()}
+		if !out.Contains(expect) {
+			t.Errorf("expected stamped tuple: %#v, got: %v", expect, out.m)
+		}
+	}
+
+	defer func() {
+		if recover() == nil {
+			t.Errorf("expected stamping a non-int field to panic")
+		}
+	}()
+	d.Join(src, func(s *string) *testStamped { return nil }).Into(out).StampTick("Val")
+}
+
+func TestRaftLeaderLease(t *testing.T) {
+	tr := NewMemTransport()
+	addrs := []string{"a", "b", "c"}
+	ds := newRaftCluster(tr, addrs...)
+	c := &fakeClock{now: time.Unix(1000, 0)}
+	for i, a := range addrs {
+		ds[a].Now = c.Now
+		ds[a].Rand = rand.New(rand.NewSource(int64(i)))
+	}
+	canServe := func(a string) bool {
+		return ds[a].Relations["RaftCanServeReads"].(*LBool).Bool()
+	}
+	leaderOf := func(a string) (bool, int) {
+		s := ds[a].Relations["raftCurState"].(*LMaxBy).Value().(raftState)
+		return s.Kind == state_LEADER,
+			ds[a].Relations["raftCurTerm"].(*LMax).Int()
+	}
+	round := func() {
+		c.Advance(RaftHeartbeatPeriod)
+		for _, a := range addrs {
+			ds[a].Tick()
+		}
+	}
+
+	ds["a"].AddNext(ds["a"].Relations["raftAlarm"], true)
+	ds["a"].DrainAsync(tr, 20)
+	for i := 0; i < 3; i++ {
+		round()
+	}
+	if isLeader, _ := leaderOf("a"); !isLeader || !canServe("a") {
+		t.Fatalf("expected a to lead and serve reads")
+	}
+	if canServe("b") || canServe("c") {
+		t.Errorf("expected followers to not serve reads")
+	}
+
+	// Once partitioned, a still thinks it leads, but its lease expires
+	// before anyone else can take over.
+	tr.Isolate("a", true)
+	newLeader := ""
+	for i := 0; i < 20 && newLeader == ""; i++ {
+		round()
+		for _, a := range []string{"b", "c"} {
+			if isLeader, term := leaderOf(a); isLeader && term > 1 {
+				newLeader = a
+			}
+		}
+		if newLeader != "" && canServe("a") {
+			t.Errorf("expected a's lease to expire before a new leader")
+		}
+	}
+	if isLeader, _ := leaderOf("a"); newLeader == "" || !isLeader || canServe("a") {
+		t.Fatalf("expected a new leader while stale leader a can't serve reads"+
+			", newLeader: %q, a can serve: %v", newLeader, canServe("a"))
+	}
+
+	// The new leader serves reads, once it's stable and acked.
+	for i := 0; i < 6; i++ {
+		round()
+	}
+	newLeader = ""
+	for _, a := range []string{"b", "c"} {
+		if isLeader, _ := leaderOf(a); isLeader {
+			newLeader = a
+		}
+	}
+	if newLeader == "" || !canServe(newLeader) {
+		t.Errorf("expected new leader: %q, to serve reads", newLeader)
+	}
+}
+
+func TestRaftPreVote(t *testing.T) {
+	defer func(v bool) { RaftPreVote = v }(RaftPreVote)
+	RaftPreVote = true
+
+	tr := NewMemTransport()
+	addrs := []string{"a", "b", "c"}
+	ds := newRaftCluster(tr, addrs...)
+	c := &fakeClock{now: time.Unix(1000, 0)}
+	for i, a := range addrs {
+		ds[a].Now = c.Now
+		ds[a].Rand = rand.New(rand.NewSource(int64(i)))
+	}
+	leaderOf := func(a string) (bool, int) {
+		s := ds[a].Relations["raftCurState"].(*LMaxBy).Value().(raftState)
+		return s.Kind == state_LEADER,
+			ds[a].Relations["raftCurTerm"].(*LMax).Int()
+	}
+	round := func() {
+		c.Advance(RaftHeartbeatPeriod)
+		for _, a := range addrs {
+			ds[a].Tick()
+		}
+	}
+
+	ds["a"].AddNext(ds["a"].Relations["raftAlarm"], true)
+	for i := 0; i < 10; i++ { // Pre-votes take an extra round trip.
+		round()
+	}
+	isLeader, term := leaderOf("a")
+	if !isLeader || term != 1 {
+		t.Fatalf("expected a to lead term 1, isLeader: %v, term: %d", isLeader, term)
+	}
+
+	// A partitioned node times out repeatedly, but can't win pre-votes,
+	// so doesn't inflate its term.
+	tr.Isolate("c", true)
+	for i := 0; i < 20; i++ {
+		round()
+	}
+	if _, cterm := leaderOf("c"); cterm != term {
+		t.Errorf("expected isolated c to stay at term: %d, got: %d", term, cterm)
+	}
+	if ds["c"].Relations["raftPreVoteTerm"].(*LMax).Int() != term+1 {
+		t.Errorf("expected isolated c to ask for pre-votes")
+	}
+
+	// Once reconnected, c rejoins without disrupting the leader.
+	tr.Isolate("c", false)
+	for i := 0; i < 10; i++ {
+		round()
+		if isLeader, aterm := leaderOf("a"); !isLeader || aterm != term {
+			t.Fatalf("expected a to stay leader of term: %d, isLeader: %v, term: %d",
+				term, isLeader, aterm)
+		}
+	}
+	if isLeader, cterm := leaderOf("c"); isLeader || cterm != term {
+		t.Errorf("expected c to follow at term: %d, got: %d", term, cterm)
+	}
+}
+
+func TestRecordReplayRaft(t *testing.T) {
+	tr := NewMemTransport()
+	addrs := []string{"a", "b", "c"}
+	ds := newRaftCluster(tr, addrs...)
+	c := &fakeClock{now: time.Unix(1000, 0)}
+	for i, a := range addrs {
+		ds[a].Now = c.Now
+		ds[a].Rand = rand.New(rand.NewSource(int64(i)))
+		ds[a].StartRecording()
+	}
+	rounds := func(n int) {
+		for i := 0; i < n; i++ {
+			c.Advance(RaftHeartbeatPeriod)
+			for _, a := range addrs {
+				ds[a].Tick()
+			}
+		}
+	}
+	ds["a"].AddNext(ds["a"].Relations["raftAlarm"], true)
+	rounds(10)
+	leader := ""
+	for _, a := range addrs {
+		if ds[a].Relations["raftCurState"].(*LMaxBy).Value().(raftState).Kind == state_LEADER {
+			leader = a
+		}
+	}
+	if leader == "" {
+		t.Fatalf("expected a leader to be elected")
+	}
+	ds[leader].AddNext(ds[leader].Relations["RaftClientReq"],
+		&RaftClientReq{To: leader, From: leader, Id: "r0", Command: "x"})
+	rounds(5)
+
+	for _, a := range addrs {
+		var buf bytes.Buffer
+		if err := ds[a].SaveRecording(&buf); err != nil {
+			t.Fatalf("expected save to work, err: %v", err)
+		}
+		r := RaftInit(NewD(a), "", nil)
+		for _, m := range addrs {
+			r.Relations["raftMember"].(*LSet).DirectAdd(m)
+		}
+		if err := r.Replay(&buf); err != nil {
+			t.Fatalf("expected replay to work, err: %v", err)
+		}
+		exp, _ := ds[a].MarshalState()
+		got, _ := r.MarshalState()
+		if !bytes.Equal(exp, got) || r.ticks != ds[a].ticks {
+			t.Errorf("expected replay of %s to reach the same state, exp: %s, got: %s",
+				a, exp, got)
+		}
+	}
+
+	if err := NewD("x").Replay(strings.NewReader(`{"Ticks":[{"Fired":["nope"]}]}`)); err == nil {
+		t.Errorf("expected replay of an unknown periodic to fail")
+	}
+}
+
+// Checks Raft safety invariants across the nodes of a cluster, keeping
+// the history needed to check invariants that span ticks.
+type raftSafetyChecker struct {
+	leaders   map[int]string    // Key: term, val: addr of its leader.
+	committed map[int]RaftEntry // Key: index.
+}
+
+func newRaftSafetyChecker() *raftSafetyChecker {
+	return &raftSafetyChecker{leaders: map[int]string{}, committed: map[int]RaftEntry{}}
+}
+
+func raftLogOf(d *D) map[int]RaftEntry {
+	log := map[int]RaftEntry{}
+	logEntry := d.Relations["raftEntry"].(*LMap)
+	for _, k := range logEntry.Keys() {
+		if e := raftEntryAt(logEntry, keyToIndex(k)); e != nil {
+			log[e.Index] = *e
+		}
+	}
+	return log
+}
+
+func (c *raftSafetyChecker) check(t *testing.T, when string, ds map[string]*D) {
+	t.Helper()
+	addrs := make([]string, 0, len(ds))
+	for a := range ds {
+		addrs = append(addrs, a)
+	}
+	sort.Strings(addrs)
+
+	logs := map[string]map[int]RaftEntry{}
+	for _, a := range addrs {
+		d := ds[a]
+		term := d.Relations["raftCurTerm"].(*LMax).Int()
+		if d.Relations["raftCurState"].(*LMaxBy).Value().(raftState).Kind == state_LEADER {
+			if x, ok := c.leaders[term]; ok && x != a {
+				t.Fatalf("%s: election safety, two leaders in term: %d, %s and %s",
+					when, term, x, a)
+			}
+			c.leaders[term] = a
+		}
+
+		logs[a] = raftLogOf(d)
+		commit := d.Relations["raftLogCommit"].(*LMax).Int()
+		for i := 1; i <= commit; i++ {
+			e, ok := logs[a][i]
+			if !ok {
+				continue // Compacted into a snapshot.
+			}
+			if x, ok := c.committed[i]; ok && x != e {
+				t.Fatalf("%s: committed entry changed at %s, index: %d, was: %#v, now: %#v",
+					when, a, i, x, e)
+			}
+			c.committed[i] = e
+		}
+	}
+
+	for i, a := range addrs {
+		for _, b := range addrs[i+1:] {
+			la, lb := logs[a], logs[b]
+			last := 0
+			for j := range la {
+				if j > last {
+					last = j
+				}
+			}
+			matched := false // Whether a later index already matched on term.
+			for j := last; j > 0; j-- {
+				ea, oka := la[j]
+				eb, okb := lb[j]
+				if !oka || !okb {
+					continue
+				}
+				if ea.Term == eb.Term {
+					matched = true
+				}
+				if matched && ea != eb {
+					t.Fatalf("%s: log matching, %s and %s differ at index: %d"+
+						", %#v vs %#v", when, a, b, j, ea, eb)
+				}
+			}
+		}
+	}
+}
+
+func TestRaftSafetyRandomPartitions(t *testing.T) {
+	tr := NewMemTransport()
+	addrs := []string{"a", "b", "c", "d", "e"}
+	ds := newRaftCluster(tr, addrs...)
+	c := &fakeClock{now: time.Unix(1000, 0)}
+	for i, a := range addrs {
+		ds[a].Now = c.Now
+		ds[a].Rand = rand.New(rand.NewSource(int64(i)))
+	}
+	r := rand.New(rand.NewSource(1))
+	checker := newRaftSafetyChecker()
+
+	for round := 0; round < 400; round++ {
+		if round%20 == 0 { // Shuffle the network.
+			for _, a := range addrs {
+				for _, b := range addrs {
+					tr.SetReachable(a, b, round >= 300 || r.Intn(4) > 0)
+					if round < 300 && r.Intn(4) == 0 {
+						tr.AddDelay(a, b, 1+r.Intn(3))
+					} else {
+						tr.AddDelay(a, b, 0)
+					}
+				}
+			}
+		}
+		c.Advance(RaftHeartbeatPeriod)
+		for _, a := range addrs {
+			if round%5 == 0 &&
+				ds[a].Relations["raftCurState"].(*LMaxBy).Value().(raftState).Kind == state_LEADER {
+				ds[a].AddNext(ds[a].Relations["RaftClientReq"], &RaftClientReq{
+					To: a, From: a, Id: fmt.Sprintf("r%d", round), Command: "x"})
+			}
+			ds[a].Tick()
+			checker.check(t, fmt.Sprintf("round: %d, after: %s", round, a), ds)
+		}
+	}
+
+	if len(checker.leaders) == 0 || len(checker.committed) == 0 {
+		t.Errorf("expected leaders and commits, got leaders: %v, commits: %d",
+			checker.leaders, len(checker.committed))
 	}
 }
@@ -0,0 +1,69 @@
+package gdec
+
+import (
+	"fmt"
+	"reflect"
+)
+
+// Join1 is a typed Join of a single source, whose selectWhere func is
+// checked at compile time and invoked without reflection.  A nil result
+// produces no output.
+func Join1[A, Out any](d *D, a Relation, f func(*A) *Out) *joinDeclaration {
+	jd := d.Join(a)
+	checkJoinParam[A](jd, 0)
+	jd.call = func(join []interface{}, deref bool) interface{} {
+		return joinResult(f(joinParam[A](join[0])), deref)
+	}
+	jd.callOut = typeOf[Out]()
+	return jd
+}
+
+// Join2 is like Join1, but for the cross product of two sources.
+func Join2[A, B, Out any](d *D, a, b Relation,
+	f func(*A, *B) *Out) *joinDeclaration {
+	jd := d.Join(a, b)
+	checkJoinParam[A](jd, 0)
+	checkJoinParam[B](jd, 1)
+	jd.call = func(join []interface{}, deref bool) interface{} {
+		return joinResult(f(joinParam[A](join[0]), joinParam[B](join[1])), deref)
+	}
+	jd.callOut = typeOf[Out]()
+	return jd
+}
+
+func typeOf[T any]() reflect.Type {
+	var x *T
+	return reflect.TypeOf(x).Elem()
+}
+
+func checkJoinParam[T any](jd *joinDeclaration, i int) {
+	if jd.err != nil {
+		return
+	}
+	if t := typeOf[T](); t != jd.sources[i].TupleType() {
+		jd.fail(fmt.Sprintf("typed join param #%d type: %v, does not match"+
+			" source: %s, tuple type: %v", i, t,
+			jd.d.relationLabel(jd.sources[i]), jd.sources[i].TupleType()))
+	}
+}
+
+// Relations like LMax or an LSet of strings scan out plain values, so
+// wrap as needed, like asParam().
+func joinParam[T any](x interface{}) *T {
+	if p, ok := x.(*T); ok {
+		return p
+	}
+	v := x.(T)
+	return &v
+}
+
+// Scalar lattices want plain values, see acceptsTuple().
+func joinResult[T any](out *T, deref bool) interface{} {
+	if out == nil {
+		return nil
+	}
+	if deref {
+		return *out
+	}
+	return out
+}
@@ -4,11 +4,25 @@ import (
 	"encoding/json"
 	"fmt"
 	"reflect"
+	"sort"
 )
 
 type Lattice interface {
 	DirectMerge(rel Relation) bool
 	Snapshot() Lattice
+
+	// Zero returns a new, empty lattice of the same kind and
+	// configuration, holding the bottom element, which merges into
+	// any lattice without changing it.  A scratch relation resets to
+	// its Zero() at the start of each tick.
+	Zero() Lattice
+}
+
+// IsZero returns true if the lattice holds just its bottom element,
+// like an empty LSet or a false LBool.
+func IsZero(l Lattice) bool {
+	r, ok := l.(Relation)
+	return ok && !l.Zero().DirectMerge(r)
 }
 
 type LMap struct {
@@ -16,6 +30,12 @@ type LMap struct {
 	d       *D
 	m       map[string]Lattice
 	scratch bool
+	delta   deltaKeys
+
+	// Optional, when every value must be of the same lattice type,
+	// see DeclareLMapOf().
+	newVal  func() Lattice
+	valType reflect.Type
 }
 
 type LMapEntry struct {
@@ -23,13 +43,34 @@ type LMapEntry struct {
 	Val Lattice
 }
 
+// Tuples are keyed by their JSON, which is canonical for a tuple's
+// exported fields, so equal valued tuples, like distinct pointers to
+// equal structs, are the same tuple.  Unexported fields are ignored.
 type LSet struct {
 	name    string
 	d       *D
 	t       reflect.Type
-	m       map[string]interface{}
+	m       map[string]interface{} // Key: tuple's JSON.
 	scratch bool
 	channel bool // When true, this LSet was declared as a channel.
+	delta   deltaKeys
+
+	// Tuples sent to a channel during the current tick, waiting to
+	// be drained by a transport or looped back on the next tick.
+	outbox []interface{}
+
+	outboxMax  int // When > 0, bounds the outbox, see DeclareBoundedChannel().
+	outboxDrop DropPolicy
+	dropped    int64
+
+	dedup  *channelDedup  // Optional, see DeclareDedup().
+	causal *channelCausal // Optional, see DeclareCausal().
+
+	indexes map[string]lsetIndex // Key: field, see DeclareIndex().
+
+	dominated func(a, b interface{}) bool // Optional, see DeclareDominated().
+
+	constant *LSet // The fixed tuples, see DeclareConst().
 }
 
 type LMax struct {
@@ -39,6 +80,8 @@ type LMax struct {
 	scratch bool
 }
 
+// Merges to the lexicographically greatest string, by byte-wise
+// comparison as with Go's < operator, so "" is the identity.
 type LMaxString struct {
 	name    string
 	d       *D
@@ -46,6 +89,17 @@ type LMaxString struct {
 	scratch bool
 }
 
+// Merges to the lexicographically least string, by byte-wise
+// comparison.  There's no greatest string to serve as the identity, so
+// an empty LMinString is unset, and its Scan() yields nothing.
+type LMinString struct {
+	name    string
+	d       *D
+	v       string
+	set     bool
+	scratch bool
+}
+
 type LBool struct {
 	name    string
 	d       *D
@@ -65,6 +119,18 @@ func (d *D) DeclareLSet(name string, x interface{}) *LSet {
 	return d.DeclareRelation(name, m).(*LSet)
 }
 
+// DeclareLMapOf declares an LMap whose values must all be of the type
+// that newVal returns, where newVal returns a fresh, empty value, which
+// AtOrZero() and LMapAt() return for a missing key, so they're never
+// nil, and which a key's first added value is merged into, so the LMap
+// never holds on to a value that a join produced.
+func (d *D) DeclareLMapOf(name string, newVal func() Lattice) *LMap {
+	m := d.NewLMap()
+	m.name = name
+	m.newVal, m.valType = newVal, reflect.TypeOf(newVal())
+	return d.DeclareRelation(name, m).(*LMap)
+}
+
 func (d *D) DeclareLMax(name string) *LMax {
 	m := d.NewLMax()
 	m.name = name
@@ -77,6 +143,12 @@ func (d *D) DeclareLMaxString(name string) *LMaxString {
 	return d.DeclareRelation(name, m).(*LMaxString)
 }
 
+func (d *D) DeclareLMinString(name string) *LMinString {
+	m := d.NewLMinString()
+	m.name = name
+	return d.DeclareRelation(name, m).(*LMinString)
+}
+
 func (d *D) DeclareLBool(name string) *LBool {
 	m := d.NewLBool()
 	m.name = name
@@ -93,6 +165,8 @@ func (d *D) NewLMax() *LMax { return &LMax{d: d} }
 
 func (d *D) NewLMaxString() *LMaxString { return &LMaxString{d: d} }
 
+func (d *D) NewLMinString() *LMinString { return &LMinString{d: d} }
+
 func (d *D) NewLBool() *LBool { return &LBool{d: d} }
 
 func (m *LMap) TupleType() reflect.Type {
@@ -112,6 +186,10 @@ func (m *LMaxString) TupleType() reflect.Type {
 	return reflect.TypeOf("")
 }
 
+func (m *LMinString) TupleType() reflect.Type {
+	return reflect.TypeOf("")
+}
+
 func (m *LBool) TupleType() reflect.Type {
 	var x bool
 	return reflect.TypeOf(x)
@@ -133,55 +211,158 @@ func (m *LMaxString) DeclareScratch() {
 	m.scratch = true
 }
 
+func (m *LMinString) DeclareScratch() {
+	m.scratch = true
+}
+
 func (m *LBool) DeclareScratch() {
 	m.scratch = true
 }
 
+func (m *LMap) isScratch() bool { return m.scratch }
+
+func (m *LSet) isScratch() bool { return m.scratch }
+
+func (m *LMax) isScratch() bool { return m.scratch }
+
+func (m *LMaxString) isScratch() bool { return m.scratch }
+
+func (m *LMinString) isScratch() bool { return m.scratch }
+
+func (m *LBool) isScratch() bool { return m.scratch }
+
 func (m *LMap) startTick() {
 	if m.scratch {
-		m.m = map[string]Lattice{}
+		m.Clear()
 	}
 }
 
 func (m *LSet) startTick() {
 	if m.scratch {
-		m.m = map[string]interface{}{}
+		m.Clear()
+	}
+	if m.constant != nil {
+		m.startTickConst()
 	}
 }
 
 func (m *LMax) startTick() {
 	if m.scratch {
-		m.v = 0
+		m.Clear()
 	}
 }
 
 func (m *LMaxString) startTick() {
 	if m.scratch {
-		m.v = ""
+		m.Clear()
+	}
+}
+
+func (m *LMinString) startTick() {
+	if m.scratch {
+		m.Clear()
 	}
 }
 
 func (m *LBool) startTick() {
 	if m.scratch {
-		m.v = false
+		m.Clear()
 	}
 }
 
+func (m *LMap) Clear() bool {
+	changed := len(m.m) > 0
+	z := m.Zero().(*LMap)
+	m.m, m.delta = z.m, z.delta
+	m.d.cleared(m)
+	return changed
+}
+
+// Clear of a constant LSet only lasts until the next tick, which
+// restores the constant's tuples.
+func (m *LSet) Clear() bool {
+	changed := len(m.m) > 0
+	z := m.Zero().(*LSet)
+	m.m, m.delta = z.m, z.delta
+	m.reindex()
+	m.d.cleared(m)
+	return changed
+}
+
+func (m *LMax) Clear() bool {
+	z := m.Zero().(*LMax)
+	changed := m.v != z.v
+	m.v = z.v
+	m.d.cleared(m)
+	return changed
+}
+
+func (m *LMaxString) Clear() bool {
+	z := m.Zero().(*LMaxString)
+	changed := m.v != z.v
+	m.v = z.v
+	m.d.cleared(m)
+	return changed
+}
+
+func (m *LMinString) Clear() bool {
+	changed := m.set
+	z := m.Zero().(*LMinString)
+	m.v, m.set = z.v, z.set
+	m.d.cleared(m)
+	return changed
+}
+
+func (m *LBool) Clear() bool {
+	z := m.Zero().(*LBool)
+	changed := m.v != z.v
+	m.v = z.v
+	m.d.cleared(m)
+	return changed
+}
+
 func (m *LMap) DirectAdd(v interface{}) bool {
 	if v == nil {
 		panic("unexpected nil during LMap.DirectAdd")
 	}
 	e := v.(*LMapEntry)
+	if m.valType != nil && reflect.TypeOf(e.Val) != m.valType {
+		panic(fmt.Sprintf("LMap.DirectAdd() value type: %T, does not match"+
+			": %v, LMap.name: %s, key: %s", e.Val, m.valType, m.name, e.Key))
+	}
 	o, _ := m.m[e.Key]
 	if o != nil {
 		changed := o.DirectMerge(e.Val.(Relation))
 		m.m[e.Key] = o
+		if changed {
+			m.delta.add(e.Key)
+		}
 		return changed
 	}
-	m.m[e.Key] = e.Val
+	if m.newVal != nil { // A new key is a change, even for a bottom value.
+		o = m.newVal()
+		o.DirectMerge(e.Val.(Relation))
+		m.m[e.Key] = o
+	} else {
+		m.m[e.Key] = e.Val
+	}
+	m.delta.add(e.Key)
 	return true
 }
 
+// DirectAddAll is like DirectAdd() for each tuple, returning true if
+// any changed the LSet, and sizes an empty LSet for them up front.
+func (m *LSet) DirectAddAll(tuples []interface{}) bool {
+	if len(m.m) == 0 {
+		m.m = make(map[string]interface{}, len(tuples))
+	}
+	changed := false
+	for _, v := range tuples {
+		changed = m.DirectAdd(v) || changed
+	}
+	return changed
+}
+
 func (m *LSet) DirectAdd(v interface{}) bool {
 	if v == nil {
 		panic("unexpected nil during LSet.DirectAdd")
@@ -195,9 +376,17 @@ func (m *LSet) DirectAdd(v interface{}) bool {
 			", v: %#v, LSet.name: %s", v, m.name))
 	}
 	js := string(j)
-	_, exists := m.m[js]
+	if _, exists := m.m[js]; exists {
+		return false // Keeps the first of equal valued tuples.
+	}
+	if m.constant != nil {
+		panic(fmt.Sprintf("unexpected add to a constant during LSet.DirectAdd"+
+			", v: %#v, LSet.name: %s", v, m.name))
+	}
 	m.m[js] = v
-	return !exists
+	m.delta.add(js)
+	m.indexAdd(js, v)
+	return true
 }
 
 func (m *LMax) DirectAdd(v interface{}) bool {
@@ -218,6 +407,15 @@ func (m *LMaxString) DirectAdd(v interface{}) bool {
 	return false
 }
 
+func (m *LMinString) DirectAdd(v interface{}) bool {
+	vs := v.(string)
+	if !m.set || vs < m.v {
+		m.v, m.set = vs, true
+		return true
+	}
+	return false
+}
+
 func (m *LBool) DirectAdd(v interface{}) bool {
 	old := m.v
 	m.v = m.v || v.(bool)
@@ -250,6 +448,14 @@ func (m *LMaxString) DirectMerge(rel Relation) bool {
 	return m.DirectAdd(rel.(*LMaxString).v)
 }
 
+func (m *LMinString) DirectMerge(rel Relation) bool {
+	r := rel.(*LMinString)
+	if !r.set {
+		return false
+	}
+	return m.DirectAdd(r.v)
+}
+
 func (m *LBool) DirectMerge(rel Relation) bool {
 	return m.DirectAdd(rel.(*LBool).v)
 }
@@ -257,8 +463,14 @@ func (m *LBool) DirectMerge(rel Relation) bool {
 func (m *LMap) Scan() chan interface{} {
 	ch := make(chan interface{})
 	go func() {
-		for k, v := range m.m {
-			ch <- &LMapEntry{k, v}
+		if m.d.sortedScan() {
+			for _, k := range m.Keys() {
+				ch <- &LMapEntry{k, m.m[k]}
+			}
+		} else {
+			for k, v := range m.m {
+				ch <- &LMapEntry{k, v}
+			}
 		}
 		close(ch)
 	}()
@@ -268,8 +480,14 @@ func (m *LMap) Scan() chan interface{} {
 func (m *LSet) Scan() chan interface{} {
 	ch := make(chan interface{})
 	go func() {
-		for _, v := range m.m {
-			ch <- v
+		if m.d.sortedScan() {
+			for _, k := range sortedKeys(m.m) {
+				ch <- m.m[k]
+			}
+		} else {
+			for _, v := range m.m {
+				ch <- v
+			}
 		}
 		close(ch)
 	}()
@@ -294,6 +512,17 @@ func (m *LMaxString) Scan() chan interface{} {
 	return ch
 }
 
+func (m *LMinString) Scan() chan interface{} {
+	ch := make(chan interface{})
+	go func() {
+		if m.set {
+			ch <- m.v
+		}
+		close(ch)
+	}()
+	return ch
+}
+
 func (m *LBool) Scan() chan interface{} {
 	ch := make(chan interface{})
 	go func() {
@@ -303,8 +532,55 @@ func (m *LBool) Scan() chan interface{} {
 	return ch
 }
 
+func (m *LMap) ScanDelta() chan interface{} { return m.scanKeys(m.delta.keys(m.d)) }
+
+func (m *LSet) ScanDelta() chan interface{} { return m.scanKeys(m.delta.keys(m.d)) }
+
+func (m *LMap) ScanTickDelta() chan interface{} {
+	return m.scanKeys(m.delta.tickKeys(m.d))
+}
+
+func (m *LSet) ScanTickDelta() chan interface{} {
+	return m.scanKeys(m.delta.tickKeys(m.d))
+}
+
+func (m *LMap) scanKeys(keys []string) chan interface{} {
+	ch := make(chan interface{})
+	go func() {
+		for _, k := range keys {
+			if v, ok := m.m[k]; ok {
+				ch <- &LMapEntry{k, v}
+			}
+		}
+		close(ch)
+	}()
+	return ch
+}
+
+func (m *LSet) scanKeys(keys []string) chan interface{} {
+	ch := make(chan interface{})
+	go func() {
+		for _, k := range keys {
+			if v, ok := m.m[k]; ok {
+				ch <- v
+			}
+		}
+		close(ch)
+	}()
+	return ch
+}
+
+func (m *LMap) rotateDelta() { m.delta.rotate() }
+
+func (m *LSet) rotateDelta() { m.delta.rotate() }
+
+func (m *LMap) clearTickDelta() { m.delta.tick = nil }
+
+func (m *LSet) clearTickDelta() { m.delta.tick = nil }
+
 func (m *LMap) Snapshot() Lattice {
 	s := m.d.NewLMap()
+	s.newVal, s.valType = m.newVal, m.valType
 	for k, v := range m.m {
 		s.m[k] = v.Snapshot()
 	}
@@ -336,17 +612,135 @@ func (m *LMaxString) Snapshot() Lattice {
 	return s
 }
 
+func (m *LMinString) Snapshot() Lattice {
+	s := m.d.NewLMinString()
+	s.v, s.set = m.v, m.set
+	return s
+}
+
 func (m *LBool) Snapshot() Lattice {
 	s := m.d.NewLBool()
 	s.v = m.v
 	return s
 }
 
+func (m *LMap) Zero() Lattice {
+	s := m.d.NewLMap()
+	s.newVal, s.valType = m.newVal, m.valType
+	return s
+}
+
+func (m *LSet) Zero() Lattice { return m.d.NewLSet(m.t) }
+
+func (m *LMax) Zero() Lattice { return m.d.NewLMax() }
+
+func (m *LMaxString) Zero() Lattice { return m.d.NewLMaxString() }
+
+func (m *LMinString) Zero() Lattice { return m.d.NewLMinString() }
+
+func (m *LBool) Zero() Lattice { return m.d.NewLBool() }
+
 func (m *LMap) At(key string) Lattice {
 	v, _ := m.m[key]
 	return v
 }
 
+// AtOrZero is like At(), but for a missing key of an LMap from
+// DeclareLMapOf(), returns a fresh, empty value.  That value is a
+// read-only default, as it's not added, so changes to it are lost;
+// add an LMapEntry instead.
+func (m *LMap) AtOrZero(key string) Lattice {
+	v, ok := m.m[key]
+	if !ok && m.newVal != nil {
+		return m.newVal()
+	}
+	return v
+}
+
+// HasKey returns true if a value was added at key.
+func (m *LMap) HasKey(key string) bool {
+	_, ok := m.m[key]
+	return ok
+}
+
+// Typed variants of At(), with ok of false when the key is missing or
+// holds a different lattice type.
+
+func (m *LMap) AtLSet(key string) (*LSet, bool) {
+	v, ok := m.m[key].(*LSet)
+	return v, ok
+}
+
+func (m *LMap) AtLMax(key string) (*LMax, bool) {
+	v, ok := m.m[key].(*LMax)
+	return v, ok
+}
+
+func (m *LMap) AtLBool(key string) (*LBool, bool) {
+	v, ok := m.m[key].(*LBool)
+	return v, ok
+}
+
+// LMapAt returns the value at key of an LMap from DeclareLMapOf(), or a
+// fresh, empty value when the key is missing, which is not added.
+func LMapAt[V Lattice](m *LMap, key string) V {
+	if m.valType != typeOf[V]() {
+		panic(fmt.Sprintf("LMapAt() type: %v, does not match: %v, LMap.name: %s",
+			typeOf[V](), m.valType, m.name))
+	}
+	return m.AtOrZero(key).(V)
+}
+
+// LMapKey returns the canonical LMap key of a composite key, like a
+// struct of a term and an index, which is its JSON, so that distinct
+// composites never collide, as they can when their parts are joined
+// with a separator that a part may contain.
+func LMapKey(k interface{}) string {
+	j, err := json.Marshal(k)
+	if err != nil {
+		panic(err)
+	}
+	return string(j)
+}
+
+// LMapKeyOf decodes a key from LMapKey(), such as one from Keys() or a
+// scanned LMapEntry, back into a K.
+func LMapKeyOf[K any](key string) K {
+	var k K
+	if err := json.Unmarshal([]byte(key), &k); err != nil {
+		panic(fmt.Sprintf("LMapKeyOf() key: %q, is not a %v, err: %v",
+			key, typeOf[K](), err))
+	}
+	return k
+}
+
+// AtKey is like At(), for a composite key, see LMapKey().
+func (m *LMap) AtKey(k interface{}) Lattice {
+	return m.At(LMapKey(k))
+}
+
+// Keys returns the keys in sorted order.
+func (m *LMap) Keys() []string {
+	keys := make([]string, 0, len(m.m))
+	for k := range m.m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func (m *LMap) Len() int {
+	return len(m.m)
+}
+
+// Remove deletes a key, returning true if it was present.  Like
+// LSet.Remove, this is a non-monotonic escape hatch.
+func (m *LMap) Remove(key string) bool {
+	_, ok := m.m[key]
+	delete(m.m, key)
+	return ok
+}
+
 func (m *LSet) Contains(v interface{}) bool {
 	if v == nil {
 		panic("unexpected nil during LSet.Contains")
@@ -363,6 +757,59 @@ func (m *LSet) Contains(v interface{}) bool {
 	return ok
 }
 
+// Remove deletes a tuple, returning true if it was present.  This is a
+// non-monotonic escape hatch, so use it with care.
+func (m *LSet) Remove(v interface{}) bool {
+	if v == nil {
+		panic("unexpected nil during LSet.Remove")
+	}
+	j, err := json.Marshal(v)
+	if err != nil {
+		panic(err)
+	}
+	js := string(j)
+	x, ok := m.m[js]
+	if ok {
+		delete(m.m, js)
+		m.indexRemove(js, x)
+	}
+	return ok
+}
+
+// Returns and clears the tuples sent to a channel that have not been
+// delivered yet.
+func (m *LSet) Drain() []interface{} {
+	rv := m.outbox
+	m.outbox = nil
+	return rv
+}
+
+// Appends to a channel's outbox, enforcing its bound.
+func (m *LSet) send(v interface{}) {
+	if m.outboxMax > 0 && len(m.outbox) >= m.outboxMax {
+		m.dropped++
+		if m.d.LogEnabled(LogDebug) {
+			m.d.Log(LogDebug, "bounded channel dropped tuple", "addr", m.d.Addr,
+				"rel", m.name, "policy", m.outboxDrop)
+		}
+		if m.outboxDrop == DropNewest {
+			return
+		}
+		m.outbox = append(m.outbox[:0], m.outbox[1:]...)
+	}
+	m.outbox = append(m.outbox, v)
+}
+
+// Returns the number of tuples a bounded channel has dropped, from its
+// outbox or, see DeclareCausal(), while holding them.
+func (m *LSet) Dropped() int64 {
+	return m.dropped
+}
+
+func (m *LSet) IsChannel() bool {
+	return m.channel
+}
+
 func (m *LSet) Size() int {
 	return len(m.m)
 }
@@ -375,16 +822,39 @@ func (m *LMaxString) String() string {
 	return m.v
 }
 
+func (m *LMinString) String() string { // Returns "" when unset.
+	return m.v
+}
+
+func (m *LMinString) IsSet() bool {
+	return m.set
+}
+
 func (m *LBool) Bool() bool {
 	return m.v
 }
 
+func sortedKeys(m map[string]interface{}) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
 func NewLSetOne(d *D, v interface{}) *LSet { // Helper creator for a 1 item LSet.
 	s := d.NewLSet(reflect.TypeOf(v))
 	s.DirectAdd(v)
 	return s
 }
 
+func NewLMax(d *D, v int) *LMax { // Helper creator for an initialized LMax.
+	s := d.NewLMax()
+	s.DirectAdd(v)
+	return s
+}
+
 func NewLBool(d *D, v bool) *LBool { // Helper creator for an initialized LBool.
 	s := d.NewLBool()
 	s.DirectAdd(v)
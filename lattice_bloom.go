@@ -0,0 +1,186 @@
+package gdec
+
+import (
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"math/bits"
+	"reflect"
+)
+
+// A Bloom filter, which answers whether an element may have been added
+// without storing the elements, with no false negatives and a false
+// positive rate that grows as bits fill up.  Each element sets hashes
+// bits of a fixed size bit array.  As a lattice, merging ORs the bits,
+// so replicas converge on the filter of all their elements.  Elements
+// are hashed by their JSON, so equal valued elements are the same.
+type LBloom struct {
+	name    string
+	d       *D
+	size    int // Number of bits.
+	hashes  int // Bits set per element.
+	bits    []uint64
+	scratch bool
+}
+
+// A set bit, the tuple form of an LBloom.
+type LBloomBit struct {
+	Index int
+}
+
+func (d *D) DeclareLBloom(name string, size, hashes int) *LBloom {
+	m := d.NewLBloom(size, hashes)
+	m.name = name
+	return d.DeclareRelation(name, m).(*LBloom)
+}
+
+// NewLBloom gives a filter of size bits, where each element sets hashes
+// bits.  Filters only merge with those of the same size and hashes.
+func (d *D) NewLBloom(size, hashes int) *LBloom {
+	if size <= 0 || hashes <= 0 {
+		panic(fmt.Sprintf("NewLBloom() size: %d, hashes: %d"+
+			", should be positive", size, hashes))
+	}
+	return &LBloom{d: d, size: size, hashes: hashes,
+		bits: make([]uint64, (size+63)/64)}
+}
+
+func (m *LBloom) TupleType() reflect.Type {
+	var x *LBloomBit
+	return reflect.TypeOf(x).Elem()
+}
+
+func (m *LBloom) DeclareScratch() {
+	m.scratch = true
+}
+
+func (m *LBloom) isScratch() bool { return m.scratch }
+
+func (m *LBloom) startTick() {
+	if m.scratch {
+		m.Clear()
+	}
+}
+
+func (m *LBloom) Clear() bool {
+	changed := false
+	for _, b := range m.bits {
+		changed = changed || b != 0
+	}
+	m.bits = make([]uint64, len(m.bits))
+	m.d.cleared(m)
+	return changed
+}
+
+// Returns the bits of an element, by double hashing its JSON.
+func (m *LBloom) indexes(v interface{}) []int {
+	if v == nil {
+		panic("unexpected nil during LBloom hashing")
+	}
+	j, err := json.Marshal(v)
+	if err != nil {
+		panic(err)
+	}
+	h := fnv.New64a()
+	h.Write(j)
+	h1 := mix64(h.Sum64())
+	h2 := mix64(h1) | 1
+	rv := make([]int, m.hashes)
+	for i := range rv {
+		rv[i] = int((h1 + uint64(i)*h2) % uint64(m.size))
+	}
+	return rv
+}
+
+func (m *LBloom) set(i int) bool {
+	w, b := i/64, uint64(1)<<uint(i%64)
+	if m.bits[w]&b != 0 {
+		return false
+	}
+	m.bits[w] |= b
+	return true
+}
+
+// DirectAdd takes a *LBloomBit, such as one from Scan(), or else an
+// element, whose bits it sets.
+func (m *LBloom) DirectAdd(v interface{}) bool {
+	if b, ok := v.(*LBloomBit); ok {
+		if b.Index < 0 || b.Index >= m.size {
+			panic(fmt.Sprintf("bit out of range during LBloom.DirectAdd"+
+				", b: %#v, size: %d, LBloom.name: %s", b, m.size, m.name))
+		}
+		return m.set(b.Index)
+	}
+	changed := false
+	for _, i := range m.indexes(v) {
+		changed = m.set(i) || changed
+	}
+	return changed
+}
+
+func (m *LBloom) DirectMerge(rel Relation) bool {
+	o := rel.(*LBloom)
+	if o.size != m.size || o.hashes != m.hashes {
+		panic(fmt.Sprintf("shape mismatch during LBloom.DirectMerge"+
+			", size: %d, hashes: %d, other size: %d, other hashes: %d"+
+			", LBloom.name: %s", m.size, m.hashes, o.size, o.hashes, m.name))
+	}
+	changed := false
+	for i, w := range o.bits {
+		if m.bits[i]|w != m.bits[i] {
+			m.bits[i] |= w
+			changed = true
+		}
+	}
+	return changed
+}
+
+// Of returns a new filter, shaped like m, holding just the element, for
+// JoinFlat()'s that add their results to m.
+func (m *LBloom) Of(v interface{}) *LBloom {
+	rv := m.d.NewLBloom(m.size, m.hashes)
+	rv.DirectAdd(v)
+	return rv
+}
+
+// MayContain returns false if the element was surely never added, and
+// otherwise true, which is wrong for a false positive.
+func (m *LBloom) MayContain(v interface{}) bool {
+	for _, i := range m.indexes(v) {
+		if m.bits[i/64]&(uint64(1)<<uint(i%64)) == 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// Count returns the number of set bits.
+func (m *LBloom) Count() int {
+	n := 0
+	for _, w := range m.bits {
+		n += bits.OnesCount64(w)
+	}
+	return n
+}
+
+// Scan yields the set bits.
+func (m *LBloom) Scan() chan interface{} {
+	ch := make(chan interface{})
+	go func() {
+		for i := 0; i < m.size; i++ {
+			if m.bits[i/64]&(uint64(1)<<uint(i%64)) != 0 {
+				ch <- &LBloomBit{i}
+			}
+		}
+		close(ch)
+	}()
+	return ch
+}
+
+func (m *LBloom) Zero() Lattice { return m.d.NewLBloom(m.size, m.hashes) }
+
+func (m *LBloom) Snapshot() Lattice {
+	s := m.d.NewLBloom(m.size, m.hashes)
+	copy(s.bits, m.bits)
+	return s
+}
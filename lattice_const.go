@@ -0,0 +1,32 @@
+package gdec
+
+// DeclareConst declares an LSet of fixed tuples, for static facts like
+// configuration, that's there on every tick and that nothing derives.
+// Unlike an Input(), which is scratch and so starts each tick empty, a
+// constant's tuples are re-materialized at the start of each tick from
+// a backing copy, so a Remove() only lasts until the next tick.  Adding
+// to a constant panics, and a join can't use one as its Into().  Joins
+// reading only constants, and state that only grows, stay maintainable,
+// see SemiNaive().
+func (d *D) DeclareConst(name string, x interface{}, tuples ...interface{}) *LSet {
+	m := d.DeclareLSet(name, x)
+	m.DirectAddAll(tuples)
+	m.constant = m.Snapshot().(*LSet)
+	return m
+}
+
+func (m *LSet) IsConst() bool {
+	return m.constant != nil
+}
+
+// Restores any removed tuples of a constant, as changes, so that joins
+// see them again.
+func (m *LSet) startTickConst() {
+	for k, v := range m.constant.m {
+		if _, ok := m.m[k]; !ok {
+			m.m[k] = v
+			m.delta.add(k)
+			m.indexAdd(k, v)
+		}
+	}
+}
@@ -0,0 +1,223 @@
+package gdec
+
+import (
+	"fmt"
+	"reflect"
+)
+
+// A grow-only counter, replicated by keeping a separate count per node.
+// Merging takes the per-node max, so it's commutative and idempotent.
+type GCounter struct {
+	name    string
+	d       *D
+	m       map[string]int // Key: node id, val: count from that node.
+	scratch bool
+}
+
+type GCounterEntry struct {
+	Node  string
+	Count int
+}
+
+func (d *D) DeclareGCounter(name string) *GCounter {
+	m := d.NewGCounter()
+	m.name = name
+	return d.DeclareRelation(name, m).(*GCounter)
+}
+
+func (d *D) NewGCounter() *GCounter { return &GCounter{d: d, m: map[string]int{}} }
+
+func (m *GCounter) TupleType() reflect.Type {
+	var x *GCounterEntry
+	return reflect.TypeOf(x).Elem()
+}
+
+func (m *GCounter) DeclareScratch() {
+	m.scratch = true
+}
+
+func (m *GCounter) isScratch() bool { return m.scratch }
+
+func (m *GCounter) startTick() {
+	if m.scratch {
+		m.Clear()
+	}
+}
+
+func (m *GCounter) Clear() bool {
+	changed := len(m.m) > 0
+	m.m = m.Zero().(*GCounter).m
+	m.d.cleared(m)
+	return changed
+}
+
+// Inc adds a non-negative delta to a node's count.
+func (m *GCounter) Inc(node string, delta int) bool {
+	if delta < 0 {
+		panic(fmt.Sprintf("negative delta during GCounter.Inc"+
+			", node: %s, delta: %d, GCounter.name: %s", node, delta, m.name))
+	}
+	if delta == 0 {
+		return false
+	}
+	m.m[node] += delta
+	return true
+}
+
+// DirectAdd takes a *GCounterEntry, such as one from Scan(), and merges
+// it in by keeping the larger of the two counts for that node.
+func (m *GCounter) DirectAdd(v interface{}) bool {
+	if v == nil {
+		panic("unexpected nil during GCounter.DirectAdd")
+	}
+	e := v.(*GCounterEntry)
+	if e.Count < 0 {
+		panic(fmt.Sprintf("negative count during GCounter.DirectAdd"+
+			", e: %#v, GCounter.name: %s", e, m.name))
+	}
+	if m.m[e.Node] < e.Count {
+		m.m[e.Node] = e.Count
+		return true
+	}
+	return false
+}
+
+func (m *GCounter) DirectMerge(rel Relation) bool {
+	changed := false
+	for k, v := range rel.(*GCounter).m {
+		changed = m.DirectAdd(&GCounterEntry{k, v}) || changed
+	}
+	return changed
+}
+
+func (m *GCounter) Scan() chan interface{} {
+	ch := make(chan interface{})
+	go func() {
+		for k, v := range m.m {
+			ch <- &GCounterEntry{k, v}
+		}
+		close(ch)
+	}()
+	return ch
+}
+
+func (m *GCounter) Zero() Lattice { return m.d.NewGCounter() }
+
+func (m *GCounter) Snapshot() Lattice {
+	s := m.d.NewGCounter()
+	for k, v := range m.m {
+		s.m[k] = v
+	}
+	return s
+}
+
+func (m *GCounter) Value() int {
+	sum := 0
+	for _, v := range m.m {
+		sum += v
+	}
+	return sum
+}
+
+// A counter that supports decrements, by pairing a GCounter of
+// increments with a GCounter of decrements.
+type PNCounter struct {
+	name    string
+	d       *D
+	pos     *GCounter
+	neg     *GCounter
+	scratch bool
+}
+
+type PNCounterEntry struct {
+	Node  string
+	Neg   bool // When true, Count is from the decrements GCounter.
+	Count int
+}
+
+func (d *D) DeclarePNCounter(name string) *PNCounter {
+	m := d.NewPNCounter()
+	m.name = name
+	return d.DeclareRelation(name, m).(*PNCounter)
+}
+
+func (d *D) NewPNCounter() *PNCounter {
+	return &PNCounter{d: d, pos: d.NewGCounter(), neg: d.NewGCounter()}
+}
+
+func (m *PNCounter) TupleType() reflect.Type {
+	var x *PNCounterEntry
+	return reflect.TypeOf(x).Elem()
+}
+
+func (m *PNCounter) DeclareScratch() {
+	m.scratch = true
+}
+
+func (m *PNCounter) isScratch() bool { return m.scratch }
+
+func (m *PNCounter) startTick() {
+	if m.scratch {
+		m.Clear()
+	}
+}
+
+func (m *PNCounter) Clear() bool {
+	changed := len(m.pos.m) > 0 || len(m.neg.m) > 0
+	z := m.Zero().(*PNCounter)
+	m.pos, m.neg = z.pos, z.neg
+	m.d.cleared(m)
+	return changed
+}
+
+func (m *PNCounter) Inc(node string, delta int) bool {
+	return m.pos.Inc(node, delta)
+}
+
+func (m *PNCounter) Dec(node string, delta int) bool {
+	return m.neg.Inc(node, delta)
+}
+
+func (m *PNCounter) DirectAdd(v interface{}) bool {
+	if v == nil {
+		panic("unexpected nil during PNCounter.DirectAdd")
+	}
+	e := v.(*PNCounterEntry)
+	if e.Neg {
+		return m.neg.DirectAdd(&GCounterEntry{e.Node, e.Count})
+	}
+	return m.pos.DirectAdd(&GCounterEntry{e.Node, e.Count})
+}
+
+func (m *PNCounter) DirectMerge(rel Relation) bool {
+	r := rel.(*PNCounter)
+	changed := m.pos.DirectMerge(r.pos)
+	return m.neg.DirectMerge(r.neg) || changed
+}
+
+func (m *PNCounter) Scan() chan interface{} {
+	ch := make(chan interface{})
+	go func() {
+		for k, v := range m.pos.m {
+			ch <- &PNCounterEntry{k, false, v}
+		}
+		for k, v := range m.neg.m {
+			ch <- &PNCounterEntry{k, true, v}
+		}
+		close(ch)
+	}()
+	return ch
+}
+
+func (m *PNCounter) Zero() Lattice { return m.d.NewPNCounter() }
+
+func (m *PNCounter) Snapshot() Lattice {
+	s := m.d.NewPNCounter()
+	s.pos = m.pos.Snapshot().(*GCounter)
+	s.neg = m.neg.Snapshot().(*GCounter)
+	return s
+}
+
+func (m *PNCounter) Value() int {
+	return m.pos.Value() - m.neg.Value()
+}
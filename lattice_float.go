@@ -0,0 +1,155 @@
+package gdec
+
+import (
+	"math"
+	"reflect"
+)
+
+// Float lattices, whose zero values are the identities of their merges,
+// -Inf for LMaxFloat and +Inf for LMinFloat.  A NaN is ignored, since
+// it can't be ordered against anything.
+type LMaxFloat struct {
+	name    string
+	d       *D
+	v       float64
+	scratch bool
+}
+
+type LMinFloat struct {
+	name    string
+	d       *D
+	v       float64
+	scratch bool
+}
+
+func (d *D) DeclareLMaxFloat(name string) *LMaxFloat {
+	m := d.NewLMaxFloat()
+	m.name = name
+	return d.DeclareRelation(name, m).(*LMaxFloat)
+}
+
+func (d *D) DeclareLMinFloat(name string) *LMinFloat {
+	m := d.NewLMinFloat()
+	m.name = name
+	return d.DeclareRelation(name, m).(*LMinFloat)
+}
+
+func (d *D) NewLMaxFloat() *LMaxFloat { return &LMaxFloat{d: d, v: math.Inf(-1)} }
+
+func (d *D) NewLMinFloat() *LMinFloat { return &LMinFloat{d: d, v: math.Inf(1)} }
+
+func (m *LMaxFloat) TupleType() reflect.Type {
+	return reflect.TypeOf(0.0)
+}
+
+func (m *LMinFloat) TupleType() reflect.Type {
+	return reflect.TypeOf(0.0)
+}
+
+func (m *LMaxFloat) DeclareScratch() {
+	m.scratch = true
+}
+
+func (m *LMinFloat) DeclareScratch() {
+	m.scratch = true
+}
+
+func (m *LMaxFloat) isScratch() bool { return m.scratch }
+
+func (m *LMinFloat) isScratch() bool { return m.scratch }
+
+func (m *LMaxFloat) startTick() {
+	if m.scratch {
+		m.Clear()
+	}
+}
+
+func (m *LMaxFloat) Clear() bool {
+	z := m.Zero().(*LMaxFloat)
+	changed := m.v != z.v
+	m.v = z.v
+	m.d.cleared(m)
+	return changed
+}
+
+func (m *LMinFloat) startTick() {
+	if m.scratch {
+		m.Clear()
+	}
+}
+
+func (m *LMinFloat) Clear() bool {
+	z := m.Zero().(*LMinFloat)
+	changed := m.v != z.v
+	m.v = z.v
+	m.d.cleared(m)
+	return changed
+}
+
+func (m *LMaxFloat) DirectAdd(v interface{}) bool {
+	vf := v.(float64)
+	if m.v < vf { // Always false for NaN.
+		m.v = vf
+		return true
+	}
+	return false
+}
+
+func (m *LMinFloat) DirectAdd(v interface{}) bool {
+	vf := v.(float64)
+	if m.v > vf { // Always false for NaN.
+		m.v = vf
+		return true
+	}
+	return false
+}
+
+func (m *LMaxFloat) DirectMerge(rel Relation) bool {
+	return m.DirectAdd(rel.(*LMaxFloat).v)
+}
+
+func (m *LMinFloat) DirectMerge(rel Relation) bool {
+	return m.DirectAdd(rel.(*LMinFloat).v)
+}
+
+func (m *LMaxFloat) Scan() chan interface{} {
+	ch := make(chan interface{})
+	go func() {
+		ch <- m.v
+		close(ch)
+	}()
+	return ch
+}
+
+func (m *LMinFloat) Scan() chan interface{} {
+	ch := make(chan interface{})
+	go func() {
+		ch <- m.v
+		close(ch)
+	}()
+	return ch
+}
+
+func (m *LMaxFloat) Zero() Lattice { return m.d.NewLMaxFloat() }
+
+func (m *LMinFloat) Zero() Lattice { return m.d.NewLMinFloat() }
+
+func (m *LMaxFloat) Snapshot() Lattice {
+	s := m.d.NewLMaxFloat()
+	s.v = m.v
+	return s
+}
+
+func (m *LMinFloat) Snapshot() Lattice {
+	s := m.d.NewLMinFloat()
+	s.v = m.v
+	return s
+}
+
+func (m *LMaxFloat) Float() float64 {
+	return m.v
+}
+
+func (m *LMinFloat) Float() float64 {
+	return m.v
+}
@@ -0,0 +1,189 @@
+package gdec
+
+import (
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"math"
+	"math/bits"
+	"reflect"
+)
+
+// The default precision of DeclareLHLL(), giving 2^14 registers, for a
+// standard error of about 0.8%.
+const LHLLPrecision = 14
+
+// A HyperLogLog sketch, which estimates the number of distinct elements
+// added to it without storing them.  Each element is hashed to one of
+// 2^precision registers, which keeps the longest run of leading zeros
+// seen in the rest of the hash.  As a lattice, merging takes the
+// per-register max, so a merged sketch estimates the union.  Elements
+// are hashed by their JSON, so, as with an LSet, equal valued elements
+// count once.
+type LHLL struct {
+	name      string
+	d         *D
+	precision int
+	regs      []uint8
+	scratch   bool
+}
+
+// A register and its rank, the tuple form of an LHLL.  Register() gives
+// the one for an element, for joins that count their results.
+type LHLLRegister struct {
+	Index int
+	Rank  uint8
+}
+
+func (d *D) DeclareLHLL(name string) *LHLL {
+	m := d.NewLHLL(LHLLPrecision)
+	m.name = name
+	return d.DeclareRelation(name, m).(*LHLL)
+}
+
+// NewLHLL gives a sketch of 2^precision registers, where precision is
+// from 4 to 18.  Sketches only merge with those of the same precision.
+func (d *D) NewLHLL(precision int) *LHLL {
+	if precision < 4 || precision > 18 {
+		panic(fmt.Sprintf("NewLHLL() precision: %d, should be from 4 to 18",
+			precision))
+	}
+	return &LHLL{d: d, precision: precision, regs: make([]uint8, 1<<precision)}
+}
+
+func (m *LHLL) TupleType() reflect.Type {
+	var x *LHLLRegister
+	return reflect.TypeOf(x).Elem()
+}
+
+func (m *LHLL) DeclareScratch() {
+	m.scratch = true
+}
+
+func (m *LHLL) isScratch() bool { return m.scratch }
+
+func (m *LHLL) startTick() {
+	if m.scratch {
+		m.Clear()
+	}
+}
+
+func (m *LHLL) Clear() bool {
+	changed := false
+	for _, r := range m.regs {
+		changed = changed || r != 0
+	}
+	m.regs = make([]uint8, len(m.regs))
+	m.d.cleared(m)
+	return changed
+}
+
+// Register returns the register that an element hashes to, and the
+// rank that the element gives it.
+func (m *LHLL) Register(v interface{}) *LHLLRegister {
+	if v == nil {
+		panic("unexpected nil during LHLL.Register")
+	}
+	j, err := json.Marshal(v)
+	if err != nil {
+		panic(err)
+	}
+	h := fnv.New64a()
+	h.Write(j)
+	x := mix64(h.Sum64())
+	rest := x<<uint(m.precision) | 1<<uint(m.precision-1) // Bounds the rank.
+	return &LHLLRegister{
+		Index: int(x >> uint(64-m.precision)),
+		Rank:  uint8(bits.LeadingZeros64(rest) + 1),
+	}
+}
+
+// DirectAdd takes a *LHLLRegister, such as one from Scan(), keeping the
+// larger of the two ranks for that register, or else an element, which
+// is hashed by Register().
+func (m *LHLL) DirectAdd(v interface{}) bool {
+	if v == nil {
+		panic("unexpected nil during LHLL.DirectAdd")
+	}
+	r, ok := v.(*LHLLRegister)
+	if !ok {
+		r = m.Register(v)
+	}
+	if r.Index < 0 || r.Index >= len(m.regs) {
+		panic(fmt.Sprintf("register out of range during LHLL.DirectAdd"+
+			", r: %#v, registers: %d, LHLL.name: %s", r, len(m.regs), m.name))
+	}
+	if m.regs[r.Index] < r.Rank {
+		m.regs[r.Index] = r.Rank
+		return true
+	}
+	return false
+}
+
+func (m *LHLL) DirectMerge(rel Relation) bool {
+	o := rel.(*LHLL)
+	if o.precision != m.precision {
+		panic(fmt.Sprintf("precision mismatch during LHLL.DirectMerge"+
+			", precision: %d, other: %d, LHLL.name: %s",
+			m.precision, o.precision, m.name))
+	}
+	changed := false
+	for i, rank := range o.regs {
+		if m.regs[i] < rank {
+			m.regs[i] = rank
+			changed = true
+		}
+	}
+	return changed
+}
+
+// Scan yields the registers with a non-zero rank.
+func (m *LHLL) Scan() chan interface{} {
+	ch := make(chan interface{})
+	go func() {
+		for i, rank := range m.regs {
+			if rank > 0 {
+				ch <- &LHLLRegister{i, rank}
+			}
+		}
+		close(ch)
+	}()
+	return ch
+}
+
+func (m *LHLL) Zero() Lattice { return m.d.NewLHLL(m.precision) }
+
+func (m *LHLL) Snapshot() Lattice {
+	s := m.d.NewLHLL(m.precision)
+	copy(s.regs, m.regs)
+	return s
+}
+
+// Estimate returns the approximate number of distinct elements added,
+// using linear counting while many registers are still zero.
+func (m *LHLL) Estimate() int {
+	n := float64(len(m.regs))
+	sum, zeros := 0.0, 0
+	for _, rank := range m.regs {
+		sum += math.Ldexp(1, -int(rank))
+		if rank == 0 {
+			zeros++
+		}
+	}
+	e := 0.7213 / (1 + 1.079/n) * n * n / sum
+	if e <= 2.5*n && zeros > 0 {
+		e = n * math.Log(n/float64(zeros))
+	}
+	return int(e + 0.5)
+}
+
+// Spreads a hash's entropy across all its bits, as FNV leaves the high
+// bits of short inputs poorly mixed.  From SplitMix64.
+func mix64(x uint64) uint64 {
+	x ^= x >> 30
+	x *= 0xbf58476d1ce4e5b9
+	x ^= x >> 27
+	x *= 0x94d049bb133111eb
+	x ^= x >> 31
+	return x
+}
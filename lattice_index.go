@@ -0,0 +1,110 @@
+package gdec
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+)
+
+// A secondary index of an LSet's tuples by the value of a field.
+type lsetIndex map[interface{}]map[string]bool // Key: field value, val: tuple keys.
+
+// DeclareIndex maintains an index of the LSet's tuples by the named
+// field, so that Lookup() and ContainsWhere() on that field take time
+// proportional to the matches, instead of scanning every tuple.  The
+// index follows DirectAdd(), DirectMerge(), Remove() and scratch
+// resets.
+func (m *LSet) DeclareIndex(field string) *LSet {
+	t := m.t
+	if t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	if t.Kind() != reflect.Struct {
+		panic(fmt.Sprintf("DeclareIndex() tuple type: %v, is not a struct"+
+			", LSet.name: %s", m.t, m.name))
+	}
+	f, ok := t.FieldByName(field)
+	if !ok || !f.Type.Comparable() {
+		panic(fmt.Sprintf("DeclareIndex() tuple type: %v, has no comparable"+
+			" field: %s, LSet.name: %s", m.t, field, m.name))
+	}
+	if m.indexes == nil {
+		m.indexes = map[string]lsetIndex{}
+	}
+	idx := lsetIndex{}
+	for k, v := range m.m {
+		idx.add(tupleField(v, field), k)
+	}
+	m.indexes[field] = idx
+	return m
+}
+
+func (idx lsetIndex) add(fv interface{}, k string) {
+	keys := idx[fv]
+	if keys == nil {
+		keys = map[string]bool{}
+		idx[fv] = keys
+	}
+	keys[k] = true
+}
+
+// Used when the tuple v, of key k, is added to the LSet.
+func (m *LSet) indexAdd(k string, v interface{}) {
+	for field, idx := range m.indexes {
+		idx.add(tupleField(v, field), k)
+	}
+}
+
+// Used when the tuple v, of key k, is removed from the LSet.
+func (m *LSet) indexRemove(k string, v interface{}) {
+	for field, idx := range m.indexes {
+		fv := tupleField(v, field)
+		delete(idx[fv], k)
+		if len(idx[fv]) == 0 {
+			delete(idx, fv)
+		}
+	}
+}
+
+// Used when the LSet's tuples are replaced wholesale.
+func (m *LSet) reindex() {
+	for field := range m.indexes {
+		m.DeclareIndex(field)
+	}
+}
+
+// Lookup returns the tuples whose field equals value, ordered by their
+// JSON.  Without DeclareIndex() on the field, it scans every tuple.
+func (m *LSet) Lookup(field string, value interface{}) []interface{} {
+	var keys []string
+	if idx, ok := m.indexes[field]; ok {
+		for k := range idx[value] {
+			keys = append(keys, k)
+		}
+	} else {
+		for k, v := range m.m {
+			if tupleField(v, field) == value {
+				keys = append(keys, k)
+			}
+		}
+	}
+	sort.Strings(keys)
+	rv := make([]interface{}, len(keys))
+	for i, k := range keys {
+		rv[i] = m.m[k]
+	}
+	return rv
+}
+
+// ContainsWhere returns true if a tuple's field equals value.
+func (m *LSet) ContainsWhere(field string, value interface{}) bool {
+	if idx, ok := m.indexes[field]; ok {
+		return len(idx[value]) > 0
+	}
+	for _, v := range m.m {
+		if tupleField(v, field) == value {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,100 @@
+package gdec
+
+import (
+	"reflect"
+)
+
+// A last-writer-wins register.  Merging keeps the value with the higher
+// timestamp, breaking ties by the lexicographically larger value so
+// that all replicas agree.
+type LWWReg struct {
+	name    string
+	d       *D
+	v       LWWRegEntry
+	scratch bool
+}
+
+type LWWRegEntry struct {
+	Ts  int64
+	Val string
+}
+
+func (d *D) DeclareLWWReg(name string) *LWWReg {
+	m := d.NewLWWReg()
+	m.name = name
+	return d.DeclareRelation(name, m).(*LWWReg)
+}
+
+func (d *D) NewLWWReg() *LWWReg { return &LWWReg{d: d} }
+
+func (m *LWWReg) TupleType() reflect.Type {
+	var x *LWWRegEntry
+	return reflect.TypeOf(x).Elem()
+}
+
+func (m *LWWReg) DeclareScratch() {
+	m.scratch = true
+}
+
+func (m *LWWReg) isScratch() bool { return m.scratch }
+
+func (m *LWWReg) startTick() {
+	if m.scratch {
+		m.Clear()
+	}
+}
+
+func (m *LWWReg) Clear() bool {
+	z := m.Zero().(*LWWReg)
+	changed := m.v != z.v
+	m.v = z.v
+	m.d.cleared(m)
+	return changed
+}
+
+func (m *LWWReg) Set(ts int64, val string) bool {
+	return m.DirectAdd(&LWWRegEntry{ts, val})
+}
+
+func (m *LWWReg) DirectAdd(v interface{}) bool {
+	if v == nil {
+		panic("unexpected nil during LWWReg.DirectAdd")
+	}
+	e := v.(*LWWRegEntry)
+	if e.Ts > m.v.Ts || (e.Ts == m.v.Ts && e.Val > m.v.Val) {
+		m.v = *e
+		return true
+	}
+	return false
+}
+
+func (m *LWWReg) DirectMerge(rel Relation) bool {
+	r := rel.(*LWWReg).v
+	return m.DirectAdd(&r)
+}
+
+func (m *LWWReg) Scan() chan interface{} {
+	ch := make(chan interface{})
+	go func() {
+		v := m.v
+		ch <- &v
+		close(ch)
+	}()
+	return ch
+}
+
+func (m *LWWReg) Zero() Lattice { return m.d.NewLWWReg() }
+
+func (m *LWWReg) Snapshot() Lattice {
+	s := m.d.NewLWWReg()
+	s.v = m.v
+	return s
+}
+
+func (m *LWWReg) Value() string {
+	return m.v.Val
+}
+
+func (m *LWWReg) Timestamp() int64 {
+	return m.v.Ts
+}
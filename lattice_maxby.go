@@ -0,0 +1,94 @@
+package gdec
+
+import (
+	"fmt"
+	"reflect"
+)
+
+// An LMax over values of any type, ordered by a less-than comparator
+// given at declaration, so richer values, like a (version, kind)
+// struct, get max merge semantics without being packed into an int.
+// The less func must be a total order with the zero value of the type
+// as its least element, which is the LMaxBy's bottom.
+type LMaxBy struct {
+	name    string
+	d       *D
+	t       reflect.Type
+	less    func(a, b interface{}) bool
+	v       interface{}
+	scratch bool
+}
+
+func (d *D) DeclareLMaxBy(name string, x interface{},
+	less func(a, b interface{}) bool) *LMaxBy {
+	m := d.NewLMaxBy(reflect.TypeOf(x), less)
+	m.name = name
+	return d.DeclareRelation(name, m).(*LMaxBy)
+}
+
+func (d *D) NewLMaxBy(t reflect.Type, less func(a, b interface{}) bool) *LMaxBy {
+	if t == nil || t.Kind() == reflect.Ptr {
+		panic(fmt.Sprintf("NewLMaxBy() needs a non-pointer value type: %v", t))
+	}
+	if less == nil {
+		panic(fmt.Sprintf("NewLMaxBy() needs a less func, type: %v", t))
+	}
+	return &LMaxBy{d: d, t: t, less: less, v: reflect.Zero(t).Interface()}
+}
+
+func (m *LMaxBy) TupleType() reflect.Type { return m.t }
+
+func (m *LMaxBy) DeclareScratch() {
+	m.scratch = true
+}
+
+func (m *LMaxBy) isScratch() bool { return m.scratch }
+
+func (m *LMaxBy) startTick() {
+	if m.scratch {
+		m.Clear()
+	}
+}
+
+func (m *LMaxBy) Clear() bool {
+	z := m.Zero().(*LMaxBy)
+	changed := !reflect.DeepEqual(m.v, z.v)
+	m.v = z.v
+	m.d.cleared(m)
+	return changed
+}
+
+func (m *LMaxBy) Value() interface{} { return m.v }
+
+func (m *LMaxBy) DirectAdd(v interface{}) bool {
+	if v == nil || reflect.TypeOf(v) != m.t {
+		panic(fmt.Sprintf("unexpected tuple during LMaxBy.DirectAdd: %#v"+
+			", LMaxBy.name: %s, type: %v", v, m.name, m.t))
+	}
+	if m.less(m.v, v) {
+		m.v = v
+		return true
+	}
+	return false
+}
+
+func (m *LMaxBy) DirectMerge(rel Relation) bool {
+	return m.DirectAdd(rel.(*LMaxBy).v)
+}
+
+func (m *LMaxBy) Scan() chan interface{} {
+	ch := make(chan interface{})
+	go func() {
+		ch <- m.v
+		close(ch)
+	}()
+	return ch
+}
+
+func (m *LMaxBy) Zero() Lattice { return m.d.NewLMaxBy(m.t, m.less) }
+
+func (m *LMaxBy) Snapshot() Lattice {
+	s := m.d.NewLMaxBy(m.t, m.less)
+	s.v = m.v
+	return s
+}
@@ -0,0 +1,164 @@
+package gdec
+
+import (
+	"reflect"
+)
+
+// A multi-value register, which keeps every value written concurrently
+// as a sibling, tracking causality with a version vector per sibling.
+// Merging drops siblings whose version vectors are dominated by
+// another's, so a write that has seen all the siblings replaces them.
+// Siblings with equal version vectors have their values merged.
+type MVReg struct {
+	name     string
+	d        *D
+	siblings []*MVRegSibling
+	scratch  bool
+}
+
+type MVRegSibling struct {
+	VV  map[string]int // Key: replica id, val: count of writes.
+	Val Lattice
+}
+
+func (d *D) DeclareMVReg(name string) *MVReg {
+	m := d.NewMVReg()
+	m.name = name
+	return d.DeclareRelation(name, m).(*MVReg)
+}
+
+func (d *D) NewMVReg() *MVReg { return &MVReg{d: d} }
+
+func (m *MVReg) TupleType() reflect.Type {
+	var x *MVRegSibling
+	return reflect.TypeOf(x).Elem()
+}
+
+func (m *MVReg) DeclareScratch() {
+	m.scratch = true
+}
+
+func (m *MVReg) isScratch() bool { return m.scratch }
+
+func (m *MVReg) startTick() {
+	if m.scratch {
+		m.Clear()
+	}
+}
+
+func (m *MVReg) Clear() bool {
+	changed := len(m.siblings) > 0
+	m.siblings = m.Zero().(*MVReg).siblings
+	m.d.cleared(m)
+	return changed
+}
+
+// Set writes a value at a replica, superseding all current siblings.
+func (m *MVReg) Set(replica string, val Lattice) bool {
+	vv := m.VV()
+	vv[replica]++
+	return m.DirectAdd(&MVRegSibling{vv, val})
+}
+
+// DirectAdd takes a *MVRegSibling, such as one from Scan().
+func (m *MVReg) DirectAdd(v interface{}) bool {
+	if v == nil {
+		panic("unexpected nil during MVReg.DirectAdd")
+	}
+	s := v.(*MVRegSibling)
+	for _, x := range m.siblings {
+		if vvEqual(x.VV, s.VV) {
+			return x.Val.DirectMerge(s.Val.(Relation))
+		}
+		if vvDescends(x.VV, s.VV) {
+			return false
+		}
+	}
+	rest := m.siblings[0:0]
+	for _, x := range m.siblings {
+		if !vvDescends(s.VV, x.VV) {
+			rest = append(rest, x)
+		}
+	}
+	m.siblings = append(rest, &MVRegSibling{vvCopy(s.VV), s.Val.Snapshot()})
+	return true
+}
+
+func (m *MVReg) DirectMerge(rel Relation) bool {
+	changed := false
+	for _, s := range rel.(*MVReg).siblings {
+		changed = m.DirectAdd(s) || changed
+	}
+	return changed
+}
+
+func (m *MVReg) Scan() chan interface{} {
+	ch := make(chan interface{})
+	go func() {
+		for _, s := range m.siblings {
+			ch <- s
+		}
+		close(ch)
+	}()
+	return ch
+}
+
+func (m *MVReg) Zero() Lattice { return m.d.NewMVReg() }
+
+func (m *MVReg) Snapshot() Lattice {
+	s := m.d.NewMVReg()
+	for _, x := range m.siblings {
+		s.siblings = append(s.siblings,
+			&MVRegSibling{vvCopy(x.VV), x.Val.Snapshot()})
+	}
+	return s
+}
+
+// Returns the values of the siblings, more than one meaning that there
+// were concurrent writes that still need to be resolved.
+func (m *MVReg) Values() []Lattice {
+	rv := make([]Lattice, len(m.siblings))
+	for i, s := range m.siblings {
+		rv[i] = s.Val
+	}
+	return rv
+}
+
+func (m *MVReg) Conflicted() bool {
+	return len(m.siblings) > 1
+}
+
+// Returns the version vector that dominates all the siblings.
+func (m *MVReg) VV() map[string]int {
+	vv := map[string]int{}
+	for _, s := range m.siblings {
+		for k, v := range s.VV {
+			if vv[k] < v {
+				vv[k] = v
+			}
+		}
+	}
+	return vv
+}
+
+// Returns true if a has seen everything that b has.
+func vvDescends(a, b map[string]int) bool {
+	for k, v := range b {
+		if a[k] < v {
+			return false
+		}
+	}
+	return true
+}
+
+func vvEqual(a, b map[string]int) bool {
+	return vvDescends(a, b) && vvDescends(b, a)
+}
+
+func vvCopy(vv map[string]int) map[string]int {
+	rv := make(map[string]int, len(vv))
+	for k, v := range vv {
+		rv[k] = v
+	}
+	return rv
+}
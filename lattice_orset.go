@@ -0,0 +1,207 @@
+package gdec
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+// An observed-remove set.  Each add of an element is tagged with a
+// unique token, and a remove only tombstones the tokens it observed,
+// so a concurrent add at another replica wins.
+type ORSet struct {
+	name    string
+	d       *D
+	t       reflect.Type
+	elems   map[string]interface{}     // Key: element JSON.
+	adds    map[string]map[string]bool // Key: element JSON, val: tokens.
+	removes map[string]bool            // Key: tombstoned token.
+	seq     int
+	scratch bool
+}
+
+func (d *D) DeclareORSet(name string, x interface{}) *ORSet {
+	m := d.NewORSet(reflect.TypeOf(x))
+	m.name = name
+	return d.DeclareRelation(name, m).(*ORSet)
+}
+
+func (d *D) NewORSet(t reflect.Type) *ORSet {
+	return &ORSet{d: d, t: t,
+		elems:   map[string]interface{}{},
+		adds:    map[string]map[string]bool{},
+		removes: map[string]bool{},
+	}
+}
+
+func (m *ORSet) TupleType() reflect.Type {
+	return m.t
+}
+
+func (m *ORSet) DeclareScratch() {
+	m.scratch = true
+}
+
+func (m *ORSet) isScratch() bool { return m.scratch }
+
+func (m *ORSet) startTick() {
+	if m.scratch {
+		m.Clear()
+	}
+}
+
+func (m *ORSet) Clear() bool {
+	changed := len(m.elems) > 0 || len(m.adds) > 0 || len(m.removes) > 0
+	z := m.Zero().(*ORSet)
+	m.elems, m.adds, m.removes = z.elems, z.adds, z.removes
+	m.d.cleared(m)
+	return changed
+}
+
+func (m *ORSet) key(v interface{}) string {
+	if v == nil {
+		panic("unexpected nil during ORSet key")
+	}
+	j, err := json.Marshal(v)
+	if err != nil {
+		panic(err)
+	}
+	if string(j) == "null" {
+		panic(fmt.Sprintf("unexpected null during ORSet key"+
+			", v: %#v, ORSet.name: %s", v, m.name))
+	}
+	return string(j)
+}
+
+// Add tags the element with a fresh token, even if it's already present.
+func (m *ORSet) Add(v interface{}) bool {
+	m.seq++
+	return m.addToken(m.key(v), m.tokenPrefix()+strconv.Itoa(m.seq), v)
+}
+
+func (m *ORSet) tokenPrefix() string {
+	return fmt.Sprintf("%s/%s/", m.d.Addr, m.name)
+}
+
+// Keeps seq at or past the sequence of a token that this replica
+// issued, which may come back from a restored state, or merged in from
+// another replica after a restart, so that Add() never reissues it.
+func (m *ORSet) observeToken(prefix, token string) {
+	if strings.HasPrefix(token, prefix) {
+		if n, err := strconv.Atoi(token[len(prefix):]); err == nil && n > m.seq {
+			m.seq = n
+		}
+	}
+}
+
+// Used when the tokens are replaced wholesale.
+func (m *ORSet) observeTokens() {
+	prefix := m.tokenPrefix()
+	for _, tokens := range m.adds {
+		for token := range tokens {
+			m.observeToken(prefix, token)
+		}
+	}
+}
+
+func (m *ORSet) addToken(k, token string, v interface{}) bool {
+	tokens := m.adds[k]
+	if tokens == nil {
+		tokens = map[string]bool{}
+		m.adds[k] = tokens
+	}
+	if tokens[token] {
+		return false
+	}
+	tokens[token] = true
+	m.elems[k] = v
+	return true
+}
+
+// Remove tombstones all the currently observed tokens for the element.
+func (m *ORSet) Remove(v interface{}) bool {
+	changed := false
+	for token := range m.adds[m.key(v)] {
+		if !m.removes[token] {
+			m.removes[token] = true
+			changed = true
+		}
+	}
+	return changed
+}
+
+func (m *ORSet) Contains(v interface{}) bool {
+	return m.present(m.key(v))
+}
+
+func (m *ORSet) present(k string) bool {
+	for token := range m.adds[k] {
+		if !m.removes[token] {
+			return true
+		}
+	}
+	return false
+}
+
+func (m *ORSet) Size() int {
+	n := 0
+	for k := range m.adds {
+		if m.present(k) {
+			n++
+		}
+	}
+	return n
+}
+
+// DirectAdd adds the element only if it isn't already present, so that
+// joins into an ORSet reach a fixpoint.
+func (m *ORSet) DirectAdd(v interface{}) bool {
+	if m.Contains(v) {
+		return false
+	}
+	return m.Add(v)
+}
+
+func (m *ORSet) DirectMerge(rel Relation) bool {
+	changed := false
+	r := rel.(*ORSet)
+	prefix := m.tokenPrefix()
+	for k, tokens := range r.adds {
+		for token := range tokens {
+			m.observeToken(prefix, token)
+			changed = m.addToken(k, token, r.elems[k]) || changed
+		}
+	}
+	for token := range r.removes {
+		if !m.removes[token] {
+			m.removes[token] = true
+			changed = true
+		}
+	}
+	return changed
+}
+
+// Scan yields the currently present elements.
+func (m *ORSet) Scan() chan interface{} {
+	ch := make(chan interface{})
+	go func() {
+		for k, v := range m.elems {
+			if m.present(k) {
+				ch <- v
+			}
+		}
+		close(ch)
+	}()
+	return ch
+}
+
+func (m *ORSet) Zero() Lattice { return m.d.NewORSet(m.t) }
+
+func (m *ORSet) Snapshot() Lattice {
+	s := m.d.NewORSet(m.t)
+	s.DirectMerge(m)
+	s.seq = m.seq
+	return s
+}
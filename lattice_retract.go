@@ -0,0 +1,283 @@
+package gdec
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sort"
+)
+
+// How a RetractSet resolves an add and a remove of the same element
+// that happened concurrently, at different replicas.
+type RetractPolicy int
+
+const (
+	RetractAddWins RetractPolicy = iota
+	RetractRemoveWins
+)
+
+// A set whose elements can be retracted, for state that genuinely
+// shrinks, unlike the grow-only lattices.  Each element has an add
+// clock and a remove clock, which merge by max, and the element is
+// present while its add clock is ahead.  A remove catches the remove
+// clock up to the add clock, or for RetractRemoveWins, one past it, so
+// that a concurrent Add() elsewhere loses.
+//
+// A RetractSet that's the destination of a join is derived: during a
+// tick it holds just what its joins derive that tick, and at the end
+// of the tick, elements that are no longer derived are retracted, so
+// retractions flow through joins into dependent RetractSets.  Joins
+// into grow-only relations don't see retractions.
+type RetractSet struct {
+	name    string
+	d       *D
+	t       reflect.Type
+	policy  RetractPolicy
+	elems   map[string]interface{} // Key: element JSON.
+	adds    map[string]int         // Key: element JSON, val: add clock.
+	removes map[string]int         // Key: element JSON, val: remove clock.
+	scratch bool
+
+	derived bool                   // Set by Into(), see settle().
+	cur     map[string]interface{} // This tick's derived elements.
+}
+
+func (d *D) DeclareRetractSet(name string, x interface{}, policy RetractPolicy) *RetractSet {
+	m := d.NewRetractSet(reflect.TypeOf(x), policy)
+	m.name = name
+	return d.DeclareRelation(name, m).(*RetractSet)
+}
+
+func (d *D) NewRetractSet(t reflect.Type, policy RetractPolicy) *RetractSet {
+	return &RetractSet{d: d, t: t, policy: policy,
+		elems:   map[string]interface{}{},
+		adds:    map[string]int{},
+		removes: map[string]int{},
+		cur:     map[string]interface{}{},
+	}
+}
+
+func (m *RetractSet) TupleType() reflect.Type {
+	return m.t
+}
+
+func (m *RetractSet) DeclareScratch() {
+	m.scratch = true
+}
+
+func (m *RetractSet) isScratch() bool { return m.scratch }
+
+func (m *RetractSet) startTick() {
+	if m.scratch {
+		m.Clear()
+	}
+	if m.derived {
+		m.cur = map[string]interface{}{}
+	}
+}
+
+func (m *RetractSet) Clear() bool {
+	changed := len(m.elems) > 0 || len(m.adds) > 0 || len(m.removes) > 0
+	z := m.Zero().(*RetractSet)
+	m.elems, m.adds, m.removes = z.elems, z.adds, z.removes
+	if m.derived {
+		m.cur = map[string]interface{}{}
+	}
+	m.d.cleared(m)
+	return changed
+}
+
+func (m *RetractSet) key(v interface{}) string {
+	if v == nil {
+		panic("unexpected nil during RetractSet key")
+	}
+	j, err := json.Marshal(v)
+	if err != nil {
+		panic(err)
+	}
+	if string(j) == "null" {
+		panic(fmt.Sprintf("unexpected null during RetractSet key"+
+			", v: %#v, RetractSet.name: %s", v, m.name))
+	}
+	return string(j)
+}
+
+func (m *RetractSet) present(k string) bool {
+	return m.adds[k] > m.removes[k]
+}
+
+// Add advances the element's add clock past both clocks, even if it's
+// already present, so that it reasserts the element against a remove
+// at another replica.
+func (m *RetractSet) Add(v interface{}) bool {
+	k := m.key(v)
+	c := m.adds[k]
+	if m.removes[k] > c {
+		c = m.removes[k]
+	}
+	m.adds[k] = c + 1
+	m.elems[k] = v
+	return true
+}
+
+func (m *RetractSet) addIfAbsent(k string, v interface{}) bool {
+	if m.present(k) {
+		return false
+	}
+	m.adds[k] = m.removes[k] + 1
+	m.elems[k] = v
+	return true
+}
+
+// Remove retracts the element if it's present.
+func (m *RetractSet) Remove(v interface{}) bool {
+	return m.remove(m.key(v))
+}
+
+func (m *RetractSet) remove(k string) bool {
+	if !m.present(k) {
+		return false
+	}
+	m.removes[k] = m.adds[k]
+	if m.policy == RetractRemoveWins {
+		m.removes[k]++
+	}
+	return true
+}
+
+// Contains reports whether the element is present, or for a derived
+// set during a tick, whether it's been derived so far.
+func (m *RetractSet) Contains(v interface{}) bool {
+	if m.derived {
+		_, ok := m.cur[m.key(v)]
+		return ok
+	}
+	return m.present(m.key(v))
+}
+
+func (m *RetractSet) Size() int {
+	if m.derived {
+		return len(m.cur)
+	}
+	n := 0
+	for k := range m.adds {
+		if m.present(k) {
+			n++
+		}
+	}
+	return n
+}
+
+// DirectAdd adds the element only if it isn't already present, so that
+// joins reach a fixpoint, or for a derived set, records it as derived
+// during the current tick.
+func (m *RetractSet) DirectAdd(v interface{}) bool {
+	if m.derived {
+		k := m.key(v)
+		if _, ok := m.cur[k]; ok {
+			return false
+		}
+		m.cur[k] = v
+		return true
+	}
+	return m.addIfAbsent(m.key(v), v)
+}
+
+// DirectMerge merges the clocks of another replica.  For a derived set,
+// the next settle() then overrides whatever was merged.
+func (m *RetractSet) DirectMerge(rel Relation) bool {
+	changed := false
+	r := rel.(*RetractSet)
+	for k, c := range r.adds {
+		if c > m.adds[k] {
+			m.adds[k] = c
+			m.elems[k] = r.elems[k]
+			changed = true
+		}
+	}
+	for k, c := range r.removes {
+		if c > m.removes[k] {
+			m.removes[k] = c
+			changed = true
+		}
+	}
+	return changed
+}
+
+// Retracts the elements of a derived set that weren't derived during
+// the tick, and adds those that newly were, returning the number of
+// elements that changed.
+func (m *RetractSet) settle() int {
+	n := 0
+	for k := range m.adds {
+		if _, ok := m.cur[k]; !ok && m.remove(k) {
+			n++
+		}
+	}
+	for k, v := range m.cur {
+		if m.addIfAbsent(k, v) {
+			n++
+		}
+	}
+	return n
+}
+
+// Used at the end of a tick's fixpoints.
+func (d *D) settleRetractions() {
+	for _, r := range d.Relations {
+		if m, ok := r.(*RetractSet); ok && m.derived && !m.scratch {
+			n := m.settle()
+			d.tickChanges += n
+			if n > 0 && d.tickChanged != nil {
+				d.tickChanged[m] = true
+			}
+		}
+	}
+}
+
+// Returns true if the relation's changes during a tick are rederived
+// every tick, so that they only count once settled.
+func isRederived(r Relation) bool {
+	m, ok := r.(*RetractSet)
+	return ok && m.derived
+}
+
+// Scan yields the present elements, or for a derived set during a
+// tick, those derived so far.
+func (m *RetractSet) Scan() chan interface{} {
+	var keys []string
+	if m.derived {
+		keys = sortedKeys(m.cur)
+	} else {
+		for k := range m.adds {
+			if m.present(k) {
+				keys = append(keys, k)
+			}
+		}
+		sort.Strings(keys)
+	}
+	ch := make(chan interface{})
+	go func() {
+		for _, k := range keys {
+			if m.derived {
+				ch <- m.cur[k]
+			} else {
+				ch <- m.elems[k]
+			}
+		}
+		close(ch)
+	}()
+	return ch
+}
+
+func (m *RetractSet) Zero() Lattice { return m.d.NewRetractSet(m.t, m.policy) }
+
+func (m *RetractSet) Snapshot() Lattice {
+	s := m.d.NewRetractSet(m.t, m.policy)
+	s.DirectMerge(m)
+	s.derived = m.derived
+	for k, v := range m.cur {
+		s.cur[k] = v
+	}
+	return s
+}
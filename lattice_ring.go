@@ -0,0 +1,164 @@
+package gdec
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sort"
+)
+
+// A bounded set that retains only the capacity tuples with the highest
+// ordering keys, where the key is an integer field of the tuples, such
+// as a log index.  Ties on the key are broken by the tuples' JSON, so
+// merging keeps the top-N of the union, and every replica that has
+// merged the same tuples holds the same window.
+type LRing struct {
+	name     string
+	d        *D
+	t        reflect.Type
+	capacity int
+	key      string
+	m        map[string]interface{} // Key: tuple's JSON.
+	scratch  bool
+}
+
+func (d *D) DeclareLRing(name string, x interface{}, capacity int, key string) *LRing {
+	m := d.NewLRing(reflect.TypeOf(x), capacity, key)
+	m.name = name
+	return d.DeclareRelation(name, m).(*LRing)
+}
+
+func (d *D) NewLRing(t reflect.Type, capacity int, key string) *LRing {
+	if capacity <= 0 {
+		panic(fmt.Sprintf("NewLRing() needs a positive capacity: %d", capacity))
+	}
+	st := t
+	if st.Kind() == reflect.Ptr {
+		st = st.Elem()
+	}
+	if st.Kind() != reflect.Struct {
+		panic(fmt.Sprintf("NewLRing() tuple type: %v, is not a struct", t))
+	}
+	if f, ok := st.FieldByName(key); !ok || !isIntKind(f.Type.Kind()) {
+		panic(fmt.Sprintf("NewLRing() tuple type: %v, has no integer field: %s",
+			t, key))
+	}
+	return &LRing{d: d, t: t, capacity: capacity, key: key,
+		m: map[string]interface{}{}}
+}
+
+func isIntKind(k reflect.Kind) bool {
+	switch k {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return true
+	}
+	return false
+}
+
+func (m *LRing) TupleType() reflect.Type { return m.t }
+
+func (m *LRing) DeclareScratch() {
+	m.scratch = true
+}
+
+func (m *LRing) isScratch() bool { return m.scratch }
+
+func (m *LRing) startTick() {
+	if m.scratch {
+		m.Clear()
+	}
+}
+
+func (m *LRing) Clear() bool {
+	changed := len(m.m) > 0
+	m.m = m.Zero().(*LRing).m
+	m.d.cleared(m)
+	return changed
+}
+
+func (m *LRing) Capacity() int { return m.capacity }
+
+func (m *LRing) Size() int { return len(m.m) }
+
+func (m *LRing) keyOf(v interface{}) int64 {
+	return reflect.Indirect(reflect.ValueOf(v)).FieldByName(m.key).Int()
+}
+
+// Returns true if tuple a, with JSON ja, sorts before tuple b.
+func (m *LRing) less(a interface{}, ja string, b interface{}, jb string) bool {
+	ka, kb := m.keyOf(a), m.keyOf(b)
+	return ka < kb || (ka == kb && ja < jb)
+}
+
+func (m *LRing) DirectAdd(v interface{}) bool {
+	if v == nil {
+		panic("unexpected nil during LRing.DirectAdd")
+	}
+	j, err := json.Marshal(v)
+	if err != nil {
+		panic(err)
+	}
+	js := string(j)
+	if _, exists := m.m[js]; exists {
+		return false
+	}
+	if len(m.m) >= m.capacity {
+		lowest := ""
+		for k, x := range m.m {
+			if lowest == "" || m.less(x, k, m.m[lowest], lowest) {
+				lowest = k
+			}
+		}
+		if m.less(v, js, m.m[lowest], lowest) {
+			return false // Older than everything in a full window.
+		}
+		delete(m.m, lowest)
+	}
+	m.m[js] = v
+	return true
+}
+
+func (m *LRing) DirectMerge(rel Relation) bool {
+	changed := false
+	for _, v := range rel.(*LRing).m {
+		changed = m.DirectAdd(v) || changed
+	}
+	return changed
+}
+
+// Scan yields tuples in ascending key order, oldest first.
+func (m *LRing) Scan() chan interface{} {
+	ch := make(chan interface{})
+	go func() {
+		for _, v := range m.Tuples() {
+			ch <- v
+		}
+		close(ch)
+	}()
+	return ch
+}
+
+// Tuples returns the window in ascending key order, oldest first.
+func (m *LRing) Tuples() []interface{} {
+	keys := sortedKeys(m.m)
+	sort.SliceStable(keys, func(i, j int) bool {
+		return m.less(m.m[keys[i]], keys[i], m.m[keys[j]], keys[j])
+	})
+	rv := make([]interface{}, len(keys))
+	for i, k := range keys {
+		rv[i] = m.m[k]
+	}
+	return rv
+}
+
+func (m *LRing) Zero() Lattice {
+	return m.d.NewLRing(m.t, m.capacity, m.key)
+}
+
+func (m *LRing) Snapshot() Lattice {
+	s := m.d.NewLRing(m.t, m.capacity, m.key)
+	for k, v := range m.m {
+		s.m[k] = v
+	}
+	return s
+}
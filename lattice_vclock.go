@@ -0,0 +1,157 @@
+package gdec
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+)
+
+// A vector clock, with a counter per node id, for the causal ordering
+// of events.  A node calls Tick() with its own id on each event, such as
+// a send, and Merge() with the clock of each message it receives, so a
+// clock happens before another when the other has seen all its events.
+// As a lattice, merging takes the per-node max.  A VectorClock may be
+// carried in a tuple's field, where it's keyed by its JSON.
+type VectorClock struct {
+	name    string
+	d       *D
+	m       map[string]int // Key: node id, val: count of events at that node.
+	scratch bool
+}
+
+type VectorClockEntry struct {
+	Node  string
+	Count int
+}
+
+func (d *D) DeclareVectorClock(name string) *VectorClock {
+	m := d.NewVectorClock()
+	m.name = name
+	return d.DeclareRelation(name, m).(*VectorClock)
+}
+
+func (d *D) NewVectorClock() *VectorClock {
+	return &VectorClock{d: d, m: map[string]int{}}
+}
+
+func (m *VectorClock) TupleType() reflect.Type {
+	var x *VectorClockEntry
+	return reflect.TypeOf(x).Elem()
+}
+
+func (m *VectorClock) DeclareScratch() {
+	m.scratch = true
+}
+
+func (m *VectorClock) isScratch() bool { return m.scratch }
+
+func (m *VectorClock) startTick() {
+	if m.scratch {
+		m.Clear()
+	}
+}
+
+func (m *VectorClock) Clear() bool {
+	changed := len(m.m) > 0
+	m.m = m.Zero().(*VectorClock).m
+	m.d.cleared(m)
+	return changed
+}
+
+// Tick increments the count of the node, usually the caller's own id.
+func (m *VectorClock) Tick(node string) {
+	m.m[node]++
+}
+
+// Merge takes in the events seen by another clock, such as the clock
+// of a received message.
+func (m *VectorClock) Merge(other *VectorClock) bool {
+	return m.DirectMerge(other)
+}
+
+// Get returns the count of a node, which is 0 for an unknown node.
+func (m *VectorClock) Get(node string) int { return m.m[node] }
+
+// DirectAdd takes a *VectorClockEntry, such as one from Scan(), and
+// keeps the larger of the two counts for that node.
+func (m *VectorClock) DirectAdd(v interface{}) bool {
+	if v == nil {
+		panic("unexpected nil during VectorClock.DirectAdd")
+	}
+	e := v.(*VectorClockEntry)
+	if e.Count < 0 {
+		panic(fmt.Sprintf("negative count during VectorClock.DirectAdd"+
+			", e: %#v, VectorClock.name: %s", e, m.name))
+	}
+	if m.m[e.Node] < e.Count {
+		m.m[e.Node] = e.Count
+		return true
+	}
+	return false
+}
+
+func (m *VectorClock) DirectMerge(rel Relation) bool {
+	changed := false
+	for k, v := range rel.(*VectorClock).m {
+		changed = m.DirectAdd(&VectorClockEntry{k, v}) || changed
+	}
+	return changed
+}
+
+func (m *VectorClock) Scan() chan interface{} {
+	ch := make(chan interface{})
+	go func() {
+		for k, v := range m.m {
+			ch <- &VectorClockEntry{k, v}
+		}
+		close(ch)
+	}()
+	return ch
+}
+
+func (m *VectorClock) Zero() Lattice { return m.d.NewVectorClock() }
+
+func (m *VectorClock) Snapshot() Lattice {
+	s := m.d.NewVectorClock()
+	s.m = vvCopy(m.m)
+	return s
+}
+
+// Returns the counts, keyed by node id.
+func (m *VectorClock) Value() map[string]int { return vvCopy(m.m) }
+
+// HappensBefore returns true if every event seen by m was seen by
+// other, and other saw more.
+func (m *VectorClock) HappensBefore(other *VectorClock) bool {
+	return vvDescends(other.m, m.m) && !vvDescends(m.m, other.m)
+}
+
+// Concurrent returns true if neither clock happens before the other,
+// and they differ.
+func (m *VectorClock) Concurrent(other *VectorClock) bool {
+	return !vvDescends(other.m, m.m) && !vvDescends(m.m, other.m)
+}
+
+// Equal returns true if the clocks have seen the same events.
+func (m *VectorClock) Equal(other *VectorClock) bool {
+	return vvEqual(m.m, other.m)
+}
+
+func (m *VectorClock) MarshalJSON() ([]byte, error) {
+	rv := map[string]int{}
+	for k, v := range m.m {
+		if v != 0 {
+			rv[k] = v
+		}
+	}
+	return json.Marshal(rv)
+}
+
+func (m *VectorClock) UnmarshalJSON(b []byte) error {
+	vv := map[string]int{}
+	if err := json.Unmarshal(b, &vv); err != nil {
+		return err
+	}
+	m.m = vv
+	return nil
+}
@@ -0,0 +1,190 @@
+package gdec
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sort"
+	"time"
+)
+
+// A set that retains only the tuples of a recent window, where each
+// tuple's key is an integer field holding when it arrived, as stamped
+// by StampTick() or StampTime().  At the start of each tick, tuples
+// that fell out of the window are evicted, and tuples that arrive
+// already outside the window are ignored, so an aggregate over the
+// window, like JoinAgg() with AggCount, yields a rate.  Unlike LRing,
+// which is bounded by count, an LWindow is bounded by time, so it
+// shrinks as well as grows.
+type LWindow struct {
+	name    string
+	d       *D
+	t       reflect.Type
+	span    int64        // Retains keys greater than now() - span.
+	now     func() int64 // The clock of the keys, ticks or unix nanos.
+	timed   bool         // True when now is unix nanos.
+	key     string
+	m       map[string]interface{} // Key: tuple's JSON.
+	scratch bool
+}
+
+// DeclareLWindow retains the tuples whose key, stamped by StampTick(),
+// is one of the last ticks ticks, including the current tick.
+func (d *D) DeclareLWindow(name string, x interface{}, ticks int64, key string) *LWindow {
+	m := d.NewLWindow(reflect.TypeOf(x), ticks, key)
+	m.name = name
+	return d.DeclareRelation(name, m).(*LWindow)
+}
+
+// DeclareLTimeWindow retains the tuples whose key, stamped by
+// StampTime(), is within span of the current TickTime().
+func (d *D) DeclareLTimeWindow(name string, x interface{}, span time.Duration, key string) *LWindow {
+	m := d.NewLTimeWindow(reflect.TypeOf(x), span, key)
+	m.name = name
+	return d.DeclareRelation(name, m).(*LWindow)
+}
+
+func (d *D) NewLWindow(t reflect.Type, ticks int64, key string) *LWindow {
+	return d.newLWindow(t, ticks, d.Ticks, key)
+}
+
+func (d *D) NewLTimeWindow(t reflect.Type, span time.Duration, key string) *LWindow {
+	m := d.newLWindow(t, int64(span),
+		func() int64 { return d.TickTime().UnixNano() }, key)
+	m.timed = true
+	return m
+}
+
+func (d *D) newLWindow(t reflect.Type, span int64, now func() int64, key string) *LWindow {
+	if span <= 0 {
+		panic(fmt.Sprintf("NewLWindow() needs a positive window: %d", span))
+	}
+	st := t
+	if st.Kind() == reflect.Ptr {
+		st = st.Elem()
+	}
+	if st.Kind() != reflect.Struct {
+		panic(fmt.Sprintf("NewLWindow() tuple type: %v, is not a struct", t))
+	}
+	if f, ok := st.FieldByName(key); !ok || !isIntKind(f.Type.Kind()) {
+		panic(fmt.Sprintf("NewLWindow() tuple type: %v, has no integer field: %s",
+			t, key))
+	}
+	return &LWindow{d: d, t: t, span: span, now: now, key: key,
+		m: map[string]interface{}{}}
+}
+
+func (m *LWindow) TupleType() reflect.Type { return m.t }
+
+func (m *LWindow) DeclareScratch() {
+	m.scratch = true
+}
+
+func (m *LWindow) isScratch() bool { return m.scratch }
+
+func (m *LWindow) startTick() {
+	if m.scratch {
+		m.Clear()
+	}
+}
+
+func (m *LWindow) Clear() bool {
+	changed := len(m.m) > 0
+	m.m = m.Zero().(*LWindow).m
+	m.d.cleared(m)
+	return changed
+}
+
+func (m *LWindow) Size() int { return len(m.m) }
+
+func (m *LWindow) keyOf(v interface{}) int64 {
+	return reflect.Indirect(reflect.ValueOf(v)).FieldByName(m.key).Int()
+}
+
+func (m *LWindow) inWindow(v interface{}) bool {
+	return m.keyOf(v) > m.now()-m.span
+}
+
+// Evicts the tuples that fell out of the window.
+func (m *LWindow) evict() {
+	for k, v := range m.m {
+		if !m.inWindow(v) {
+			delete(m.m, k)
+		}
+	}
+}
+
+// Used once per tick, after the tick's clock is set.
+func (d *D) evictWindows() {
+	for _, r := range d.Relations {
+		if m, ok := r.(*LWindow); ok {
+			m.evict()
+		}
+	}
+}
+
+func (m *LWindow) DirectAdd(v interface{}) bool {
+	if v == nil {
+		panic("unexpected nil during LWindow.DirectAdd")
+	}
+	if !m.inWindow(v) {
+		return false
+	}
+	j, err := json.Marshal(v)
+	if err != nil {
+		panic(err)
+	}
+	if _, exists := m.m[string(j)]; exists {
+		return false
+	}
+	m.m[string(j)] = v
+	return true
+}
+
+func (m *LWindow) DirectMerge(rel Relation) bool {
+	changed := false
+	for _, v := range rel.(*LWindow).m {
+		changed = m.DirectAdd(v) || changed
+	}
+	return changed
+}
+
+// Scan yields tuples in ascending key order, oldest first.
+func (m *LWindow) Scan() chan interface{} {
+	ch := make(chan interface{})
+	go func() {
+		for _, v := range m.Tuples() {
+			ch <- v
+		}
+		close(ch)
+	}()
+	return ch
+}
+
+// Tuples returns the window in ascending key order, oldest first.
+func (m *LWindow) Tuples() []interface{} {
+	keys := sortedKeys(m.m)
+	sort.SliceStable(keys, func(i, j int) bool {
+		return m.keyOf(m.m[keys[i]]) < m.keyOf(m.m[keys[j]])
+	})
+	rv := make([]interface{}, len(keys))
+	for i, k := range keys {
+		rv[i] = m.m[k]
+	}
+	return rv
+}
+
+func (m *LWindow) Zero() Lattice {
+	z := m.d.newLWindow(m.t, m.span, m.now, m.key)
+	z.timed = m.timed
+	return z
+}
+
+func (m *LWindow) Snapshot() Lattice {
+	s := &LWindow{d: m.d, t: m.t, span: m.span, now: m.now, timed: m.timed,
+		key: m.key, m: map[string]interface{}{}}
+	for k, v := range m.m {
+		s.m[k] = v
+	}
+	return s
+}
@@ -0,0 +1,107 @@
+package gdec
+
+import (
+	"fmt"
+	"log"
+	"strings"
+)
+
+type LogLevel int
+
+const (
+	LogDebug LogLevel = iota
+	LogInfo
+	LogWarn
+	LogError
+)
+
+func (l LogLevel) String() string {
+	switch l {
+	case LogDebug:
+		return "debug"
+	case LogInfo:
+		return "info"
+	case LogWarn:
+		return "warn"
+	case LogError:
+		return "error"
+	}
+	return fmt.Sprintf("level%d", int(l))
+}
+
+// A Logger receives leveled, structured records from a D, its transport
+// and its modules, like Raft's state transitions, see SetLogger().  The
+// keyvals alternate between string keys and their values.  Transports
+// log from their own goroutines, so a Logger must be safe for
+// concurrent use.
+type Logger interface {
+	Enabled(level LogLevel) bool
+	Log(level LogLevel, msg string, keyvals ...interface{})
+}
+
+// SetLogger sets the Logger of d, which D's embedded in it also use,
+// before ticking or listening.  Without one, records are dropped,
+// except that tuples dropped by a transport go to the standard log, as
+// they always have.
+func (d *D) SetLogger(l Logger) {
+	d.logger = l
+}
+
+// LogEnabled returns true if d's Logger wants records of the level.
+// Building a record's keyvals allocates, so callers on hot paths check
+// this first, leaving a disabled level allocation free.
+func (d *D) LogEnabled(level LogLevel) bool {
+	d = d.host()
+	return d.logger != nil && d.logger.Enabled(level)
+}
+
+// Log hands a record to d's Logger, if it wants the level.
+func (d *D) Log(level LogLevel, msg string, keyvals ...interface{}) {
+	if d.LogEnabled(level) {
+		d.host().logger.Log(level, msg, keyvals...)
+	}
+}
+
+// Used when a transport drops a tuple.
+func (d *D) logDropped(to, relName string, err error) {
+	if d.host().logger == nil {
+		log.Printf("gdec: dropped tuple, to: %s, rel: %s, err: %v",
+			to, relName, err)
+		return
+	}
+	if d.LogEnabled(LogWarn) {
+		d.Log(LogWarn, "dropped tuple", "addr", d.Addr, "to", to,
+			"rel", relName, "err", err)
+	}
+}
+
+// NewStdLogger returns a Logger that writes records of at least the
+// min level to l, or to the standard log when l is nil, as lines like
+// "gdec: info: raft became leader addr=a term=2".
+func NewStdLogger(l *log.Logger, min LogLevel) Logger {
+	return &stdLogger{l: l, min: min}
+}
+
+type stdLogger struct {
+	l   *log.Logger
+	min LogLevel
+}
+
+func (s *stdLogger) Enabled(level LogLevel) bool { return level >= s.min }
+
+func (s *stdLogger) Log(level LogLevel, msg string, keyvals ...interface{}) {
+	var b strings.Builder
+	fmt.Fprintf(&b, "gdec: %s: %s", level, msg)
+	for i := 0; i < len(keyvals); i += 2 {
+		if i+1 < len(keyvals) {
+			fmt.Fprintf(&b, " %v=%v", keyvals[i], keyvals[i+1])
+		} else {
+			fmt.Fprintf(&b, " %v", keyvals[i])
+		}
+	}
+	if s.l != nil {
+		s.l.Print(b.String())
+	} else {
+		log.Print(b.String())
+	}
+}
@@ -0,0 +1,76 @@
+package gdec
+
+import (
+	"sort"
+	"time"
+)
+
+// A snapshot of relation and join statistics, see EnableMetrics().
+type Metrics struct {
+	Relations map[string]RelationMetrics // Key: relation name.
+	Joins     []JoinMetrics              // In declaration order.
+}
+
+type RelationMetrics struct {
+	Tuples  int   // Current number of tuples, as seen by Scan().
+	Changes int64 // Tuples that actually changed the relation.
+	Held    int   // Inbound tuples held by a channel, see DeclareCausal().
+}
+
+type JoinMetrics struct {
+	Join  string // The join's Name(), else "join#" and its position.
+	Into  string
+	Evals int64         // Times that the join was evaluated.
+	Time  time.Duration // Total time spent evaluating the join.
+}
+
+// EnableMetrics starts counting relation changes and join evaluations,
+// resetting any earlier counts.  Counting is off by default, as timing
+// every join evaluation isn't free.
+func (d *D) EnableMetrics() {
+	d.metrics = true
+	d.relationChanges = map[Relation]int64{}
+	for _, jd := range d.Joins {
+		jd.evals, jd.evalTime = 0, 0
+	}
+}
+
+func (d *D) DisableMetrics() {
+	d.metrics = false
+}
+
+// Metrics returns the counts since EnableMetrics(), along with current
+// tuple counts, which are available even when metrics are disabled.
+func (d *D) Metrics() *Metrics {
+	m := &Metrics{Relations: map[string]RelationMetrics{}}
+	for name, r := range d.Relations {
+		n := 0
+		for range r.Scan() {
+			n++
+		}
+		rm := RelationMetrics{Tuples: n, Changes: d.relationChanges[r]}
+		if c, ok := r.(*LSet); ok {
+			rm.Held = c.Held()
+		}
+		m.Relations[name] = rm
+	}
+	for _, jd := range d.Joins {
+		m.Joins = append(m.Joins, JoinMetrics{
+			Join:  jd.label(),
+			Into:  d.relationName(jd.into),
+			Evals: jd.evals,
+			Time:  jd.evalTime,
+		})
+	}
+	return m
+}
+
+// Returns the joins that took the most time, most first.
+func (m *Metrics) SlowestJoins(n int) []JoinMetrics {
+	rv := append([]JoinMetrics(nil), m.Joins...)
+	sort.SliceStable(rv, func(i, j int) bool { return rv[i].Time > rv[j].Time })
+	if n < len(rv) {
+		rv = rv[:n]
+	}
+	return rv
+}
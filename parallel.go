@@ -0,0 +1,85 @@
+package gdec
+
+import (
+	"sync"
+)
+
+// Runs joins that only depend on each other through relation changes
+// that are applied after they all run, as with the joins of a single
+// fixpoint step.  With d.Workers above 1, the joins run concurrently,
+// each buffering its results, which are then handed off in declaration
+// order, so the tick sees the same changes in the same order as when
+// the joins run serially.  Tracing, and CheckDeterminism(), force
+// serial execution.
+func (d *D) executeJoins(joins []*joinDeclaration, useDelta bool) {
+	if d.Workers <= 1 || len(joins) <= 1 || d.trace || d.checkDeterminism {
+		for _, jd := range joins {
+			jd.executeJoinInto(useDelta)
+		}
+		return
+	}
+
+	work := make(chan *joinDeclaration)
+	var wg sync.WaitGroup
+	var panicM sync.Mutex
+	var panicked interface{}
+
+	workers := d.Workers
+	if workers > len(joins) {
+		workers = len(joins)
+	}
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for jd := range work {
+				func() {
+					defer func() {
+						if r := recover(); r != nil {
+							panicM.Lock()
+							if panicked == nil {
+								panicked = r
+							}
+							panicM.Unlock()
+						}
+					}()
+					jd.executeJoinInto(useDelta)
+				}()
+			}
+		}()
+	}
+	for _, jd := range joins {
+		jd.buffered = true
+		work <- jd
+	}
+	close(work)
+	wg.Wait()
+
+	for _, jd := range joins {
+		jd.buffered = false
+		for _, c := range jd.out {
+			jd.handOff(c)
+		}
+		jd.out = jd.out[0:0]
+	}
+	if panicked != nil {
+		panic(panicked) // Surface a join's panic on the ticking goroutine.
+	}
+}
+
+// Used by a running join for each of its results.
+func (jd *joinDeclaration) result(c relationChange) {
+	if jd.buffered {
+		jd.out = append(jd.out, c)
+		return
+	}
+	jd.handOff(c)
+}
+
+func (jd *joinDeclaration) handOff(c relationChange) {
+	if jd.async {
+		jd.d.next = append(jd.d.next, c)
+	} else {
+		jd.d.immediate = append(jd.d.immediate, c)
+	}
+}
@@ -0,0 +1,80 @@
+package gdec
+
+import (
+	"fmt"
+	"math/rand"
+	"time"
+)
+
+type periodic struct {
+	rel    *LBool
+	period time.Duration
+	last   time.Time // When the periodic last fired, or started.
+
+	min, max time.Duration // When max > min, period is randomized.
+}
+
+// DeclarePeriodic declares a scratch LBool that is true during any
+// tick that starts at least period after the last time it fired.  The
+// period is measured from the first tick, using d.Now.
+func (d *D) DeclarePeriodic(name string, period time.Duration) *LBool {
+	b := d.DeclareLBool(name)
+	b.DeclareScratch()
+	d.periodics = append(d.periodics, &periodic{rel: b, period: period})
+	return b
+}
+
+// DeclareRandomPeriodic is like DeclarePeriodic, but each period is
+// drawn from d.Rand in the range [min, max), and is redrawn whenever
+// the periodic fires or is reset.
+func (d *D) DeclareRandomPeriodic(name string, min, max time.Duration) *LBool {
+	b := d.DeclarePeriodic(name, min)
+	p := d.periodics[len(d.periodics)-1]
+	p.min, p.max = min, max
+	return b
+}
+
+// ResetPeriodic restarts the period of a periodic from now, as if it
+// had just fired, such as when a timeout should be pushed back.
+func (d *D) ResetPeriodic(b *LBool) {
+	d = d.host()
+	for _, p := range d.periodics {
+		if p.rel == b {
+			p.last = d.Now()
+			p.period = d.nextPeriod(p)
+			return
+		}
+	}
+	panic(fmt.Sprintf("ResetPeriodic() on a non-periodic: %s", b.name))
+}
+
+func (d *D) nextPeriod(p *periodic) time.Duration {
+	if p.max <= p.min {
+		return p.period
+	}
+	return p.min + time.Duration(d.random().Int63n(int64(p.max-p.min)))
+}
+
+// Returns the source of randomness for d's periodics and joins, which
+// is the host's for an embedded D, so that seeding the host's Rand
+// makes every module deterministic.
+func (d *D) random() *rand.Rand { return d.host().Rand }
+
+// Returns the periodics that fired.
+func (d *D) firePeriodics() (fired []*LBool) {
+	now := d.Now()
+	for _, p := range d.periodics {
+		if p.last.IsZero() {
+			p.last = now
+			p.period = d.nextPeriod(p)
+			continue
+		}
+		if now.Sub(p.last) >= p.period {
+			p.rel.DirectAdd(true)
+			p.last = now
+			p.period = d.nextPeriod(p)
+			fired = append(fired, p.rel)
+		}
+	}
+	return fired
+}
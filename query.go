@@ -0,0 +1,76 @@
+package gdec
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+// Query returns the tuples of the named relation, for reading results
+// without knowing its lattice type.  For an LMap, those are the tuples
+// of its values, ordered by key, like the paths of ShortestPath, and
+// otherwise they're ordered as by RelationValue(), mostly by JSON.
+func (d *D) Query(relName string) []interface{} {
+	return queryTuples(d.queryRelation("Query", relName))
+}
+
+func (d *D) queryRelation(op, relName string) Relation {
+	r, ok := d.Relations[relName]
+	if !ok {
+		panic(fmt.Sprintf("%s() on unknown relation: %s", op, relName))
+	}
+	return r
+}
+
+func queryTuples(r Relation) []interface{} {
+	switch m := r.(type) {
+	case *LMap:
+		var rv []interface{}
+		for _, k := range m.Keys() {
+			if v, ok := m.m[k].(Relation); ok {
+				rv = append(rv, queryTuples(v)...)
+			}
+		}
+		return rv
+	case *LRing:
+		return m.Tuples()
+	case *LWindow:
+		return m.Tuples()
+	}
+	return sortedTuples(r)
+}
+
+// QueryOf is like Query(), but returns the tuples as T's, whether the
+// relation holds T's or pointers to them, skipping tuples of other
+// types.
+func QueryOf[T any](d *D, relName string) []T {
+	var rv []T
+	for _, x := range d.Query(relName) {
+		switch v := x.(type) {
+		case T:
+			rv = append(rv, v)
+		case *T:
+			rv = append(rv, *v)
+		}
+	}
+	return rv
+}
+
+// Has returns true if the named relation's tuples, as by Query(),
+// include one equal in value to tuple, so a tuple and a pointer to an
+// equal tuple match.  Like an LSet, tuples are compared by their JSON.
+func (d *D) Has(relName string, tuple interface{}) bool {
+	r := d.queryRelation("Has", relName)
+	if m, ok := r.(*LSet); ok && tuple != nil {
+		return m.Contains(tuple)
+	}
+	j, err := json.Marshal(tuple)
+	if err != nil {
+		panic(err)
+	}
+	for _, x := range queryTuples(r) {
+		if xj, err := json.Marshal(x); err == nil && string(xj) == string(j) {
+			return true
+		}
+	}
+	return false
+}
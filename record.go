@@ -0,0 +1,230 @@
+package gdec
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"reflect"
+	"time"
+)
+
+// A recording of the inputs that a D saw from outside its joins,
+// per tick, see StartRecording().
+type recording struct {
+	Transport bool // Whether the recorded D had a transport.
+	Ticks     []*recordedTick
+}
+
+type recordedTick struct {
+	Time    int64             // Tick time, as Unix nanos.
+	Fired   []string          `json:",omitempty"` // Periodics that fired.
+	Next    []*recordedChange `json:",omitempty"` // From AddNext() and friends.
+	Inbound []*recordedChange `json:",omitempty"` // From the transport.
+}
+
+type recordedChange struct {
+	Rel   string
+	Add   bool            // Else a merge, of Val.
+	Tuple json.RawMessage `json:",omitempty"`
+	Ptr   bool            `json:",omitempty"` // Whether Tuple was a pointer.
+	Key   string          `json:",omitempty"` // For an *LMapEntry, with Val.
+	Val   *stateLattice   `json:",omitempty"`
+}
+
+// A decoded recordedTick, ready to replay.
+type replayTick struct {
+	time    time.Time
+	fired   []*LBool
+	next    []relationChange
+	inbound []relationChange
+}
+
+// StartRecording starts recording the external inputs of every tick:
+// the tick's clock value, which periodics fired, changes from
+// AddNext() and MergeNext(), and inbound channel tuples, dropping any
+// earlier recording.  To be replayable, recording should start before
+// the first Tick(), see Replay().
+func (d *D) StartRecording() {
+	d.recording = &recording{Transport: d.transport != nil}
+	d.recordingErr = nil
+}
+
+func (d *D) StopRecording() {
+	d.recording = nil
+}
+
+// SaveRecording writes the ticks recorded since StartRecording() as
+// JSON, or returns the first error in recording an input, such as for
+// a tuple that can't be marshaled.
+func (d *D) SaveRecording(w io.Writer) error {
+	if d.recording == nil {
+		return fmt.Errorf("not recording")
+	}
+	if d.recordingErr != nil {
+		return d.recordingErr
+	}
+	return json.NewEncoder(w).Encode(d.recording)
+}
+
+// Replay ticks d once per tick of a recording from SaveRecording(),
+// feeding d the recorded inputs instead of its clock, periodics and
+// transport, so d should be freshly declared just like the recorded
+// D, with the same initial state.  Channel tuples that d sends are
+// dropped.  When Replay() returns, d has the recorded D's state.
+func (d *D) Replay(r io.Reader) error {
+	var rec recording
+	if err := json.NewDecoder(r).Decode(&rec); err != nil {
+		return err
+	}
+	d.registerStateTypes()
+	ticks := make([]*replayTick, len(rec.Ticks))
+	for i, t := range rec.Ticks {
+		rt, err := d.decodeRecordedTick(t)
+		if err != nil {
+			return fmt.Errorf("tick: %d, err: %v", i, err)
+		}
+		ticks[i] = rt
+	}
+
+	transport := d.transport
+	if rec.Transport {
+		d.transport = replayTransport{}
+	}
+	d.replay = ticks
+	for len(d.replay) > 0 {
+		d.Tick()
+	}
+	d.replay = nil
+	d.transport = transport
+	return nil
+}
+
+// Used when recording, before the tick's changes are applied.
+func (d *D) recordTick(fired []*LBool) {
+	t := &recordedTick{Time: d.tickTime.UnixNano()}
+	for _, b := range fired {
+		t.Fired = append(t.Fired, b.name)
+	}
+	t.Next = d.recordChanges(d.next[d.nextMark:])
+	d.recording.Ticks = append(d.recording.Ticks, t)
+}
+
+func (d *D) recordInbound(changes []relationChange) {
+	t := d.recording.Ticks[len(d.recording.Ticks)-1]
+	t.Inbound = append(t.Inbound, d.recordChanges(changes)...)
+}
+
+func (d *D) recordChanges(changes []relationChange) []*recordedChange {
+	var rv []*recordedChange
+	for _, c := range changes {
+		rc, err := d.recordChange(c)
+		if err != nil && d.recordingErr == nil {
+			d.recordingErr = fmt.Errorf("tick: %d, rel: %s, err: %v",
+				d.ticks, d.relationLabel(c.into), err)
+		}
+		rv = append(rv, rc)
+	}
+	return rv
+}
+
+func (d *D) recordChange(c relationChange) (*recordedChange, error) {
+	rc := &recordedChange{Rel: d.relationName(c.into), Add: c.add}
+	if !c.add {
+		l, ok := c.arg.(Lattice)
+		if !ok {
+			return rc, fmt.Errorf("merge of a non-lattice: %T", c.arg)
+		}
+		s, err := marshalLattice(l)
+		rc.Val = s
+		return rc, err
+	}
+	if e, ok := c.arg.(*LMapEntry); ok {
+		s, err := marshalLattice(e.Val)
+		rc.Key, rc.Val = e.Key, s
+		return rc, err
+	}
+	j, err := json.Marshal(c.arg)
+	rc.Tuple, rc.Ptr = j, reflect.TypeOf(c.arg).Kind() == reflect.Ptr
+	return rc, err
+}
+
+func (d *D) decodeRecordedTick(t *recordedTick) (*replayTick, error) {
+	rt := &replayTick{time: time.Unix(0, t.Time)}
+	for _, name := range t.Fired {
+		b, ok := d.Relations[name].(*LBool)
+		if !ok {
+			return nil, fmt.Errorf("unknown periodic: %s", name)
+		}
+		rt.fired = append(rt.fired, b)
+	}
+	var err error
+	if rt.next, err = d.decodeRecordedChanges(t.Next); err != nil {
+		return nil, err
+	}
+	if rt.inbound, err = d.decodeRecordedChanges(t.Inbound); err != nil {
+		return nil, err
+	}
+	return rt, nil
+}
+
+func (d *D) decodeRecordedChanges(rcs []*recordedChange) ([]relationChange, error) {
+	var rv []relationChange
+	for _, rc := range rcs {
+		r := d.Relations[rc.Rel]
+		if r == nil {
+			return nil, fmt.Errorf("undeclared relation: %s", rc.Rel)
+		}
+		if rc.Val != nil {
+			like, _ := r.(Lattice)
+			if m, ok := r.(*LMap); ok && rc.Add {
+				like = m.stateLike(rc.Key)
+			}
+			l, err := d.unmarshalLattice(rc.Val, like)
+			if err != nil {
+				return nil, fmt.Errorf("relation: %s, err: %v", rc.Rel, err)
+			}
+			if rc.Add {
+				rv = append(rv, relationChange{r, &LMapEntry{rc.Key, l}, true})
+			} else {
+				rv = append(rv, relationChange{r, l.(Relation), false})
+			}
+			continue
+		}
+		t := r.TupleType()
+		if t.Kind() == reflect.Ptr {
+			t = t.Elem()
+		}
+		p := reflect.New(t)
+		if err := json.Unmarshal(rc.Tuple, p.Interface()); err != nil {
+			return nil, fmt.Errorf("relation: %s, err: %v", rc.Rel, err)
+		}
+		if rc.Ptr {
+			rv = append(rv, relationChange{r, p.Interface(), true})
+		} else {
+			rv = append(rv, relationChange{r, p.Elem().Interface(), true})
+		}
+	}
+	return rv, nil
+}
+
+// Used instead of firing periodics and reading the clock.
+func (d *D) replayTickBefore() {
+	rt := d.replay[0]
+	d.replay = d.replay[1:]
+	d.tickTime = rt.time
+	for _, b := range rt.fired {
+		b.DirectAdd(true)
+	}
+	d.next = append(d.next, rt.next...)
+	d.inboundM.Lock()
+	d.inbound = append(d.inbound, rt.inbound...)
+	d.inboundM.Unlock()
+}
+
+// Drops whatever a replaying D sends, as the recorded D's peers
+// already received it.
+type replayTransport struct{}
+
+func (replayTransport) Send(destAddr, relName string, tuple interface{}) error {
+	return nil
+}
@@ -0,0 +1,98 @@
+package gdec
+
+// Per join access statistics, see EnableScanStats().
+type JoinScanStats struct {
+	Join    string // The join's Name(), else "join#" and its position.
+	Into    string
+	Sources []SourceScanStats // By source position.
+
+	Combos  int64 // Combinations of source tuples given to the join's func.
+	Results int64 // Combinations that produced a result, after any Minus().
+}
+
+type SourceScanStats struct {
+	Source string
+
+	// Tuples that the join visited, from scanning the source, or only
+	// its delta on semi-naive steps, or from looking up a JoinOn() index.
+	Scanned int64
+
+	// Tuples visited that matched the join key, or all of them for
+	// unkeyed sources, and so were combined with later sources' tuples.
+	Passed int64
+
+	// Tuples scanned to build JoinOn() indexes, once per evaluation.
+	Indexed int64
+}
+
+// Selectivity returns Passed / Scanned, or 1 when nothing was scanned.
+// Keyed sources with a low selectivity are candidates for an index.
+func (s SourceScanStats) Selectivity() float64 {
+	if s.Scanned == 0 {
+		return 1
+	}
+	return float64(s.Passed) / float64(s.Scanned)
+}
+
+// EnableScanStats starts counting, per join and per source, the tuples
+// scanned and how many of them passed the join's key, resetting any
+// earlier counts.  Counting is off by default, as it's done per tuple.
+func (d *D) EnableScanStats() {
+	d.scanStats = true
+	for _, jd := range d.Joins {
+		jd.scanned = nil
+		jd.combos, jd.results = 0, 0
+	}
+}
+
+func (d *D) DisableScanStats() {
+	d.scanStats = false
+}
+
+// ScanStats returns the counts since EnableScanStats(), in join
+// declaration order.  Joins declared afterwards count from their
+// declaration.
+func (d *D) ScanStats() []JoinScanStats {
+	var rv []JoinScanStats
+	for _, jd := range d.Joins {
+		s := JoinScanStats{
+			Join:    jd.label(),
+			Into:    d.relationName(jd.into),
+			Combos:  jd.combos,
+			Results: jd.results,
+		}
+		for i, src := range jd.sources {
+			ss := SourceScanStats{Source: d.relationLabel(baseRelation(src))}
+			if jd.scanned != nil {
+				ss.Scanned, ss.Passed = jd.scanned[i], jd.passed[i]
+				ss.Indexed = jd.indexed[i]
+			}
+			s.Sources = append(s.Sources, ss)
+		}
+		rv = append(rv, s)
+	}
+	return rv
+}
+
+// Used by a running join, whose counters are its own, so joins that
+// run concurrently, see executeJoins(), don't contend.
+func (jd *joinDeclaration) countScan(pos int, passed bool) {
+	jd.initScanStats()
+	jd.scanned[pos]++
+	if passed {
+		jd.passed[pos]++
+	}
+}
+
+func (jd *joinDeclaration) countIndexed(pos int) {
+	jd.initScanStats()
+	jd.indexed[pos]++
+}
+
+func (jd *joinDeclaration) initScanStats() {
+	if jd.scanned == nil {
+		jd.scanned = make([]int64, len(jd.sources))
+		jd.passed = make([]int64, len(jd.sources))
+		jd.indexed = make([]int64, len(jd.sources))
+	}
+}
@@ -0,0 +1,74 @@
+package gdec
+
+import (
+	"fmt"
+	"reflect"
+	"time"
+)
+
+// Ticks returns the number of ticks completed, which makes a logical
+// clock that selectWhere funcs can read.
+func (d *D) Ticks() int64 { return d.host().ticks }
+
+// TickTime returns d.Now() as of the start of the current tick, so it's
+// stable through a tick's fixpoint, unlike d.Now().
+func (d *D) TickTime() time.Time { return d.host().tickTime }
+
+type joinStamp struct {
+	field string
+	value func() int64
+}
+
+// StampTick sets the named integer field of each output tuple to
+// d.Ticks().  The join's outputs should be pointers to structs, which
+// are copied before they're stamped.
+func (jd *joinDeclaration) StampTick(field string) *joinDeclaration {
+	return jd.addStamp(field, jd.d.Ticks)
+}
+
+// StampTime is like StampTick, but stamps the unix nanos of TickTime().
+func (jd *joinDeclaration) StampTime(field string) *joinDeclaration {
+	return jd.addStamp(field, func() int64 { return jd.d.tickTime.UnixNano() })
+}
+
+func (jd *joinDeclaration) addStamp(field string, value func() int64) *joinDeclaration {
+	if jd.err != nil {
+		return jd
+	}
+	var out reflect.Type
+	if jd.call != nil {
+		out = jd.callOut
+	} else if jd.selectWhereFunc != nil && !jd.selectWhereFlat {
+		if ft := reflect.TypeOf(jd.selectWhereFunc); ft.NumOut() == 1 &&
+			ft.Out(0).Kind() == reflect.Ptr {
+			out = ft.Out(0).Elem()
+		}
+	}
+	if out == nil || out.Kind() != reflect.Struct {
+		return jd.fail(fmt.Sprintf("stamp join: %s, field: %s, needs outputs that"+
+			" are pointers to structs", jd.label(), field))
+	}
+	f, ok := out.FieldByName(field)
+	if !ok {
+		return jd.fail(fmt.Sprintf("stamp join: %s, output type: %v, has no field: %s",
+			jd.label(), out, field))
+	}
+	switch f.Type.Kind() {
+	case reflect.Int, reflect.Int32, reflect.Int64:
+	default:
+		return jd.fail(fmt.Sprintf("stamp join: %s, field: %s, type: %v, is not an int",
+			jd.label(), field, f.Type))
+	}
+	jd.stamps = append(jd.stamps, joinStamp{field, value})
+	return jd
+}
+
+// Returns a stamped copy of a join's output.
+func (jd *joinDeclaration) stamp(out interface{}) interface{} {
+	v := reflect.New(reflect.TypeOf(out).Elem())
+	v.Elem().Set(reflect.ValueOf(out).Elem())
+	for _, s := range jd.stamps {
+		v.Elem().FieldByName(s.field).SetInt(s.value())
+	}
+	return v.Interface()
+}
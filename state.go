@@ -0,0 +1,673 @@
+package gdec
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// The JSON form of a lattice, tagged with its type so that LMap's
+// heterogeneous values and LSet's arbitrary tuples can be restored.
+type stateLattice struct {
+	Type      string                   // Ex: "LSet", "LMap", "LMax".
+	TupleType string                   `json:",omitempty"` // For LSet, LMaxBy, and other sets.
+	Tuples    []json.RawMessage        `json:",omitempty"` // For LSet, LMaxBy, LWWReg, LRing, LWindow.
+	Entries   map[string]*stateLattice `json:",omitempty"` // For LMap, PNCounter.
+	Int       int                      `json:",omitempty"` // For LMax.
+	String    string                   `json:",omitempty"` // For LMax/MinString, LMax/MinFloat.
+	Bool      bool                     `json:",omitempty"` // For LBool, LMinString set.
+	Counts    map[string]int           `json:",omitempty"` // For GCounter, VectorClock.
+	State     json.RawMessage          `json:",omitempty"` // For the rest, ex: stateRing.
+}
+
+// The State of lattices that have parameters, like an LRing's capacity,
+// or more than a set of tuples.  Parameters are only used to rebuild a
+// lattice nested in an LMap, as a declared relation keeps its own.
+type stateRing struct {
+	Capacity int
+	Key      string
+}
+
+type stateWindow struct {
+	Span  int64
+	Key   string
+	Timed bool `json:",omitempty"`
+}
+
+type stateRetract struct {
+	Policy  RetractPolicy
+	Adds    map[string]int // Key: element JSON, val: add clock.
+	Removes map[string]int // Key: element JSON, val: remove clock.
+}
+
+type stateORSet struct {
+	Adds    map[string][]string // Key: element JSON, val: tokens.
+	Removes []string            // Tombstoned tokens.
+}
+
+type stateMVRegSibling struct {
+	VV  map[string]int
+	Val *stateLattice
+}
+
+type stateHLL struct {
+	Precision int
+	Regs      []uint8
+}
+
+type stateBloom struct {
+	Size   int
+	Hashes int
+	Bits   []uint64
+}
+
+type stateShortestPath struct {
+	Path  *ShortestPath `json:",omitempty"`
+	Route []string      `json:",omitempty"`
+}
+
+var stateTypesM sync.Mutex
+var stateTypes = map[string]reflect.Type{} // Key: reflect.Type.String().
+
+// RegisterStateType allows LSet's of x's type, or of pointers to x's
+// type, to be restored by UnmarshalState(), even when nested in an LMap.
+// The tuple types of declared LSet's are registered automatically.
+func RegisterStateType(x interface{}) {
+	registerStateType(reflect.TypeOf(x))
+}
+
+func registerStateType(t reflect.Type) {
+	if t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	stateTypesM.Lock()
+	stateTypes[t.String()] = t
+	stateTypes[reflect.PtrTo(t).String()] = reflect.PtrTo(t)
+	stateTypesM.Unlock()
+}
+
+var stateLessM sync.Mutex
+var stateLess = map[string]func(a, b interface{}) bool{} // Key: reflect.Type.String().
+
+// RegisterStateLMaxBy allows LMaxBy's of x's type, with the less func,
+// to be restored by UnmarshalState() when nested in an LMap, where
+// there's no declared LMaxBy to take the less func from.
+func RegisterStateLMaxBy(x interface{}, less func(a, b interface{}) bool) {
+	t := reflect.TypeOf(x)
+	registerStateType(t)
+	stateLessM.Lock()
+	stateLess[t.String()] = less
+	stateLessM.Unlock()
+}
+
+func init() {
+	for _, x := range []interface{}{"", 0, int64(0), false, 0.0} {
+		RegisterStateType(x)
+	}
+}
+
+func (d *D) registerStateTypes() {
+	for _, r := range d.Relations {
+		switch s := r.(type) {
+		case *LSet:
+			registerStateType(s.t)
+		case *LMaxBy:
+			registerStateType(s.t)
+		case *LRing:
+			registerStateType(s.t)
+		case *LWindow:
+			registerStateType(s.t)
+		case *RetractSet:
+			registerStateType(s.t)
+		case *ORSet:
+			registerStateType(s.t)
+		}
+	}
+}
+
+func stateTupleType(name string) (reflect.Type, error) {
+	stateTypesM.Lock()
+	t := stateTypes[name]
+	stateTypesM.Unlock()
+	if t == nil {
+		return nil, fmt.Errorf("unregistered tuple type: %s", name)
+	}
+	return t, nil
+}
+
+// Returns the tuple of type t from its JSON, where struct tuples are
+// kept as pointers.
+func decodeStateTuple(t reflect.Type, j []byte) (interface{}, error) {
+	var p reflect.Value
+	if t.Kind() == reflect.Ptr {
+		p = reflect.New(t.Elem())
+	} else {
+		p = reflect.New(t)
+	}
+	if err := json.Unmarshal(j, p.Interface()); err != nil {
+		return nil, err
+	}
+	if t.Kind() == reflect.Ptr || t.Kind() == reflect.Struct {
+		return p.Interface(), nil
+	}
+	return p.Elem().Interface(), nil
+}
+
+// Returns the sorted keys, which are tuple JSON, as raw JSON.
+func stateTuples(m map[string]interface{}) []json.RawMessage {
+	var rv []json.RawMessage
+	for _, k := range sortedKeys(m) {
+		rv = append(rv, json.RawMessage(k))
+	}
+	return rv
+}
+
+// Returns s with its State set to the JSON of v.
+func withState(s *stateLattice, v interface{}) (*stateLattice, error) {
+	j, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	s.State = j
+	return s, nil
+}
+
+// Floats are kept as strings, since JSON has no infinities.
+func formatStateFloat(f float64) string {
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
+
+// MarshalState serializes every non-scratch relation to JSON, keyed by
+// relation name.  Scratch relations, including channels, are skipped
+// since they reset every tick.
+func (d *D) MarshalState() ([]byte, error) {
+	d.registerStateTypes()
+	state := map[string]*stateLattice{}
+	for name, r := range d.Relations {
+		if r.isScratch() {
+			continue
+		}
+		l, ok := r.(Lattice)
+		if !ok {
+			return nil, fmt.Errorf("relation is not a lattice: %s", name)
+		}
+		s, err := marshalLattice(l)
+		if err != nil {
+			return nil, fmt.Errorf("relation: %s, err: %v", name, err)
+		}
+		state[name] = s
+	}
+	return json.Marshal(state)
+}
+
+// UnmarshalState replaces the contents of the already declared
+// relations of d with state from MarshalState().
+func (d *D) UnmarshalState(b []byte) error {
+	d.registerStateTypes()
+	var state map[string]*stateLattice
+	if err := json.Unmarshal(b, &state); err != nil {
+		return err
+	}
+	restored := map[string]Lattice{}
+	for name, s := range state {
+		r := d.Relations[name]
+		if r == nil {
+			return fmt.Errorf("undeclared relation: %s", name)
+		}
+		l, err := d.unmarshalLattice(s, r.(Lattice))
+		if err != nil {
+			return fmt.Errorf("relation: %s, err: %v", name, err)
+		}
+		if reflect.TypeOf(l) != reflect.TypeOf(r) {
+			return fmt.Errorf("relation: %s, type: %s, does not match: %T",
+				name, s.Type, r)
+		}
+		restored[name] = l
+	}
+	for name, l := range restored { // Only modify d once everything parsed.
+		switch r := d.Relations[name].(type) {
+		case *LSet:
+			r.m, r.delta = l.(*LSet).m, l.(*LSet).delta
+			r.reindex()
+		case *LMap:
+			r.m, r.delta = l.(*LMap).m, l.(*LMap).delta
+		case *LMax:
+			r.v = l.(*LMax).v
+		case *LMaxString:
+			r.v = l.(*LMaxString).v
+		case *LMinString:
+			r.v, r.set = l.(*LMinString).v, l.(*LMinString).set
+		case *LBool:
+			r.v = l.(*LBool).v
+		case *LMaxBy:
+			r.v = l.(*LMaxBy).v
+		case *GCounter:
+			r.m = l.(*GCounter).m
+		case *PNCounter:
+			r.pos, r.neg = l.(*PNCounter).pos, l.(*PNCounter).neg
+		case *VectorClock:
+			r.m = l.(*VectorClock).m
+		case *LWWReg:
+			r.v = l.(*LWWReg).v
+		case *LMaxFloat:
+			r.v = l.(*LMaxFloat).v
+		case *LMinFloat:
+			r.v = l.(*LMinFloat).v
+		case *LRing:
+			r.m = l.(*LRing).m
+		case *LWindow:
+			r.m = l.(*LWindow).m
+		case *RetractSet:
+			x := l.(*RetractSet)
+			r.elems, r.adds, r.removes = x.elems, x.adds, x.removes
+		case *ORSet:
+			x := l.(*ORSet)
+			r.elems, r.adds, r.removes = x.elems, x.adds, x.removes
+			r.observeTokens()
+		case *MVReg:
+			r.siblings = l.(*MVReg).siblings
+		case *LHLL:
+			r.regs = l.(*LHLL).regs
+		case *LBloom:
+			r.bits = l.(*LBloom).bits
+		}
+	}
+	return nil
+}
+
+func marshalLattice(l Lattice) (*stateLattice, error) {
+	switch m := l.(type) {
+	case *LSet:
+		s := &stateLattice{Type: "LSet", TupleType: m.t.String()}
+		for _, k := range sortedKeys(m.m) { // Keys are JSON, so stable output.
+			s.Tuples = append(s.Tuples, json.RawMessage(k))
+		}
+		return s, nil
+	case *LMap:
+		s := &stateLattice{Type: "LMap", Entries: map[string]*stateLattice{}}
+		for k, v := range m.m {
+			e, err := marshalLattice(v)
+			if err != nil {
+				return nil, fmt.Errorf("key: %s, err: %v", k, err)
+			}
+			s.Entries[k] = e
+		}
+		return s, nil
+	case *LMax:
+		return &stateLattice{Type: "LMax", Int: m.v}, nil
+	case *LMaxString:
+		return &stateLattice{Type: "LMaxString", String: m.v}, nil
+	case *LMinString:
+		return &stateLattice{Type: "LMinString", String: m.v, Bool: m.set}, nil
+	case *LBool:
+		return &stateLattice{Type: "LBool", Bool: m.v}, nil
+	case *LMaxBy:
+		j, err := json.Marshal(m.v)
+		if err != nil {
+			return nil, err
+		}
+		return &stateLattice{Type: "LMaxBy", TupleType: m.t.String(),
+			Tuples: []json.RawMessage{j}}, nil
+	case *GCounter:
+		return &stateLattice{Type: "GCounter", Counts: m.m}, nil
+	case *PNCounter:
+		return &stateLattice{Type: "PNCounter", Entries: map[string]*stateLattice{
+			"pos": {Type: "GCounter", Counts: m.pos.m},
+			"neg": {Type: "GCounter", Counts: m.neg.m},
+		}}, nil
+	case *VectorClock:
+		return &stateLattice{Type: "VectorClock", Counts: m.m}, nil
+	case *LWWReg:
+		j, err := json.Marshal(m.v)
+		if err != nil {
+			return nil, err
+		}
+		return &stateLattice{Type: "LWWReg", Tuples: []json.RawMessage{j}}, nil
+	case *LMaxFloat:
+		return &stateLattice{Type: "LMaxFloat", String: formatStateFloat(m.v)}, nil
+	case *LMinFloat:
+		return &stateLattice{Type: "LMinFloat", String: formatStateFloat(m.v)}, nil
+	case *LRing:
+		return withState(&stateLattice{Type: "LRing", TupleType: m.t.String(),
+			Tuples: stateTuples(m.m)}, stateRing{m.capacity, m.key})
+	case *LWindow:
+		return withState(&stateLattice{Type: "LWindow", TupleType: m.t.String(),
+			Tuples: stateTuples(m.m)}, stateWindow{m.span, m.key, m.timed})
+	case *RetractSet:
+		return withState(&stateLattice{Type: "RetractSet", TupleType: m.t.String()},
+			stateRetract{m.policy, m.adds, m.removes})
+	case *ORSet:
+		st := stateORSet{Adds: map[string][]string{}, Removes: sortedTokens(m.removes)}
+		for k, tokens := range m.adds {
+			st.Adds[k] = sortedTokens(tokens)
+		}
+		return withState(&stateLattice{Type: "ORSet", TupleType: m.t.String()}, st)
+	case *MVReg:
+		var siblings []stateMVRegSibling
+		for i, x := range m.siblings {
+			v, err := marshalLattice(x.Val)
+			if err != nil {
+				return nil, fmt.Errorf("sibling: %d, err: %v", i, err)
+			}
+			siblings = append(siblings, stateMVRegSibling{x.VV, v})
+		}
+		return withState(&stateLattice{Type: "MVReg"}, siblings)
+	case *LHLL:
+		return withState(&stateLattice{Type: "LHLL"}, stateHLL{m.precision, m.regs})
+	case *LBloom:
+		return withState(&stateLattice{Type: "LBloom"},
+			stateBloom{m.size, m.hashes, m.bits})
+	case *shortestPathBest:
+		return withState(&stateLattice{Type: "shortestPathBest"},
+			stateShortestPath{m.path, m.route})
+	}
+	return nil, fmt.Errorf("unsupported lattice type: %T", l)
+}
+
+func sortedTokens(m map[string]bool) []string {
+	rv := make([]string, 0, len(m))
+	for k := range m {
+		rv = append(rv, k)
+	}
+	sort.Strings(rv)
+	return rv
+}
+
+// Restores a lattice, where like, when non-nil, is the declared
+// relation or LMap value that it's restored into, whose configuration,
+// such as an LMaxBy's less func, it takes on.
+func (d *D) unmarshalLattice(s *stateLattice, like Lattice) (Lattice, error) {
+	switch s.Type {
+	case "LSet":
+		t, err := stateTupleType(s.TupleType)
+		if err != nil {
+			return nil, err
+		}
+		m := d.NewLSet(t)
+		for _, j := range s.Tuples {
+			v, err := decodeStateTuple(t, j)
+			if err != nil {
+				return nil, err
+			}
+			m.DirectAdd(v)
+		}
+		return m, nil
+	case "LMap":
+		m := d.NewLMap()
+		lm, _ := like.(*LMap)
+		for k, e := range s.Entries {
+			v, err := d.unmarshalLattice(e, lm.stateLike(k))
+			if err != nil {
+				return nil, fmt.Errorf("key: %s, err: %v", k, err)
+			}
+			if b, ok := v.(*LMaxBy); ok && b.less == nil { // Not in the JSON.
+				return nil, fmt.Errorf("key: %s, unregistered LMaxBy less func"+
+					", type: %s", k, e.TupleType)
+			}
+			m.DirectAdd(&LMapEntry{k, v})
+		}
+		return m, nil
+	case "LMax":
+		m := d.NewLMax()
+		m.v = s.Int
+		return m, nil
+	case "LMaxString":
+		m := d.NewLMaxString()
+		m.v = s.String
+		return m, nil
+	case "LMinString":
+		m := d.NewLMinString()
+		m.v, m.set = s.String, s.Bool
+		return m, nil
+	case "LBool":
+		m := d.NewLBool()
+		m.v = s.Bool
+		return m, nil
+	case "LMaxBy":
+		t, err := stateTupleType(s.TupleType)
+		if err != nil {
+			return nil, err
+		}
+		if len(s.Tuples) != 1 {
+			return nil, fmt.Errorf("LMaxBy needs 1 tuple, got: %d", len(s.Tuples))
+		}
+		p := reflect.New(t)
+		if err := json.Unmarshal(s.Tuples[0], p.Interface()); err != nil {
+			return nil, err
+		}
+		// The less func isn't in the JSON, so it's from like, or else
+		// from RegisterStateLMaxBy().
+		stateLessM.Lock()
+		less := stateLess[s.TupleType]
+		stateLessM.Unlock()
+		if b, ok := like.(*LMaxBy); ok && b.t == t {
+			less = b.less
+		}
+		return &LMaxBy{d: d, t: t, less: less, v: p.Elem().Interface()}, nil
+	case "GCounter":
+		m := d.NewGCounter()
+		for k, v := range s.Counts {
+			m.m[k] = v
+		}
+		return m, nil
+	case "PNCounter":
+		m := d.NewPNCounter()
+		for k, v := range s.Entries["pos"].counts() {
+			m.pos.m[k] = v
+		}
+		for k, v := range s.Entries["neg"].counts() {
+			m.neg.m[k] = v
+		}
+		return m, nil
+	case "VectorClock":
+		m := d.NewVectorClock()
+		for k, v := range s.Counts {
+			m.m[k] = v
+		}
+		return m, nil
+	case "LWWReg":
+		m := d.NewLWWReg()
+		if len(s.Tuples) != 1 {
+			return nil, fmt.Errorf("LWWReg needs 1 tuple, got: %d", len(s.Tuples))
+		}
+		if err := json.Unmarshal(s.Tuples[0], &m.v); err != nil {
+			return nil, err
+		}
+		return m, nil
+	case "LMaxFloat", "LMinFloat":
+		f, err := strconv.ParseFloat(s.String, 64)
+		if err != nil {
+			return nil, err
+		}
+		if s.Type == "LMaxFloat" {
+			m := d.NewLMaxFloat()
+			m.v = f
+			return m, nil
+		}
+		m := d.NewLMinFloat()
+		m.v = f
+		return m, nil
+	case "LRing":
+		t, err := stateTupleType(s.TupleType)
+		if err != nil {
+			return nil, err
+		}
+		var st stateRing
+		if err := json.Unmarshal(s.State, &st); err != nil {
+			return nil, err
+		}
+		var m *LRing
+		if r, ok := like.(*LRing); ok {
+			m = r.Zero().(*LRing)
+		} else {
+			m = d.NewLRing(t, st.Capacity, st.Key)
+		}
+		for _, j := range s.Tuples {
+			v, err := decodeStateTuple(t, j)
+			if err != nil {
+				return nil, err
+			}
+			m.DirectAdd(v) // Keeps to a declared capacity.
+		}
+		return m, nil
+	case "LWindow":
+		t, err := stateTupleType(s.TupleType)
+		if err != nil {
+			return nil, err
+		}
+		var st stateWindow
+		if err := json.Unmarshal(s.State, &st); err != nil {
+			return nil, err
+		}
+		var m *LWindow
+		if r, ok := like.(*LWindow); ok {
+			m = r.Zero().(*LWindow)
+		} else if st.Timed {
+			m = d.NewLTimeWindow(t, time.Duration(st.Span), st.Key)
+		} else {
+			m = d.NewLWindow(t, st.Span, st.Key)
+		}
+		for _, j := range s.Tuples {
+			v, err := decodeStateTuple(t, j)
+			if err != nil {
+				return nil, err
+			}
+			m.m[string(j)] = v // Evicted by the next tick, if it's out of the window.
+		}
+		return m, nil
+	case "RetractSet":
+		t, err := stateTupleType(s.TupleType)
+		if err != nil {
+			return nil, err
+		}
+		var st stateRetract
+		if err := json.Unmarshal(s.State, &st); err != nil {
+			return nil, err
+		}
+		var m *RetractSet
+		if r, ok := like.(*RetractSet); ok {
+			m = r.Zero().(*RetractSet)
+		} else {
+			m = d.NewRetractSet(t, st.Policy)
+		}
+		for k, c := range st.Adds {
+			v, err := decodeStateTuple(t, []byte(k))
+			if err != nil {
+				return nil, err
+			}
+			m.elems[k], m.adds[k] = v, c
+		}
+		for k, c := range st.Removes {
+			m.removes[k] = c
+		}
+		return m, nil
+	case "ORSet":
+		t, err := stateTupleType(s.TupleType)
+		if err != nil {
+			return nil, err
+		}
+		var st stateORSet
+		if err := json.Unmarshal(s.State, &st); err != nil {
+			return nil, err
+		}
+		m := d.NewORSet(t)
+		for k, tokens := range st.Adds {
+			v, err := decodeStateTuple(t, []byte(k))
+			if err != nil {
+				return nil, err
+			}
+			for _, token := range tokens {
+				m.addToken(k, token, v)
+			}
+		}
+		for _, token := range st.Removes {
+			m.removes[token] = true
+		}
+		m.observeTokens()
+		return m, nil
+	case "MVReg":
+		var siblings []stateMVRegSibling
+		if err := json.Unmarshal(s.State, &siblings); err != nil {
+			return nil, err
+		}
+		m := d.NewMVReg()
+		for i, x := range siblings {
+			v, err := d.unmarshalLattice(x.Val, nil)
+			if err != nil {
+				return nil, fmt.Errorf("sibling: %d, err: %v", i, err)
+			}
+			m.siblings = append(m.siblings, &MVRegSibling{vvCopy(x.VV), v})
+		}
+		return m, nil
+	case "LHLL":
+		var st stateHLL
+		if err := json.Unmarshal(s.State, &st); err != nil {
+			return nil, err
+		}
+		if r, ok := like.(*LHLL); ok && r.precision != st.Precision {
+			return nil, fmt.Errorf("LHLL precision: %d, does not match: %d",
+				st.Precision, r.precision)
+		}
+		m := d.NewLHLL(st.Precision)
+		if len(st.Regs) != len(m.regs) {
+			return nil, fmt.Errorf("LHLL needs %d registers, got: %d",
+				len(m.regs), len(st.Regs))
+		}
+		copy(m.regs, st.Regs)
+		return m, nil
+	case "LBloom":
+		var st stateBloom
+		if err := json.Unmarshal(s.State, &st); err != nil {
+			return nil, err
+		}
+		if r, ok := like.(*LBloom); ok && (r.size != st.Size || r.hashes != st.Hashes) {
+			return nil, fmt.Errorf("LBloom size: %d, hashes: %d, does not match"+
+				" size: %d, hashes: %d", st.Size, st.Hashes, r.size, r.hashes)
+		}
+		m := d.NewLBloom(st.Size, st.Hashes)
+		if len(st.Bits) != len(m.bits) {
+			return nil, fmt.Errorf("LBloom needs %d words, got: %d",
+				len(m.bits), len(st.Bits))
+		}
+		copy(m.bits, st.Bits)
+		return m, nil
+	case "shortestPathBest":
+		var st stateShortestPath
+		if err := json.Unmarshal(s.State, &st); err != nil {
+			return nil, err
+		}
+		r, ok := like.(*shortestPathBest) // Has the better func.
+		if !ok {
+			return nil, fmt.Errorf("shortestPathBest outside a ShortestPath relation")
+		}
+		m := r.Zero().(*shortestPathBest)
+		m.path, m.route = st.Path, st.Route
+		return m, nil
+	}
+	return nil, fmt.Errorf("unsupported lattice type: %s", s.Type)
+}
+
+// Returns what a value restored at key k is like, if it's known.
+func (m *LMap) stateLike(k string) Lattice {
+	if m == nil {
+		return nil
+	}
+	if v := m.m[k]; v != nil {
+		return v
+	}
+	if m.newVal != nil {
+		return m.newVal()
+	}
+	return nil
+}
+
+func (s *stateLattice) counts() map[string]int {
+	if s == nil {
+		return nil
+	}
+	return s.Counts
+}
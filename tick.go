@@ -3,6 +3,8 @@ package gdec
 import (
 	"fmt"
 	"reflect"
+	"sort"
+	"time"
 )
 
 type relationChange struct {
@@ -12,49 +14,385 @@ type relationChange struct {
 }
 
 func (d *D) Tick() {
+	if d.embeddedIn != nil {
+		panic(fmt.Sprintf("Tick() on an embedded D, addr: %s", d.Addr))
+	}
+	d.tickBefore()
+	d.tickMain()
+	d.tickAfter()
+}
+
+func (d *D) tickBefore() {
 	for _, r := range d.Relations {
 		r.startTick()
 	}
+	for r, tuples := range d.seeds { // Scratch resets drop them.
+		if r.isScratch() {
+			for _, v := range tuples {
+				r.DirectAdd(v)
+			}
+		}
+	}
 
-	// TODO: Incorporate periodics.
-	// TODO: Incorporate network.
+	if d.replay != nil {
+		d.replayTickBefore()
+	} else {
+		d.tickTime = d.Now()
+		fired := d.firePeriodics()
+		if d.recording != nil {
+			d.recordTick(fired)
+		}
+	}
+	d.evictWindows()
 
-	applyRelationChanges(d.next) // Apply pending data from last tick.
-	d.next = d.next[0:0]
+	d.tickChanges = 0
+	if d.tickChanged != nil {
+		d.tickChanged = map[Relation]bool{}
+	}
 
-	d.tickMain()
-	d.ticks++
+	for _, r := range d.Relations { // Loopback any undrained channel tuples.
+		if c, ok := r.(*LSet); ok && c.channel {
+			for _, v := range c.Drain() {
+				d.next = append(d.next, relationChange{c, v, true})
+			}
+		}
+	}
 
-	// TODO: Emit to network.
+	d.applyRelationChanges(d.next, true) // Apply pending data from last tick.
+	d.next = d.next[0:0]
+	d.nextMark = 0
+
+	d.receive()
 }
 
 func (d *D) tickMain() {
-	for { // TODO: Hugely naive, inefficient, simple implementation.
-		for _, jd := range d.Joins {
-			d.next, d.immediate = jd.executeJoinInto(d.next, d.immediate)
+	if d.strata == nil {
+		d.strata, d.asyncJoins = d.stratify()
+		d.reads = stratumReads(d.strata)
+	}
+	d.rotateDeltas() // The first step covers changes from tickBefore().
+	if d.SnapshotReads {
+		d.snapshotReads()
+		defer func() { d.readSnapshots = nil }()
+	}
+	d.tickFixpoint()
+
+	// Async joins only need to see the fixpoint, not every step on the
+	// way there.  Their selectWhere funcs might still have invoked
+	// d.Add() and friends, so reach the fixpoint again for those.
+	d.executeJoins(d.asyncJoins, false)
+	if len(d.immediate) > 0 {
+		d.tickFixpoint()
+	}
+	d.settleRetractions()
+	d.clearTickDeltas()
+}
+
+func (d *D) tickFixpoint() {
+	for s, joins := range d.strata {
+		for step := 0; ; step++ {
+			d.executeJoins(joins, step > 0)
+			d.immediate = d.checkImmediate(s, routeChannelChanges(d.immediate))
+			changed := d.applyRelationChanges(d.immediate, false)
+			d.refreshReadSnapshots(d.immediate)
+			d.immediate = d.immediate[0:0]
+			d.rotateDeltas()
+			if !changed {
+				break
+			}
+		}
+	}
+}
+
+// Groups the non-async joins into strata, so that each relation used
+// by Minus() is fully computed in an earlier stratum than the joins
+// that negate it.  Async joins are returned separately.
+func (d *D) stratify() (strata [][]*joinDeclaration, async []*joinDeclaration) {
+	relStratum := map[Relation]int{}
+	joinStratum := make([]int, len(d.Joins))
+	for changed := true; changed; {
+		changed = false
+		for i, jd := range d.Joins {
+			s := 0
+			for _, r := range jd.sources {
+				if r = baseRelation(r); relStratum[r] > s {
+					s = relStratum[r]
+				}
+			}
+			for _, r := range jd.minus {
+				if relStratum[r]+1 > s {
+					s = relStratum[r] + 1
+				}
+			}
+			if jd.agg != nil { // Aggregates need settled sources, like Minus().
+				for _, r := range jd.sources {
+					if r = baseRelation(r); relStratum[r]+1 > s {
+						s = relStratum[r] + 1
+					}
+				}
+			}
+			if s > len(d.Joins) {
+				// Unless collecting errors, fail() panics, else it drops
+				// the join, so stratify what's left.
+				jd.fail(fmt.Sprintf("joins are not stratifiable, cycle through"+
+					" Minus() or JoinAgg() at join: %s", jd.label()))
+				return d.stratify()
+			}
+			if s != joinStratum[i] {
+				joinStratum[i] = s
+				changed = true
+			}
+			if jd.into != nil && !jd.async && relStratum[jd.into] < s {
+				relStratum[jd.into] = s
+				changed = true
+			}
+		}
+	}
+
+	for i, jd := range d.Joins {
+		jd.maintained = false
+		if jd.async {
+			async = append(async, jd)
+			continue
+		}
+		for len(strata) <= joinStratum[i] {
+			strata = append(strata, nil)
 		}
-		changed := applyRelationChanges(d.immediate)
-		d.immediate = d.immediate[0:0]
-		if !changed {
+		strata[joinStratum[i]] = append(strata[joinStratum[i]], jd)
+	}
+	return strata, async
+}
+
+// Snapshots the relations that joins read but that no join derives,
+// so that, during the tick, a join doesn't see changes that an earlier
+// join's selectWhere func made directly, like a Remove().  Relations
+// that joins derive are read live, as the fixpoint needs.
+func (d *D) snapshotReads() {
+	derived := map[Relation]bool{}
+	for _, joins := range d.strata {
+		for _, jd := range joins {
+			if jd.into != nil {
+				derived[jd.into] = true
+			}
+		}
+	}
+	d.readSnapshots = map[Relation]Relation{}
+	for _, jd := range d.Joins {
+		for _, r := range jd.sources {
+			r = baseRelation(r)
+			if l, ok := r.(Lattice); ok && !derived[r] && d.readSnapshots[r] == nil {
+				d.readSnapshots[r] = l.Snapshot().(Relation)
+			}
+		}
+	}
+}
+
+// Changes from d.Add() and friends go through the fixpoint, so they're
+// seen at the next step, along with whatever else their relations hold.
+func (d *D) refreshReadSnapshots(changes []relationChange) {
+	if d.readSnapshots == nil {
+		return
+	}
+	stale := map[Relation]bool{}
+	for _, c := range changes {
+		if _, ok := d.readSnapshots[c.into]; ok {
+			stale[c.into] = true
+		}
+	}
+	for r := range stale {
+		d.readSnapshots[r] = r.(Lattice).Snapshot().(Relation)
+	}
+}
+
+// Returns what the join scans as its source #i, which, under
+// SnapshotReads, may be a snapshot.
+func (jd *joinDeclaration) source(i int) Relation {
+	if jd.d.readSnapshots == nil {
+		return jd.sources[i]
+	}
+	return jd.d.readSnapshot(jd.sources[i])
+}
+
+func (d *D) readSnapshot(r Relation) Relation {
+	if v, ok := r.(*LSetView); ok {
+		if src := d.readSnapshot(v.src); src != v.src {
+			return &LSetView{src: src, t: v.t, filter: v.filter, mapper: v.mapper}
+		}
+		return v
+	}
+	if s, ok := d.readSnapshots[r]; ok {
+		return s
+	}
+	return r
+}
+
+// The earliest reader of a relation in the strata.
+type stratumRead struct {
+	jd      *joinDeclaration
+	stratum int // Changes applied from this stratum on are missed.
+}
+
+// Returns, for each relation that the strata read, the earliest stratum
+// from which a change to the relation would be missed by a reader: the
+// stratum after a plain read, or the stratum of a Minus() or JoinAgg()
+// read, which needs the relation settled beforehand.
+func stratumReads(strata [][]*joinDeclaration) map[Relation]stratumRead {
+	reads := map[Relation]stratumRead{}
+	read := func(r Relation, jd *joinDeclaration, s int) {
+		if x, ok := reads[r]; !ok || s < x.stratum {
+			reads[r] = stratumRead{jd, s}
+		}
+	}
+	for s, joins := range strata {
+		for _, jd := range joins {
+			for _, r := range jd.sources {
+				if jd.agg != nil {
+					read(baseRelation(r), jd, s)
+				} else {
+					read(baseRelation(r), jd, s+1)
+				}
+			}
+			for _, r := range jd.minus {
+				read(r, jd, s)
+			}
+		}
+	}
+	return reads
+}
+
+// Checks the changes to be applied at the end of a step of stratum s.
+// Join results are stratified, so only d.Add() and friends, from a
+// selectWhere func, can write to a relation that an earlier stratum
+// read, which would leave that stratum's results inconsistent with the
+// tick.  Those changes panic, unless d is collecting errors, when
+// they're recorded and dropped.  Adding a tuple that's already there
+// is harmless.
+func (d *D) checkImmediate(s int, changes []relationChange) []relationChange {
+	if s == 0 {
+		return changes
+	}
+	rv := changes[0:0]
+	for _, c := range changes {
+		x, ok := d.reads[c.into]
+		if ok && x.stratum <= s {
+			if m, isContains := c.into.(containser); !c.add || !isContains ||
+				!m.Contains(c.arg) {
+				d.tickFail(x.jd, fmt.Sprintf("change to relation: %s, in stratum: %d"+
+					", is missed by join: %s, in an earlier or settled read"+
+					"; use a join's Into() or d.AddNext()",
+					d.relationLabel(c.into), s, x.jd.label()))
+				continue
+			}
+		}
+		rv = append(rv, c)
+	}
+	return rv
+}
+
+func (d *D) tickAfter() {
+	d.next = routeChannelChanges(d.next)
+	d.nextMark = len(d.next)
+	d.ticks++
+
+	for _, f := range d.beforeEmit {
+		if err := f(); err != nil {
+			d.dropEmit(err)
 			return
 		}
 	}
+	d.emit()
+}
+
+// RunUntilQuiescent ticks until a tick changes no non-scratch relation
+// and delivers no async or network tuples that change anything, or
+// until maxTicks.  Periodics firing don't count as changes, but what
+// they cause does.  At least two ticks are run, since the first tick's
+// async results only show up in the second.  Returns true if
+// quiescence was reached.
+func (d *D) RunUntilQuiescent(maxTicks int) bool {
+	return d.RunUntilQuiescentErr(maxTicks) == nil
+}
+
+// The number of final ticks whose changed relations a QuiescenceError
+// reports, enough to catch a relation that flips every other tick.
+const quiescenceWindow = 3
+
+// RunUntilQuiescentErr is like RunUntilQuiescent(), but on reaching
+// maxTicks returns a *QuiescenceError naming the relations that changed
+// during the final ticks, the likely culprits of a join that isn't
+// monotonic or an async loop that never settles.
+func (d *D) RunUntilQuiescentErr(maxTicks int) error {
+	d.tickChanged = map[Relation]bool{}
+	defer func() { d.tickChanged = nil }()
+
+	var recent []map[Relation]bool // The last quiescenceWindow ticks.
+	for i := 0; i < maxTicks; i++ {
+		d.Tick()
+		if i > 0 && d.tickChanges == 0 {
+			return nil
+		}
+		recent = append(recent, d.tickChanged)
+		if len(recent) > quiescenceWindow {
+			recent = recent[1:]
+		}
+	}
+
+	counts := map[string]int{}
+	for _, changed := range recent {
+		for r := range changed {
+			counts[d.relationLabel(r)]++
+		}
+	}
+	err := &QuiescenceError{Addr: d.Addr, Ticks: maxTicks, Changes: counts}
+	for name := range counts {
+		err.Changing = append(err.Changing, name)
+	}
+	sort.Strings(err.Changing)
+	return err
 }
 
-func (jd *joinDeclaration) executeJoinInto(next, immediate []relationChange) (
-	nextOut, immediateOut []relationChange) {
+// Results are appended to the D's next or immediate changes, alongside
+// any changes from selectWhere funcs that invoke d.Add() and friends.
+// When useDelta is true, SemiNaive joins only consider combinations of
+// tuples that include at least one recently changed tuple, or else one
+// changed during the tick when the join is maintainable().
+func (jd *joinDeclaration) executeJoinInto(useDelta bool) {
+	if jd.disabled {
+		return
+	}
+	d := jd.d
 	numSources := len(jd.sources)
 
+	if d.metrics {
+		start := time.Now()
+		defer func() {
+			jd.evals++
+			jd.evalTime += time.Since(start)
+		}()
+	}
+
+	if jd.agg != nil {
+		jd.executeAgg()
+		return
+	}
+
 	join := make([]interface{}, numSources)
 	values := make([]reflect.Value, numSources)
 
 	selectWhere := func() *relationChange {
-		if jd.selectWhereFunc != nil {
-			for i, x := range join {
-				values[i] = reflect.ValueOf(x)
+		if jd.call != nil {
+			if out := jd.call(join, jd.callDeref); out != nil {
+				return &relationChange{jd.into, out, true}
 			}
+		} else if jd.selectWhereFunc != nil {
 			ft := reflect.ValueOf(jd.selectWhereFunc)
+			for i, x := range join {
+				values[i] = asParam(reflect.ValueOf(x), ft.Type().In(i))
+			}
 			out := ft.Call(values)
+			if len(out) == 0 && jd.into == nil {
+				return nil // Side-effect only join, like one that calls d.Add().
+			}
 			if out == nil || len(out) != 1 {
 				panic(fmt.Sprintf("unexpected # out results: %#v", out))
 			}
@@ -78,44 +416,236 @@ func (jd *joinDeclaration) executeJoinInto(next, immediate []relationChange) (
 		return nil
 	}
 
+	var deltas []deltaRelation
+	tickDelta := !useDelta && jd.maintainable()
+	if useDelta || tickDelta {
+		deltas = jd.deltaSources()
+	}
+	if deltas == nil && !useDelta {
+		jd.maintained = true
+	}
+	deltaPos := -1 // The source that only scans its delta.
+
+	// For JoinOn(), the first keyed source binds the key, and later
+	// keyed sources are looked up in a hash index by that key.
+	keyFirst := -1
+	indexes := make([]map[interface{}][]interface{}, numSources)
+	for i, f := range jd.on {
+		if f == "" {
+			continue
+		}
+		if keyFirst < 0 {
+			keyFirst = i
+			continue
+		}
+		indexes[i] = map[interface{}][]interface{}{}
+		for tuple := range jd.source(i).Scan() {
+			if d.scanStats {
+				jd.countIndexed(i)
+			}
+			k := tupleField(tuple, f)
+			indexes[i][k] = append(indexes[i][k], tuple)
+		}
+	}
+	var key interface{}
+
 	var joiner func(int)
 	joiner = func(pos int) {
 		if pos < numSources {
-			for tuple := range jd.sources[pos].Scan() {
+			if indexes[pos] != nil && pos != deltaPos {
+				for _, tuple := range indexes[pos][key] {
+					if d.scanStats {
+						jd.countScan(pos, true)
+					}
+					join[pos] = tuple
+					joiner(pos + 1)
+				}
+				return
+			}
+			scan := jd.source(pos).Scan
+			if pos == deltaPos && tickDelta {
+				scan = deltas[pos].ScanTickDelta
+			} else if pos == deltaPos {
+				scan = deltas[pos].ScanDelta
+			}
+			for tuple := range scan() {
 				if tuple == nil {
-					panic("Scan() gave nil tuple")
+					d.tickFail(jd, fmt.Sprintf("Scan() gave nil tuple"+
+						", join: %s, source: %s", jd.label(),
+						d.relationLabel(jd.sources[pos])))
+					continue
+				}
+				if pos == keyFirst {
+					key = tupleField(tuple, jd.on[pos])
+				} else if indexes[pos] != nil &&
+					tupleField(tuple, jd.on[pos]) != key {
+					if d.scanStats {
+						jd.countScan(pos, false)
+					}
+					continue
+				}
+				if d.scanStats {
+					jd.countScan(pos, true)
 				}
 				join[pos] = tuple
 				joiner(pos + 1)
 			}
 		} else {
 			res := selectWhere()
-			if res != nil {
-				if jd.async {
-					next = append(next, *res)
-				} else {
-					immediate = append(immediate, *res)
+			if d.checkDeterminism && jd.into != nil {
+				jd.checkDeterministic(join, res, jd.rerun(selectWhere))
+			}
+			if d.scanStats {
+				jd.combos++
+			}
+			if res != nil && res.add && jd.stamps != nil {
+				res.arg = jd.stamp(res.arg)
+			}
+			if res != nil && res.add {
+				for _, m := range jd.minus {
+					if m.Contains(res.arg) {
+						res = nil
+						break
+					}
 				}
 			}
+			if res != nil && d.scanStats {
+				jd.results++
+			}
+			if res != nil && jd.selectWhereFlat {
+				jd.resultFlat(join, res.arg)
+			} else if res != nil {
+				if d.trace {
+					d.traceJoin(jd, join, res.arg)
+				}
+				jd.result(*res)
+			}
 		}
 	}
-	joiner(0)
-
-	return next, immediate
+	if deltas == nil {
+		joiner(0)
+		return
+	}
+	for deltaPos = 0; deltaPos < numSources; deltaPos++ {
+		joiner(0)
+	}
 }
 
-func applyRelationChanges(changes []relationChange) bool {
+// Returns true if any relation changed.  Changes to non-scratch
+// relations, or to any relation when external is true, are counted
+// towards the tick's changes.
+func (d *D) applyRelationChanges(changes []relationChange, external bool) bool {
 	changed := false
 	for _, c := range changes {
+		var ch bool
 		if c.add {
-			changed = c.into.DirectAdd(c.arg) || changed
+			ch = c.into.DirectAdd(c.arg)
 		} else {
-			changed = c.into.DirectMerge(c.arg.(Relation)) || changed
+			ch = c.into.DirectMerge(c.arg.(Relation))
+		}
+		if ch && (external || !c.into.isScratch() && !isRederived(c.into)) {
+			d.tickChanges++
+			if d.tickChanged != nil {
+				d.tickChanged[c.into] = true
+			}
+		}
+		if ch && d.metrics {
+			d.relationChanges[c.into]++
+		}
+		if ch {
+			for _, f := range d.onChange[c.into] {
+				f(c.arg)
+			}
 		}
+		changed = ch || changed
 	}
 	return changed
 }
 
+// Moves changes that target a channel into that channel's outbox, so
+// that a channel only ever shows tuples that were sent in an earlier
+// tick.  Returns the remaining, non-channel changes.
+func routeChannelChanges(changes []relationChange) []relationChange {
+	rest := changes[0:0]
+	for _, c := range changes {
+		ch, ok := c.into.(*LSet)
+		if !ok || !ch.channel {
+			rest = append(rest, c)
+			continue
+		}
+		if c.add {
+			ch.send(c.arg)
+		} else {
+			m := c.arg.(*LSet).m
+			for _, k := range sortedKeys(m) {
+				ch.send(m[k])
+			}
+		}
+	}
+	return rest
+}
+
+func tupleField(tuple interface{}, field string) interface{} {
+	return reflect.Indirect(reflect.ValueOf(tuple)).FieldByName(field).Interface()
+}
+
+// Relations like LMax or an LSet of strings scan out plain values,
+// while selectWhere funcs always take pointers, so wrap as needed.
+func asParam(v reflect.Value, pt reflect.Type) reflect.Value {
+	if v.Type() != pt && pt.Kind() == reflect.Ptr && v.Type() == pt.Elem() {
+		p := reflect.New(v.Type())
+		p.Elem().Set(v)
+		return p
+	}
+	return v
+}
+
+// Used for a JoinFlat() result, a relation to merge into the join's
+// Into(), or a slice of them.  Relations that can't merge, like an
+// LSet of another tuple type, are reported via tickFail().
+func (jd *joinDeclaration) resultFlat(join []interface{}, out interface{}) {
+	d := jd.d
+	v := reflect.ValueOf(out)
+	rels := []reflect.Value{v}
+	if v.Kind() == reflect.Slice {
+		rels = rels[:0]
+		for i := 0; i < v.Len(); i++ {
+			rels = append(rels, v.Index(i))
+		}
+	}
+	for _, rv := range rels {
+		if isNil(rv) {
+			continue
+		}
+		r := rv.Interface().(Relation)
+		if msg := flatMismatch(jd.into, r); msg != "" {
+			d.tickFail(jd, fmt.Sprintf("JoinFlat() join: %s, produced a relation"+
+				" that cannot merge into relation: %s, %s",
+				jd.label(), d.relationLabel(jd.into), msg))
+			continue
+		}
+		if d.trace {
+			d.traceJoin(jd, join, r)
+		}
+		jd.result(relationChange{jd.into, r, false})
+	}
+}
+
+// Returns why r can't be merged into dest, else "".
+func flatMismatch(dest, r Relation) string {
+	if dest.TupleType() != r.TupleType() {
+		return fmt.Sprintf("tuple type: %v, wants: %v", r.TupleType(), dest.TupleType())
+	}
+	if m, ok := dest.(*LMap); ok && m.valType != nil {
+		for k, v := range r.(*LMap).m {
+			if reflect.TypeOf(v) != m.valType {
+				return fmt.Sprintf("key: %s, value type: %T, wants: %v", k, v, m.valType)
+			}
+		}
+	}
+	return ""
+}
+
 func isNil(v reflect.Value) bool {
 	switch v.Kind() {
 	case reflect.Chan, reflect.Func, reflect.Interface, reflect.Map,
@@ -0,0 +1,75 @@
+package gdec
+
+import (
+	"fmt"
+)
+
+// A record of a join producing a tuple, see EnableTrace().
+type TraceEntry struct {
+	Tick    int64
+	Join    string        // The join's Name(), else "join#" and its position.
+	Into    string        // Name of the destination relation.
+	Async   bool          // True when the output shows up on the next tick.
+	Sources []interface{} // The source tuples that the join combined.
+	Output  interface{}
+}
+
+// EnableTrace starts recording which joins produce which tuples,
+// dropping any earlier records.  Every production is recorded, so a
+// join that runs on several steps of a fixpoint shows up repeatedly.
+func (d *D) EnableTrace() {
+	d.trace = true
+	d.traceLog = nil
+}
+
+func (d *D) DisableTrace() {
+	d.trace = false
+}
+
+// Trace returns the records since EnableTrace(), in order.
+func (d *D) Trace() []TraceEntry {
+	return d.traceLog
+}
+
+// OnChange registers f to be invoked whenever a tuple actually changes
+// the named relation, with that tuple, or with the merged relation for
+// a merge.  Re-adding a tuple that's already there is not a change,
+// though a scratch relation starts each tick empty, so its tuples are
+// changes again on every tick that rederives them.  Hooks run during Tick(), so should not themselves Tick().
+func (d *D) OnChange(relName string, f func(added interface{})) {
+	r, ok := d.Relations[relName]
+	if !ok {
+		panic(fmt.Sprintf("OnChange() on unknown relation: %s", relName))
+	}
+	if d.onChange == nil {
+		d.onChange = map[Relation][]func(interface{}){}
+	}
+	d.onChange[r] = append(d.onChange[r], f)
+}
+
+func (d *D) traceJoin(jd *joinDeclaration, join []interface{}, out interface{}) {
+	d.traceLog = append(d.traceLog, TraceEntry{
+		Tick:    d.ticks,
+		Join:    jd.label(),
+		Into:    d.relationName(jd.into),
+		Async:   jd.async,
+		Sources: append([]interface{}(nil), join...),
+		Output:  out,
+	})
+}
+
+func (d *D) relationName(r Relation) string {
+	for name, x := range d.Relations {
+		if x == r {
+			return name
+		}
+	}
+	return ""
+}
+
+func (d *D) relationLabel(r Relation) string {
+	if name := d.relationName(r); name != "" {
+		return name
+	}
+	return "(undeclared)"
+}
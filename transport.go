@@ -0,0 +1,509 @@
+package gdec
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sort"
+	"sync"
+)
+
+// A Transport delivers channel tuples to the D whose Addr matches
+// destAddr, into the channel relation named relName.
+type Transport interface {
+	Send(destAddr string, relName string, tuple interface{}) error
+}
+
+func (d *D) SetTransport(t Transport) {
+	d.transport = t
+}
+
+// Deliver is used by transports to hand an incoming tuple to a D.  The
+// tuple is queued and becomes visible in the named channel relation at
+// the start of the next tick.  Deliver is safe for concurrent use.
+func (d *D) Deliver(relName string, tuple interface{}) error {
+	return d.deliverAfter(relName, tuple, 0)
+}
+
+// An inbound tuple that's held back for some more ticks.
+type delayedChange struct {
+	c     relationChange
+	ticks int
+}
+
+// Like Deliver(), but the tuple becomes visible the given number of
+// ticks later.
+func (d *D) deliverAfter(relName string, tuple interface{}, ticks int) error {
+	c, ok := d.Relations[relName].(*LSet)
+	if !ok || !c.channel {
+		return fmt.Errorf("no channel for Deliver(), relName: %s, addr: %s",
+			relName, d.Addr)
+	}
+	d.inboundM.Lock()
+	if ticks > 0 {
+		d.delayed = append(d.delayed, delayedChange{relationChange{c, tuple, true}, ticks})
+	} else {
+		d.inbound = append(d.inbound, relationChange{c, tuple, true})
+	}
+	d.inboundM.Unlock()
+	return nil
+}
+
+func (d *D) receive() {
+	d.inboundM.Lock()
+	inbound := d.inbound
+	d.inbound = nil
+	delayed := d.delayed[0:0]
+	for _, x := range d.delayed {
+		if x.ticks--; x.ticks > 0 {
+			delayed = append(delayed, x)
+		} else {
+			d.inbound = append(d.inbound, x.c) // For the next tick.
+		}
+	}
+	d.delayed = delayed
+	d.inboundM.Unlock()
+
+	if d.recording != nil {
+		d.recordInbound(inbound)
+	}
+
+	rest := inbound[0:0]
+	for _, c := range inbound {
+		if dd := c.into.(*LSet).dedup; dd == nil || !dd.seen(d.ticks, c.arg) {
+			rest = append(rest, c)
+		}
+	}
+	rest = d.releaseCausal(rest)
+
+	d.applyRelationChanges(rest, true)
+}
+
+// Remembers the latest inbound tuple per key, so that redeliveries of
+// the same tuple within a window of ticks can be suppressed.
+type channelDedup struct {
+	window     int64
+	fields     []string // Key fields, or nil to key on the whole tuple.
+	last       map[string]channelDedupSeen
+	suppressed int64
+}
+
+type channelDedupSeen struct {
+	tuple string // JSON of the whole tuple.
+	tick  int64
+}
+
+// DeclareDedup suppresses tuples delivered to a channel by a transport
+// that are identical to a tuple delivered within the last window ticks.
+// Only the latest tuple is remembered for each combination of the key
+// fields, such as From and Term, so tuples that share a key but differ
+// otherwise are never suppressed.  No fields means the whole tuple is
+// the key.  See Suppressed().
+func (m *LSet) DeclareDedup(window int, fields ...string) *LSet {
+	if !m.channel || window <= 0 {
+		panic(fmt.Sprintf("DeclareDedup() needs a channel and a positive"+
+			" window, LSet.name: %s, window: %d", m.name, window))
+	}
+	t := m.t
+	if t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	for _, f := range fields {
+		if _, ok := t.FieldByName(f); t.Kind() != reflect.Struct || !ok {
+			panic(fmt.Sprintf("DeclareDedup() tuple type: %v, has no field: %s"+
+				", LSet.name: %s", m.t, f, m.name))
+		}
+	}
+	m.dedup = &channelDedup{
+		window: int64(window),
+		fields: fields,
+		last:   map[string]channelDedupSeen{},
+	}
+	return m
+}
+
+// Returns the number of inbound tuples suppressed as duplicates.
+func (m *LSet) Suppressed() int64 {
+	if m.dedup == nil {
+		return 0
+	}
+	return m.dedup.suppressed
+}
+
+// Returns true if the tuple is a duplicate within the window, else
+// remembers it.
+func (dd *channelDedup) seen(tick int64, tuple interface{}) bool {
+	for k, s := range dd.last {
+		if tick-s.tick >= dd.window {
+			delete(dd.last, k)
+		}
+	}
+	j, err := json.Marshal(tuple)
+	if err != nil {
+		panic(err)
+	}
+	js, key := string(j), string(j)
+	if dd.fields != nil {
+		vals := make([]interface{}, len(dd.fields))
+		for i, f := range dd.fields {
+			vals[i] = tupleField(tuple, f)
+		}
+		if j, err = json.Marshal(vals); err != nil {
+			panic(err)
+		}
+		key = string(j)
+	}
+	if s, ok := dd.last[key]; ok && s.tuple == js {
+		dd.suppressed++
+		return true
+	}
+	dd.last[key] = channelDedupSeen{js, tick}
+	return false
+}
+
+// Holds the inbound tuples of a channel until the tuples that causally
+// precede them have been delivered, see DeclareCausal().
+type channelCausal struct {
+	clockField string
+	fromField  string
+	max        int
+	delivered  map[string]int // Key: sender, val: count of its tuples delivered.
+	held       []relationChange
+	arrived    bool // True while collecting a tick's inbound tuples.
+}
+
+// DeclareCausal delays the delivery of tuples to a channel by a
+// transport until every tuple that causally precedes them has been
+// delivered, by the *VectorClock in each tuple's clockField, which the
+// sender named in the fromField has ticked for the send, as in causal
+// broadcast.  At most max tuples are held, beyond which the newest are
+// dropped, see Held() and Dropped().
+func (m *LSet) DeclareCausal(clockField, fromField string, max int) *LSet {
+	if !m.channel || max <= 0 {
+		panic(fmt.Sprintf("DeclareCausal() needs a channel and a positive"+
+			" max, LSet.name: %s, max: %d", m.name, max))
+	}
+	t := m.t
+	if t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	fields := []string{clockField, fromField}
+	types := []reflect.Type{reflect.TypeOf(&VectorClock{}), reflect.TypeOf("")}
+	for i, f := range fields {
+		if t.Kind() != reflect.Struct {
+			panic(fmt.Sprintf("DeclareCausal() tuple type: %v, is not a struct"+
+				", LSet.name: %s", m.t, m.name))
+		}
+		if sf, ok := t.FieldByName(f); !ok || sf.Type != types[i] {
+			panic(fmt.Sprintf("DeclareCausal() tuple type: %v, has no field: %s"+
+				", of type: %v, LSet.name: %s", m.t, f, types[i], m.name))
+		}
+	}
+	m.causal = &channelCausal{
+		clockField: clockField,
+		fromField:  fromField,
+		max:        max,
+		delivered:  map[string]int{},
+	}
+	return m
+}
+
+// Returns the number of inbound tuples held, waiting for the tuples
+// that causally precede them.
+func (m *LSet) Held() int {
+	if m.causal == nil {
+		return 0
+	}
+	return len(m.causal.held)
+}
+
+// Returns the inbound changes along with any held changes that are now
+// deliverable, in causal order, holding the rest.
+func (d *D) releaseCausal(inbound []relationChange) []relationChange {
+	rv := inbound[0:0]
+	var causals []*LSet
+	for _, c := range inbound {
+		m := c.into.(*LSet)
+		if m.causal == nil {
+			rv = append(rv, c)
+			continue
+		}
+		if !m.causal.arrived {
+			m.causal.arrived = true
+			causals = append(causals, m)
+		}
+		m.causal.held = append(m.causal.held, c)
+	}
+	for _, m := range causals {
+		cc := m.causal
+		rv = append(rv, cc.release()...)
+		if len(cc.held) > cc.max {
+			m.dropped += int64(len(cc.held) - cc.max)
+			cc.held = cc.held[:cc.max]
+		}
+		cc.arrived = false
+	}
+	return rv
+}
+
+// Returns the held changes that are deliverable, repeating as each
+// delivery may make others deliverable.
+func (cc *channelCausal) release() (rv []relationChange) {
+	for progress := true; progress; {
+		progress = false
+		held := cc.held[0:0]
+		for _, c := range cc.held {
+			if cc.deliverable(c.arg) {
+				clock := tupleField(c.arg, cc.clockField).(*VectorClock)
+				from := tupleField(c.arg, cc.fromField).(string)
+				if cc.delivered[from] < clock.Get(from) {
+					cc.delivered[from] = clock.Get(from)
+				}
+				rv = append(rv, c)
+				progress = true
+			} else {
+				held = append(held, c)
+			}
+		}
+		cc.held = held
+	}
+	return rv
+}
+
+// A tuple is deliverable once it's the sender's next, and every tuple
+// that the sender had delivered before sending it was delivered here.
+func (cc *channelCausal) deliverable(tuple interface{}) bool {
+	clock, _ := tupleField(tuple, cc.clockField).(*VectorClock)
+	if clock == nil {
+		return true
+	}
+	from := tupleField(tuple, cc.fromField).(string)
+	for k, v := range clock.m {
+		if k == from {
+			if v > cc.delivered[k]+1 {
+				return false
+			}
+		} else if v > cc.delivered[k] {
+			return false
+		}
+	}
+	return true
+}
+
+// BeforeEmit registers f to run at the end of each tick, once what the
+// tick leaves for the next tick is known, see Pending(), but before the
+// tick's channel tuples are sent, such as to durably record the state
+// that those tuples promise.  When f fails, the tick's channel tuples
+// are dropped instead, as they might promise what wasn't recorded.
+func (d *D) BeforeEmit(f func() error) {
+	d = d.host()
+	d.beforeEmit = append(d.beforeEmit, f)
+}
+
+// Used when a BeforeEmit() func fails.
+func (d *D) dropEmit(err error) {
+	for name, r := range d.Relations {
+		if c, ok := r.(*LSet); ok && c.channel {
+			for _, tuple := range c.Drain() {
+				d.logDropped(tupleTo(tuple), name, err)
+			}
+		}
+	}
+}
+
+func (d *D) emit() {
+	if d.transport == nil {
+		return // Undrained channel tuples will loop back locally.
+	}
+	// Sends go out in the same order on every run, for reproducibility,
+	// as with a MemTransport.
+	names := make([]string, 0, len(d.Relations))
+	for name := range d.Relations {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		c, ok := d.Relations[name].(*LSet)
+		if !ok || !c.channel {
+			continue
+		}
+		var local []interface{}
+		for _, tuple := range c.Drain() {
+			to := tupleTo(tuple)
+			if to == "" {
+				local = append(local, tuple)
+				continue
+			}
+			err := d.transport.Send(to, name, tuple)
+			if err != nil {
+				d.logDropped(to, name, err)
+			}
+		}
+		c.outbox = local
+	}
+}
+
+// DrainAsync ticks d, along with the other D's registered with t, until
+// none of them have channel tuples left to deliver, and a round of
+// ticks changes nothing, as in RunUntilQuiescent(), or until maxTicks
+// rounds.  Returns true if drained.  Tuples that keep being sent, such
+// as on periodics that keep firing, prevent draining.
+func (d *D) DrainAsync(t *MemTransport, maxTicks int) bool {
+	t.m.Lock()
+	ds := []*D{d}
+	for _, x := range t.nodes {
+		if x != d {
+			ds = append(ds, x)
+		}
+	}
+	t.m.Unlock()
+	sort.Slice(ds[1:], func(i, j int) bool { return ds[1+i].Addr < ds[1+j].Addr })
+
+	for i := 0; i < maxTicks; i++ {
+		for _, x := range ds {
+			x.Tick()
+		}
+		drained := i > 0
+		for _, x := range ds {
+			drained = drained && x.tickChanges == 0 && !x.pendingAsync()
+		}
+		if drained {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns true if d has channel tuples waiting for a later tick.
+func (d *D) pendingAsync() bool {
+	d.inboundM.Lock()
+	n := len(d.inbound) + len(d.delayed)
+	d.inboundM.Unlock()
+	if n > 0 {
+		return true
+	}
+	for _, c := range d.next {
+		if ch, ok := c.into.(*LSet); ok && ch.channel {
+			return true
+		}
+	}
+	for _, r := range d.Relations {
+		if c, ok := r.(*LSet); ok && c.channel && len(c.outbox) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns the value of a tuple's To field, or "" if it has none.
+func tupleTo(tuple interface{}) string {
+	v := reflect.Indirect(reflect.ValueOf(tuple))
+	if v.Kind() != reflect.Struct {
+		return ""
+	}
+	f := v.FieldByName("To")
+	if !f.IsValid() || f.Kind() != reflect.String {
+		return ""
+	}
+	return f.String()
+}
+
+// MemTransport routes tuples between D's in the same process, which
+// is handy for tests and simulations.
+type MemTransport struct {
+	m           sync.Mutex
+	nodes       map[string]*D
+	isolated    map[string]bool
+	unreachable map[memLink]bool
+	delays      map[memLink]int
+}
+
+// A direction between two addrs.
+type memLink struct {
+	from, to string
+}
+
+func NewMemTransport() *MemTransport {
+	return &MemTransport{
+		nodes:       map[string]*D{},
+		isolated:    map[string]bool{},
+		unreachable: map[memLink]bool{},
+		delays:      map[memLink]int{},
+	}
+}
+
+// Registered D's send through a memTransportSender, so that a tuple's
+// sender is known when dropping or delaying it.
+func (t *MemTransport) Register(d *D) {
+	t.m.Lock()
+	t.nodes[d.Addr] = d
+	t.m.Unlock()
+	d.SetTransport(&memTransportSender{t, d.Addr})
+}
+
+// Isolate simulates a network partition around addr, silently dropping
+// tuples sent to or from it until it's no longer isolated.
+func (t *MemTransport) Isolate(addr string, isolated bool) {
+	t.m.Lock()
+	t.isolated[addr] = isolated
+	t.m.Unlock()
+}
+
+// SetReachable controls whether tuples sent from one addr to another
+// are delivered, silently dropping them when ok is false.  Only the
+// one direction is affected, so a full partition between two addrs
+// needs both directions.
+func (t *MemTransport) SetReachable(from, to string, ok bool) {
+	t.m.Lock()
+	if ok {
+		delete(t.unreachable, memLink{from, to})
+	} else {
+		t.unreachable[memLink{from, to}] = true
+	}
+	t.m.Unlock()
+}
+
+// AddDelay holds back tuples sent from one addr to another, so that
+// they show up the given number of ticks of the receiver later than
+// they otherwise would.  A delay of 0 removes the delay.
+func (t *MemTransport) AddDelay(from, to string, ticks int) {
+	t.m.Lock()
+	if ticks > 0 {
+		t.delays[memLink{from, to}] = ticks
+	} else {
+		delete(t.delays, memLink{from, to})
+	}
+	t.m.Unlock()
+}
+
+func (t *MemTransport) Send(destAddr string, relName string,
+	tuple interface{}) error {
+	return t.send("", destAddr, relName, tuple)
+}
+
+func (t *MemTransport) send(from, destAddr string, relName string,
+	tuple interface{}) error {
+	link := memLink{from, destAddr}
+	t.m.Lock()
+	d := t.nodes[destAddr]
+	dropped := t.isolated[destAddr] || t.isolated[from] || t.unreachable[link]
+	delay := t.delays[link]
+	t.m.Unlock()
+	if d == nil {
+		return fmt.Errorf("unknown destAddr: %s", destAddr)
+	}
+	if dropped {
+		return nil
+	}
+	return d.deliverAfter(relName, tuple, delay)
+}
+
+type memTransportSender struct {
+	t    *MemTransport
+	from string
+}
+
+func (s *memTransportSender) Send(destAddr string, relName string,
+	tuple interface{}) error {
+	return s.t.send(s.from, destAddr, relName, tuple)
+}
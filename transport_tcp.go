@@ -0,0 +1,185 @@
+package gdec
+
+import (
+	"encoding/gob"
+	"fmt"
+	"net"
+	"reflect"
+	"sync"
+	"time"
+)
+
+// TCPTransport encodes channel tuples with its Codec, gob by default,
+// and sends them over TCP to the host:port registered for the
+// destination D's Addr.
+type TCPTransport struct {
+	// Bounds how long Send() waits to connect to a peer, so that an
+	// unreachable peer only delays the sends to it.  Set it before the
+	// first Send().
+	DialTimeout time.Duration
+
+	// Bounds how long Send() waits on a peer that's stopped reading,
+	// after which the connection's dropped, to be redialed by a later
+	// Send().  Set it before the first Send().
+	WriteTimeout time.Duration
+
+	m         sync.Mutex
+	codec     Codec
+	addrs     map[string]string // Key: d.Addr, val: "host:port".
+	conns     map[string]*tcpConn
+	listeners []net.Listener
+}
+
+type tcpConn struct {
+	m   sync.Mutex // Serializes the encodes, so each peer blocks only its own sends.
+	c   net.Conn
+	enc CodecEncoder
+}
+
+func NewTCPTransport(addrs map[string]string) *TCPTransport {
+	return NewTCPTransportCodec(addrs, GobCodec{})
+}
+
+// NewTCPTransportCodec is like NewTCPTransport(), but with the given
+// Codec, like JSONCodec{}, which every peer must also use.
+func NewTCPTransportCodec(addrs map[string]string, codec Codec) *TCPTransport {
+	t := &TCPTransport{
+		DialTimeout:  5 * time.Second,
+		WriteTimeout: 5 * time.Second,
+		codec:        codec,
+		addrs:        map[string]string{},
+		conns:        map[string]*tcpConn{},
+	}
+	for k, v := range addrs {
+		t.addrs[k] = v
+	}
+	return t
+}
+
+// Listen starts accepting tuples for d on its registered host:port,
+// and makes t the transport for d.  A registered port of 0 picks a
+// free port, which is then recorded in the registry.
+func (t *TCPTransport) Listen(d *D) error {
+	for _, r := range d.Relations {
+		if c, ok := r.(*LSet); ok && c.channel {
+			gob.Register(reflect.New(c.TupleType()).Interface())
+		}
+	}
+
+	t.m.Lock()
+	hostPort, ok := t.addrs[d.Addr]
+	t.m.Unlock()
+	if !ok {
+		return fmt.Errorf("no host:port registered for addr: %s", d.Addr)
+	}
+	ln, err := net.Listen("tcp", hostPort)
+	if err != nil {
+		return err
+	}
+
+	t.m.Lock()
+	t.addrs[d.Addr] = ln.Addr().String()
+	t.listeners = append(t.listeners, ln)
+	t.m.Unlock()
+
+	d.SetTransport(t)
+
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go t.receive(d, c)
+		}
+	}()
+	return nil
+}
+
+func (t *TCPTransport) receive(d *D, c net.Conn) {
+	defer c.Close()
+	dec := t.codec.NewDecoder(c, func(relName string) reflect.Type {
+		if ch, ok := d.Relations[relName].(*LSet); ok && ch.channel {
+			return ch.TupleType()
+		}
+		return nil
+	})
+	for {
+		relName, tuple, err := dec.Decode()
+		if err != nil && relName == "" {
+			return
+		}
+		if err == nil {
+			err = d.Deliver(relName, tuple)
+		}
+		if err != nil {
+			d.logDropped(d.Addr, relName, err)
+		}
+	}
+}
+
+func (t *TCPTransport) Send(destAddr string, relName string,
+	tuple interface{}) error {
+	t.m.Lock()
+	hostPort, ok := t.addrs[destAddr]
+	tc := t.conns[hostPort]
+	t.m.Unlock()
+	if !ok {
+		return fmt.Errorf("unknown destAddr: %s", destAddr)
+	}
+	if tc == nil {
+		// Dial without the lock, so sends to other peers go on meanwhile.
+		c, err := net.DialTimeout("tcp", hostPort, t.DialTimeout)
+		if err != nil {
+			return err
+		}
+		t.m.Lock()
+		if tc = t.conns[hostPort]; tc == nil {
+			tc = &tcpConn{c: c, enc: t.codec.NewEncoder(c)}
+			t.conns[hostPort] = tc
+		} else {
+			c.Close() // Another Send() connected first.
+		}
+		t.m.Unlock()
+	}
+
+	var deadline time.Time // Zero, for no deadline, like DialTimeout.
+	if t.WriteTimeout > 0 {
+		deadline = time.Now().Add(t.WriteTimeout)
+	}
+	tc.m.Lock()
+	err := tc.c.SetWriteDeadline(deadline)
+	if err == nil {
+		err = tc.enc.Encode(relName, tuple)
+	}
+	tc.m.Unlock()
+	if err != nil { // The caller logs the dropped tuple.
+		tc.c.Close()
+		t.m.Lock()
+		if t.conns[hostPort] == tc {
+			delete(t.conns, hostPort)
+		}
+		t.m.Unlock()
+	}
+	return err
+}
+
+func (t *TCPTransport) Addr(addr string) string {
+	t.m.Lock()
+	defer t.m.Unlock()
+	return t.addrs[addr]
+}
+
+func (t *TCPTransport) Close() error {
+	t.m.Lock()
+	defer t.m.Unlock()
+	for _, ln := range t.listeners {
+		ln.Close()
+	}
+	t.listeners = nil
+	for k, tc := range t.conns {
+		tc.c.Close()
+		delete(t.conns, k)
+	}
+	return nil
+}
@@ -0,0 +1,83 @@
+package gdec
+
+import (
+	"encoding/json"
+	"sort"
+)
+
+// RelationValue returns the current value of any relation as a plain
+// Go value, for generic tooling like dumps and UIs: an int for LMax and
+// the counters, a string for LMaxString, LMinString and LWWReg, a bool
+// for LBool, a float64 for LMaxFloat and LMinFloat, the value of an
+// LMaxBy, the counts of a VectorClock, the estimate of an LHLL, a map
+// keyed like the LMap of its values' RelationValue()'s, the siblings'
+// values of an MVReg, and otherwise the tuples, ordered by their JSON
+// except for an LRing's or LWindow's, which are oldest first.  It's a
+// func rather than a Relation method as several lattices already have
+// a typed Value().
+func RelationValue(r Relation) interface{} {
+	switch m := r.(type) {
+	case *LMax:
+		return m.Int()
+	case *LMaxString:
+		return m.String()
+	case *LMinString:
+		return m.String()
+	case *LBool:
+		return m.Bool()
+	case *LMaxFloat:
+		return m.Float()
+	case *LMinFloat:
+		return m.Float()
+	case *GCounter:
+		return m.Value()
+	case *PNCounter:
+		return m.Value()
+	case *LWWReg:
+		return m.Value()
+	case *LMaxBy:
+		return m.Value()
+	case *VectorClock:
+		return m.Value()
+	case *LHLL:
+		return m.Estimate()
+	case *LMap:
+		rv := map[string]interface{}{}
+		for k, v := range m.m {
+			rv[k] = RelationValue(v.(Relation))
+		}
+		return rv
+	case *MVReg:
+		rv := []interface{}{}
+		for _, v := range m.Values() {
+			rv = append(rv, RelationValue(v.(Relation)))
+		}
+		return rv
+	case *LRing:
+		return m.Tuples()
+	case *LWindow:
+		return m.Tuples()
+	}
+	return sortedTuples(r)
+}
+
+func sortedTuples(r Relation) []interface{} {
+	var keys []string
+	byKey := map[string]interface{}{}
+	for v := range r.Scan() {
+		j, err := json.Marshal(v)
+		if err != nil {
+			panic(err)
+		}
+		keys = append(keys, string(j))
+		byKey[string(j)] = v
+	}
+	sort.Strings(keys)
+	rv := []interface{}{}
+	for i, k := range keys {
+		if i == 0 || k != keys[i-1] {
+			rv = append(rv, byKey[k])
+		}
+	}
+	return rv
+}
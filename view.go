@@ -0,0 +1,88 @@
+package gdec
+
+import (
+	"fmt"
+	"reflect"
+)
+
+// A read-only view of another relation's tuples, which are filtered
+// and transformed lazily during each Scan(), so a view can be a join
+// source without declaring a join to materialize it.
+type LSetView struct {
+	src    Relation
+	t      reflect.Type
+	filter func(interface{}) bool        // Optional.
+	mapper func(interface{}) interface{} // Optional.
+}
+
+// Filter returns a view of the tuples for which pred returns true.
+// Tuples are passed to pred as they're scanned, so as stored.
+func (m *LSet) Filter(pred func(interface{}) bool) *LSetView {
+	return &LSetView{src: m, t: m.t, filter: pred}
+}
+
+// Map returns a view of the results of f on each tuple, where x is an
+// example result, as in DeclareLSet().  A nil result is skipped.
+func (m *LSet) Map(x interface{}, f func(interface{}) interface{}) *LSetView {
+	return &LSetView{src: m, t: reflect.TypeOf(x), mapper: f}
+}
+
+func (v *LSetView) Filter(pred func(interface{}) bool) *LSetView {
+	return &LSetView{src: v, t: v.t, filter: pred}
+}
+
+func (v *LSetView) Map(x interface{}, f func(interface{}) interface{}) *LSetView {
+	return &LSetView{src: v, t: reflect.TypeOf(x), mapper: f}
+}
+
+// Returns the declared relation underneath any views.
+func baseRelation(r Relation) Relation {
+	for {
+		v, ok := r.(*LSetView)
+		if !ok {
+			return r
+		}
+		r = v.src
+	}
+}
+
+func (v *LSetView) TupleType() reflect.Type { return v.t }
+
+func (v *LSetView) DeclareScratch() {
+	panic(fmt.Sprintf("DeclareScratch() on read-only LSetView: %#v", v))
+}
+
+func (v *LSetView) isScratch() bool { return false }
+
+func (v *LSetView) startTick() {}
+
+func (v *LSetView) Clear() bool {
+	panic(fmt.Sprintf("Clear() on read-only LSetView: %#v", v))
+}
+
+func (v *LSetView) Scan() chan interface{} {
+	ch := make(chan interface{})
+	go func() {
+		for x := range v.src.Scan() {
+			if v.filter != nil && !v.filter(x) {
+				continue
+			}
+			if v.mapper != nil {
+				if x = v.mapper(x); x == nil {
+					continue
+				}
+			}
+			ch <- x
+		}
+		close(ch)
+	}()
+	return ch
+}
+
+func (v *LSetView) DirectAdd(tuple interface{}) bool {
+	panic(fmt.Sprintf("DirectAdd() on read-only LSetView, tuple: %#v", tuple))
+}
+
+func (v *LSetView) DirectMerge(rel Relation) bool {
+	panic(fmt.Sprintf("DirectMerge() on read-only LSetView, rel: %#v", rel))
+}